@@ -11,6 +11,15 @@ import (
 // @host localhost:8080
 // @BasePath /v1
 
+// @securityDefinitions.apikey ApiKeyAuth
+// @in header
+// @name X-API-Key
+
+// @securityDefinitions.apikey BearerAuth
+// @in header
+// @name Authorization
+// @description A JWT signed with HS256, prefixed with "Bearer "
+
 // @contact.name Andrew
 // @contact.url https://t.me/realPointer
 
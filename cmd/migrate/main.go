@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"text/tabwriter"
+	"time"
+
+	"github.com/realPointer/segments/internal/repo/migrations"
+	"github.com/realPointer/segments/pkg/migrate"
+	"github.com/realPointer/segments/pkg/postgres"
+)
+
+const usage = `Usage: migrate [-url postgres://...] <command> [arg]
+
+Commands:
+  up         apply all pending migrations
+  down [N]   roll back the last N migrations (default 1)
+  goto V     migrate up or down to version V (0 rolls back everything)
+  status     list migrations and whether they are applied
+`
+
+func main() {
+	url := flag.String("url", os.Getenv("PG_URL"), "postgres connection string (defaults to $PG_URL)")
+	flag.Usage = func() {
+		fmt.Fprint(flag.CommandLine.Output(), usage)
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if flag.NArg() == 0 || *url == "" {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	pg, err := postgres.New(*url)
+	if err != nil {
+		log.Fatalf("migrate - postgres.New: %s", err)
+	}
+	defer pg.Close()
+
+	m, err := migrate.New(pg, migrations.FS)
+	if err != nil {
+		log.Fatalf("migrate - migrate.New: %s", err)
+	}
+
+	ctx := context.Background()
+
+	var done []migrate.Migration
+
+	switch cmd := flag.Arg(0); cmd {
+	case "up":
+		done, err = m.Up(ctx)
+	case "down":
+		steps := 1
+		if flag.NArg() > 1 {
+			steps, err = strconv.Atoi(flag.Arg(1))
+			if err != nil || steps < 1 {
+				log.Fatalf("migrate - down: invalid number of steps %q", flag.Arg(1))
+			}
+		}
+		done, err = m.Down(ctx, steps)
+	case "goto":
+		if flag.NArg() < 2 {
+			log.Fatal("migrate - goto: version is required")
+		}
+		version, parseErr := strconv.ParseUint(flag.Arg(1), 10, 32)
+		if parseErr != nil {
+			log.Fatalf("migrate - goto: invalid version %q", flag.Arg(1))
+		}
+		done, err = m.Goto(ctx, uint(version))
+	case "status":
+		err = printStatus(ctx, m)
+	default:
+		log.Fatalf("migrate - unknown command %q", cmd)
+	}
+
+	if err != nil {
+		log.Fatalf("migrate - %s: %s", flag.Arg(0), err)
+	}
+
+	for _, mig := range done {
+		log.Printf("%04d_%s: done", mig.Version, mig.Name)
+	}
+}
+
+func printStatus(ctx context.Context, m *migrate.Migrator) error {
+	statuses, err := m.Status(ctx)
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "VERSION\tNAME\tAPPLIED AT")
+	for _, s := range statuses {
+		appliedAt := "pending"
+		if s.Applied {
+			appliedAt = s.AppliedAt.Format(time.RFC3339)
+		}
+		fmt.Fprintf(w, "%04d\t%s\t%s\n", s.Version, s.Name, appliedAt)
+	}
+
+	return w.Flush()
+}
@@ -3,6 +3,7 @@ package config
 import (
 	"fmt"
 	"os"
+	"time"
 
 	"github.com/ilyakaznacheev/cleanenv"
 )
@@ -10,11 +11,16 @@ import (
 type (
 	// Config -.
 	Config struct {
-		App    `yaml:"app"`
-		HTTP   `yaml:"http"`
-		Log    `yaml:"logger"`
-		PG     `yaml:"postgres"`
-		WebAPI `yaml:"webapi"`
+		App       `yaml:"app"`
+		HTTP      `yaml:"http"`
+		Log       `yaml:"logger"`
+		PG        `yaml:"postgres"`
+		WebAPI    `yaml:"webapi"`
+		Storage   `yaml:"storage"`
+		Scheduler `yaml:"scheduler"`
+		Reports   `yaml:"reports"`
+		Bulk      `yaml:"bulk"`
+		Auth      `yaml:"auth"`
 	}
 
 	// App -.
@@ -40,7 +46,92 @@ type (
 	}
 
 	WebAPI struct {
-		YandexToken string `env-required:"true" env:"YANDEX_TOKEN"`
+		YandexToken string `env:"YANDEX_TOKEN"`
+	}
+
+	// Storage is where reports are uploaded. Backend is one of yandex, local,
+	// s3 and webdav, each reading its own section.
+	Storage struct {
+		Backend string        `yaml:"backend" env:"STORAGE_BACKEND" env-default:"yandex"`
+		Yandex  StorageYandex `yaml:"yandex"`
+		Local   StorageLocal  `yaml:"local"`
+		S3      StorageS3     `yaml:"s3"`
+		WebDAV  StorageWebDAV `yaml:"webdav"`
+	}
+
+	// StorageYandex tunes the Yandex Disk client, the token is
+	// WebAPI.YandexToken.
+	StorageYandex struct {
+		BaseURL          string        `yaml:"base_url"          env:"STORAGE_YANDEX_BASE_URL"          env-default:"https://cloud-api.yandex.net/v1/disk"`
+		Timeout          time.Duration `yaml:"timeout"           env:"STORAGE_YANDEX_TIMEOUT"           env-default:"30s"`
+		MaxRetries       int           `yaml:"max_retries"       env:"STORAGE_YANDEX_MAX_RETRIES"       env-default:"3"`
+		BreakerThreshold int           `yaml:"breaker_threshold" env:"STORAGE_YANDEX_BREAKER_THRESHOLD" env-default:"5"`
+		BreakerCooldown  time.Duration `yaml:"breaker_cooldown"  env:"STORAGE_YANDEX_BREAKER_COOLDOWN"  env-default:"30s"`
+	}
+
+	// StorageLocal keeps reports in Dir and serves them from the service at
+	// BaseURL, the public address of its /files path.
+	StorageLocal struct {
+		Dir     string `yaml:"dir"      env:"STORAGE_LOCAL_DIR"      env-default:"reports"`
+		BaseURL string `yaml:"base_url" env:"STORAGE_LOCAL_BASE_URL" env-default:"http://localhost:8080/files"`
+	}
+
+	// StorageS3 -.
+	StorageS3 struct {
+		Endpoint  string        `yaml:"endpoint"   env:"STORAGE_S3_ENDPOINT"`
+		Region    string        `yaml:"region"     env:"STORAGE_S3_REGION"     env-default:"us-east-1"`
+		Bucket    string        `yaml:"bucket"     env:"STORAGE_S3_BUCKET"`
+		AccessKey string        `                  env:"STORAGE_S3_ACCESS_KEY"`
+		SecretKey string        `                  env:"STORAGE_S3_SECRET_KEY"`
+		URLExpiry time.Duration `yaml:"url_expiry" env:"STORAGE_S3_URL_EXPIRY" env-default:"24h"`
+		PartSize  int           `yaml:"part_size"  env:"STORAGE_S3_PART_SIZE"  env-default:"8388608"`
+	}
+
+	// StorageWebDAV -.
+	StorageWebDAV struct {
+		URL       string `yaml:"url"        env:"STORAGE_WEBDAV_URL"`
+		Username  string `                  env:"STORAGE_WEBDAV_USERNAME"`
+		Password  string `                  env:"STORAGE_WEBDAV_PASSWORD"`
+		PublicURL string `yaml:"public_url" env:"STORAGE_WEBDAV_PUBLIC_URL"`
+	}
+
+	// Scheduler -.
+	Scheduler struct {
+		RebalanceInterval time.Duration `yaml:"rebalance_interval" env:"SCHEDULER_REBALANCE_INTERVAL" env-default:"10m"`
+		RecomputeInterval time.Duration `yaml:"recompute_interval" env:"SCHEDULER_RECOMPUTE_INTERVAL" env-default:"10m"`
+	}
+
+	// Auth holds the secrets callers are authenticated with, both only read
+	// from the environment. BootstrapKey is an admin API key for creating
+	// the first keys, JWTSecret verifies HS256 bearer tokens.
+	Auth struct {
+		BootstrapKey string `env:"AUTH_BOOTSTRAP_KEY"`
+		JWTSecret    string `env:"AUTH_JWT_SECRET"`
+	}
+
+	// Reports configures the workers generating asynchronous reports and
+	// how reports are laid out and kept on the storage.
+	Reports struct {
+		Workers           int           `yaml:"workers"            env:"REPORTS_WORKERS"            env-default:"2"`
+		PollInterval      time.Duration `yaml:"poll_interval"      env:"REPORTS_POLL_INTERVAL"      env-default:"2s"`
+		Lease             time.Duration `yaml:"lease"              env:"REPORTS_LEASE"              env-default:"10m"`
+		MaxAttempts       int           `yaml:"max_attempts"       env:"REPORTS_MAX_ATTEMPTS"       env-default:"3"`
+		RetryDelay        time.Duration `yaml:"retry_delay"        env:"REPORTS_RETRY_DELAY"        env-default:"30s"`
+		Gzip              bool          `yaml:"gzip"               env:"REPORTS_GZIP"               env-default:"false"`
+		Folder            string        `yaml:"folder"             env:"REPORTS_FOLDER"             env-default:"segments-reports"`
+		NameTemplate      string        `yaml:"name_template"      env:"REPORTS_NAME_TEMPLATE"      env-default:"{date}/{name}_{id}.{ext}"`
+		RetentionDays     int           `yaml:"retention_days"     env:"REPORTS_RETENTION_DAYS"     env-default:"30"`
+		RetentionInterval time.Duration `yaml:"retention_interval" env:"REPORTS_RETENTION_INTERVAL" env-default:"1h"`
+	}
+
+	// Bulk -.
+	Bulk struct {
+		Workers      int           `yaml:"workers"       env:"BULK_WORKERS"       env-default:"1"`
+		PollInterval time.Duration `yaml:"poll_interval" env:"BULK_POLL_INTERVAL" env-default:"2s"`
+		Lease        time.Duration `yaml:"lease"         env:"BULK_LEASE"         env-default:"2m"`
+		MaxAttempts  int           `yaml:"max_attempts"  env:"BULK_MAX_ATTEMPTS"  env-default:"3"`
+		RetryDelay   time.Duration `yaml:"retry_delay"   env:"BULK_RETRY_DELAY"   env-default:"30s"`
+		ChunkSize    int           `yaml:"chunk_size"    env:"BULK_CHUNK_SIZE"    env-default:"1000"`
 	}
 )
 
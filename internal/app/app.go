@@ -6,6 +6,7 @@ import (
 	"log"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
 	"time"
 
@@ -15,10 +16,12 @@ import (
 	"github.com/realPointer/segments/config"
 	v1 "github.com/realPointer/segments/internal/controller/http/v1"
 	"github.com/realPointer/segments/internal/repo"
+	"github.com/realPointer/segments/internal/repo/migrations"
 	"github.com/realPointer/segments/internal/service"
-	"github.com/realPointer/segments/internal/ydisk/ydisk"
+	"github.com/realPointer/segments/internal/service/services"
 	"github.com/realPointer/segments/pkg/httpserver"
 	"github.com/realPointer/segments/pkg/logger"
+	"github.com/realPointer/segments/pkg/migrate"
 	"github.com/realPointer/segments/pkg/postgres"
 )
 
@@ -45,24 +48,93 @@ func Run() {
 		l.Fatal(fmt.Errorf("app - Run - pg.Pool.Ping: %w", err))
 	}
 
+	// Migrations
+	migrator, err := migrate.New(pg, migrations.FS)
+	if err != nil {
+		l.Fatal(fmt.Errorf("app - Run - migrate.New: %w", err))
+	}
+
+	applied, err := migrator.Up(context.Background())
+	if err != nil {
+		l.Fatal(fmt.Errorf("app - Run - migrator.Up: %w", err))
+	}
+	for _, m := range applied {
+		l.Info("app - Run - migration applied: %04d_%s", m.Version, m.Name)
+	}
+
 	// Repositories
 	repositories := repo.NewRepositories(pg)
 
+	// Report storage
+	disk, files, err := newDisk(cfg)
+	if err != nil {
+		l.Fatal(fmt.Errorf("app - Run - newDisk: %w", err))
+	}
+
+	// Retention would otherwise delete whatever else is kept on the storage.
+	if cfg.Reports.RetentionDays > 0 && strings.Trim(cfg.Reports.Folder, "/") == "" {
+		l.Fatal("app - Run - reports retention needs a reports folder")
+	}
+
 	// Services dependencies
 	deps := service.ServicesDependencies{
-		Repos:      repositories,
-		YandexDisk: ydisk.NewYandexDisk(cfg.WebAPI.YandexToken),
+		Repos:  repositories,
+		Disk:   disk,
+		Logger: l,
+		Auth: services.AuthConfig{
+			BootstrapKey: cfg.Auth.BootstrapKey,
+			JWTSecret:    cfg.Auth.JWTSecret,
+		},
+		Export: services.ExportConfig{
+			Gzip:         cfg.Reports.Gzip,
+			Folder:       cfg.Reports.Folder,
+			NameTemplate: cfg.Reports.NameTemplate,
+			Retention:    time.Duration(cfg.Reports.RetentionDays) * 24 * time.Hour,
+		},
+		ReportWorker: services.ReportWorkerConfig{
+			Workers:      cfg.Reports.Workers,
+			PollInterval: cfg.Reports.PollInterval,
+			Lease:        cfg.Reports.Lease,
+			MaxAttempts:  cfg.Reports.MaxAttempts,
+			RetryDelay:   cfg.Reports.RetryDelay,
+		},
+		BulkWorker: services.BulkWorkerConfig{
+			Workers:      cfg.Bulk.Workers,
+			PollInterval: cfg.Bulk.PollInterval,
+			Lease:        cfg.Bulk.Lease,
+			MaxAttempts:  cfg.Bulk.MaxAttempts,
+			RetryDelay:   cfg.Bulk.RetryDelay,
+			ChunkSize:    cfg.Bulk.ChunkSize,
+		},
 	}
 	services := service.NewServices(deps)
 
+	// Report and bulk workers
+	workersCtx, stopWorkers := context.WithCancel(context.Background())
+	reportsDone, bulkDone := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(reportsDone)
+		services.ReportWorker.Run(workersCtx)
+	}()
+	go func() {
+		defer close(bulkDone)
+		services.BulkWorker.Run(workersCtx)
+	}()
+
 	// GoCron
 	s := gocron.NewScheduler(time.UTC)
 	s.Every(1).Minute().Do(services.Scheduler.DeleteExpiredRows, context.Background())
+	s.Every(1).Hour().Do(services.Scheduler.DeleteExpiredIdempotencyKeys, context.Background())
+	s.Every(cfg.Scheduler.RebalanceInterval).Do(services.Scheduler.RebalanceAutoSegments, context.Background())
+	s.Every(cfg.Scheduler.RecomputeInterval).Do(services.Scheduler.RecomputeRuleSegments, context.Background())
+	if cfg.Reports.RetentionDays > 0 {
+		s.Every(cfg.Reports.RetentionInterval).Do(services.Scheduler.DeleteOldReports, context.Background())
+	}
 	s.StartAsync()
 
 	// HTTP Server
 	handler := chi.NewRouter()
-	v1.NewRouter(handler, l, services)
+	v1.NewRouter(handler, l, services, files)
 	httpServer := httpserver.New(handler, httpserver.Port(cfg.HTTP.Port))
 
 	// Waiting signal
@@ -81,4 +153,8 @@ func Run() {
 	if err != nil {
 		l.Error(fmt.Errorf("app - Run - httpServer.Shutdown: %w", err))
 	}
+
+	stopWorkers()
+	<-reportsDone
+	<-bulkDone
 }
@@ -0,0 +1,74 @@
+package app
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/realPointer/segments/config"
+	webapi "github.com/realPointer/segments/internal/ydisk"
+	"github.com/realPointer/segments/internal/ydisk/local"
+	"github.com/realPointer/segments/internal/ydisk/s3"
+	"github.com/realPointer/segments/internal/ydisk/webdav"
+	"github.com/realPointer/segments/internal/ydisk/ydisk"
+)
+
+// newDisk returns the report storage chosen by the config and, when the
+// service serves the reports itself, the handler to mount at /files.
+func newDisk(cfg *config.Config) (webapi.Disk, http.Handler, error) {
+	switch cfg.Storage.Backend {
+	case "yandex":
+		if cfg.WebAPI.YandexToken == "" {
+			return nil, nil, fmt.Errorf("YANDEX_TOKEN is required for the yandex storage backend")
+		}
+
+		disk, err := ydisk.New(ydisk.Config{
+			Token:            cfg.WebAPI.YandexToken,
+			BaseURL:          cfg.Storage.Yandex.BaseURL,
+			Timeout:          cfg.Storage.Yandex.Timeout,
+			MaxRetries:       cfg.Storage.Yandex.MaxRetries,
+			BreakerThreshold: cfg.Storage.Yandex.BreakerThreshold,
+			BreakerCooldown:  cfg.Storage.Yandex.BreakerCooldown,
+		})
+		if err != nil {
+			return nil, nil, err
+		}
+
+		return disk, nil, nil
+	case "local":
+		disk, err := local.New(cfg.Storage.Local.Dir, cfg.Storage.Local.BaseURL)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		return disk, disk, nil
+	case "s3":
+		storage, err := s3.New(s3.Config{
+			Endpoint:  cfg.Storage.S3.Endpoint,
+			Region:    cfg.Storage.S3.Region,
+			Bucket:    cfg.Storage.S3.Bucket,
+			AccessKey: cfg.Storage.S3.AccessKey,
+			SecretKey: cfg.Storage.S3.SecretKey,
+			URLExpiry: cfg.Storage.S3.URLExpiry,
+			PartSize:  cfg.Storage.S3.PartSize,
+		})
+		if err != nil {
+			return nil, nil, err
+		}
+
+		return storage, nil, nil
+	case "webdav":
+		disk, err := webdav.New(webdav.Config{
+			URL:       cfg.Storage.WebDAV.URL,
+			Username:  cfg.Storage.WebDAV.Username,
+			Password:  cfg.Storage.WebDAV.Password,
+			PublicURL: cfg.Storage.WebDAV.PublicURL,
+		})
+		if err != nil {
+			return nil, nil, err
+		}
+
+		return disk, nil, nil
+	}
+
+	return nil, nil, fmt.Errorf("unknown storage backend %q, expected yandex, local, s3 or webdav", cfg.Storage.Backend)
+}
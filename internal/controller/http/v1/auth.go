@@ -0,0 +1,209 @@
+package v1
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/render"
+	"github.com/realPointer/segments/internal/entity"
+	"github.com/realPointer/segments/internal/repo/repoerrs"
+	"github.com/realPointer/segments/internal/service"
+	"github.com/realPointer/segments/pkg/logger"
+)
+
+// authenticate lets through the requests carrying a known API key in the
+// X-API-Key header or a valid JWT as an Authorization bearer token, with
+// their caller in the context.
+func authenticate(authService service.Auth, l logger.Interface) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			var caller entity.Caller
+			var err error
+
+			key := r.Header.Get("X-API-Key")
+			scheme, token, _ := strings.Cut(r.Header.Get("Authorization"), " ")
+
+			switch {
+			case key != "":
+				caller, err = authService.Authenticate(r.Context(), key)
+			case strings.EqualFold(scheme, "Bearer") && token != "":
+				caller, err = authService.AuthenticateToken(r.Context(), token)
+			default:
+				unauthorized(w, r, "an X-API-Key header or a bearer token is required")
+				return
+			}
+
+			switch {
+			case errors.Is(err, repoerrs.ErrNotFound):
+				unauthorized(w, r, "unknown API key")
+				return
+			case errors.Is(err, repoerrs.ErrInvalidInput):
+				var repoErr *repoerrs.Error
+				errors.As(err, &repoErr)
+				unauthorized(w, r, repoErr.Msg)
+				return
+			case err != nil:
+				handleError(w, r, l, err)
+				return
+			}
+
+			next.ServeHTTP(w, r.WithContext(entity.WithCaller(r.Context(), caller)))
+		})
+	}
+}
+
+func unauthorized(w http.ResponseWriter, r *http.Request, detail string) {
+	w.Header().Set("WWW-Authenticate", `Bearer realm="segments"`)
+	errorResponse(w, r, http.StatusUnauthorized, detail)
+}
+
+// authorize lets through the reads of callers with the read role and the
+// other requests of callers with the write role.
+func authorize(read, write string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			required := write
+			if r.Method == http.MethodGet || r.Method == http.MethodHead || r.Method == http.MethodOptions {
+				required = read
+			}
+
+			caller, _ := entity.CallerFrom(r.Context())
+			if !entity.RoleAllows(caller.Role, required) {
+				errorResponse(w, r, http.StatusForbidden, fmt.Sprintf("%s requests need the %s role, %q has the %s role", r.Method, required, caller.Name, caller.Role))
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// maxReasonLength caps the X-Change-Reason header.
+const maxReasonLength = 500
+
+// changeReason puts the X-Change-Reason header in the context, for the
+// membership changes the request makes to be logged with it.
+func changeReason(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reason := strings.TrimSpace(r.Header.Get("X-Change-Reason"))
+		if len(reason) > maxReasonLength {
+			errorResponse(w, r, http.StatusBadRequest, fmt.Sprintf("X-Change-Reason must be at most %d bytes", maxReasonLength))
+			return
+		}
+		if reason != "" {
+			r = r.WithContext(entity.WithReason(r.Context(), reason))
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+type apiKeyRoutes struct {
+	authService service.Auth
+	l           logger.Interface
+}
+
+func NewAPIKeyRouter(authService service.Auth, l logger.Interface) http.Handler {
+	ar := apiKeyRoutes{authService: authService, l: l}
+	r := chi.NewRouter()
+
+	r.Post("/", ar.createAPIKey)
+	r.Get("/", ar.getAPIKeys)
+	r.Delete("/{key_id}", ar.deleteAPIKey)
+
+	return r
+}
+
+type APIKeyRequest struct {
+	Name string `json:"name"`
+	// Role is reader, assigner or admin.
+	Role string `json:"role"`
+}
+
+// CreatedAPIKey is a new API key. Key is only ever shown here.
+type CreatedAPIKey struct {
+	entity.APIKey
+	Key string `json:"key"`
+}
+
+// @Summary Create API key
+// @Description Creates an API key with a role: reader reads, assigner also changes the segments of users, admin also manages segments and API keys. The key is returned once and only its hash is kept
+// @Tags Keys
+// @Security ApiKeyAuth
+// @Security BearerAuth
+// @Accept json
+// @Produce json
+// @Param request body APIKeyRequest true "request"
+// @Success 201 {object} CreatedAPIKey
+// @Failure 400 {object} Problem
+// @Failure 409 {object} Problem
+// @Failure 422 {object} Problem
+// @Failure 500 {object} Problem
+// @Router /keys [post]
+func (ar *apiKeyRoutes) createAPIKey(w http.ResponseWriter, r *http.Request) {
+	var req APIKeyRequest
+	err := render.DecodeJSON(r.Body, &req)
+	if err != nil {
+		errorResponse(w, r, http.StatusBadRequest, "invalid request body: "+err.Error())
+		return
+	}
+
+	apiKey, key, err := ar.authService.CreateAPIKey(r.Context(), req.Name, req.Role)
+	if err != nil {
+		handleError(w, r, ar.l, err)
+		return
+	}
+
+	render.Status(r, http.StatusCreated)
+	render.JSON(w, r, CreatedAPIKey{APIKey: apiKey, Key: key})
+}
+
+// @Summary Get API keys
+// @Description Returns all API keys, without the keys themselves
+// @Tags Keys
+// @Security ApiKeyAuth
+// @Security BearerAuth
+// @Produce json
+// @Success 200 {array} entity.APIKey
+// @Failure 500 {object} Problem
+// @Router /keys [get]
+func (ar *apiKeyRoutes) getAPIKeys(w http.ResponseWriter, r *http.Request) {
+	keys, err := ar.authService.GetAPIKeys(r.Context())
+	if err != nil {
+		handleError(w, r, ar.l, err)
+		return
+	}
+
+	render.JSON(w, r, keys)
+}
+
+// @Summary Delete API key
+// @Description Deletes an API key, requests made with it are refused from then on
+// @Tags Keys
+// @Security ApiKeyAuth
+// @Security BearerAuth
+// @Param key_id path int true "key_id"
+// @Success 204
+// @Failure 400 {object} Problem
+// @Failure 404 {object} Problem
+// @Failure 500 {object} Problem
+// @Router /keys/{key_id} [delete]
+func (ar *apiKeyRoutes) deleteAPIKey(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(chi.URLParam(r, "key_id"), 10, 64)
+	if err != nil {
+		errorResponse(w, r, http.StatusBadRequest, "key_id must be an integer")
+		return
+	}
+
+	err = ar.authService.DeleteAPIKey(r.Context(), id)
+	if err != nil {
+		handleError(w, r, ar.l, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,250 @@
+package v1
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/render"
+	"github.com/realPointer/segments/internal/entity"
+	"github.com/realPointer/segments/internal/service"
+	"github.com/realPointer/segments/pkg/logger"
+)
+
+// Limits of bulk uploads.
+const (
+	maxBulkRows  = 1000000
+	maxBulkBytes = 32 << 20
+)
+
+type bulkRoutes struct {
+	bulkService service.Bulk
+	l           logger.Interface
+}
+
+func NewBulkRouter(bulkService service.Bulk, l logger.Interface) http.Handler {
+	br := bulkRoutes{bulkService: bulkService, l: l}
+	r := chi.NewRouter()
+
+	r.Post("/", br.createBulkJob)
+	r.Get("/{job_id}", br.getBulkJob)
+	r.Get("/{job_id}/errors", br.getBulkJobErrors)
+
+	return r
+}
+
+type BulkRequest struct {
+	// Operation is add or delete.
+	Operation string `json:"operation"`
+	Segment   string `json:"segment"`
+	// UserIDs are numbers or strings. Values that aren't user ids are
+	// reported as errors of their rows.
+	UserIDs []json.RawMessage `json:"user_ids" swaggertype:"array,integer"`
+	// ExpiresAt is an RFC3339 timestamp the memberships added expire at.
+	ExpiresAt *time.Time `json:"expires_at"`
+}
+
+// @Summary Create bulk job
+// @Description Queues adding many users to a segment or removing them from it. The user ids are a JSON request, or a text/csv upload with the ids in the first column, an optional user_id header, and operation, segment and expires_at in the query. The job runs in the background, poll it for progress and fetch the errors of single rows once it is done
+// @Tags Bulk
+// @Security ApiKeyAuth
+// @Security BearerAuth
+// @Accept json
+// @Accept text/csv
+// @Produce json
+// @Param X-Change-Reason header string false "Why the memberships change, logged with them"
+// @Param request body BulkRequest false "request, when uploading JSON"
+// @Param operation query string false "add or delete, when uploading CSV"
+// @Param segment query string false "segment, when uploading CSV"
+// @Param expires_at query string false "RFC3339 expiry of the memberships added, when uploading CSV"
+// @Success 202 {object} entity.BulkJob
+// @Header 202 {string} Location "URL of the job"
+// @Failure 400 {object} Problem
+// @Failure 404 {object} Problem
+// @Failure 413 {object} Problem
+// @Failure 415 {object} Problem
+// @Failure 422 {object} Problem
+// @Failure 500 {object} Problem
+// @Router /bulk [post]
+func (br *bulkRoutes) createBulkJob(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxBulkBytes)
+
+	var job entity.BulkJob
+	var values []string
+	var err error
+
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	switch mediaType {
+	case "", mediaJSON:
+		job, values, err = bulkFromJSON(r)
+	case mediaCSV:
+		job, values, err = bulkFromCSV(r)
+	default:
+		errorResponse(w, r, http.StatusUnsupportedMediaType, "supported media types: "+mediaJSON+", "+mediaCSV)
+		return
+	}
+
+	var tooLarge *http.MaxBytesError
+	switch {
+	case errors.As(err, &tooLarge):
+		errorResponse(w, r, http.StatusRequestEntityTooLarge, fmt.Sprintf("uploads must be at most %d bytes", maxBulkBytes))
+		return
+	case err != nil:
+		errorResponse(w, r, http.StatusBadRequest, err.Error())
+		return
+	case len(values) > maxBulkRows:
+		errorResponse(w, r, http.StatusRequestEntityTooLarge, fmt.Sprintf("at most %d user ids per job", maxBulkRows))
+		return
+	}
+
+	job, err = br.bulkService.CreateBulkJob(r.Context(), job, values)
+	if err != nil {
+		handleError(w, r, br.l, err)
+		return
+	}
+
+	w.Header().Set("Location", fmt.Sprintf("/v1/bulk/%d", job.ID))
+	render.Status(r, http.StatusAccepted)
+	render.JSON(w, r, job)
+}
+
+func bulkFromJSON(r *http.Request) (entity.BulkJob, []string, error) {
+	var req BulkRequest
+	err := render.DecodeJSON(r.Body, &req)
+	if err != nil {
+		return entity.BulkJob{}, nil, fmt.Errorf("invalid request body: %w", err)
+	}
+
+	values := make([]string, len(req.UserIDs))
+	for i, raw := range req.UserIDs {
+		var s string
+		if json.Unmarshal(raw, &s) != nil {
+			s = string(raw)
+		}
+		values[i] = s
+	}
+
+	return entity.BulkJob{Operation: req.Operation, Segment: req.Segment, ExpiresAt: req.ExpiresAt}, values, nil
+}
+
+// bulkFromCSV reads the user ids from the first column of the CSV body of r,
+// skipping a user_id header, and the job from the query. It stops reading
+// past maxBulkRows.
+func bulkFromCSV(r *http.Request) (entity.BulkJob, []string, error) {
+	query := r.URL.Query()
+	job := entity.BulkJob{Operation: query.Get("operation"), Segment: query.Get("segment")}
+
+	if v := query.Get("expires_at"); v != "" {
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			return job, nil, errors.New("expires_at must be an RFC3339 timestamp")
+		}
+		job.ExpiresAt = &t
+	}
+
+	cr := csv.NewReader(r.Body)
+	cr.FieldsPerRecord = -1
+	cr.ReuseRecord = true
+
+	var values []string
+	for len(values) <= maxBulkRows {
+		record, err := cr.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return job, nil, fmt.Errorf("invalid CSV: %w", err)
+		}
+
+		value := strings.TrimSpace(record[0])
+		if len(values) == 0 && strings.EqualFold(value, "user_id") {
+			continue
+		}
+		values = append(values, value)
+	}
+
+	return job, values, nil
+}
+
+// @Summary Get bulk job
+// @Description Returns a bulk job with its progress: processed counts the rows settled so far, changed those that added or removed the user, unchanged those the user already was or wasn't in the segment, failed those with an error
+// @Tags Bulk
+// @Security ApiKeyAuth
+// @Security BearerAuth
+// @Produce json
+// @Param job_id path int true "job_id"
+// @Success 200 {object} entity.BulkJob
+// @Failure 400 {object} Problem
+// @Failure 404 {object} Problem
+// @Failure 500 {object} Problem
+// @Router /bulk/{job_id} [get]
+func (br *bulkRoutes) getBulkJob(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(chi.URLParam(r, "job_id"), 10, 64)
+	if err != nil {
+		errorResponse(w, r, http.StatusBadRequest, "job_id must be an integer")
+		return
+	}
+
+	job, err := br.bulkService.GetBulkJob(r.Context(), id)
+	if err != nil {
+		handleError(w, r, br.l, err)
+		return
+	}
+
+	render.JSON(w, r, job)
+}
+
+// @Summary Get bulk job errors
+// @Description Returns the rows of a bulk job settled with an error so far, in upload order, as CSV or a JSON array by the Accept header
+// @Tags Bulk
+// @Security ApiKeyAuth
+// @Security BearerAuth
+// @Produce json
+// @Produce text/csv
+// @Param job_id path int true "job_id"
+// @Success 200 {array} entity.BulkRow
+// @Failure 400 {object} Problem
+// @Failure 404 {object} Problem
+// @Failure 406 {object} Problem
+// @Failure 500 {object} Problem
+// @Router /bulk/{job_id}/errors [get]
+func (br *bulkRoutes) getBulkJobErrors(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(chi.URLParam(r, "job_id"), 10, 64)
+	if err != nil {
+		errorResponse(w, r, http.StatusBadRequest, "job_id must be an integer")
+		return
+	}
+
+	rows, err := br.bulkService.GetBulkJobErrors(r.Context(), id)
+	if err != nil {
+		handleError(w, r, br.l, err)
+		return
+	}
+
+	w.Header().Add("Vary", "Accept")
+	switch negotiate(r, mediaJSON, mediaCSV) {
+	case mediaJSON:
+		render.JSON(w, r, rows)
+	case mediaCSV:
+		w.Header().Set("Content-Type", mediaCSV+"; charset=utf-8; header=present")
+		w.WriteHeader(http.StatusOK)
+
+		cw := csv.NewWriter(w)
+		cw.UseCRLF = true
+		_ = cw.Write(entity.BulkRowCSVHeader)
+		for _, row := range rows {
+			_ = cw.Write(row.CSVRecord())
+		}
+		cw.Flush()
+	default:
+		errorResponse(w, r, http.StatusNotAcceptable, "supported media types: "+mediaJSON+", "+mediaCSV)
+	}
+}
@@ -0,0 +1,66 @@
+package v1
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/realPointer/segments/internal/repo/repoerrs"
+	webapi "github.com/realPointer/segments/internal/ydisk"
+	"github.com/realPointer/segments/pkg/logger"
+)
+
+// Problem is an RFC 7807 problem details body.
+type Problem struct {
+	Type     string `json:"type"`
+	Title    string `json:"title"`
+	Status   int    `json:"status"`
+	Detail   string `json:"detail,omitempty"`
+	Instance string `json:"instance,omitempty"`
+}
+
+func errorResponse(w http.ResponseWriter, r *http.Request, status int, detail string) {
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(Problem{
+		Type:     "about:blank",
+		Title:    http.StatusText(status),
+		Status:   status,
+		Detail:   detail,
+		Instance: r.URL.Path,
+	})
+}
+
+// handleError answers with the status matching the kind of err. Only the
+// messages of repository errors are shown, which are written for clients;
+// other errors may name internals, so they are logged and answered with a
+// fixed detail. Errors of unknown kinds are reported as 500.
+func handleError(w http.ResponseWriter, r *http.Request, l logger.Interface, err error) {
+	var status int
+	var fixed string
+
+	switch {
+	case errors.Is(err, repoerrs.ErrNotFound):
+		status = http.StatusNotFound
+	case errors.Is(err, repoerrs.ErrAlreadyExists), errors.Is(err, repoerrs.ErrConflict):
+		status = http.StatusConflict
+	case errors.Is(err, repoerrs.ErrInvalidInput):
+		status = http.StatusUnprocessableEntity
+	case errors.Is(err, webapi.ErrUnavailable):
+		status = http.StatusServiceUnavailable
+		fixed = "report storage is not available"
+	default:
+		l.Error(err)
+		errorResponse(w, r, http.StatusInternalServerError, "")
+		return
+	}
+
+	var repoErr *repoerrs.Error
+	if !errors.As(err, &repoErr) {
+		l.Warn("http - v1 - handleError: %s", err)
+		errorResponse(w, r, status, fixed)
+		return
+	}
+
+	errorResponse(w, r, status, repoErr.Msg)
+}
@@ -0,0 +1,178 @@
+package v1
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/realPointer/segments/internal/entity"
+	"github.com/realPointer/segments/internal/service"
+	"github.com/realPointer/segments/pkg/logger"
+)
+
+// Sizes of one read of the operation feed.
+const (
+	defaultFeedLimit = 100_000
+	maxFeedLimit     = 1_000_000
+)
+
+const (
+	// feedFlushEvery is the number of entries buffered before they are sent.
+	feedFlushEvery = 500
+	// feedWriteTimeout bounds the time a client may take to receive a batch
+	// of entries. It replaces the server write timeout, which would cut long
+	// streams short.
+	feedWriteTimeout = 10 * time.Second
+)
+
+var feedMediaTypes = []string{mediaNDJSON, "application/ndjson", mediaCSV}
+
+type feedRoutes struct {
+	userService service.User
+	l           logger.Interface
+}
+
+func NewFeedRouter(userService service.User, l logger.Interface) http.Handler {
+	f := feedRoutes{userService: userService, l: l}
+	r := chi.NewRouter()
+
+	r.Get("/", f.getOperations)
+
+	return r
+}
+
+// @Summary Get operations of all users
+// @Description Streams the operations of all users as NDJSON (default) or CSV with a header, depending on the Accept header.
+// @Description Entries are ordered by cursor and no entry ever appears before one already returned, so passing the cursor of the last loaded entry as after resumes the feed without gaps
+// @Tags Operations
+// @Security ApiKeyAuth
+// @Security BearerAuth
+// @Produce application/x-ndjson,text/csv
+// @Param after query string false "cursor of the last entry already read"
+// @Param from query string false "RFC3339 timestamp, inclusive"
+// @Param to query string false "RFC3339 timestamp, exclusive"
+// @Param segment query string false "segment name"
+// @Param source query string false "manual, auto, expire, segment_delete, rule or bulk"
+// @Param limit query int false "entries to return, 100000 by default, at most 1000000"
+// @Success 200 {array} entity.FeedEntry
+// @Failure 400 {object} Problem
+// @Failure 406 {object} Problem
+// @Failure 422 {object} Problem
+// @Failure 500 {object} Problem
+// @Router /operations [get]
+func (f *feedRoutes) getOperations(w http.ResponseWriter, r *http.Request) {
+	w.Header().Add("Vary", "Accept")
+
+	mediaType := negotiate(r, feedMediaTypes...)
+	if mediaType == "" {
+		errorResponse(w, r, http.StatusNotAcceptable, "supported media types: "+strings.Join(feedMediaTypes, ", "))
+		return
+	}
+
+	query := r.URL.Query()
+	filter := entity.FeedFilter{
+		Segment: query.Get("segment"),
+		Source:  query.Get("source"),
+		After:   query.Get("after"),
+		Limit:   defaultFeedLimit,
+	}
+
+	bounds := []struct {
+		name string
+		t    *time.Time
+	}{{"from", &filter.From}, {"to", &filter.To}}
+	for _, bound := range bounds {
+		if v := query.Get(bound.name); v != "" {
+			t, err := time.Parse(time.RFC3339, v)
+			if err != nil {
+				errorResponse(w, r, http.StatusBadRequest, fmt.Sprintf("%s must be an RFC3339 timestamp", bound.name))
+				return
+			}
+			*bound.t = t
+		}
+	}
+
+	if v := query.Get("limit"); v != "" {
+		limit, err := strconv.Atoi(v)
+		if err != nil || limit < 1 || limit > maxFeedLimit {
+			errorResponse(w, r, http.StatusBadRequest, fmt.Sprintf("limit must be an integer between 1 and %d", maxFeedLimit))
+			return
+		}
+		filter.Limit = limit
+	}
+
+	rc := http.NewResponseController(w)
+	var cw *csv.Writer
+	enc := json.NewEncoder(w)
+	started, sent := false, 0
+
+	flush := func() {
+		if cw != nil {
+			cw.Flush()
+		}
+		_ = rc.SetWriteDeadline(time.Now().Add(feedWriteTimeout))
+		_ = rc.Flush()
+	}
+
+	// The status is sent with the first entry, so that errors found before
+	// it are still reported as problems.
+	start := func() {
+		started = true
+		_ = rc.SetWriteDeadline(time.Now().Add(feedWriteTimeout))
+		if mediaType != mediaCSV {
+			w.Header().Set("Content-Type", mediaType)
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+
+		w.Header().Set("Content-Type", mediaCSV+"; charset=utf-8; header=present")
+		w.WriteHeader(http.StatusOK)
+		cw = csv.NewWriter(w)
+		cw.UseCRLF = true
+		_ = cw.Write(entity.FeedCSVHeader)
+	}
+
+	err := f.userService.StreamOperations(r.Context(), filter, func(entry entity.FeedEntry) error {
+		if !started {
+			start()
+		}
+
+		var err error
+		if cw != nil {
+			err = cw.Write(entry.CSVRecord())
+		} else {
+			err = enc.Encode(entry)
+		}
+		if err != nil {
+			return err
+		}
+
+		sent++
+		if sent%feedFlushEvery == 0 {
+			flush()
+		}
+
+		return nil
+	})
+	if err != nil {
+		if !started {
+			handleError(w, r, f.l, err)
+			return
+		}
+
+		// Part of the feed is sent already, breaking the connection is the
+		// only way left to tell the client it is incomplete.
+		f.l.Error(err)
+		panic(http.ErrAbortHandler)
+	}
+
+	if !started {
+		start()
+	}
+	flush()
+}
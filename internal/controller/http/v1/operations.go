@@ -0,0 +1,180 @@
+package v1
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/render"
+	"github.com/realPointer/segments/internal/entity"
+)
+
+// Media types operation history is served as.
+const (
+	mediaCSV    = "text/csv"
+	mediaJSON   = "application/json"
+	mediaNDJSON = "application/x-ndjson"
+)
+
+// Page sizes of operation history.
+const (
+	defaultOperationsLimit = 1000
+	maxOperationsLimit     = 10000
+)
+
+var operationMediaTypes = []string{mediaCSV, mediaJSON, mediaNDJSON, "application/ndjson"}
+
+// operationFilter reads the filter of operation history from the query of r.
+// The error names the first invalid parameter.
+func operationFilter(r *http.Request) (entity.OperationFilter, error) {
+	query := r.URL.Query()
+	filter := entity.OperationFilter{
+		Segment:   query.Get("segment"),
+		Operation: query.Get("operation"),
+		Source:    query.Get("source"),
+		Cursor:    query.Get("cursor"),
+		Limit:     defaultOperationsLimit,
+	}
+
+	if date := query.Get("date"); date != "" {
+		if query.Get("from") != "" || query.Get("to") != "" {
+			return filter, errors.New("date can't be combined with from and to")
+		}
+
+		month, err := time.Parse("2006-01", date)
+		if err != nil {
+			return filter, errors.New("date must be a month, YYYY-MM")
+		}
+		filter.From, filter.To = month, month.AddDate(0, 1, 0)
+	}
+
+	bounds := []struct {
+		name string
+		t    *time.Time
+	}{{"from", &filter.From}, {"to", &filter.To}}
+	for _, bound := range bounds {
+		if v := query.Get(bound.name); v != "" {
+			t, err := time.Parse(time.RFC3339, v)
+			if err != nil {
+				return filter, fmt.Errorf("%s must be an RFC3339 timestamp", bound.name)
+			}
+			*bound.t = t
+		}
+	}
+
+	switch query.Get("order") {
+	case "", "asc":
+	case "desc":
+		filter.Desc = true
+	default:
+		return filter, errors.New("order must be asc or desc")
+	}
+
+	if v := query.Get("limit"); v != "" {
+		limit, err := strconv.Atoi(v)
+		if err != nil || limit < 1 || limit > maxOperationsLimit {
+			return filter, fmt.Errorf("limit must be an integer between 1 and %d", maxOperationsLimit)
+		}
+		filter.Limit = limit
+	}
+
+	return filter, nil
+}
+
+// negotiate returns the offer the Accept header of r prefers. Offers the
+// client values equally are ranked in the given order, so the first offer is
+// returned when there is no Accept header. It returns "" when the client
+// accepts none of the offers.
+func negotiate(r *http.Request, offers ...string) string {
+	accept := r.Header.Get("Accept")
+	if accept == "" {
+		return offers[0]
+	}
+
+	best, bestQ := "", 0.0
+	for _, offer := range offers {
+		q := acceptQuality(accept, offer)
+		if q > bestQ {
+			best, bestQ = offer, q
+		}
+	}
+
+	return best
+}
+
+// acceptQuality returns the quality the accept header gives to mediaType,
+// taken from the most specific media range matching it.
+func acceptQuality(accept, mediaType string) float64 {
+	q, specificity := 0.0, -1
+	for _, part := range strings.Split(accept, ",") {
+		params := strings.Split(part, ";")
+		mediaRange := strings.ToLower(strings.TrimSpace(params[0]))
+
+		s := -1
+		switch {
+		case mediaRange == mediaType:
+			s = 2
+		case strings.HasSuffix(mediaRange, "/*") && strings.HasPrefix(mediaType, strings.TrimSuffix(mediaRange, "*")):
+			s = 1
+		case mediaRange == "*/*":
+			s = 0
+		}
+		if s <= specificity {
+			continue
+		}
+
+		specificity, q = s, 1
+		for _, param := range params[1:] {
+			key, value, _ := strings.Cut(strings.TrimSpace(param), "=")
+			if key == "q" {
+				v, err := strconv.ParseFloat(value, 64)
+				if err == nil {
+					q = v
+				}
+			}
+		}
+	}
+
+	return q
+}
+
+// renderOperations writes the operations in the media type the client asked
+// for: RFC 4180 CSV with a header, a JSON array or one JSON object per line.
+func renderOperations(w http.ResponseWriter, r *http.Request, operations []entity.Operation) {
+	w.Header().Add("Vary", "Accept")
+
+	mediaType := negotiate(r, operationMediaTypes...)
+	switch mediaType {
+	case "":
+		errorResponse(w, r, http.StatusNotAcceptable, "supported media types: "+strings.Join(operationMediaTypes, ", "))
+	case mediaCSV:
+		w.Header().Set("Content-Type", mediaCSV+"; charset=utf-8; header=present")
+		w.WriteHeader(http.StatusOK)
+
+		cw := csv.NewWriter(w)
+		cw.UseCRLF = true
+		_ = cw.Write(entity.OperationCSVHeader)
+		for _, operation := range operations {
+			_ = cw.Write(operation.CSVRecord())
+		}
+		cw.Flush()
+	case mediaJSON:
+		if operations == nil {
+			operations = []entity.Operation{}
+		}
+		render.JSON(w, r, operations)
+	default:
+		w.Header().Set("Content-Type", mediaType)
+		w.WriteHeader(http.StatusOK)
+
+		enc := json.NewEncoder(w)
+		for _, operation := range operations {
+			_ = enc.Encode(operation)
+		}
+	}
+}
@@ -0,0 +1,115 @@
+package v1
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/render"
+	"github.com/realPointer/segments/internal/entity"
+	"github.com/realPointer/segments/internal/service"
+	"github.com/realPointer/segments/pkg/logger"
+)
+
+type reportRoutes struct {
+	reportService service.Report
+	l             logger.Interface
+}
+
+func NewReportRouter(reportService service.Report, l logger.Interface) http.Handler {
+	rr := reportRoutes{reportService: reportService, l: l}
+	r := chi.NewRouter()
+
+	r.Post("/", rr.createReport)
+	r.Get("/{report_id}", rr.getReport)
+
+	return r
+}
+
+type ReportRequest struct {
+	// Kind is user_operations (default), the history of the user, or one of
+	// the segment reports: segment_members, segment_operations and
+	// segment_daily.
+	Kind   string `json:"kind"`
+	UserID int    `json:"user_id"`
+	// Segment is the segment reported on, or the one the history of the user
+	// is limited to.
+	Segment string `json:"segment"`
+	// From and To are RFC3339 timestamps bounding the period, From is
+	// inclusive and To exclusive.
+	From *time.Time `json:"from"`
+	To   *time.Time `json:"to"`
+	// Format is csv (default), json or ndjson.
+	Format string `json:"format"`
+}
+
+// @Summary Create report
+// @Description Queues a report: the operations of a user, or the current members, the operations or daily member counts of a segment. The report is generated in the background, poll the returned job until its status is done or failed
+// @Tags Reports
+// @Security ApiKeyAuth
+// @Security BearerAuth
+// @Accept json
+// @Produce json
+// @Param request body ReportRequest true "request"
+// @Success 202 {object} entity.ReportJob
+// @Header 202 {string} Location "URL of the job"
+// @Failure 400 {object} Problem
+// @Failure 404 {object} Problem
+// @Failure 422 {object} Problem
+// @Failure 500 {object} Problem
+// @Router /reports [post]
+func (rr *reportRoutes) createReport(w http.ResponseWriter, r *http.Request) {
+	var req ReportRequest
+	err := render.DecodeJSON(r.Body, &req)
+	if err != nil {
+		errorResponse(w, r, http.StatusBadRequest, "invalid request body: "+err.Error())
+		return
+	}
+
+	job, err := rr.reportService.CreateReport(r.Context(), entity.ReportJob{
+		Kind:    req.Kind,
+		UserID:  req.UserID,
+		Segment: req.Segment,
+		From:    req.From,
+		To:      req.To,
+		Format:  req.Format,
+	})
+	if err != nil {
+		handleError(w, r, rr.l, err)
+		return
+	}
+
+	w.Header().Set("Location", fmt.Sprintf("/v1/reports/%d", job.ID))
+	render.Status(r, http.StatusAccepted)
+	render.JSON(w, r, job)
+}
+
+// @Summary Get report
+// @Description Returns a report job. Once its status is done, url links to the report
+// @Tags Reports
+// @Security ApiKeyAuth
+// @Security BearerAuth
+// @Produce json
+// @Param report_id path int true "report_id"
+// @Success 200 {object} entity.ReportJob
+// @Failure 400 {object} Problem
+// @Failure 404 {object} Problem
+// @Failure 500 {object} Problem
+// @Router /reports/{report_id} [get]
+func (rr *reportRoutes) getReport(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(chi.URLParam(r, "report_id"), 10, 64)
+	if err != nil {
+		errorResponse(w, r, http.StatusBadRequest, "report_id must be an integer")
+		return
+	}
+
+	job, err := rr.reportService.GetReport(r.Context(), id)
+	if err != nil {
+		handleError(w, r, rr.l, err)
+		return
+	}
+
+	render.JSON(w, r, job)
+}
@@ -6,6 +6,7 @@ import (
 
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/chi/v5/middleware"
+	"github.com/realPointer/segments/internal/entity"
 	"github.com/realPointer/segments/internal/service"
 	"github.com/realPointer/segments/pkg/logger"
 
@@ -13,11 +14,20 @@ import (
 	httpSwagger "github.com/swaggo/http-swagger/v2"
 )
 
-func NewRouter(handler chi.Router, l logger.Interface, services *service.Services) {
+// NewRouter mounts the API on handler. files, when not nil, serves the
+// reports kept by the service itself under /files.
+func NewRouter(handler chi.Router, l logger.Interface, services *service.Services, files http.Handler) {
 	handler.Use(middleware.Logger)
 	handler.Use(middleware.Recoverer)
 	handler.Use(middleware.Timeout(60 * time.Second))
 
+	handler.NotFound(func(w http.ResponseWriter, r *http.Request) {
+		errorResponse(w, r, http.StatusNotFound, "")
+	})
+	handler.MethodNotAllowed(func(w http.ResponseWriter, r *http.Request) {
+		errorResponse(w, r, http.StatusMethodNotAllowed, "")
+	})
+
 	handler.Get("/ping", func(w http.ResponseWriter, r *http.Request) {
 		w.Write([]byte("pong!"))
 	})
@@ -27,7 +37,22 @@ func NewRouter(handler chi.Router, l logger.Interface, services *service.Service
 	))
 
 	handler.Route("/v1", func(r chi.Router) {
-		r.Mount("/user/{user_id:[0-9]+}", NewUserRouter(services.User, l))
-		r.Mount("/segment", NewSegmentRouter(services.Segment, l))
+		r.Use(authenticate(services.Auth, l))
+		r.Use(changeReason)
+
+		r.With(authorize(entity.RoleReader, entity.RoleAssigner)).Mount("/user/{user_id:[0-9]+}", NewUserRouter(services.User, l))
+		r.With(authorize(entity.RoleReader, entity.RoleAssigner)).Mount("/bulk", NewBulkRouter(services.Bulk, l))
+		r.With(authorize(entity.RoleReader, entity.RoleAdmin)).Mount("/segment", NewSegmentRouter(services.Segment, l))
+		r.With(authorize(entity.RoleReader, entity.RoleReader)).Mount("/operations", NewFeedRouter(services.User, l))
+		// Queuing a report only reads.
+		r.With(authorize(entity.RoleReader, entity.RoleReader)).Mount("/reports", NewReportRouter(services.Report, l))
+		r.With(authorize(entity.RoleAdmin, entity.RoleAdmin)).Mount("/keys", NewAPIKeyRouter(services.Auth, l))
 	})
+
+	// Report names can be guessed, so downloads need the same role as
+	// reading the reports.
+	if files != nil {
+		handler.With(authenticate(services.Auth, l), authorize(entity.RoleReader, entity.RoleReader)).
+			Mount("/files", http.StripPrefix("/files", files))
+	}
 }
@@ -1,61 +1,109 @@
 package v1
 
 import (
-	"log"
+	"errors"
+	"io"
 	"net/http"
 	"strconv"
 
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/render"
+	"github.com/realPointer/segments/internal/entity"
 	"github.com/realPointer/segments/internal/service"
 	"github.com/realPointer/segments/pkg/logger"
 )
 
 type segmentRoutes struct {
 	segmentService service.Segment
+	l              logger.Interface
 }
 
 func NewSegmentRouter(segmentService service.Segment, l logger.Interface) http.Handler {
-	s := segmentRoutes{segmentService: segmentService}
+	s := segmentRoutes{segmentService: segmentService, l: l}
 	r := chi.NewRouter()
 
 	r.Post("/{segmentName}", s.createSegment)
+	r.Get("/{segmentName}", s.getSegment)
+	r.Patch("/{segmentName}", s.updateSegment)
+	r.Post("/{segmentName}/rename", s.renameSegment)
 	r.Delete("/{segmentName}", s.deleteSegment)
 	r.Get("/list", s.getSegments)
 
 	return r
 }
 
+type SegmentMeta struct {
+	Description string   `json:"description"`
+	Owner       string   `json:"owner"`
+	Tags        []string `json:"tags"`
+	// Bucketing and Salt only matter for auto segments. Bucketing is "hash"
+	// (default) or "random", the salt defaults to the segment name.
+	Bucketing string `json:"bucketing"`
+	Salt      string `json:"salt"`
+	// Layer makes the segment mutually exclusive with the other segments of
+	// the layer.
+	Layer string `json:"layer"`
+	// Variants turn the segment into an experiment: every member gets one of
+	// them with the probability of its weight.
+	Variants []entity.Variant `json:"variants"`
+	// Rule makes the segment hold the users whose attributes match it.
+	Rule string `json:"rule"`
+}
+
 // @Summary Create segment
-// @Description Creates a new segment with the given name
+// @Description Creates a new segment with the given name and optional metadata
 // @Tags Segment
+// @Security ApiKeyAuth
+// @Security BearerAuth
+// @Accept json
 // @Param segmentName path string true "segmentName"
 // @Param auto query string false "auto"
+// @Param meta body SegmentMeta false "meta"
+// @Param X-Change-Reason header string false "why the changes are made, logged with them"
 // @Success 201
-// @Failure 400
-// @Failure 500
+// @Failure 400 {object} Problem
+// @Failure 409 {object} Problem
+// @Failure 422 {object} Problem
+// @Failure 500 {object} Problem
 // @Router /segment/{segmentName} [post]
 func (s *segmentRoutes) createSegment(w http.ResponseWriter, r *http.Request) {
 	segmentName := chi.URLParam(r, "segmentName")
 
 	autoStr := r.URL.Query().Get("auto")
 
-	var err error
+	var meta SegmentMeta
+	err := decodeOptionalJSON(r, &meta)
+	if err != nil {
+		errorResponse(w, r, http.StatusBadRequest, "invalid request body: "+err.Error())
+		return
+	}
+
+	segment := entity.Segment{
+		Name:        segmentName,
+		Description: meta.Description,
+		Owner:       meta.Owner,
+		Tags:        meta.Tags,
+		Bucketing:   meta.Bucketing,
+		Salt:        meta.Salt,
+		Layer:       meta.Layer,
+		Variants:    meta.Variants,
+		Rule:        meta.Rule,
+	}
 
 	if autoStr == "" {
-		err = s.segmentService.CreateSegment(r.Context(), segmentName)
+		err = s.segmentService.CreateSegment(r.Context(), segment)
 	} else {
 		percentage, parseErr := strconv.ParseFloat(autoStr, 64)
 		if parseErr != nil {
-			w.WriteHeader(http.StatusBadRequest)
+			errorResponse(w, r, http.StatusBadRequest, "auto must be a number")
 			return
 		}
 
-		err = s.segmentService.CreateSegmentAuto(r.Context(), segmentName, percentage)
+		err = s.segmentService.CreateSegmentAuto(r.Context(), segment, percentage)
 	}
 
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
+		handleError(w, r, s.l, err)
 		return
 	}
 
@@ -65,35 +113,154 @@ func (s *segmentRoutes) createSegment(w http.ResponseWriter, r *http.Request) {
 // @Summary Delete segment
 // @Description Deletes a segment with the given name
 // @Tags Segment
+// @Security ApiKeyAuth
+// @Security BearerAuth
 // @Param segmentName path string true "segmentName"
+// @Param X-Change-Reason header string false "why the changes are made, logged with them"
 // @Success 200
-// @Failure 400
-// @Failure 500
+// @Failure 404 {object} Problem
+// @Failure 500 {object} Problem
 // @Router /segment/{segmentName} [delete]
 func (s *segmentRoutes) deleteSegment(w http.ResponseWriter, r *http.Request) {
 	segmentName := chi.URLParam(r, "segmentName")
 	err := s.segmentService.DeleteSegment(r.Context(), segmentName)
 	if err != nil {
-		log.Default().Println(err)
-		w.WriteHeader(http.StatusInternalServerError)
+		handleError(w, r, s.l, err)
 		return
 	}
 
 	w.WriteHeader(http.StatusOK)
 }
 
+// @Summary Get segment
+// @Description Returns a segment with its metadata
+// @Tags Segment
+// @Security ApiKeyAuth
+// @Security BearerAuth
+// @Param segmentName path string true "segmentName"
+// @Success 200 {object} entity.Segment
+// @Failure 404 {object} Problem
+// @Failure 500 {object} Problem
+// @Router /segment/{segmentName} [get]
+func (s *segmentRoutes) getSegment(w http.ResponseWriter, r *http.Request) {
+	segmentName := chi.URLParam(r, "segmentName")
+
+	segment, err := s.segmentService.GetSegment(r.Context(), segmentName)
+	if err != nil {
+		handleError(w, r, s.l, err)
+		return
+	}
+
+	render.JSON(w, r, segment)
+}
+
+// @Summary Update segment
+// @Description Changes description, owner, tags, percentage or salt of a segment. Omitted fields stay as they are. A new percentage or salt of an auto segment is applied to its members right away
+// @Tags Segment
+// @Security ApiKeyAuth
+// @Security BearerAuth
+// @Accept json
+// @Param segmentName path string true "segmentName"
+// @Param update body entity.SegmentUpdate true "update"
+// @Param X-Change-Reason header string false "why the changes are made, logged with them"
+// @Success 200 {object} entity.Segment
+// @Failure 400 {object} Problem
+// @Failure 404 {object} Problem
+// @Failure 409 {object} Problem
+// @Failure 422 {object} Problem
+// @Failure 500 {object} Problem
+// @Router /segment/{segmentName} [patch]
+func (s *segmentRoutes) updateSegment(w http.ResponseWriter, r *http.Request) {
+	segmentName := chi.URLParam(r, "segmentName")
+
+	var update entity.SegmentUpdate
+	err := render.DecodeJSON(r.Body, &update)
+	if err != nil {
+		errorResponse(w, r, http.StatusBadRequest, "invalid request body: "+err.Error())
+		return
+	}
+
+	segment, err := s.segmentService.UpdateSegment(r.Context(), segmentName, update)
+	if err != nil {
+		handleError(w, r, s.l, err)
+		return
+	}
+
+	render.JSON(w, r, segment)
+}
+
+type SegmentRename struct {
+	Name string `json:"name"`
+}
+
+// @Summary Rename segment
+// @Description Renames a segment. Memberships and history are kept, the old name keeps resolving to the segment
+// @Tags Segment
+// @Security ApiKeyAuth
+// @Security BearerAuth
+// @Accept json
+// @Param segmentName path string true "segmentName"
+// @Param rename body SegmentRename true "rename"
+// @Success 200 {object} entity.Segment
+// @Failure 400 {object} Problem
+// @Failure 404 {object} Problem
+// @Failure 409 {object} Problem
+// @Failure 422 {object} Problem
+// @Failure 500 {object} Problem
+// @Router /segment/{segmentName}/rename [post]
+func (s *segmentRoutes) renameSegment(w http.ResponseWriter, r *http.Request) {
+	segmentName := chi.URLParam(r, "segmentName")
+
+	var rename SegmentRename
+	err := render.DecodeJSON(r.Body, &rename)
+	if err != nil {
+		errorResponse(w, r, http.StatusBadRequest, "invalid request body: "+err.Error())
+		return
+	}
+
+	segment, err := s.segmentService.RenameSegment(r.Context(), segmentName, rename.Name)
+	if err != nil {
+		handleError(w, r, s.l, err)
+		return
+	}
+
+	render.JSON(w, r, segment)
+}
+
 // @Summary Get segments
-// @Description Returns a list of segments
+// @Description Returns a list of segments, optionally filtered by tag, owner and layer
 // @Tags Segment
-// @Success 200
-// @Failure 500
+// @Security ApiKeyAuth
+// @Security BearerAuth
+// @Param tag query string false "tag"
+// @Param owner query string false "owner"
+// @Param layer query string false "layer"
+// @Success 200 {array} entity.Segment
+// @Failure 500 {object} Problem
 // @Router /segment/list [get]
 func (s *segmentRoutes) getSegments(w http.ResponseWriter, r *http.Request) {
-	segments, err := s.segmentService.GetSegments(r.Context())
+	filter := entity.SegmentFilter{
+		Tag:   r.URL.Query().Get("tag"),
+		Owner: r.URL.Query().Get("owner"),
+		Layer: r.URL.Query().Get("layer"),
+	}
+
+	segments, err := s.segmentService.GetSegments(r.Context(), filter)
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
+		handleError(w, r, s.l, err)
 		return
 	}
 
 	render.JSON(w, r, segments)
 }
+
+// decodeOptionalJSON decodes the request body into v, an empty body leaves v
+// untouched.
+func decodeOptionalJSON(r *http.Request, v interface{}) error {
+	err := render.DecodeJSON(r.Body, v)
+	if errors.Is(err, io.EOF) {
+		return nil
+	}
+
+	return err
+}
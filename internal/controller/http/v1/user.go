@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"net/http"
 	"strconv"
+	"time"
 
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/render"
@@ -14,199 +15,405 @@ import (
 
 type userRoutes struct {
 	userService service.User
+	l           logger.Interface
 }
 
 func NewUserRouter(userService service.User, l logger.Interface) http.Handler {
-	u := userRoutes{userService: userService}
+	u := userRoutes{userService: userService, l: l}
 	r := chi.NewRouter()
 
 	r.Post("/", u.createUser)
+	r.Put("/attributes", u.setUserAttributes)
+	r.Get("/attributes", u.getUserAttributes)
 	r.Post("/segments", u.addOrRemoveUserSegments)
 	r.Get("/segments", u.getUserSegments)
+	r.Put("/segments/{segment}/expiry", u.setUserSegmentExpiry)
+	r.Delete("/segments/{segment}/expiry", u.clearUserSegmentExpiry)
 	r.Get("/operations", u.getUserOperations)
-	r.Get("/operations/report-link", u.getUserOperationsYandex)
+	r.Get("/operations/report-link", u.getUserOperationsReport)
 
 	return r
 }
 
 // @Summary Create user
-// @Description Creates a new user with the given ID
+// @Description Creates a new user with the given ID and optional attributes
 // @Tags User
+// @Security ApiKeyAuth
+// @Security BearerAuth
+// @Accept json
 // @Param user_id path int true "user_id"
+// @Param attributes body entity.UserAttributes false "attributes"
+// @Param X-Change-Reason header string false "why the changes are made, logged with them"
 // @Success 201
-// @Failure 400
-// @Failure 500
+// @Failure 400 {object} Problem
+// @Failure 409 {object} Problem
+// @Failure 422 {object} Problem
+// @Failure 500 {object} Problem
 // @Router /user/{user_id} [post]
 func (u *userRoutes) createUser(w http.ResponseWriter, r *http.Request) {
 	userIdStr := chi.URLParam(r, "user_id")
 
 	userId, err := strconv.Atoi(userIdStr)
 	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
+		errorResponse(w, r, http.StatusBadRequest, "user_id must be an integer")
 		return
 	}
 
-	err = u.userService.CreateUser(r.Context(), userId)
+	var attrs entity.UserAttributes
+	err = decodeOptionalJSON(r, &attrs)
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
+		errorResponse(w, r, http.StatusBadRequest, "invalid request body: "+err.Error())
+		return
+	}
+
+	err = u.userService.CreateUser(r.Context(), userId, attrs)
+	if err != nil {
+		handleError(w, r, u.l, err)
 		return
 	}
 
 	w.WriteHeader(http.StatusCreated)
 }
 
+// @Summary Set user attributes
+// @Description Replaces the attributes of a user. Rule segments are updated right away
+// @Tags User
+// @Security ApiKeyAuth
+// @Security BearerAuth
+// @Accept json
+// @Param user_id path int true "user_id"
+// @Param attributes body entity.UserAttributes true "attributes"
+// @Param X-Change-Reason header string false "why the changes are made, logged with them"
+// @Success 200
+// @Failure 400 {object} Problem
+// @Failure 404 {object} Problem
+// @Failure 422 {object} Problem
+// @Failure 500 {object} Problem
+// @Router /user/{user_id}/attributes [put]
+func (u *userRoutes) setUserAttributes(w http.ResponseWriter, r *http.Request) {
+	userIdStr := chi.URLParam(r, "user_id")
+
+	userId, err := strconv.Atoi(userIdStr)
+	if err != nil {
+		errorResponse(w, r, http.StatusBadRequest, "user_id must be an integer")
+		return
+	}
+
+	var attrs entity.UserAttributes
+	err = render.DecodeJSON(r.Body, &attrs)
+	if err != nil {
+		errorResponse(w, r, http.StatusBadRequest, "invalid request body: "+err.Error())
+		return
+	}
+
+	err = u.userService.SetUserAttributes(r.Context(), userId, attrs)
+	if err != nil {
+		handleError(w, r, u.l, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// @Summary Get user attributes
+// @Description Returns the attributes of a user
+// @Tags User
+// @Security ApiKeyAuth
+// @Security BearerAuth
+// @Param user_id path int true "user_id"
+// @Success 200 {object} entity.UserAttributes
+// @Failure 400 {object} Problem
+// @Failure 404 {object} Problem
+// @Failure 500 {object} Problem
+// @Router /user/{user_id}/attributes [get]
+func (u *userRoutes) getUserAttributes(w http.ResponseWriter, r *http.Request) {
+	userIdStr := chi.URLParam(r, "user_id")
+
+	userId, err := strconv.Atoi(userIdStr)
+	if err != nil {
+		errorResponse(w, r, http.StatusBadRequest, "user_id must be an integer")
+		return
+	}
+
+	attrs, err := u.userService.GetUserAttributes(r.Context(), userId)
+	if err != nil {
+		handleError(w, r, u.l, err)
+		return
+	}
+
+	render.JSON(w, r, attrs)
+}
+
 // @Summary Get user segments
-// @Description Returns a list of segments for the given user
+// @Description Returns a list of segments for the given user with the variant the user got in experiment segments and when the segments added with a TTL expire.
+// @Description With at, returns the segments the user had at that moment, rebuilt from the operation log
 // @Tags User
+// @Security ApiKeyAuth
+// @Security BearerAuth
 // @Param user_id path int true "user_id"
-// @Success 200 {array} string
-// @Failure 400
-// @Failure 500
+// @Param at query string false "RFC3339 timestamp, e.g. 2023-08-15T12:00:00Z"
+// @Success 200 {array} entity.UserSegment
+// @Failure 400 {object} Problem
+// @Failure 500 {object} Problem
 // @Router /user/{user_id}/segments [get]
 func (u *userRoutes) getUserSegments(w http.ResponseWriter, r *http.Request) {
 	userIdStr := chi.URLParam(r, "user_id")
 
 	userId, err := strconv.Atoi(userIdStr)
 	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
+		errorResponse(w, r, http.StatusBadRequest, "user_id must be an integer")
 		return
 	}
 
-	segments, err := u.userService.GetUserSegments(r.Context(), userId)
+	var at time.Time
+	if atStr := r.URL.Query().Get("at"); atStr != "" {
+		at, err = time.Parse(time.RFC3339, atStr)
+		if err != nil {
+			errorResponse(w, r, http.StatusBadRequest, "at must be an RFC3339 timestamp")
+			return
+		}
+	}
+
+	var segments []entity.UserSegment
+	if at.IsZero() {
+		segments, err = u.userService.GetUserSegments(r.Context(), userId)
+	} else {
+		segments, err = u.userService.GetUserSegmentsAt(r.Context(), userId, at)
+	}
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
+		handleError(w, r, u.l, err)
 		return
 	}
 
 	render.JSON(w, r, segments)
 }
 
+// maxIdempotencyKeyLength caps the Idempotency-Key header.
+const maxIdempotencyKeyLength = 255
+
 type Segments struct {
 	AddSegments    []entity.AddSegment `json:"add_segments"`
 	RemoveSegments []string            `json:"remove_segments"`
 }
 
 // @Summary Add or remove user segments
-// @Description Adds or removes segments for the given user
+// @Description Adds or removes segments for the given user and returns the outcome for every segment: added, already_present, removed or not_member. An added segment expires after expire, a duration such as 720h, or at expires_at, an RFC3339 timestamp; adding a segment the user is already in only moves its expiry when one is given.
+// @Description Only actual changes are logged. A request retried with the same Idempotency-Key within a day returns the outcome of the first one without applying it again
 // @Tags User
+// @Security ApiKeyAuth
+// @Security BearerAuth
 // @Accept json
+// @Produce json
 // @Param user_id path int true "user_id"
 // @Param segments body Segments true "segments"
-// @Success 200
-// @Failure 400
-// @Failure 500
+// @Param X-Change-Reason header string false "why the changes are made, logged with them"
+// @Param Idempotency-Key header string false "unique key of the request, for retries"
+// @Success 200 {array} entity.SegmentChange
+// @Failure 400 {object} Problem
+// @Failure 404 {object} Problem
+// @Failure 409 {object} Problem
+// @Failure 422 {object} Problem
+// @Failure 500 {object} Problem
 // @Router /user/{user_id}/segments [post]
 func (u *userRoutes) addOrRemoveUserSegments(w http.ResponseWriter, r *http.Request) {
 	userIdStr := chi.URLParam(r, "user_id")
 
 	userId, err := strconv.Atoi(userIdStr)
 	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
+		errorResponse(w, r, http.StatusBadRequest, "user_id must be an integer")
+		return
+	}
+
+	idempotencyKey := r.Header.Get("Idempotency-Key")
+	if len(idempotencyKey) > maxIdempotencyKeyLength {
+		errorResponse(w, r, http.StatusBadRequest, fmt.Sprintf("Idempotency-Key must be at most %d bytes", maxIdempotencyKeyLength))
 		return
 	}
 
 	var segments Segments
 	err = render.DecodeJSON(r.Body, &segments)
 	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
+		errorResponse(w, r, http.StatusBadRequest, "invalid request body: "+err.Error())
 		return
 	}
 
-	err = u.userService.AddOrRemoveUserSegments(r.Context(), userId, segments.AddSegments, segments.RemoveSegments)
+	changes, err := u.userService.AddOrRemoveUserSegments(r.Context(), userId, segments.AddSegments, segments.RemoveSegments, idempotencyKey)
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
+		handleError(w, r, u.l, err)
 		return
 	}
 
-	w.WriteHeader(http.StatusOK)
+	render.JSON(w, r, changes)
 }
 
-// @Summary Get user operations
-// @Description Returns a list of operations for the given user
+// @Summary Set user segment expiry
+// @Description Moves the expiry of the membership of the user in the segment to expire from now, a duration such as 720h, or to expires_at, an RFC3339 timestamp. Without either the membership no longer expires. The change is logged as a ttl operation
 // @Tags User
+// @Security ApiKeyAuth
+// @Security BearerAuth
+// @Accept json
+// @Produce json
 // @Param user_id path int true "user_id"
-// @Param date query string false "date"
-// @Success 200
-// @Failure 400
-// @Failure 500
-// @Router /user/{user_id}/operations [get]
-func (u *userRoutes) getUserOperations(w http.ResponseWriter, r *http.Request) {
+// @Param segment path string true "segment"
+// @Param expiry body entity.Expiry false "expiry"
+// @Param X-Change-Reason header string false "why the changes are made, logged with them"
+// @Success 200 {object} entity.UserSegment
+// @Failure 400 {object} Problem
+// @Failure 404 {object} Problem
+// @Failure 422 {object} Problem
+// @Failure 500 {object} Problem
+// @Router /user/{user_id}/segments/{segment}/expiry [put]
+func (u *userRoutes) setUserSegmentExpiry(w http.ResponseWriter, r *http.Request) {
 	userIdStr := chi.URLParam(r, "user_id")
 
 	userId, err := strconv.Atoi(userIdStr)
 	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
+		errorResponse(w, r, http.StatusBadRequest, "user_id must be an integer")
 		return
 	}
 
-	date := r.URL.Query().Get("date")
-
-	var operations []string
-	var queryErr error
+	var expiry entity.Expiry
+	err = decodeOptionalJSON(r, &expiry)
+	if err != nil {
+		errorResponse(w, r, http.StatusBadRequest, "invalid request body: "+err.Error())
+		return
+	}
 
-	if date == "" {
-		operations, queryErr = u.userService.GetUserOperations(r.Context(), userId)
-	} else {
-		operations, queryErr = u.userService.GetUserOperationsByMonth(r.Context(), userId, date)
+	segment, err := u.userService.SetUserSegmentExpiry(r.Context(), userId, chi.URLParam(r, "segment"), expiry)
+	if err != nil {
+		handleError(w, r, u.l, err)
+		return
 	}
 
-	if queryErr != nil {
-		w.WriteHeader(http.StatusInternalServerError)
+	render.JSON(w, r, segment)
+}
+
+// @Summary Clear user segment expiry
+// @Description Makes the membership of the user in the segment permanent. The change is logged as a ttl operation
+// @Tags User
+// @Security ApiKeyAuth
+// @Security BearerAuth
+// @Produce json
+// @Param user_id path int true "user_id"
+// @Param segment path string true "segment"
+// @Param X-Change-Reason header string false "why the changes are made, logged with them"
+// @Success 200 {object} entity.UserSegment
+// @Failure 400 {object} Problem
+// @Failure 404 {object} Problem
+// @Failure 500 {object} Problem
+// @Router /user/{user_id}/segments/{segment}/expiry [delete]
+func (u *userRoutes) clearUserSegmentExpiry(w http.ResponseWriter, r *http.Request) {
+	userIdStr := chi.URLParam(r, "user_id")
+
+	userId, err := strconv.Atoi(userIdStr)
+	if err != nil {
+		errorResponse(w, r, http.StatusBadRequest, "user_id must be an integer")
 		return
 	}
 
-	w.Header().Set("Content-Type", "text/csv")
-	w.WriteHeader(http.StatusOK)
-	for _, operation := range operations {
-		w.Write([]byte(operation + "\n"))
+	segment, err := u.userService.SetUserSegmentExpiry(r.Context(), userId, chi.URLParam(r, "segment"), entity.Expiry{})
+	if err != nil {
+		handleError(w, r, u.l, err)
+		return
 	}
+
+	render.JSON(w, r, segment)
 }
 
-// @Summary Get user operations report link
-// @Description Returns a link to a report with a list of operations for the given user
+// @Summary Get user operations
+// @Description Returns a page of the operations of the given user as CSV with a header (default), a JSON array or NDJSON depending on the Accept header.
+// @Description When there are more operations, the Link header holds the URL of the next page with rel="next"
 // @Tags User
+// @Security ApiKeyAuth
+// @Security BearerAuth
+// @Produce text/csv,json,application/x-ndjson
 // @Param user_id path int true "user_id"
-// @Param date query string false "date"
-// @Success 200
-// @Failure 400
-// @Failure 500
-// @Router /user/{user_id}/operations/report-link [get]
-func (u *userRoutes) getUserOperationsYandex(w http.ResponseWriter, r *http.Request) {
+// @Param date query string false "month, YYYY-MM, same as from and to spanning it"
+// @Param from query string false "RFC3339 timestamp, inclusive"
+// @Param to query string false "RFC3339 timestamp, exclusive"
+// @Param segment query string false "segment name"
+// @Param operation query string false "add, delete, expire or ttl"
+// @Param source query string false "manual, auto, expire, segment_delete, rule or bulk"
+// @Param order query string false "asc (default) or desc by time"
+// @Param limit query int false "page size, 1000 by default, at most 10000"
+// @Param cursor query string false "cursor from the Link header of the previous page"
+// @Success 200 {array} entity.Operation
+// @Header 200 {string} Link "next page"
+// @Failure 400 {object} Problem
+// @Failure 406 {object} Problem
+// @Failure 422 {object} Problem
+// @Failure 500 {object} Problem
+// @Router /user/{user_id}/operations [get]
+func (u *userRoutes) getUserOperations(w http.ResponseWriter, r *http.Request) {
 	userIdStr := chi.URLParam(r, "user_id")
 
 	userId, err := strconv.Atoi(userIdStr)
 	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
+		errorResponse(w, r, http.StatusBadRequest, "user_id must be an integer")
 		return
 	}
 
-	date := r.URL.Query().Get("date")
+	filter, err := operationFilter(r)
+	if err != nil {
+		errorResponse(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
 
-	var operations []string
-	var queryErr error
+	operations, next, err := u.userService.GetUserOperationsPage(r.Context(), userId, filter)
+	if err != nil {
+		handleError(w, r, u.l, err)
+		return
+	}
 
-	if date == "" {
-		operations, queryErr = u.userService.GetUserOperations(r.Context(), userId)
-	} else {
-		operations, queryErr = u.userService.GetUserOperationsByMonth(r.Context(), userId, date)
+	if next != "" {
+		query := r.URL.Query()
+		query.Set("cursor", next)
+		w.Header().Set("Link", fmt.Sprintf("<%s?%s>; rel=\"next\"", r.URL.Path, query.Encode()))
 	}
 
-	if queryErr != nil {
-		w.WriteHeader(http.StatusInternalServerError)
+	renderOperations(w, r, operations)
+}
+
+// @Summary Get user operations report link
+// @Description Returns a link to a CSV report with a list of operations for the given user, for the month of date (YYYY-MM) when it is given. The report is streamed to the storage, gzipped when reports are configured to be, and named after the reports name template, so that reports requested at the same time are kept apart
+// @Tags User
+// @Security ApiKeyAuth
+// @Security BearerAuth
+// @Param user_id path int true "user_id"
+// @Param date query string false "date"
+// @Success 200
+// @Failure 400 {object} Problem
+// @Failure 422 {object} Problem
+// @Failure 500 {object} Problem
+// @Failure 503 {object} Problem
+// @Router /user/{user_id}/operations/report-link [get]
+func (u *userRoutes) getUserOperationsReport(w http.ResponseWriter, r *http.Request) {
+	userIdStr := chi.URLParam(r, "user_id")
+
+	userId, err := strconv.Atoi(userIdStr)
+	if err != nil {
+		errorResponse(w, r, http.StatusBadRequest, "user_id must be an integer")
 		return
 	}
 
-	var fileName string
+	date := r.URL.Query().Get("date")
 
-	if date == "" {
-		fileName = fmt.Sprintf("%d.csv", userId)
-	} else {
-		fileName = fmt.Sprintf("%d_%s.csv", userId, date)
+	var filter entity.OperationFilter
+	name := strconv.Itoa(userId)
+
+	if date != "" {
+		month, err := time.Parse("2006-01", date)
+		if err != nil {
+			errorResponse(w, r, http.StatusUnprocessableEntity, fmt.Sprintf("invalid month %q, expected YYYY-MM", date))
+			return
+		}
+		filter.From, filter.To = month, month.AddDate(0, 1, 0)
+		name = fmt.Sprintf("%d_%s", userId, date)
 	}
 
-	url, err := u.userService.UploadAndReturnDownloadURL(r.Context(), fileName, operations)
+	url, err := u.userService.UploadUserOperations(r.Context(), userId, filter, name)
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
+		handleError(w, r, u.l, err)
 		return
 	}
 
@@ -1,6 +1,418 @@
 package entity
 
+import (
+	"context"
+	"strconv"
+	"time"
+)
+
+// AddSegment adds the user to a segment, until Expire from now, a duration
+// such as "720h", or until ExpiresAt when either is given.
 type AddSegment struct {
+	Name      string     `json:"name"`
+	Expire    string     `json:"expire"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+	// Variant of an experiment segment, picked by weight when empty.
+	Variant string `json:"variant"`
+}
+
+// Expiry sets when a membership expires: Expire from now, a duration such as
+// "720h", or ExpiresAt. Without either the membership doesn't expire.
+type Expiry struct {
+	Expire    string     `json:"expire,omitempty"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+}
+
+// Outcomes of adding users to segments and removing them.
+const (
+	OutcomeAdded          = "added"
+	OutcomeAlreadyPresent = "already_present"
+	OutcomeRemoved        = "removed"
+	OutcomeNotMember      = "not_member"
+)
+
+// SegmentChange is the outcome of adding the user to a segment or removing
+// them from it. Variant and ExpiresAt are those of the membership the user
+// has after an add.
+type SegmentChange struct {
+	Segment   string     `json:"segment"`
+	Outcome   string     `json:"outcome"`
+	Variant   string     `json:"variant,omitempty"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+}
+
+// UserSegment is a segment the user is in. ExpiresAt is when the user leaves
+// it, nil for memberships that don't expire.
+type UserSegment struct {
+	Name      string     `json:"name"`
+	Variant   string     `json:"variant,omitempty"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+}
+
+// Operation is an entry of the membership history of a user. Actor is the
+// caller who made the change, empty for changes the service makes on its
+// own, and Source is the path it was made through. Changes made together
+// share a Batch. ExpiresAt is the expiry set by adds and TTL changes, nil for
+// TTL changes that clear it.
+type Operation struct {
+	UserID    int        `json:"user_id"`
+	Segment   string     `json:"segment"`
+	Variant   string     `json:"variant,omitempty"`
+	Operation string     `json:"operation"`
+	Time      time.Time  `json:"time"`
+	Actor     string     `json:"actor,omitempty"`
+	Source    string     `json:"source,omitempty"`
+	Reason    string     `json:"reason,omitempty"`
+	Batch     string     `json:"batch,omitempty"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+}
+
+// Kinds of operations.
+const (
+	OperationAdd    = "add"
+	OperationDelete = "delete"
+	// OperationExpire removes a membership that reached its expiry.
+	OperationExpire = "expire"
+	// OperationTTL changes when a membership expires, leaving it in place.
+	OperationTTL = "ttl"
+)
+
+// Sources of operations.
+const (
+	// SourceManual is a change requested for the user.
+	SourceManual = "manual"
+	// SourceAuto is an auto segment picking or dropping the user.
+	SourceAuto = "auto"
+	// SourceExpire is a membership reaching its expiry.
+	SourceExpire = "expire"
+	// SourceSegmentDelete is a segment being deleted with its members.
+	SourceSegmentDelete = "segment_delete"
+	// SourceRule is a rule segment following the attributes of the user.
+	SourceRule = "rule"
+	// SourceBulk is a bulk job adding or removing many users at once.
+	SourceBulk = "bulk"
+)
+
+// OperationFilter selects a page of the operation history. Zero fields
+// don't filter, From is inclusive and To exclusive. Cursor is the NextCursor
+// of the previous page.
+type OperationFilter struct {
+	From      time.Time
+	To        time.Time
+	Segment   string
+	Operation string
+	Source    string
+	Desc      bool
+	Limit     int
+	Cursor    string
+}
+
+// FeedFilter selects entries of the operation feed of all users. Zero fields
+// don't filter, From is inclusive and To exclusive. After is the cursor of
+// the last entry already read.
+type FeedFilter struct {
+	From    time.Time
+	To      time.Time
+	Segment string
+	Source  string
+	After   string
+	Limit   int
+}
+
+// FeedEntry is an operation in the feed of all users. Entries are ordered by
+// Cursor, and no entry ever appears before one already read, so the cursor
+// of the last loaded entry is where the next load resumes.
+type FeedEntry struct {
+	Cursor string `json:"cursor"`
+	Operation
+}
+
+// FeedCSVHeader names the columns of FeedEntry.CSVRecord.
+var FeedCSVHeader = append([]string{"cursor"}, OperationCSVHeader...)
+
+// CSVRecord returns the entry as a CSV record.
+func (e FeedEntry) CSVRecord() []string {
+	return append([]string{e.Cursor}, e.Operation.CSVRecord()...)
+}
+
+// OperationCSVHeader names the columns of Operation.CSVRecord.
+var OperationCSVHeader = []string{"user_id", "segment", "variant", "operation", "time", "actor", "source", "reason", "batch", "expires_at"}
+
+// CSVRecord returns the operation as a CSV record, times in RFC 3339.
+func (o Operation) CSVRecord() []string {
+	var expiresAt string
+	if o.ExpiresAt != nil {
+		expiresAt = o.ExpiresAt.Format(time.RFC3339Nano)
+	}
+
+	return []string{strconv.Itoa(o.UserID), o.Segment, o.Variant, o.Operation, o.Time.Format(time.RFC3339Nano), o.Actor, o.Source, o.Reason, o.Batch, expiresAt}
+}
+
+// Formats of reports.
+const (
+	FormatCSV    = "csv"
+	FormatJSON   = "json"
+	FormatNDJSON = "ndjson"
+)
+
+// Statuses of report jobs.
+const (
+	ReportPending = "pending"
+	ReportRunning = "running"
+	ReportDone    = "done"
+	ReportFailed  = "failed"
+)
+
+// Kinds of reports. The history of a user is reported by UserID, the other
+// kinds report on the Segment.
+const (
+	// ReportUserOperations is the operation history of a user.
+	ReportUserOperations = "user_operations"
+	// ReportSegmentMembers lists the current members of a segment.
+	ReportSegmentMembers = "segment_members"
+	// ReportSegmentOperations is the history of a segment, the additions and
+	// removals of all its users.
+	ReportSegmentOperations = "segment_operations"
+	// ReportSegmentDaily counts the members of a segment at the end of every
+	// day, with the additions and removals of the day.
+	ReportSegmentDaily = "segment_daily"
+)
+
+// ReportJob is a report generated in the background. URL is set once the job
+// is done, Error explains why it failed or why its last attempt did. Segment
+// is the name given when the job was queued, SegmentID the segment it covers
+// under whatever name it has since.
+type ReportJob struct {
+	ID         int64      `json:"id"`
+	Kind       string     `json:"kind"`
+	UserID     int        `json:"user_id,omitempty"`
+	Segment    string     `json:"segment,omitempty"`
+	SegmentID  int64      `json:"-"`
+	From       *time.Time `json:"from,omitempty"`
+	To         *time.Time `json:"to,omitempty"`
+	Format     string     `json:"format"`
+	Status     string     `json:"status"`
+	URL        string     `json:"url,omitempty"`
+	Error      string     `json:"error,omitempty"`
+	Attempts   int        `json:"attempts"`
+	CreatedAt  time.Time  `json:"created_at"`
+	StartedAt  *time.Time `json:"started_at,omitempty"`
+	FinishedAt *time.Time `json:"finished_at,omitempty"`
+}
+
+// SegmentMember is a user in a segment.
+type SegmentMember struct {
+	UserID  int        `json:"user_id"`
+	Variant string     `json:"variant,omitempty"`
+	Expire  *time.Time `json:"expire,omitempty"`
+}
+
+// SegmentMemberCSVHeader names the columns of SegmentMember.CSVRecord.
+var SegmentMemberCSVHeader = []string{"user_id", "variant", "expire"}
+
+// CSVRecord returns the member as a CSV record, the expiry in RFC 3339.
+func (m SegmentMember) CSVRecord() []string {
+	var expire string
+	if m.Expire != nil {
+		expire = m.Expire.Format(time.RFC3339)
+	}
+
+	return []string{strconv.Itoa(m.UserID), m.Variant, expire}
+}
+
+// SegmentDailyCount is the size of a segment at the end of a day, Date in
+// UTC formatted as YYYY-MM-DD.
+type SegmentDailyCount struct {
+	Date    string `json:"date"`
+	Members int    `json:"members"`
+	Added   int    `json:"added"`
+	Removed int    `json:"removed"`
+}
+
+// SegmentDailyCountCSVHeader names the columns of SegmentDailyCount.CSVRecord.
+var SegmentDailyCountCSVHeader = []string{"date", "members", "added", "removed"}
+
+// CSVRecord returns the count as a CSV record.
+func (c SegmentDailyCount) CSVRecord() []string {
+	return []string{c.Date, strconv.Itoa(c.Members), strconv.Itoa(c.Added), strconv.Itoa(c.Removed)}
+}
+
+// BulkJob adds the users of its rows to Segment or removes them from it in
+// the background, Operation is add or delete. It goes through the statuses of
+// report jobs; Processed counts the rows settled so far, which Changed,
+// Unchanged and Failed break down. Error explains why the job failed or why
+// its last attempt did, errors of single rows are kept with the rows.
+// Segment is the name given when the job was queued, SegmentID the segment it
+// applies to under whatever name it has since.
+type BulkJob struct {
+	ID         int64      `json:"id"`
+	Operation  string     `json:"operation"`
+	Segment    string     `json:"segment"`
+	SegmentID  int64      `json:"-"`
+	ExpiresAt  *time.Time `json:"expires_at,omitempty"`
+	Actor      string     `json:"actor,omitempty"`
+	Reason     string     `json:"reason,omitempty"`
+	Status     string     `json:"status"`
+	Total      int        `json:"total"`
+	Processed  int        `json:"processed"`
+	Changed    int        `json:"changed"`
+	Unchanged  int        `json:"unchanged"`
+	Failed     int        `json:"failed"`
+	Error      string     `json:"error,omitempty"`
+	Attempts   int        `json:"attempts"`
+	CreatedAt  time.Time  `json:"created_at"`
+	StartedAt  *time.Time `json:"started_at,omitempty"`
+	FinishedAt *time.Time `json:"finished_at,omitempty"`
+}
+
+// BulkRow is an uploaded user id of a bulk job, numbered from 1 in upload
+// order. Value is the id as uploaded. A settled row has either an Outcome or
+// an Error.
+type BulkRow struct {
+	Row     int    `json:"row"`
+	Value   string `json:"value"`
+	UserID  int    `json:"user_id,omitempty"`
+	Outcome string `json:"outcome,omitempty"`
+	Error   string `json:"error,omitempty"`
+}
+
+// BulkRowCSVHeader names the columns of BulkRow.CSVRecord.
+var BulkRowCSVHeader = []string{"row", "value", "user_id", "outcome", "error"}
+
+// CSVRecord returns the row as a CSV record, an empty user_id when the value
+// isn't one.
+func (r BulkRow) CSVRecord() []string {
+	var userID string
+	if r.UserID != 0 {
+		userID = strconv.Itoa(r.UserID)
+	}
+
+	return []string{strconv.Itoa(r.Row), r.Value, userID, r.Outcome, r.Error}
+}
+
+// UserAttributes describe a user for rule segments. SignupDate is formatted
+// as YYYY-MM-DD.
+type UserAttributes struct {
+	Country    string         `json:"country"`
+	Platform   string         `json:"platform"`
+	SignupDate string         `json:"signup_date,omitempty"`
+	Properties map[string]any `json:"properties,omitempty"`
+}
+
+// Variant is an arm of an experiment segment. Users of the segment are spread
+// over its variants in proportion to their weights.
+type Variant struct {
 	Name   string `json:"name"`
-	Expire string `json:"expire"`
+	Weight int    `json:"weight"`
+}
+
+// Ways of picking users of an auto segment.
+const (
+	// BucketingHash puts a user into the segment when the hash of the segment
+	// salt and the user id falls into the segment's range of buckets.
+	BucketingHash = "hash"
+	// BucketingRandom picks users at random.
+	BucketingRandom = "random"
+)
+
+// Segment is a group of users. Segments sharing a Layer are mutually
+// exclusive, auto segments of a layer own the buckets
+// [BucketOffset, BucketOffset + Percentage * 100). A segment with a Rule
+// holds the users whose attributes match it.
+type Segment struct {
+	ID           int64     `json:"id"`
+	Name         string    `json:"name"`
+	Description  string    `json:"description"`
+	Owner        string    `json:"owner"`
+	Tags         []string  `json:"tags"`
+	Percentage   *float64  `json:"percentage,omitempty"`
+	Bucketing    string    `json:"bucketing,omitempty"`
+	Salt         string    `json:"salt,omitempty"`
+	Layer        string    `json:"layer,omitempty"`
+	BucketOffset int       `json:"bucket_offset,omitempty"`
+	Variants     []Variant `json:"variants,omitempty"`
+	Rule         string    `json:"rule,omitempty"`
+	CreatedAt    time.Time `json:"created_at"`
+	UpdatedAt    time.Time `json:"updated_at"`
+}
+
+// SegmentUpdate holds the segment fields to change, nil fields stay as is.
+type SegmentUpdate struct {
+	Description *string   `json:"description"`
+	Owner       *string   `json:"owner"`
+	Tags        *[]string `json:"tags"`
+	Percentage  *float64  `json:"percentage"`
+	Salt        *string   `json:"salt"`
+}
+
+type SegmentFilter struct {
+	Tag   string
+	Owner string
+	Layer string
+}
+
+// Roles of API callers. Each role is allowed everything the roles before it
+// are: readers read, assigners also change memberships of users and admins
+// also manage segments and API keys.
+const (
+	RoleReader   = "reader"
+	RoleAssigner = "assigner"
+	RoleAdmin    = "admin"
+)
+
+var roleRanks = map[string]int{RoleReader: 1, RoleAssigner: 2, RoleAdmin: 3}
+
+// ValidRole reports whether role is one of the known roles.
+func ValidRole(role string) bool {
+	return roleRanks[role] != 0
+}
+
+// RoleAllows reports whether role is allowed what required is.
+func RoleAllows(role, required string) bool {
+	return ValidRole(role) && roleRanks[role] >= roleRanks[required]
+}
+
+// APIKey is a key callers authenticate with. Only its hash is stored, Prefix
+// is the start of the key to tell keys apart.
+type APIKey struct {
+	ID        int64     `json:"id"`
+	Name      string    `json:"name"`
+	Role      string    `json:"role"`
+	Prefix    string    `json:"prefix"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Caller is who makes a request: the name of an API key or the subject of a
+// bearer token, and the role it has.
+type Caller struct {
+	Name string
+	Role string
+}
+
+type callerKey struct{}
+
+// WithCaller returns a copy of ctx carrying the caller.
+func WithCaller(ctx context.Context, caller Caller) context.Context {
+	return context.WithValue(ctx, callerKey{}, caller)
+}
+
+// CallerFrom returns the caller ctx carries.
+func CallerFrom(ctx context.Context) (Caller, bool) {
+	caller, ok := ctx.Value(callerKey{}).(Caller)
+
+	return caller, ok
+}
+
+type reasonKey struct{}
+
+// WithReason returns a copy of ctx carrying why the caller makes changes.
+func WithReason(ctx context.Context, reason string) context.Context {
+	return context.WithValue(ctx, reasonKey{}, reason)
+}
+
+// ReasonFrom returns the reason ctx carries, empty when there is none.
+func ReasonFrom(ctx context.Context) string {
+	reason, _ := ctx.Value(reasonKey{}).(string)
+
+	return reason
 }
@@ -0,0 +1,4 @@
+DROP TABLE IF EXISTS user_segments_log;
+DROP TABLE IF EXISTS user_segments;
+DROP TABLE IF EXISTS segments;
+DROP TABLE IF EXISTS users;
@@ -21,4 +21,4 @@ CREATE TABLE IF NOT EXISTS user_segments_log (
     segment_name VARCHAR(255) NOT NULL,
     operation VARCHAR(20) NOT NULL,
     operation_time TIMESTAMP DEFAULT NOW()
-);
\ No newline at end of file
+);
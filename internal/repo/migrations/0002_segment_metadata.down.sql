@@ -0,0 +1,9 @@
+DROP INDEX IF EXISTS segments_tags_idx;
+DROP INDEX IF EXISTS segments_owner_idx;
+
+ALTER TABLE segments
+    DROP COLUMN updated_at,
+    DROP COLUMN created_at,
+    DROP COLUMN tags,
+    DROP COLUMN owner,
+    DROP COLUMN description;
@@ -0,0 +1,9 @@
+ALTER TABLE segments
+    ADD COLUMN description TEXT NOT NULL DEFAULT '',
+    ADD COLUMN owner VARCHAR(255) NOT NULL DEFAULT '',
+    ADD COLUMN tags TEXT[] NOT NULL DEFAULT '{}',
+    ADD COLUMN created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    ADD COLUMN updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW();
+
+CREATE INDEX segments_owner_idx ON segments (owner);
+CREATE INDEX segments_tags_idx ON segments USING GIN (tags);
@@ -0,0 +1,14 @@
+DROP TABLE IF EXISTS segment_aliases;
+
+DROP TRIGGER IF EXISTS user_segments_log_segment_id ON user_segments_log;
+DROP FUNCTION IF EXISTS user_segments_log_segment_id();
+
+DROP INDEX IF EXISTS user_segments_log_segment_id_idx;
+ALTER TABLE user_segments_log DROP COLUMN segment_id;
+
+ALTER TABLE user_segments DROP CONSTRAINT user_segments_segment_name_fkey;
+ALTER TABLE user_segments ADD CONSTRAINT user_segments_segment_name_fkey
+    FOREIGN KEY (segment_name) REFERENCES segments (name) ON DELETE CASCADE;
+
+ALTER TABLE segments DROP CONSTRAINT segments_id_key;
+ALTER TABLE segments DROP COLUMN id;
@@ -0,0 +1,35 @@
+-- Segments get a stable surrogate id. The name stays the primary key so
+-- memberships keep referencing it, but renames now cascade to them.
+ALTER TABLE segments ADD COLUMN id BIGSERIAL NOT NULL;
+ALTER TABLE segments ADD CONSTRAINT segments_id_key UNIQUE (id);
+
+ALTER TABLE user_segments DROP CONSTRAINT user_segments_segment_name_fkey;
+ALTER TABLE user_segments ADD CONSTRAINT user_segments_segment_name_fkey
+    FOREIGN KEY (segment_name) REFERENCES segments (name) ON DELETE CASCADE ON UPDATE CASCADE;
+
+-- Log entries keep the name the segment had at the time and point to the
+-- segment by id, so history survives renames.
+ALTER TABLE user_segments_log ADD COLUMN segment_id BIGINT;
+UPDATE user_segments_log AS l SET segment_id = s.id FROM segments AS s WHERE s.name = l.segment_name;
+CREATE INDEX user_segments_log_segment_id_idx ON user_segments_log (segment_id);
+
+CREATE FUNCTION user_segments_log_segment_id() RETURNS trigger AS $$
+BEGIN
+    IF NEW.segment_id IS NULL THEN
+        SELECT id INTO NEW.segment_id FROM segments WHERE name = NEW.segment_name;
+    END IF;
+    RETURN NEW;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER user_segments_log_segment_id BEFORE INSERT ON user_segments_log
+    FOR EACH ROW EXECUTE FUNCTION user_segments_log_segment_id();
+
+-- Former names of renamed segments.
+CREATE TABLE segment_aliases (
+    name VARCHAR(255) NOT NULL,
+    segment_id BIGINT NOT NULL,
+    renamed_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    CONSTRAINT segment_aliases_pkey PRIMARY KEY (name, segment_id),
+    CONSTRAINT segment_aliases_segment_id_fkey FOREIGN KEY (segment_id) REFERENCES segments (id) ON DELETE CASCADE
+);
@@ -0,0 +1,3 @@
+ALTER TABLE segments DROP CONSTRAINT segments_bucketing_check;
+ALTER TABLE segments DROP COLUMN salt;
+ALTER TABLE segments DROP COLUMN bucketing;
@@ -0,0 +1,8 @@
+-- Auto segments pick users either by hash bucket or at random. Existing auto
+-- segments were filled at random and keep doing so, manual segments have no
+-- bucketing at all.
+ALTER TABLE segments ADD COLUMN bucketing VARCHAR(10) NOT NULL DEFAULT '';
+ALTER TABLE segments ADD COLUMN salt VARCHAR(255) NOT NULL DEFAULT '';
+ALTER TABLE segments ADD CONSTRAINT segments_bucketing_check CHECK (bucketing IN ('', 'hash', 'random'));
+
+UPDATE segments SET bucketing = 'random', salt = name WHERE amount IS NOT NULL;
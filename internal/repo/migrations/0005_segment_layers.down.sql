@@ -0,0 +1,10 @@
+DROP INDEX IF EXISTS user_segments_layer_key;
+
+DROP TRIGGER IF EXISTS user_segments_layer ON user_segments;
+DROP FUNCTION IF EXISTS user_segments_layer();
+
+ALTER TABLE user_segments DROP COLUMN layer;
+
+DROP INDEX IF EXISTS segments_layer_idx;
+ALTER TABLE segments DROP COLUMN bucket_offset;
+ALTER TABLE segments DROP COLUMN layer;
@@ -0,0 +1,22 @@
+-- Segments of one layer are mutually exclusive: a user can be in at most one
+-- of them. Auto segments of a layer hash users with the layer name as salt and
+-- own disjoint bucket ranges starting at bucket_offset.
+ALTER TABLE segments ADD COLUMN layer VARCHAR(255) NOT NULL DEFAULT '';
+ALTER TABLE segments ADD COLUMN bucket_offset INTEGER NOT NULL DEFAULT 0;
+CREATE INDEX segments_layer_idx ON segments (layer) WHERE layer <> '';
+
+-- Memberships carry the layer of their segment so exclusivity is enforced by
+-- a unique index.
+ALTER TABLE user_segments ADD COLUMN layer VARCHAR(255) NOT NULL DEFAULT '';
+
+CREATE FUNCTION user_segments_layer() RETURNS trigger AS $$
+BEGIN
+    NEW.layer := COALESCE((SELECT layer FROM segments WHERE name = NEW.segment_name), '');
+    RETURN NEW;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER user_segments_layer BEFORE INSERT ON user_segments
+    FOR EACH ROW EXECUTE FUNCTION user_segments_layer();
+
+CREATE UNIQUE INDEX user_segments_layer_key ON user_segments (user_id, layer) WHERE layer <> '';
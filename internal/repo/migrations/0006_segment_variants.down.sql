@@ -0,0 +1,3 @@
+ALTER TABLE user_segments_log DROP COLUMN variant;
+ALTER TABLE user_segments DROP COLUMN variant;
+ALTER TABLE segments DROP COLUMN variants;
@@ -0,0 +1,5 @@
+-- Experiment segments split their users into weighted variants. Every
+-- membership and log entry of such a segment carries the variant.
+ALTER TABLE segments ADD COLUMN variants JSONB NOT NULL DEFAULT '[]';
+ALTER TABLE user_segments ADD COLUMN variant VARCHAR(255) NOT NULL DEFAULT '';
+ALTER TABLE user_segments_log ADD COLUMN variant VARCHAR(255) NOT NULL DEFAULT '';
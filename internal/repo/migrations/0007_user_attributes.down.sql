@@ -0,0 +1,7 @@
+DROP INDEX IF EXISTS segments_rule_idx;
+ALTER TABLE segments DROP COLUMN rule;
+
+ALTER TABLE users DROP COLUMN properties;
+ALTER TABLE users DROP COLUMN signup_date;
+ALTER TABLE users DROP COLUMN platform;
+ALTER TABLE users DROP COLUMN country;
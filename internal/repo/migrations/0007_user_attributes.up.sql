@@ -0,0 +1,9 @@
+-- Users carry the attributes rule segments are matched against.
+ALTER TABLE users ADD COLUMN country VARCHAR(64) NOT NULL DEFAULT '';
+ALTER TABLE users ADD COLUMN platform VARCHAR(64) NOT NULL DEFAULT '';
+ALTER TABLE users ADD COLUMN signup_date DATE;
+ALTER TABLE users ADD COLUMN properties JSONB NOT NULL DEFAULT '{}';
+
+-- A rule segment holds exactly the users whose attributes match its rule.
+ALTER TABLE segments ADD COLUMN rule TEXT NOT NULL DEFAULT '';
+CREATE INDEX segments_rule_idx ON segments (name) WHERE rule <> '';
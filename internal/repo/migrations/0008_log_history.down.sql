@@ -0,0 +1,5 @@
+DROP INDEX IF EXISTS user_segments_log_user_id_time_idx;
+ALTER TABLE user_segments_log DROP CONSTRAINT user_segments_log_pkey;
+ALTER TABLE user_segments_log DROP COLUMN id;
+ALTER TABLE user_segments_log ALTER COLUMN operation_time DROP NOT NULL;
+ALTER TABLE user_segments_log ALTER COLUMN operation_time TYPE TIMESTAMP;
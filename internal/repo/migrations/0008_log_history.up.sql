@@ -0,0 +1,8 @@
+-- Membership at any moment is rebuilt from the log, so entries need a total
+-- order: operation_time is an absolute instant and id breaks ties between
+-- entries written by one transaction.
+ALTER TABLE user_segments_log ALTER COLUMN operation_time TYPE TIMESTAMPTZ;
+ALTER TABLE user_segments_log ALTER COLUMN operation_time SET NOT NULL;
+ALTER TABLE user_segments_log ADD COLUMN id BIGSERIAL NOT NULL;
+ALTER TABLE user_segments_log ADD CONSTRAINT user_segments_log_pkey PRIMARY KEY (id);
+CREATE INDEX user_segments_log_user_id_time_idx ON user_segments_log (user_id, operation_time);
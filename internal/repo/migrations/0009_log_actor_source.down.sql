@@ -0,0 +1,2 @@
+ALTER TABLE user_segments_log DROP COLUMN source;
+ALTER TABLE user_segments_log DROP COLUMN actor;
@@ -0,0 +1,4 @@
+-- Who made a membership change and through which path. Entries written
+-- before these columns existed have neither.
+ALTER TABLE user_segments_log ADD COLUMN actor VARCHAR(255) NOT NULL DEFAULT '';
+ALTER TABLE user_segments_log ADD COLUMN source VARCHAR(32) NOT NULL DEFAULT '';
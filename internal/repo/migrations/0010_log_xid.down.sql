@@ -0,0 +1,2 @@
+DROP INDEX IF EXISTS user_segments_log_xid_id_idx;
+ALTER TABLE user_segments_log DROP COLUMN xid;
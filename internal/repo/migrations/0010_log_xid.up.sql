@@ -0,0 +1,7 @@
+-- Ids are taken from the sequence before commit, so a reader paging by id can
+-- skip an entry that commits after a larger id was already read. The id of
+-- the writing transaction orders entries by visibility instead: once every
+-- transaction below a snapshot's xmin has finished, no new entry can appear
+-- below it. Requires PostgreSQL 13 or newer.
+ALTER TABLE user_segments_log ADD COLUMN xid XID8 NOT NULL DEFAULT pg_current_xact_id();
+CREATE INDEX user_segments_log_xid_id_idx ON user_segments_log (xid, id);
@@ -0,0 +1,24 @@
+-- Reports are generated in the background. A job is claimed by one worker at
+-- a time; a running job whose worker stopped renewing it is claimed again
+-- once its lease runs out, so jobs survive restarts.
+CREATE TABLE report_jobs (
+    id BIGSERIAL PRIMARY KEY,
+    user_id INTEGER NOT NULL,
+    segment VARCHAR(255) NOT NULL DEFAULT '',
+    date_from TIMESTAMPTZ,
+    date_to TIMESTAMPTZ,
+    format VARCHAR(16) NOT NULL,
+    status VARCHAR(16) NOT NULL DEFAULT 'pending',
+    url TEXT NOT NULL DEFAULT '',
+    error TEXT NOT NULL DEFAULT '',
+    attempts INTEGER NOT NULL DEFAULT 0,
+    run_after TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    started_at TIMESTAMPTZ,
+    finished_at TIMESTAMPTZ,
+    CONSTRAINT report_jobs_user_id_fkey FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE,
+    CONSTRAINT report_jobs_format_check CHECK (format IN ('csv', 'json', 'ndjson')),
+    CONSTRAINT report_jobs_status_check CHECK (status IN ('pending', 'running', 'done', 'failed'))
+);
+
+CREATE INDEX report_jobs_queue_idx ON report_jobs (run_after) WHERE status IN ('pending', 'running');
@@ -0,0 +1,6 @@
+DELETE FROM report_jobs WHERE kind <> 'user_operations';
+
+ALTER TABLE report_jobs DROP CONSTRAINT report_jobs_subject_check;
+ALTER TABLE report_jobs DROP CONSTRAINT report_jobs_kind_check;
+ALTER TABLE report_jobs ALTER COLUMN user_id SET NOT NULL;
+ALTER TABLE report_jobs DROP COLUMN kind;
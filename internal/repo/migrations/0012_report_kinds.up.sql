@@ -0,0 +1,9 @@
+-- Reports can cover a whole segment. Their jobs name the segment instead of
+-- a user.
+ALTER TABLE report_jobs ADD COLUMN kind VARCHAR(32) NOT NULL DEFAULT 'user_operations';
+ALTER TABLE report_jobs ALTER COLUMN user_id DROP NOT NULL;
+
+ALTER TABLE report_jobs ADD CONSTRAINT report_jobs_kind_check
+    CHECK (kind IN ('user_operations', 'segment_members', 'segment_operations', 'segment_daily'));
+ALTER TABLE report_jobs ADD CONSTRAINT report_jobs_subject_check
+    CHECK (CASE WHEN kind = 'user_operations' THEN user_id IS NOT NULL ELSE user_id IS NULL AND segment <> '' END);
@@ -0,0 +1,11 @@
+-- Keys callers authenticate with. A key is shown once when it is created,
+-- only its SHA-256 hash is kept.
+CREATE TABLE api_keys (
+    id BIGSERIAL PRIMARY KEY,
+    name VARCHAR(255) NOT NULL UNIQUE,
+    role VARCHAR(16) NOT NULL,
+    prefix VARCHAR(16) NOT NULL,
+    key_hash CHAR(64) NOT NULL UNIQUE,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    CONSTRAINT api_keys_role_check CHECK (role IN ('reader', 'assigner', 'admin'))
+);
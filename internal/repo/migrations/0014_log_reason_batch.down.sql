@@ -0,0 +1,2 @@
+ALTER TABLE user_segments_log DROP COLUMN batch_id;
+ALTER TABLE user_segments_log DROP COLUMN reason;
@@ -0,0 +1,9 @@
+-- Why a membership changed, and the batch of changes it was made in. A batch
+-- defaults to the transaction writing the entry, so every change made by one
+-- request shares it; earlier entries get the transaction they were written
+-- in.
+ALTER TABLE user_segments_log ADD COLUMN reason TEXT NOT NULL DEFAULT '';
+ALTER TABLE user_segments_log ADD COLUMN batch_id VARCHAR(64);
+UPDATE user_segments_log SET batch_id = xid::text;
+ALTER TABLE user_segments_log ALTER COLUMN batch_id SET DEFAULT pg_current_xact_id()::text;
+ALTER TABLE user_segments_log ALTER COLUMN batch_id SET NOT NULL;
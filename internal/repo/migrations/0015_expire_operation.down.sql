@@ -0,0 +1 @@
+UPDATE user_segments_log SET operation = 'delete' WHERE operation = 'expire';
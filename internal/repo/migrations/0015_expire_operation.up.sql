@@ -0,0 +1,3 @@
+-- Expiries are logged as their own operation. Entries the expiry job wrote
+-- as deletes since sources were recorded become expiries too.
+UPDATE user_segments_log SET operation = 'expire' WHERE operation = 'delete' AND source = 'expire';
@@ -0,0 +1,2 @@
+DELETE FROM user_segments_log WHERE operation = 'ttl';
+ALTER TABLE user_segments_log DROP COLUMN expires_at;
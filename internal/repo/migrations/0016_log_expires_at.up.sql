@@ -0,0 +1,3 @@
+-- The expiry set by an add or a TTL change. Empty for TTL changes that clear
+-- it and for entries written before expiries were logged.
+ALTER TABLE user_segments_log ADD COLUMN expires_at TIMESTAMPTZ;
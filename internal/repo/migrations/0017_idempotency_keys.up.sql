@@ -0,0 +1,13 @@
+-- Outcomes of segment changes requested with an Idempotency-Key, returned
+-- again when a request is retried with the same key. Keys belong to the
+-- caller and are deleted after a day.
+CREATE TABLE idempotency_keys (
+    actor VARCHAR(255) NOT NULL,
+    key VARCHAR(255) NOT NULL,
+    request_hash CHAR(64) NOT NULL,
+    response JSONB,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    CONSTRAINT idempotency_keys_pkey PRIMARY KEY (actor, key)
+);
+
+CREATE INDEX idempotency_keys_created_at_idx ON idempotency_keys (created_at);
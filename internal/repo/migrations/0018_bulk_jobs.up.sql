@@ -0,0 +1,42 @@
+-- Bulk jobs add many users to a segment or remove them from it in the
+-- background, leased to one worker at a time like report jobs. The rows of a
+-- job are the user ids uploaded, in order; a row is pending until it has an
+-- outcome or an error, and rows are settled in the transaction applying
+-- them, so a job picked up again after a crash resumes where it stopped.
+CREATE TABLE bulk_jobs (
+    id BIGSERIAL PRIMARY KEY,
+    operation VARCHAR(16) NOT NULL,
+    segment VARCHAR(255) NOT NULL,
+    expires_at TIMESTAMPTZ,
+    actor VARCHAR(255) NOT NULL DEFAULT '',
+    reason TEXT NOT NULL DEFAULT '',
+    status VARCHAR(16) NOT NULL DEFAULT 'pending',
+    total INTEGER NOT NULL DEFAULT 0,
+    processed INTEGER NOT NULL DEFAULT 0,
+    changed INTEGER NOT NULL DEFAULT 0,
+    unchanged INTEGER NOT NULL DEFAULT 0,
+    failed INTEGER NOT NULL DEFAULT 0,
+    error TEXT NOT NULL DEFAULT '',
+    attempts INTEGER NOT NULL DEFAULT 0,
+    run_after TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    started_at TIMESTAMPTZ,
+    finished_at TIMESTAMPTZ,
+    CONSTRAINT bulk_jobs_operation_check CHECK (operation IN ('add', 'delete')),
+    CONSTRAINT bulk_jobs_status_check CHECK (status IN ('pending', 'running', 'done', 'failed'))
+);
+
+CREATE INDEX bulk_jobs_queue_idx ON bulk_jobs (run_after) WHERE status IN ('pending', 'running');
+
+CREATE TABLE bulk_job_rows (
+    job_id BIGINT NOT NULL,
+    row_number INTEGER NOT NULL,
+    value TEXT NOT NULL,
+    user_id INTEGER,
+    outcome VARCHAR(16) NOT NULL DEFAULT '',
+    error TEXT NOT NULL DEFAULT '',
+    CONSTRAINT bulk_job_rows_pkey PRIMARY KEY (job_id, row_number),
+    CONSTRAINT bulk_job_rows_job_id_fkey FOREIGN KEY (job_id) REFERENCES bulk_jobs (id) ON DELETE CASCADE
+);
+
+CREATE INDEX bulk_job_rows_pending_idx ON bulk_job_rows (job_id, row_number) WHERE outcome = '' AND error = '';
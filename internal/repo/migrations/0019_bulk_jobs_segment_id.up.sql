@@ -0,0 +1,5 @@
+-- Bulk jobs point to their segment by id, so renaming the segment doesn't
+-- fail the jobs queued for it. Jobs whose segment is already gone keep no id
+-- and fail when they run.
+ALTER TABLE bulk_jobs ADD COLUMN segment_id BIGINT;
+UPDATE bulk_jobs AS j SET segment_id = s.id FROM segments AS s WHERE s.name = j.segment;
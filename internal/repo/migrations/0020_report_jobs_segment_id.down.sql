@@ -0,0 +1 @@
+ALTER TABLE report_jobs DROP COLUMN segment_id;
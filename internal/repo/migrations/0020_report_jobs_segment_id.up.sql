@@ -0,0 +1,5 @@
+-- Segment report jobs point to their segment by id, so renaming the segment
+-- doesn't fail the jobs queued for it. Jobs whose segment is already gone
+-- keep no id and fail when they run.
+ALTER TABLE report_jobs ADD COLUMN segment_id BIGINT;
+UPDATE report_jobs AS j SET segment_id = s.id FROM segments AS s WHERE j.kind <> 'user_operations' AND s.name = j.segment;
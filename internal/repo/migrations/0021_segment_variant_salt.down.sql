@@ -0,0 +1 @@
+UPDATE segments SET salt = '' WHERE bucketing = '' AND salt = name AND variants <> '[]';
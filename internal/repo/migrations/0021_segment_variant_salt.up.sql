@@ -0,0 +1,4 @@
+-- Manual and rule experiment segments keep the salt their variants are
+-- picked with, so renaming them doesn't reshuffle the variants of new
+-- members. Existing ones were hashed with their current name.
+UPDATE segments SET salt = name WHERE bucketing = '' AND salt = '' AND variants <> '[]';
@@ -0,0 +1,12 @@
+// Package migrations holds the versioned database schema of the service.
+//
+// Every change is a pair of files named NNNN_description.up.sql and
+// NNNN_description.down.sql. They are embedded into the binary and applied
+// by pkg/migrate, so never edit a migration that has already been released;
+// add a new one instead.
+package migrations
+
+import "embed"
+
+//go:embed *.sql
+var FS embed.FS
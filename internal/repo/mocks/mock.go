@@ -0,0 +1,788 @@
+// Code generated by MockGen. DO NOT EDIT.
+// Source: repo.go
+//
+// Generated by this command:
+//
+//	mockgen -source=repo.go -destination=mocks/mock.go
+//
+// Package mock_repo is a generated GoMock package.
+package mock_repo
+
+import (
+	context "context"
+	reflect "reflect"
+	time "time"
+
+	entity "github.com/realPointer/segments/internal/entity"
+	gomock "go.uber.org/mock/gomock"
+)
+
+// MockUser is a mock of User interface.
+type MockUser struct {
+	ctrl     *gomock.Controller
+	recorder *MockUserMockRecorder
+}
+
+// MockUserMockRecorder is the mock recorder for MockUser.
+type MockUserMockRecorder struct {
+	mock *MockUser
+}
+
+// NewMockUser creates a new mock instance.
+func NewMockUser(ctrl *gomock.Controller) *MockUser {
+	mock := &MockUser{ctrl: ctrl}
+	mock.recorder = &MockUserMockRecorder{mock}
+	return mock
+}
+
+// EXPECT returns an object that allows the caller to indicate expected use.
+func (m *MockUser) EXPECT() *MockUserMockRecorder {
+	return m.recorder
+}
+
+// AddOrRemoveUserSegments mocks base method.
+func (m *MockUser) AddOrRemoveUserSegments(ctx context.Context, userId int, addSegments []entity.AddSegment, removeSegments []string, idempotencyKey string) ([]entity.SegmentChange, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "AddOrRemoveUserSegments", ctx, userId, addSegments, removeSegments, idempotencyKey)
+	ret0, _ := ret[0].([]entity.SegmentChange)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// AddOrRemoveUserSegments indicates an expected call of AddOrRemoveUserSegments.
+func (mr *MockUserMockRecorder) AddOrRemoveUserSegments(ctx, userId, addSegments, removeSegments, idempotencyKey any) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "AddOrRemoveUserSegments", reflect.TypeOf((*MockUser)(nil).AddOrRemoveUserSegments), ctx, userId, addSegments, removeSegments, idempotencyKey)
+}
+
+// CreateUser mocks base method.
+func (m *MockUser) CreateUser(ctx context.Context, userId int, attrs entity.UserAttributes) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "CreateUser", ctx, userId, attrs)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// CreateUser indicates an expected call of CreateUser.
+func (mr *MockUserMockRecorder) CreateUser(ctx, userId, attrs any) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "CreateUser", reflect.TypeOf((*MockUser)(nil).CreateUser), ctx, userId, attrs)
+}
+
+// GetUserAttributes mocks base method.
+func (m *MockUser) GetUserAttributes(ctx context.Context, userId int) (entity.UserAttributes, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetUserAttributes", ctx, userId)
+	ret0, _ := ret[0].(entity.UserAttributes)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetUserAttributes indicates an expected call of GetUserAttributes.
+func (mr *MockUserMockRecorder) GetUserAttributes(ctx, userId any) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetUserAttributes", reflect.TypeOf((*MockUser)(nil).GetUserAttributes), ctx, userId)
+}
+
+// GetUserOperations mocks base method.
+func (m *MockUser) GetUserOperations(ctx context.Context, userId int) ([]entity.Operation, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetUserOperations", ctx, userId)
+	ret0, _ := ret[0].([]entity.Operation)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetUserOperations indicates an expected call of GetUserOperations.
+func (mr *MockUserMockRecorder) GetUserOperations(ctx, userId any) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetUserOperations", reflect.TypeOf((*MockUser)(nil).GetUserOperations), ctx, userId)
+}
+
+// GetUserOperationsByMonth mocks base method.
+func (m *MockUser) GetUserOperationsByMonth(ctx context.Context, userId int, yearMonth string) ([]entity.Operation, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetUserOperationsByMonth", ctx, userId, yearMonth)
+	ret0, _ := ret[0].([]entity.Operation)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetUserOperationsByMonth indicates an expected call of GetUserOperationsByMonth.
+func (mr *MockUserMockRecorder) GetUserOperationsByMonth(ctx, userId, yearMonth any) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetUserOperationsByMonth", reflect.TypeOf((*MockUser)(nil).GetUserOperationsByMonth), ctx, userId, yearMonth)
+}
+
+// GetUserOperationsPage mocks base method.
+func (m *MockUser) GetUserOperationsPage(ctx context.Context, userId int, filter entity.OperationFilter) ([]entity.Operation, string, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetUserOperationsPage", ctx, userId, filter)
+	ret0, _ := ret[0].([]entity.Operation)
+	ret1, _ := ret[1].(string)
+	ret2, _ := ret[2].(error)
+	return ret0, ret1, ret2
+}
+
+// GetUserOperationsPage indicates an expected call of GetUserOperationsPage.
+func (mr *MockUserMockRecorder) GetUserOperationsPage(ctx, userId, filter any) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetUserOperationsPage", reflect.TypeOf((*MockUser)(nil).GetUserOperationsPage), ctx, userId, filter)
+}
+
+// GetUserSegments mocks base method.
+func (m *MockUser) GetUserSegments(ctx context.Context, userId int) ([]entity.UserSegment, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetUserSegments", ctx, userId)
+	ret0, _ := ret[0].([]entity.UserSegment)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetUserSegments indicates an expected call of GetUserSegments.
+func (mr *MockUserMockRecorder) GetUserSegments(ctx, userId any) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetUserSegments", reflect.TypeOf((*MockUser)(nil).GetUserSegments), ctx, userId)
+}
+
+// GetUserSegmentsAt mocks base method.
+func (m *MockUser) GetUserSegmentsAt(ctx context.Context, userId int, at time.Time) ([]entity.UserSegment, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetUserSegmentsAt", ctx, userId, at)
+	ret0, _ := ret[0].([]entity.UserSegment)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetUserSegmentsAt indicates an expected call of GetUserSegmentsAt.
+func (mr *MockUserMockRecorder) GetUserSegmentsAt(ctx, userId, at any) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetUserSegmentsAt", reflect.TypeOf((*MockUser)(nil).GetUserSegmentsAt), ctx, userId, at)
+}
+
+// SetUserAttributes mocks base method.
+func (m *MockUser) SetUserAttributes(ctx context.Context, userId int, attrs entity.UserAttributes) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "SetUserAttributes", ctx, userId, attrs)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// SetUserAttributes indicates an expected call of SetUserAttributes.
+func (mr *MockUserMockRecorder) SetUserAttributes(ctx, userId, attrs any) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SetUserAttributes", reflect.TypeOf((*MockUser)(nil).SetUserAttributes), ctx, userId, attrs)
+}
+
+// SetUserSegmentExpiry mocks base method.
+func (m *MockUser) SetUserSegmentExpiry(ctx context.Context, userId int, segment string, expiry entity.Expiry) (entity.UserSegment, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "SetUserSegmentExpiry", ctx, userId, segment, expiry)
+	ret0, _ := ret[0].(entity.UserSegment)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// SetUserSegmentExpiry indicates an expected call of SetUserSegmentExpiry.
+func (mr *MockUserMockRecorder) SetUserSegmentExpiry(ctx, userId, segment, expiry any) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SetUserSegmentExpiry", reflect.TypeOf((*MockUser)(nil).SetUserSegmentExpiry), ctx, userId, segment, expiry)
+}
+
+// StreamOperations mocks base method.
+func (m *MockUser) StreamOperations(ctx context.Context, filter entity.FeedFilter, fn func(entity.FeedEntry) error) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "StreamOperations", ctx, filter, fn)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// StreamOperations indicates an expected call of StreamOperations.
+func (mr *MockUserMockRecorder) StreamOperations(ctx, filter, fn any) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "StreamOperations", reflect.TypeOf((*MockUser)(nil).StreamOperations), ctx, filter, fn)
+}
+
+// StreamUserOperations mocks base method.
+func (m *MockUser) StreamUserOperations(ctx context.Context, userId int, filter entity.OperationFilter, fn func(entity.Operation) error) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "StreamUserOperations", ctx, userId, filter, fn)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// StreamUserOperations indicates an expected call of StreamUserOperations.
+func (mr *MockUserMockRecorder) StreamUserOperations(ctx, userId, filter, fn any) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "StreamUserOperations", reflect.TypeOf((*MockUser)(nil).StreamUserOperations), ctx, userId, filter, fn)
+}
+
+// MockSegment is a mock of Segment interface.
+type MockSegment struct {
+	ctrl     *gomock.Controller
+	recorder *MockSegmentMockRecorder
+}
+
+// MockSegmentMockRecorder is the mock recorder for MockSegment.
+type MockSegmentMockRecorder struct {
+	mock *MockSegment
+}
+
+// NewMockSegment creates a new mock instance.
+func NewMockSegment(ctrl *gomock.Controller) *MockSegment {
+	mock := &MockSegment{ctrl: ctrl}
+	mock.recorder = &MockSegmentMockRecorder{mock}
+	return mock
+}
+
+// EXPECT returns an object that allows the caller to indicate expected use.
+func (m *MockSegment) EXPECT() *MockSegmentMockRecorder {
+	return m.recorder
+}
+
+// CreateSegment mocks base method.
+func (m *MockSegment) CreateSegment(ctx context.Context, segment entity.Segment) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "CreateSegment", ctx, segment)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// CreateSegment indicates an expected call of CreateSegment.
+func (mr *MockSegmentMockRecorder) CreateSegment(ctx, segment any) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "CreateSegment", reflect.TypeOf((*MockSegment)(nil).CreateSegment), ctx, segment)
+}
+
+// CreateSegmentAuto mocks base method.
+func (m *MockSegment) CreateSegmentAuto(ctx context.Context, segment entity.Segment, percentage float64) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "CreateSegmentAuto", ctx, segment, percentage)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// CreateSegmentAuto indicates an expected call of CreateSegmentAuto.
+func (mr *MockSegmentMockRecorder) CreateSegmentAuto(ctx, segment, percentage any) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "CreateSegmentAuto", reflect.TypeOf((*MockSegment)(nil).CreateSegmentAuto), ctx, segment, percentage)
+}
+
+// DeleteSegment mocks base method.
+func (m *MockSegment) DeleteSegment(ctx context.Context, name string) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "DeleteSegment", ctx, name)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// DeleteSegment indicates an expected call of DeleteSegment.
+func (mr *MockSegmentMockRecorder) DeleteSegment(ctx, name any) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "DeleteSegment", reflect.TypeOf((*MockSegment)(nil).DeleteSegment), ctx, name)
+}
+
+// GetSegment mocks base method.
+func (m *MockSegment) GetSegment(ctx context.Context, name string) (entity.Segment, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetSegment", ctx, name)
+	ret0, _ := ret[0].(entity.Segment)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetSegment indicates an expected call of GetSegment.
+func (mr *MockSegmentMockRecorder) GetSegment(ctx, name any) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetSegment", reflect.TypeOf((*MockSegment)(nil).GetSegment), ctx, name)
+}
+
+// GetSegments mocks base method.
+func (m *MockSegment) GetSegments(ctx context.Context, filter entity.SegmentFilter) ([]entity.Segment, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetSegments", ctx, filter)
+	ret0, _ := ret[0].([]entity.Segment)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetSegments indicates an expected call of GetSegments.
+func (mr *MockSegmentMockRecorder) GetSegments(ctx, filter any) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetSegments", reflect.TypeOf((*MockSegment)(nil).GetSegments), ctx, filter)
+}
+
+// RebalanceAutoSegments mocks base method.
+func (m *MockSegment) RebalanceAutoSegments(ctx context.Context) (int, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "RebalanceAutoSegments", ctx)
+	ret0, _ := ret[0].(int)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// RebalanceAutoSegments indicates an expected call of RebalanceAutoSegments.
+func (mr *MockSegmentMockRecorder) RebalanceAutoSegments(ctx any) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "RebalanceAutoSegments", reflect.TypeOf((*MockSegment)(nil).RebalanceAutoSegments), ctx)
+}
+
+// RecomputeRuleSegments mocks base method.
+func (m *MockSegment) RecomputeRuleSegments(ctx context.Context) (int, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "RecomputeRuleSegments", ctx)
+	ret0, _ := ret[0].(int)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// RecomputeRuleSegments indicates an expected call of RecomputeRuleSegments.
+func (mr *MockSegmentMockRecorder) RecomputeRuleSegments(ctx any) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "RecomputeRuleSegments", reflect.TypeOf((*MockSegment)(nil).RecomputeRuleSegments), ctx)
+}
+
+// RenameSegment mocks base method.
+func (m *MockSegment) RenameSegment(ctx context.Context, name, newName string) (entity.Segment, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "RenameSegment", ctx, name, newName)
+	ret0, _ := ret[0].(entity.Segment)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// RenameSegment indicates an expected call of RenameSegment.
+func (mr *MockSegmentMockRecorder) RenameSegment(ctx, name, newName any) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "RenameSegment", reflect.TypeOf((*MockSegment)(nil).RenameSegment), ctx, name, newName)
+}
+
+// StreamSegmentMembers mocks base method.
+func (m *MockSegment) StreamSegmentMembers(ctx context.Context, segmentID int64, fn func(entity.SegmentMember) error) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "StreamSegmentMembers", ctx, segmentID, fn)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// StreamSegmentMembers indicates an expected call of StreamSegmentMembers.
+func (mr *MockSegmentMockRecorder) StreamSegmentMembers(ctx, segmentID, fn any) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "StreamSegmentMembers", reflect.TypeOf((*MockSegment)(nil).StreamSegmentMembers), ctx, segmentID, fn)
+}
+
+// StreamSegmentOperations mocks base method.
+func (m *MockSegment) StreamSegmentOperations(ctx context.Context, segmentID int64, from, to time.Time, fn func(entity.Operation) error) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "StreamSegmentOperations", ctx, segmentID, from, to, fn)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// StreamSegmentOperations indicates an expected call of StreamSegmentOperations.
+func (mr *MockSegmentMockRecorder) StreamSegmentOperations(ctx, segmentID, from, to, fn any) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "StreamSegmentOperations", reflect.TypeOf((*MockSegment)(nil).StreamSegmentOperations), ctx, segmentID, from, to, fn)
+}
+
+// UpdateSegment mocks base method.
+func (m *MockSegment) UpdateSegment(ctx context.Context, name string, update entity.SegmentUpdate) (entity.Segment, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "UpdateSegment", ctx, name, update)
+	ret0, _ := ret[0].(entity.Segment)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// UpdateSegment indicates an expected call of UpdateSegment.
+func (mr *MockSegmentMockRecorder) UpdateSegment(ctx, name, update any) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "UpdateSegment", reflect.TypeOf((*MockSegment)(nil).UpdateSegment), ctx, name, update)
+}
+
+// MockExpired is a mock of Expired interface.
+type MockExpired struct {
+	ctrl     *gomock.Controller
+	recorder *MockExpiredMockRecorder
+}
+
+// MockExpiredMockRecorder is the mock recorder for MockExpired.
+type MockExpiredMockRecorder struct {
+	mock *MockExpired
+}
+
+// NewMockExpired creates a new mock instance.
+func NewMockExpired(ctrl *gomock.Controller) *MockExpired {
+	mock := &MockExpired{ctrl: ctrl}
+	mock.recorder = &MockExpiredMockRecorder{mock}
+	return mock
+}
+
+// EXPECT returns an object that allows the caller to indicate expected use.
+func (m *MockExpired) EXPECT() *MockExpiredMockRecorder {
+	return m.recorder
+}
+
+// DeleteExpiredIdempotencyKeys mocks base method.
+func (m *MockExpired) DeleteExpiredIdempotencyKeys(ctx context.Context) (int, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "DeleteExpiredIdempotencyKeys", ctx)
+	ret0, _ := ret[0].(int)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// DeleteExpiredIdempotencyKeys indicates an expected call of DeleteExpiredIdempotencyKeys.
+func (mr *MockExpiredMockRecorder) DeleteExpiredIdempotencyKeys(ctx any) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "DeleteExpiredIdempotencyKeys", reflect.TypeOf((*MockExpired)(nil).DeleteExpiredIdempotencyKeys), ctx)
+}
+
+// DeleteExpiredRows mocks base method.
+func (m *MockExpired) DeleteExpiredRows(ctx context.Context) (int, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "DeleteExpiredRows", ctx)
+	ret0, _ := ret[0].(int)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// DeleteExpiredRows indicates an expected call of DeleteExpiredRows.
+func (mr *MockExpiredMockRecorder) DeleteExpiredRows(ctx any) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "DeleteExpiredRows", reflect.TypeOf((*MockExpired)(nil).DeleteExpiredRows), ctx)
+}
+
+// MockReport is a mock of Report interface.
+type MockReport struct {
+	ctrl     *gomock.Controller
+	recorder *MockReportMockRecorder
+}
+
+// MockReportMockRecorder is the mock recorder for MockReport.
+type MockReportMockRecorder struct {
+	mock *MockReport
+}
+
+// NewMockReport creates a new mock instance.
+func NewMockReport(ctrl *gomock.Controller) *MockReport {
+	mock := &MockReport{ctrl: ctrl}
+	mock.recorder = &MockReportMockRecorder{mock}
+	return mock
+}
+
+// EXPECT returns an object that allows the caller to indicate expected use.
+func (m *MockReport) EXPECT() *MockReportMockRecorder {
+	return m.recorder
+}
+
+// ClaimReportJob mocks base method.
+func (m *MockReport) ClaimReportJob(ctx context.Context, lease time.Duration) (entity.ReportJob, bool, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "ClaimReportJob", ctx, lease)
+	ret0, _ := ret[0].(entity.ReportJob)
+	ret1, _ := ret[1].(bool)
+	ret2, _ := ret[2].(error)
+	return ret0, ret1, ret2
+}
+
+// ClaimReportJob indicates an expected call of ClaimReportJob.
+func (mr *MockReportMockRecorder) ClaimReportJob(ctx, lease any) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ClaimReportJob", reflect.TypeOf((*MockReport)(nil).ClaimReportJob), ctx, lease)
+}
+
+// CompleteReportJob mocks base method.
+func (m *MockReport) CompleteReportJob(ctx context.Context, id int64, url string) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "CompleteReportJob", ctx, id, url)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// CompleteReportJob indicates an expected call of CompleteReportJob.
+func (mr *MockReportMockRecorder) CompleteReportJob(ctx, id, url any) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "CompleteReportJob", reflect.TypeOf((*MockReport)(nil).CompleteReportJob), ctx, id, url)
+}
+
+// CreateReportJob mocks base method.
+func (m *MockReport) CreateReportJob(ctx context.Context, job entity.ReportJob) (entity.ReportJob, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "CreateReportJob", ctx, job)
+	ret0, _ := ret[0].(entity.ReportJob)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// CreateReportJob indicates an expected call of CreateReportJob.
+func (mr *MockReportMockRecorder) CreateReportJob(ctx, job any) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "CreateReportJob", reflect.TypeOf((*MockReport)(nil).CreateReportJob), ctx, job)
+}
+
+// FailReportJob mocks base method.
+func (m *MockReport) FailReportJob(ctx context.Context, id int64, reason string) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "FailReportJob", ctx, id, reason)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// FailReportJob indicates an expected call of FailReportJob.
+func (mr *MockReportMockRecorder) FailReportJob(ctx, id, reason any) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "FailReportJob", reflect.TypeOf((*MockReport)(nil).FailReportJob), ctx, id, reason)
+}
+
+// GetReportJob mocks base method.
+func (m *MockReport) GetReportJob(ctx context.Context, id int64) (entity.ReportJob, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetReportJob", ctx, id)
+	ret0, _ := ret[0].(entity.ReportJob)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetReportJob indicates an expected call of GetReportJob.
+func (mr *MockReportMockRecorder) GetReportJob(ctx, id any) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetReportJob", reflect.TypeOf((*MockReport)(nil).GetReportJob), ctx, id)
+}
+
+// RetryReportJob mocks base method.
+func (m *MockReport) RetryReportJob(ctx context.Context, id int64, reason string, delay time.Duration) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "RetryReportJob", ctx, id, reason, delay)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// RetryReportJob indicates an expected call of RetryReportJob.
+func (mr *MockReportMockRecorder) RetryReportJob(ctx, id, reason, delay any) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "RetryReportJob", reflect.TypeOf((*MockReport)(nil).RetryReportJob), ctx, id, reason, delay)
+}
+
+// MockBulk is a mock of Bulk interface.
+type MockBulk struct {
+	ctrl     *gomock.Controller
+	recorder *MockBulkMockRecorder
+}
+
+// MockBulkMockRecorder is the mock recorder for MockBulk.
+type MockBulkMockRecorder struct {
+	mock *MockBulk
+}
+
+// NewMockBulk creates a new mock instance.
+func NewMockBulk(ctrl *gomock.Controller) *MockBulk {
+	mock := &MockBulk{ctrl: ctrl}
+	mock.recorder = &MockBulkMockRecorder{mock}
+	return mock
+}
+
+// EXPECT returns an object that allows the caller to indicate expected use.
+func (m *MockBulk) EXPECT() *MockBulkMockRecorder {
+	return m.recorder
+}
+
+// ClaimBulkJob mocks base method.
+func (m *MockBulk) ClaimBulkJob(ctx context.Context, lease time.Duration) (entity.BulkJob, bool, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "ClaimBulkJob", ctx, lease)
+	ret0, _ := ret[0].(entity.BulkJob)
+	ret1, _ := ret[1].(bool)
+	ret2, _ := ret[2].(error)
+	return ret0, ret1, ret2
+}
+
+// ClaimBulkJob indicates an expected call of ClaimBulkJob.
+func (mr *MockBulkMockRecorder) ClaimBulkJob(ctx, lease any) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ClaimBulkJob", reflect.TypeOf((*MockBulk)(nil).ClaimBulkJob), ctx, lease)
+}
+
+// CompleteBulkJob mocks base method.
+func (m *MockBulk) CompleteBulkJob(ctx context.Context, id int64) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "CompleteBulkJob", ctx, id)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// CompleteBulkJob indicates an expected call of CompleteBulkJob.
+func (mr *MockBulkMockRecorder) CompleteBulkJob(ctx, id any) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "CompleteBulkJob", reflect.TypeOf((*MockBulk)(nil).CompleteBulkJob), ctx, id)
+}
+
+// CreateBulkJob mocks base method.
+func (m *MockBulk) CreateBulkJob(ctx context.Context, job entity.BulkJob, values []string) (entity.BulkJob, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "CreateBulkJob", ctx, job, values)
+	ret0, _ := ret[0].(entity.BulkJob)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// CreateBulkJob indicates an expected call of CreateBulkJob.
+func (mr *MockBulkMockRecorder) CreateBulkJob(ctx, job, values any) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "CreateBulkJob", reflect.TypeOf((*MockBulk)(nil).CreateBulkJob), ctx, job, values)
+}
+
+// FailBulkJob mocks base method.
+func (m *MockBulk) FailBulkJob(ctx context.Context, id int64, reason string) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "FailBulkJob", ctx, id, reason)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// FailBulkJob indicates an expected call of FailBulkJob.
+func (mr *MockBulkMockRecorder) FailBulkJob(ctx, id, reason any) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "FailBulkJob", reflect.TypeOf((*MockBulk)(nil).FailBulkJob), ctx, id, reason)
+}
+
+// GetBulkJob mocks base method.
+func (m *MockBulk) GetBulkJob(ctx context.Context, id int64) (entity.BulkJob, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetBulkJob", ctx, id)
+	ret0, _ := ret[0].(entity.BulkJob)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetBulkJob indicates an expected call of GetBulkJob.
+func (mr *MockBulkMockRecorder) GetBulkJob(ctx, id any) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetBulkJob", reflect.TypeOf((*MockBulk)(nil).GetBulkJob), ctx, id)
+}
+
+// GetBulkJobErrors mocks base method.
+func (m *MockBulk) GetBulkJobErrors(ctx context.Context, id int64) ([]entity.BulkRow, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetBulkJobErrors", ctx, id)
+	ret0, _ := ret[0].([]entity.BulkRow)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetBulkJobErrors indicates an expected call of GetBulkJobErrors.
+func (mr *MockBulkMockRecorder) GetBulkJobErrors(ctx, id any) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetBulkJobErrors", reflect.TypeOf((*MockBulk)(nil).GetBulkJobErrors), ctx, id)
+}
+
+// ProcessBulkRows mocks base method.
+func (m *MockBulk) ProcessBulkRows(ctx context.Context, job entity.BulkJob, limit int, lease time.Duration) (int, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "ProcessBulkRows", ctx, job, limit, lease)
+	ret0, _ := ret[0].(int)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// ProcessBulkRows indicates an expected call of ProcessBulkRows.
+func (mr *MockBulkMockRecorder) ProcessBulkRows(ctx, job, limit, lease any) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ProcessBulkRows", reflect.TypeOf((*MockBulk)(nil).ProcessBulkRows), ctx, job, limit, lease)
+}
+
+// RetryBulkJob mocks base method.
+func (m *MockBulk) RetryBulkJob(ctx context.Context, id int64, reason string, delay time.Duration) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "RetryBulkJob", ctx, id, reason, delay)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// RetryBulkJob indicates an expected call of RetryBulkJob.
+func (mr *MockBulkMockRecorder) RetryBulkJob(ctx, id, reason, delay any) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "RetryBulkJob", reflect.TypeOf((*MockBulk)(nil).RetryBulkJob), ctx, id, reason, delay)
+}
+
+// MockAPIKey is a mock of APIKey interface.
+type MockAPIKey struct {
+	ctrl     *gomock.Controller
+	recorder *MockAPIKeyMockRecorder
+}
+
+// MockAPIKeyMockRecorder is the mock recorder for MockAPIKey.
+type MockAPIKeyMockRecorder struct {
+	mock *MockAPIKey
+}
+
+// NewMockAPIKey creates a new mock instance.
+func NewMockAPIKey(ctrl *gomock.Controller) *MockAPIKey {
+	mock := &MockAPIKey{ctrl: ctrl}
+	mock.recorder = &MockAPIKeyMockRecorder{mock}
+	return mock
+}
+
+// EXPECT returns an object that allows the caller to indicate expected use.
+func (m *MockAPIKey) EXPECT() *MockAPIKeyMockRecorder {
+	return m.recorder
+}
+
+// CreateAPIKey mocks base method.
+func (m *MockAPIKey) CreateAPIKey(ctx context.Context, key entity.APIKey, hash string) (entity.APIKey, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "CreateAPIKey", ctx, key, hash)
+	ret0, _ := ret[0].(entity.APIKey)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// CreateAPIKey indicates an expected call of CreateAPIKey.
+func (mr *MockAPIKeyMockRecorder) CreateAPIKey(ctx, key, hash any) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "CreateAPIKey", reflect.TypeOf((*MockAPIKey)(nil).CreateAPIKey), ctx, key, hash)
+}
+
+// DeleteAPIKey mocks base method.
+func (m *MockAPIKey) DeleteAPIKey(ctx context.Context, id int64) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "DeleteAPIKey", ctx, id)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// DeleteAPIKey indicates an expected call of DeleteAPIKey.
+func (mr *MockAPIKeyMockRecorder) DeleteAPIKey(ctx, id any) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "DeleteAPIKey", reflect.TypeOf((*MockAPIKey)(nil).DeleteAPIKey), ctx, id)
+}
+
+// GetAPIKeyByHash mocks base method.
+func (m *MockAPIKey) GetAPIKeyByHash(ctx context.Context, hash string) (entity.APIKey, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetAPIKeyByHash", ctx, hash)
+	ret0, _ := ret[0].(entity.APIKey)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetAPIKeyByHash indicates an expected call of GetAPIKeyByHash.
+func (mr *MockAPIKeyMockRecorder) GetAPIKeyByHash(ctx, hash any) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetAPIKeyByHash", reflect.TypeOf((*MockAPIKey)(nil).GetAPIKeyByHash), ctx, hash)
+}
+
+// GetAPIKeys mocks base method.
+func (m *MockAPIKey) GetAPIKeys(ctx context.Context) ([]entity.APIKey, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetAPIKeys", ctx)
+	ret0, _ := ret[0].([]entity.APIKey)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetAPIKeys indicates an expected call of GetAPIKeys.
+func (mr *MockAPIKeyMockRecorder) GetAPIKeys(ctx any) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetAPIKeys", reflect.TypeOf((*MockAPIKey)(nil).GetAPIKeys), ctx)
+}
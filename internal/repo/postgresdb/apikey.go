@@ -0,0 +1,120 @@
+package postgresdb
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/Masterminds/squirrel"
+	"github.com/jackc/pgx/v5"
+
+	"github.com/realPointer/segments/internal/entity"
+	"github.com/realPointer/segments/internal/repo/repoerrs"
+	"github.com/realPointer/segments/pkg/postgres"
+)
+
+var apiKeyColumns = []string{"id", "name", "role", "prefix", "created_at"}
+
+type APIKeyRepo struct {
+	*postgres.Postgres
+}
+
+func NewAPIKeyRepo(pg *postgres.Postgres) *APIKeyRepo {
+	return &APIKeyRepo{pg}
+}
+
+func scanAPIKey(row pgx.Row) (entity.APIKey, error) {
+	var key entity.APIKey
+	err := row.Scan(&key.ID, &key.Name, &key.Role, &key.Prefix, &key.CreatedAt)
+
+	return key, err
+}
+
+// CreateAPIKey stores the key under hash, the hex SHA-256 of the key itself.
+func (r *APIKeyRepo) CreateAPIKey(ctx context.Context, key entity.APIKey, hash string) (entity.APIKey, error) {
+	if key.Name == "" {
+		return entity.APIKey{}, fmt.Errorf("APIKeyRepo.CreateAPIKey: %w", repoerrs.New(repoerrs.ErrInvalidInput, "name is required", nil))
+	}
+	if !entity.ValidRole(key.Role) {
+		return entity.APIKey{}, fmt.Errorf("APIKeyRepo.CreateAPIKey: %w", repoerrs.New(repoerrs.ErrInvalidInput,
+			fmt.Sprintf("unknown role %q, expected %s, %s or %s", key.Role, entity.RoleReader, entity.RoleAssigner, entity.RoleAdmin), nil))
+	}
+
+	sql, args, _ := r.Builder.
+		Insert("api_keys").
+		Columns("name", "role", "prefix", "key_hash").
+		Values(key.Name, key.Role, key.Prefix, hash).
+		Suffix("RETURNING " + strings.Join(apiKeyColumns, ", ")).
+		ToSql()
+
+	key, err := scanAPIKey(r.Pool.QueryRow(ctx, sql, args...))
+	if err != nil {
+		return entity.APIKey{}, fmt.Errorf("APIKeyRepo.CreateAPIKey - r.Pool.QueryRow: %w", classify(err))
+	}
+
+	return key, nil
+}
+
+// GetAPIKeyByHash returns the key whose hash is hash.
+func (r *APIKeyRepo) GetAPIKeyByHash(ctx context.Context, hash string) (entity.APIKey, error) {
+	sql, args, _ := r.Builder.
+		Select(apiKeyColumns...).
+		From("api_keys").
+		Where(squirrel.Eq{"key_hash": hash}).
+		ToSql()
+
+	key, err := scanAPIKey(r.Pool.QueryRow(ctx, sql, args...))
+	if err != nil {
+		return entity.APIKey{}, fmt.Errorf("APIKeyRepo.GetAPIKeyByHash - r.Pool.QueryRow: %w", missing(err, "API key"))
+	}
+
+	return key, nil
+}
+
+func (r *APIKeyRepo) GetAPIKeys(ctx context.Context) ([]entity.APIKey, error) {
+	sql, args, _ := r.Builder.
+		Select(apiKeyColumns...).
+		From("api_keys").
+		OrderBy("id").
+		ToSql()
+
+	rows, err := r.Pool.Query(ctx, sql, args...)
+	if err != nil {
+		return nil, fmt.Errorf("APIKeyRepo.GetAPIKeys - r.Pool.Query: %w", classify(err))
+	}
+	defer rows.Close()
+
+	keys := []entity.APIKey{}
+	for rows.Next() {
+		key, err := scanAPIKey(rows)
+		if err != nil {
+			return nil, fmt.Errorf("APIKeyRepo.GetAPIKeys - rows.Scan: %w", classify(err))
+		}
+
+		keys = append(keys, key)
+	}
+
+	err = rows.Err()
+	if err != nil {
+		return nil, fmt.Errorf("APIKeyRepo.GetAPIKeys - rows.Err: %w", classify(err))
+	}
+
+	return keys, nil
+}
+
+func (r *APIKeyRepo) DeleteAPIKey(ctx context.Context, id int64) error {
+	sql, args, _ := r.Builder.
+		Delete("api_keys").
+		Where(squirrel.Eq{"id": id}).
+		ToSql()
+
+	tag, err := r.Pool.Exec(ctx, sql, args...)
+	if err != nil {
+		return fmt.Errorf("APIKeyRepo.DeleteAPIKey - r.Pool.Exec: %w", classify(err))
+	}
+	if tag.RowsAffected() == 0 {
+		return fmt.Errorf("APIKeyRepo.DeleteAPIKey: %w", repoerrs.New(repoerrs.ErrNotFound, fmt.Sprintf("API key %d not found", id), nil))
+	}
+
+	return nil
+}
@@ -0,0 +1,125 @@
+package postgresdb
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/Masterminds/squirrel"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/pashagolub/pgxmock/v3"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/realPointer/segments/internal/entity"
+	"github.com/realPointer/segments/internal/repo/repoerrs"
+	"github.com/realPointer/segments/pkg/postgres"
+)
+
+var apiKeyRows = []string{"id", "name", "role", "prefix", "created_at"}
+
+func newAPIKeyRepoMock(poolMock pgxmock.PgxPoolIface) *APIKeyRepo {
+	return NewAPIKeyRepo(&postgres.Postgres{
+		Builder: squirrel.StatementBuilder.PlaceholderFormat(squirrel.Dollar),
+		Pool:    poolMock,
+	})
+}
+
+func TestAPIKeyRepo_CreateAPIKey(t *testing.T) {
+	type MockBehavior func(m pgxmock.PgxPoolIface, key entity.APIKey)
+
+	created := time.Date(2023, 9, 1, 12, 0, 0, 0, time.UTC)
+
+	testCases := []struct {
+		name         string
+		key          entity.APIKey
+		mockBehavior MockBehavior
+		want         entity.APIKey
+		wantErr      bool
+		wantErrIs    error
+	}{
+		{
+			name: "OK",
+			key:  entity.APIKey{Name: "marketing", Role: entity.RoleAssigner, Prefix: "seg_0123abcd"},
+			mockBehavior: func(m pgxmock.PgxPoolIface, key entity.APIKey) {
+				m.ExpectQuery("INSERT INTO api_keys \\(name,role,prefix,key_hash\\) VALUES \\(\\$1,\\$2,\\$3,\\$4\\) RETURNING id, name, role, prefix, created_at").
+					WithArgs("marketing", "assigner", "seg_0123abcd", "hash").
+					WillReturnRows(pgxmock.NewRows(apiKeyRows).AddRow(int64(3), "marketing", "assigner", "seg_0123abcd", created))
+			},
+			want: entity.APIKey{ID: 3, Name: "marketing", Role: entity.RoleAssigner, Prefix: "seg_0123abcd", CreatedAt: created},
+		},
+		{
+			name: "name taken",
+			key:  entity.APIKey{Name: "marketing", Role: entity.RoleReader},
+			mockBehavior: func(m pgxmock.PgxPoolIface, key entity.APIKey) {
+				m.ExpectQuery("INSERT INTO api_keys").
+					WithArgs("marketing", "reader", "", "hash").
+					WillReturnError(&pgconn.PgError{Code: "23505", Detail: "Key (name)=(marketing) already exists."})
+			},
+			wantErr:   true,
+			wantErrIs: repoerrs.ErrAlreadyExists,
+		},
+		{
+			name:         "unknown role",
+			key:          entity.APIKey{Name: "marketing", Role: "owner"},
+			mockBehavior: func(m pgxmock.PgxPoolIface, key entity.APIKey) {},
+			wantErr:      true,
+			wantErrIs:    repoerrs.ErrInvalidInput,
+		},
+		{
+			name:         "no name",
+			key:          entity.APIKey{Role: entity.RoleReader},
+			mockBehavior: func(m pgxmock.PgxPoolIface, key entity.APIKey) {},
+			wantErr:      true,
+			wantErrIs:    repoerrs.ErrInvalidInput,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			poolMock, _ := pgxmock.NewPool()
+			defer poolMock.Close()
+			tc.mockBehavior(poolMock, tc.key)
+
+			got, err := newAPIKeyRepoMock(poolMock).CreateAPIKey(context.Background(), tc.key, "hash")
+			if tc.wantErr {
+				assert.Error(t, err)
+				if tc.wantErrIs != nil {
+					assert.ErrorIs(t, err, tc.wantErrIs)
+				}
+				return
+			}
+			assert.NoError(t, err)
+
+			err = poolMock.ExpectationsWereMet()
+			assert.NoError(t, err)
+			assert.Equal(t, tc.want, got)
+		})
+	}
+}
+
+func TestAPIKeyRepo_GetAPIKeyByHash(t *testing.T) {
+	poolMock, _ := pgxmock.NewPool()
+	defer poolMock.Close()
+
+	poolMock.ExpectQuery("SELECT id, name, role, prefix, created_at FROM api_keys WHERE key_hash = \\$1").
+		WithArgs("hash").
+		WillReturnError(pgx.ErrNoRows)
+
+	_, err := newAPIKeyRepoMock(poolMock).GetAPIKeyByHash(context.Background(), "hash")
+	assert.ErrorIs(t, err, repoerrs.ErrNotFound)
+	assert.NoError(t, poolMock.ExpectationsWereMet())
+}
+
+func TestAPIKeyRepo_DeleteAPIKey(t *testing.T) {
+	poolMock, _ := pgxmock.NewPool()
+	defer poolMock.Close()
+
+	poolMock.ExpectExec("DELETE FROM api_keys WHERE id = \\$1").
+		WithArgs(int64(3)).
+		WillReturnResult(pgxmock.NewResult("DELETE", 0))
+
+	err := newAPIKeyRepoMock(poolMock).DeleteAPIKey(context.Background(), 3)
+	assert.ErrorIs(t, err, repoerrs.ErrNotFound)
+	assert.NoError(t, poolMock.ExpectationsWereMet())
+}
@@ -0,0 +1,127 @@
+package postgresdb
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/Masterminds/squirrel"
+	"github.com/jackc/pgx/v5"
+
+	"github.com/realPointer/segments/internal/entity"
+	"github.com/realPointer/segments/internal/repo/repoerrs"
+	"github.com/realPointer/segments/pkg/rules"
+)
+
+var attributeColumns = []string{"country", "platform", "COALESCE(to_char(signup_date, 'YYYY-MM-DD'), '')", "properties"}
+
+// attributedUser is a user id with the attributes rules are matched against.
+type attributedUser struct {
+	id    int
+	attrs entity.UserAttributes
+}
+
+func parseRule(src string) (*rules.Rule, error) {
+	rule, err := rules.Parse(src)
+	if err != nil {
+		return nil, repoerrs.New(repoerrs.ErrInvalidInput, fmt.Sprintf("invalid rule %q: %s", src, err), err)
+	}
+
+	return rule, nil
+}
+
+// ruleAttrs returns the attributes of a user as seen by rules.
+func ruleAttrs(userID int, attrs entity.UserAttributes) map[string]any {
+	env := map[string]any{
+		"id":         userID,
+		"country":    attrs.Country,
+		"platform":   attrs.Platform,
+		"properties": attrs.Properties,
+	}
+	if attrs.SignupDate != "" {
+		env["signup_date"] = attrs.SignupDate
+	}
+
+	return env
+}
+
+// signupDate validates the signup date of attrs and returns it as a query
+// argument.
+func signupDate(attrs entity.UserAttributes) (any, error) {
+	if attrs.SignupDate == "" {
+		return nil, nil
+	}
+
+	date, err := time.Parse("2006-01-02", attrs.SignupDate)
+	if err != nil {
+		return nil, repoerrs.New(repoerrs.ErrInvalidInput, fmt.Sprintf("invalid signup_date %q, expected YYYY-MM-DD", attrs.SignupDate), err)
+	}
+
+	return date, nil
+}
+
+func propertiesOrEmpty(properties map[string]any) map[string]any {
+	if properties == nil {
+		return map[string]any{}
+	}
+
+	return properties
+}
+
+func usersWithAttributes(ctx context.Context, tx pgx.Tx, b squirrel.StatementBuilderType) ([]attributedUser, error) {
+	sql, args, _ := b.
+		Select(append([]string{"id"}, attributeColumns...)...).
+		From("users").
+		OrderBy("id").
+		ToSql()
+
+	rows, err := tx.Query(ctx, sql, args...)
+	if err != nil {
+		return nil, fmt.Errorf("tx.Query: %w", classify(err))
+	}
+	defer rows.Close()
+
+	var users []attributedUser
+	for rows.Next() {
+		var user attributedUser
+		err := rows.Scan(&user.id, &user.attrs.Country, &user.attrs.Platform, &user.attrs.SignupDate, &user.attrs.Properties)
+		if err != nil {
+			return nil, fmt.Errorf("rows.Scan: %w", classify(err))
+		}
+
+		users = append(users, user)
+	}
+
+	err = rows.Err()
+	if err != nil {
+		return nil, fmt.Errorf("rows.Err: %w", classify(err))
+	}
+
+	return users, nil
+}
+
+// planRuleMembers returns the users to add to and to remove from a rule
+// segment so that it holds exactly the users matching the rule.
+func planRuleMembers(rule *rules.Rule, users []attributedUser, members []int) (add, remove []int) {
+	isMember := make(map[int]bool, len(members))
+	for _, id := range members {
+		isMember[id] = true
+	}
+
+	matches := make(map[int]bool, len(users))
+	for _, user := range users {
+		if rule.Match(ruleAttrs(user.id, user.attrs)) {
+			matches[user.id] = true
+			if !isMember[user.id] {
+				add = append(add, user.id)
+			}
+		}
+	}
+	for _, id := range members {
+		if !matches[id] {
+			remove = append(remove, id)
+		}
+	}
+
+	return add, remove
+}
@@ -0,0 +1,715 @@
+package postgresdb
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Masterminds/squirrel"
+	"github.com/jackc/pgx/v5"
+
+	"github.com/realPointer/segments/internal/entity"
+	"github.com/realPointer/segments/internal/repo/repoerrs"
+	"github.com/realPointer/segments/pkg/postgres"
+)
+
+var bulkColumns = []string{"id", "operation", "segment", "COALESCE(segment_id, 0)", "expires_at", "actor", "reason", "status", "total", "processed",
+	"changed", "unchanged", "failed", "error", "attempts", "created_at", "started_at", "finished_at"}
+
+var bulkLogColumns = []string{"user_id", "segment_name", "variant", "operation", "actor", "source", "reason", "batch_id", "expires_at"}
+
+type BulkRepo struct {
+	*postgres.Postgres
+	tp TimeProvider
+}
+
+func NewBulkRepo(pg *postgres.Postgres, tp TimeProvider) *BulkRepo {
+	return &BulkRepo{
+		Postgres: pg,
+		tp:       tp,
+	}
+}
+
+func scanBulkJob(row pgx.Row) (entity.BulkJob, error) {
+	var job entity.BulkJob
+	err := row.Scan(&job.ID, &job.Operation, &job.Segment, &job.SegmentID, &job.ExpiresAt, &job.Actor, &job.Reason, &job.Status, &job.Total,
+		&job.Processed, &job.Changed, &job.Unchanged, &job.Failed, &job.Error, &job.Attempts, &job.CreatedAt, &job.StartedAt, &job.FinishedAt)
+
+	return job, err
+}
+
+// CreateBulkJob queues the job with a row for every value, by the caller and
+// for the reason ctx carries. Values that aren't user ids are settled with an
+// error right away.
+func (r *BulkRepo) CreateBulkJob(ctx context.Context, job entity.BulkJob, values []string) (entity.BulkJob, error) {
+	err := r.validateBulkJob(job, len(values))
+	if err != nil {
+		return entity.BulkJob{}, fmt.Errorf("BulkRepo.CreateBulkJob - %w", err)
+	}
+
+	tx, err := r.Pool.Begin(ctx)
+	if err != nil {
+		return entity.BulkJob{}, fmt.Errorf("BulkRepo.CreateBulkJob - r.Pool.Begin: %w", classify(err))
+	}
+	defer func() { _ = tx.Rollback(ctx) }()
+
+	// The job follows the segment through renames, but outlives it: a
+	// segment deleted meanwhile fails the job when it runs.
+	sql, args, _ := r.Builder.
+		Select("id", "bucketing").
+		From("segments").
+		Where(squirrel.Eq{"name": job.Segment}).
+		ToSql()
+
+	var segmentID int64
+	var bucketing string
+	err = tx.QueryRow(ctx, sql, args...).Scan(&segmentID, &bucketing)
+	if err != nil {
+		return entity.BulkJob{}, fmt.Errorf("BulkRepo.CreateBulkJob - tx.QueryRow: %w", missing(err, fmt.Sprintf("segment %q", job.Segment)))
+	}
+
+	// Bucketing never changes, so checking it once is enough.
+	err = checkManualChange(job.Segment, bucketing)
+	if err != nil {
+		return entity.BulkJob{}, fmt.Errorf("BulkRepo.CreateBulkJob: %w", err)
+	}
+
+	rows := make([]entity.BulkRow, len(values))
+	invalid := 0
+	for i, value := range values {
+		rows[i] = parseBulkRow(i+1, value)
+		if rows[i].Error != "" {
+			invalid++
+		}
+	}
+
+	sql, args, _ = r.Builder.
+		Insert("bulk_jobs").
+		Columns("operation", "segment", "segment_id", "expires_at", "actor", "reason", "total", "processed", "failed").
+		Values(job.Operation, job.Segment, segmentID, job.ExpiresAt, actor(ctx), entity.ReasonFrom(ctx), len(rows), invalid, invalid).
+		Suffix("RETURNING " + strings.Join(bulkColumns, ", ")).
+		ToSql()
+
+	job, err = scanBulkJob(tx.QueryRow(ctx, sql, args...))
+	if err != nil {
+		return entity.BulkJob{}, fmt.Errorf("BulkRepo.CreateBulkJob - tx.QueryRow2: %w", classify(err))
+	}
+
+	_, err = tx.CopyFrom(ctx, pgx.Identifier{"bulk_job_rows"}, []string{"job_id", "row_number", "value", "user_id", "error"},
+		pgx.CopyFromSlice(len(rows), func(i int) ([]any, error) {
+			var userID any
+			if rows[i].UserID != 0 {
+				userID = rows[i].UserID
+			}
+
+			return []any{job.ID, rows[i].Row, rows[i].Value, userID, rows[i].Error}, nil
+		}))
+	if err != nil {
+		return entity.BulkJob{}, fmt.Errorf("BulkRepo.CreateBulkJob - tx.CopyFrom: %w", classify(err))
+	}
+
+	err = tx.Commit(ctx)
+	if err != nil {
+		return entity.BulkJob{}, fmt.Errorf("BulkRepo.CreateBulkJob - tx.Commit: %w", classify(err))
+	}
+
+	return job, nil
+}
+
+func (r *BulkRepo) validateBulkJob(job entity.BulkJob, rows int) error {
+	invalid := func(msg string) error {
+		return repoerrs.New(repoerrs.ErrInvalidInput, msg, nil)
+	}
+
+	switch job.Operation {
+	case entity.OperationAdd:
+		if job.ExpiresAt != nil && !job.ExpiresAt.After(r.tp.Now()) {
+			return invalid(fmt.Sprintf("expiry %s is not in the future", job.ExpiresAt.Format(time.RFC3339)))
+		}
+	case entity.OperationDelete:
+		if job.ExpiresAt != nil {
+			return invalid("expires_at only applies to add jobs")
+		}
+	default:
+		return invalid(fmt.Sprintf("unknown operation %q, expected %s or %s", job.Operation, entity.OperationAdd, entity.OperationDelete))
+	}
+
+	if job.Segment == "" {
+		return invalid("segment is required")
+	}
+	if rows == 0 {
+		return invalid("no user ids given")
+	}
+
+	return nil
+}
+
+// parseBulkRow returns the row numbered n for value, with an error when the
+// value isn't a user id.
+func parseBulkRow(n int, value string) entity.BulkRow {
+	row := entity.BulkRow{Row: n, Value: strings.TrimSpace(value)}
+
+	userID, err := strconv.Atoi(row.Value)
+	if err != nil || userID <= 0 {
+		row.Error = "not a user id"
+		return row
+	}
+	row.UserID = userID
+
+	return row
+}
+
+func (r *BulkRepo) GetBulkJob(ctx context.Context, id int64) (entity.BulkJob, error) {
+	sql, args, _ := r.Builder.
+		Select(bulkColumns...).
+		From("bulk_jobs").
+		Where(squirrel.Eq{"id": id}).
+		ToSql()
+
+	job, err := scanBulkJob(r.Pool.QueryRow(ctx, sql, args...))
+	if err != nil {
+		return entity.BulkJob{}, fmt.Errorf("BulkRepo.GetBulkJob - r.Pool.QueryRow: %w", missing(err, fmt.Sprintf("bulk job %d", id)))
+	}
+
+	return job, nil
+}
+
+// GetBulkJobErrors returns the rows of the job settled with an error so far,
+// in upload order.
+func (r *BulkRepo) GetBulkJobErrors(ctx context.Context, id int64) ([]entity.BulkRow, error) {
+	_, err := r.GetBulkJob(ctx, id)
+	if err != nil {
+		return nil, fmt.Errorf("BulkRepo.GetBulkJobErrors - %w", err)
+	}
+
+	sql, args, _ := r.Builder.
+		Select("row_number", "value", "COALESCE(user_id, 0)", "outcome", "error").
+		From("bulk_job_rows").
+		Where(squirrel.Eq{"job_id": id}).
+		Where("error <> ''").
+		OrderBy("row_number").
+		ToSql()
+
+	rows, err := r.Pool.Query(ctx, sql, args...)
+	if err != nil {
+		return nil, fmt.Errorf("BulkRepo.GetBulkJobErrors - r.Pool.Query: %w", classify(err))
+	}
+	defer rows.Close()
+
+	bulkRows := []entity.BulkRow{}
+	for rows.Next() {
+		var row entity.BulkRow
+		err = rows.Scan(&row.Row, &row.Value, &row.UserID, &row.Outcome, &row.Error)
+		if err != nil {
+			return nil, fmt.Errorf("BulkRepo.GetBulkJobErrors - rows.Scan: %w", classify(err))
+		}
+
+		bulkRows = append(bulkRows, row)
+	}
+
+	err = rows.Err()
+	if err != nil {
+		return nil, fmt.Errorf("BulkRepo.GetBulkJobErrors - rows.Err: %w", classify(err))
+	}
+
+	return bulkRows, nil
+}
+
+// ClaimBulkJob takes the oldest job that is due and leases it for lease,
+// like ClaimReportJob. It reports false when no job is due.
+func (r *BulkRepo) ClaimBulkJob(ctx context.Context, lease time.Duration) (entity.BulkJob, bool, error) {
+	sql, args, _ := r.Builder.
+		Update("bulk_jobs").
+		Set("status", entity.ReportRunning).
+		Set("attempts", squirrel.Expr("attempts + 1")).
+		Set("started_at", squirrel.Expr("COALESCE(started_at, NOW())")).
+		Set("run_after", squirrel.Expr("NOW() + ? * INTERVAL '1 second'", int(lease.Seconds()))).
+		Where("id = (SELECT id FROM bulk_jobs WHERE status IN ('pending', 'running') AND run_after <= NOW() " +
+			"ORDER BY run_after, id LIMIT 1 FOR UPDATE SKIP LOCKED)").
+		Suffix("RETURNING " + strings.Join(bulkColumns, ", ")).
+		ToSql()
+
+	job, err := scanBulkJob(r.Pool.QueryRow(ctx, sql, args...))
+	if errors.Is(err, pgx.ErrNoRows) {
+		return entity.BulkJob{}, false, nil
+	}
+	if err != nil {
+		return entity.BulkJob{}, false, fmt.Errorf("BulkRepo.ClaimBulkJob - r.Pool.QueryRow: %w", classify(err))
+	}
+
+	return job, true, nil
+}
+
+// ProcessBulkRows applies the job to up to limit of its pending rows in one
+// transaction, logs the memberships changed, settles the rows and renews
+// the lease of the job. Rows whose user doesn't exist, or already is in
+// another segment of the layer, are settled with an error. It returns the
+// number of rows settled, 0 once none is pending.
+// Changes of a job share the batch bulk-<id>.
+func (r *BulkRepo) ProcessBulkRows(ctx context.Context, job entity.BulkJob, limit int, lease time.Duration) (int, error) {
+	tx, err := r.Pool.Begin(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("BulkRepo.ProcessBulkRows - r.Pool.Begin: %w", classify(err))
+	}
+	defer func() { _ = tx.Rollback(ctx) }()
+
+	rows, err := r.pendingRows(ctx, tx, job.ID, limit)
+	if err != nil {
+		return 0, fmt.Errorf("BulkRepo.ProcessBulkRows - %w", err)
+	}
+	if len(rows) == 0 {
+		return 0, nil
+	}
+
+	sql, args, _ := r.Builder.
+		Select("name", "layer", "salt", "variants").
+		From("segments").
+		Where(squirrel.Eq{"id": job.SegmentID}).
+		ToSql()
+
+	var target entity.Segment
+	err = tx.QueryRow(ctx, sql, args...).Scan(&target.Name, &target.Layer, &target.Salt, &target.Variants)
+	if err != nil {
+		return 0, fmt.Errorf("BulkRepo.ProcessBulkRows - tx.QueryRow: %w", missing(err, fmt.Sprintf("segment %q", job.Segment)))
+	}
+	// Changes are made and logged under the name the segment has now.
+	job.Segment = target.Name
+
+	sql, args, _ = r.Builder.
+		Select("id").
+		From("users").
+		Where("id = ANY(?)", userIDsOf(rows)).
+		ToSql()
+
+	existing, err := collectIDs(tx.Query(ctx, sql, args...))
+	if err != nil {
+		return 0, fmt.Errorf("BulkRepo.ProcessBulkRows - tx.Query: %w", err)
+	}
+
+	known := make(map[int]bool, len(existing))
+	for _, id := range existing {
+		known[id] = true
+	}
+
+	for i := range rows {
+		if !known[rows[i].UserID] {
+			rows[i].Error = fmt.Sprintf("user %d not found", rows[i].UserID)
+		}
+	}
+
+	var entries [][]any
+	if len(existing) > 0 {
+		if job.Operation == entity.OperationAdd {
+			entries, err = r.addBulkRows(ctx, tx, job, target, rows)
+		} else {
+			entries, err = r.removeBulkRows(ctx, tx, job, rows)
+		}
+		if err != nil {
+			return 0, fmt.Errorf("BulkRepo.ProcessBulkRows - %w", err)
+		}
+	}
+
+	if len(entries) > 0 {
+		_, err = tx.CopyFrom(ctx, pgx.Identifier{"user_segments_log"}, bulkLogColumns, pgx.CopyFromRows(entries))
+		if err != nil {
+			return 0, fmt.Errorf("BulkRepo.ProcessBulkRows - tx.CopyFrom: %w", classify(err))
+		}
+	}
+
+	err = r.settleRows(ctx, tx, job.ID, rows, lease)
+	if err != nil {
+		return 0, fmt.Errorf("BulkRepo.ProcessBulkRows - %w", err)
+	}
+
+	err = tx.Commit(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("BulkRepo.ProcessBulkRows - tx.Commit: %w", classify(err))
+	}
+
+	return len(rows), nil
+}
+
+func (r *BulkRepo) pendingRows(ctx context.Context, tx pgx.Tx, jobID int64, limit int) ([]entity.BulkRow, error) {
+	sql, args, _ := r.Builder.
+		Select("row_number", "user_id").
+		From("bulk_job_rows").
+		Where(squirrel.Eq{"job_id": jobID}).
+		Where("outcome = '' AND error = ''").
+		OrderBy("row_number").
+		Limit(uint64(limit)).
+		Suffix("FOR UPDATE").
+		ToSql()
+
+	rows, err := tx.Query(ctx, sql, args...)
+	if err != nil {
+		return nil, fmt.Errorf("tx.Query: %w", classify(err))
+	}
+	defer rows.Close()
+
+	var pending []entity.BulkRow
+	for rows.Next() {
+		var row entity.BulkRow
+		err = rows.Scan(&row.Row, &row.UserID)
+		if err != nil {
+			return nil, fmt.Errorf("rows.Scan: %w", classify(err))
+		}
+
+		pending = append(pending, row)
+	}
+
+	return pending, classify(rows.Err())
+}
+
+// addBulkRows adds the users of the rows without an error to the segment and
+// sets the outcome of those rows. A user in several rows is added by the
+// first one. It returns the log entries of the changes.
+func (r *BulkRepo) addBulkRows(ctx context.Context, tx pgx.Tx, job entity.BulkJob, target entity.Segment, rows []entity.BulkRow) ([][]any, error) {
+	if target.Layer != "" {
+		sql, args, _ := r.Builder.
+			Select("user_id", "segment_name").
+			From("user_segments").
+			Where(squirrel.Eq{"layer": target.Layer}).
+			Where(squirrel.NotEq{"segment_name": target.Name}).
+			Where("user_id = ANY(?)", userIDsOf(rows)).
+			ToSql()
+
+		others, err := tx.Query(ctx, sql, args...)
+		if err != nil {
+			return nil, fmt.Errorf("tx.Query: %w", classify(err))
+		}
+
+		inLayer := make(map[int]string)
+		for others.Next() {
+			var userID int
+			var other string
+			err = others.Scan(&userID, &other)
+			if err != nil {
+				others.Close()
+				return nil, fmt.Errorf("rows.Scan: %w", classify(err))
+			}
+			inLayer[userID] = other
+		}
+		others.Close()
+		err = others.Err()
+		if err != nil {
+			return nil, fmt.Errorf("rows.Err: %w", classify(err))
+		}
+
+		for i := range rows {
+			if other, ok := inLayer[rows[i].UserID]; ok && rows[i].Error == "" {
+				rows[i].Error = fmt.Sprintf("user %d is already in segment %q of layer %q", rows[i].UserID, other, target.Layer)
+			}
+		}
+	}
+
+	columns := []string{"user_id", "segment_name", "variant"}
+	if job.ExpiresAt != nil {
+		columns = append(columns, "expire")
+	}
+	insert := r.Builder.
+		Insert("user_segments").
+		Columns(columns...).
+		Suffix("ON CONFLICT DO NOTHING RETURNING user_id")
+
+	variants := make(map[int]string)
+	for _, row := range rows {
+		if row.Error != "" {
+			continue
+		}
+		if _, ok := variants[row.UserID]; ok {
+			continue
+		}
+
+		variants[row.UserID] = pickVariant(target, row.UserID)
+		values := []any{row.UserID, target.Name, variants[row.UserID]}
+		if job.ExpiresAt != nil {
+			values = append(values, expireValue(job.ExpiresAt))
+		}
+		insert = insert.Values(values...)
+	}
+	if len(variants) == 0 {
+		return nil, nil
+	}
+
+	sql, args, _ := insert.ToSql()
+	inserted, err := collectIDs(tx.Query(ctx, sql, args...))
+	if err != nil {
+		return nil, fmt.Errorf("tx.Query2: %w", err)
+	}
+
+	added := make(map[int]bool, len(inserted))
+	var entries [][]any
+	for _, userID := range inserted {
+		added[userID] = true
+		entries = append(entries, bulkLogEntry(job, userID, variants[userID], entity.OperationAdd))
+	}
+
+	var skipped []int
+	for userID := range variants {
+		if !added[userID] {
+			skipped = append(skipped, userID)
+		}
+	}
+	sort.Ints(skipped)
+
+	// Users skipped are members already, or were added to another segment
+	// of the layer since it was checked.
+	var present []int
+	if len(skipped) > 0 {
+		sql, args, _ = r.Builder.
+			Select("user_id").
+			From("user_segments").
+			Where(squirrel.Eq{"segment_name": target.Name}).
+			Where("user_id = ANY(?)", skipped).
+			OrderBy("user_id").
+			ToSql()
+
+		present, err = collectIDs(tx.Query(ctx, sql, args...))
+		if err != nil {
+			return nil, fmt.Errorf("tx.Query3: %w", err)
+		}
+	}
+
+	member := make(map[int]bool, len(present))
+	for _, userID := range present {
+		member[userID] = true
+	}
+
+	// Like single adds, adding users who already are members moves their
+	// expiry.
+	if job.ExpiresAt != nil && len(present) > 0 {
+		sql, args, _ = r.Builder.
+			Update("user_segments").
+			Set("expire", expireValue(job.ExpiresAt)).
+			Where(squirrel.Eq{"segment_name": target.Name}).
+			Where("user_id = ANY(?)", present).
+			Suffix("RETURNING user_id, variant").
+			ToSql()
+
+		updated, err := tx.Query(ctx, sql, args...)
+		if err != nil {
+			return nil, fmt.Errorf("tx.Query4: %w", classify(err))
+		}
+		for updated.Next() {
+			var userID int
+			var variant string
+			err = updated.Scan(&userID, &variant)
+			if err != nil {
+				updated.Close()
+				return nil, fmt.Errorf("rows.Scan: %w", classify(err))
+			}
+			entries = append(entries, bulkLogEntry(job, userID, variant, entity.OperationTTL))
+		}
+		updated.Close()
+		err = updated.Err()
+		if err != nil {
+			return nil, fmt.Errorf("rows.Err: %w", classify(err))
+		}
+	}
+
+	for i := range rows {
+		if rows[i].Error != "" {
+			continue
+		}
+
+		// Later rows of a user added find them present.
+		switch {
+		case added[rows[i].UserID]:
+			rows[i].Outcome = entity.OutcomeAdded
+			delete(added, rows[i].UserID)
+			member[rows[i].UserID] = true
+		case member[rows[i].UserID]:
+			rows[i].Outcome = entity.OutcomeAlreadyPresent
+		default:
+			rows[i].Error = fmt.Sprintf("user %d is already in another segment of layer %q", rows[i].UserID, target.Layer)
+		}
+	}
+
+	return entries, nil
+}
+
+// removeBulkRows removes the users of the rows without an error from the
+// segment and sets the outcome of those rows. A user in several rows is
+// removed by the first one. It returns the log entries of the changes.
+func (r *BulkRepo) removeBulkRows(ctx context.Context, tx pgx.Tx, job entity.BulkJob, rows []entity.BulkRow) ([][]any, error) {
+	var userIDs []int
+	for _, row := range rows {
+		if row.Error == "" {
+			userIDs = append(userIDs, row.UserID)
+		}
+	}
+
+	sql, args, _ := r.Builder.
+		Delete("user_segments").
+		Where(squirrel.Eq{"segment_name": job.Segment}).
+		Where("user_id = ANY(?)", userIDs).
+		Suffix("RETURNING user_id, variant").
+		ToSql()
+
+	deleted, err := tx.Query(ctx, sql, args...)
+	if err != nil {
+		return nil, fmt.Errorf("tx.Query: %w", classify(err))
+	}
+	defer deleted.Close()
+
+	removed := make(map[int]bool)
+	var entries [][]any
+	for deleted.Next() {
+		var userID int
+		var variant string
+		err = deleted.Scan(&userID, &variant)
+		if err != nil {
+			return nil, fmt.Errorf("rows.Scan: %w", classify(err))
+		}
+
+		removed[userID] = true
+		entries = append(entries, bulkLogEntry(job, userID, variant, entity.OperationDelete))
+	}
+
+	err = deleted.Err()
+	if err != nil {
+		return nil, fmt.Errorf("rows.Err: %w", classify(err))
+	}
+
+	for i := range rows {
+		if rows[i].Error != "" {
+			continue
+		}
+
+		rows[i].Outcome = entity.OutcomeNotMember
+		if removed[rows[i].UserID] {
+			rows[i].Outcome = entity.OutcomeRemoved
+			delete(removed, rows[i].UserID)
+		}
+	}
+
+	return entries, nil
+}
+
+// bulkLogEntry is a log entry of a change the job made, in the order of
+// bulkLogColumns. The actor and reason are those of the request that queued
+// the job.
+func bulkLogEntry(job entity.BulkJob, userID int, variant, operation string) []any {
+	var expiresAt any
+	if job.ExpiresAt != nil && operation != entity.OperationDelete {
+		expiresAt = *job.ExpiresAt
+	}
+
+	return []any{userID, job.Segment, variant, operation, job.Actor, entity.SourceBulk, job.Reason, "bulk-" + strconv.FormatInt(job.ID, 10), expiresAt}
+}
+
+// settleRows stores the outcomes and errors of the rows, counts them into the
+// progress of the job and renews its lease.
+func (r *BulkRepo) settleRows(ctx context.Context, tx pgx.Tx, jobID int64, rows []entity.BulkRow, lease time.Duration) error {
+	type settlement struct{ outcome, error string }
+	groups := make(map[settlement][]int)
+	var order []settlement
+	changed, unchanged, failed := 0, 0, 0
+
+	for _, row := range rows {
+		s := settlement{row.Outcome, row.Error}
+		if _, ok := groups[s]; !ok {
+			order = append(order, s)
+		}
+		groups[s] = append(groups[s], row.Row)
+
+		switch row.Outcome {
+		case entity.OutcomeAdded, entity.OutcomeRemoved:
+			changed++
+		case entity.OutcomeAlreadyPresent, entity.OutcomeNotMember:
+			unchanged++
+		default:
+			failed++
+		}
+	}
+
+	for _, s := range order {
+		sql, args, _ := r.Builder.
+			Update("bulk_job_rows").
+			Set("outcome", s.outcome).
+			Set("error", s.error).
+			Where(squirrel.Eq{"job_id": jobID}).
+			Where("row_number = ANY(?)", groups[s]).
+			ToSql()
+
+		_, err := tx.Exec(ctx, sql, args...)
+		if err != nil {
+			return fmt.Errorf("tx.Exec: %w", classify(err))
+		}
+	}
+
+	sql, args, _ := r.Builder.
+		Update("bulk_jobs").
+		Set("processed", squirrel.Expr("processed + ?", len(rows))).
+		Set("changed", squirrel.Expr("changed + ?", changed)).
+		Set("unchanged", squirrel.Expr("unchanged + ?", unchanged)).
+		Set("failed", squirrel.Expr("failed + ?", failed)).
+		Set("run_after", squirrel.Expr("NOW() + ? * INTERVAL '1 second'", int(lease.Seconds()))).
+		Where(squirrel.Eq{"id": jobID}).
+		ToSql()
+
+	_, err := tx.Exec(ctx, sql, args...)
+	if err != nil {
+		return fmt.Errorf("tx.Exec2: %w", classify(err))
+	}
+
+	return nil
+}
+
+func userIDsOf(rows []entity.BulkRow) []int {
+	ids := make([]int, 0, len(rows))
+	for _, row := range rows {
+		if row.Error == "" {
+			ids = append(ids, row.UserID)
+		}
+	}
+
+	return ids
+}
+
+func (r *BulkRepo) CompleteBulkJob(ctx context.Context, id int64) error {
+	return r.finish(ctx, "BulkRepo.CompleteBulkJob", r.Builder.
+		Update("bulk_jobs").
+		Set("status", entity.ReportDone).
+		Set("error", "").
+		Set("finished_at", squirrel.Expr("NOW()")).
+		Where(squirrel.Eq{"id": id}))
+}
+
+// RetryBulkJob records why the attempt at the job failed and queues it again
+// after delay. The rows settled so far stay settled.
+func (r *BulkRepo) RetryBulkJob(ctx context.Context, id int64, reason string, delay time.Duration) error {
+	return r.finish(ctx, "BulkRepo.RetryBulkJob", r.Builder.
+		Update("bulk_jobs").
+		Set("status", entity.ReportPending).
+		Set("error", reason).
+		Set("run_after", squirrel.Expr("NOW() + ? * INTERVAL '1 second'", int(delay.Seconds()))).
+		Where(squirrel.Eq{"id": id}))
+}
+
+func (r *BulkRepo) FailBulkJob(ctx context.Context, id int64, reason string) error {
+	return r.finish(ctx, "BulkRepo.FailBulkJob", r.Builder.
+		Update("bulk_jobs").
+		Set("status", entity.ReportFailed).
+		Set("error", reason).
+		Set("finished_at", squirrel.Expr("NOW()")).
+		Where(squirrel.Eq{"id": id}))
+}
+
+func (r *BulkRepo) finish(ctx context.Context, method string, update squirrel.UpdateBuilder) error {
+	sql, args, _ := update.ToSql()
+
+	tag, err := r.Pool.Exec(ctx, sql, args...)
+	if err != nil {
+		return fmt.Errorf("%s - r.Pool.Exec: %w", method, classify(err))
+	}
+	if tag.RowsAffected() == 0 {
+		return fmt.Errorf("%s - %w", method, repoerrs.New(repoerrs.ErrNotFound, "bulk job not found", nil))
+	}
+
+	return nil
+}
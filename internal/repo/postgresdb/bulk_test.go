@@ -0,0 +1,449 @@
+package postgresdb
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/Masterminds/squirrel"
+	"github.com/jackc/pgx/v5"
+	"github.com/pashagolub/pgxmock/v3"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/realPointer/segments/internal/entity"
+	"github.com/realPointer/segments/internal/repo/repoerrs"
+	"github.com/realPointer/segments/pkg/postgres"
+)
+
+var bulkRows = []string{"id", "operation", "segment", "segment_id", "expires_at", "actor", "reason", "status", "total", "processed",
+	"changed", "unchanged", "failed", "error", "attempts", "created_at", "started_at", "finished_at"}
+
+func newBulkRepoMock(poolMock pgxmock.PgxPoolIface) *BulkRepo {
+	return NewBulkRepo(&postgres.Postgres{
+		Builder: squirrel.StatementBuilder.PlaceholderFormat(squirrel.Dollar),
+		Pool:    poolMock,
+	}, MockTimeProvider{})
+}
+
+func TestBulkRepo_CreateBulkJob(t *testing.T) {
+	type args struct {
+		ctx    context.Context
+		job    entity.BulkJob
+		values []string
+	}
+
+	type MockBehavior func(m pgxmock.PgxPoolIface, args args)
+
+	created := time.Date(2023, 1, 1, 15, 0, 0, 0, time.UTC)
+	nextYear := created.AddDate(1, 0, 0)
+	lastYear := created.AddDate(-1, 0, 0)
+
+	testCases := []struct {
+		name         string
+		args         args
+		mockBehavior MockBehavior
+		want         entity.BulkJob
+		wantErrIs    error
+	}{
+		{
+			name: "OK",
+			args: args{
+				ctx:    entity.WithReason(entity.WithCaller(context.Background(), entity.Caller{Name: "marketing", Role: entity.RoleAssigner}), "campaign"),
+				job:    entity.BulkJob{Operation: "add", Segment: "segment1", ExpiresAt: &nextYear},
+				values: []string{"1", " 2 ", "x"},
+			},
+			mockBehavior: func(m pgxmock.PgxPoolIface, args args) {
+				m.ExpectBegin()
+				m.ExpectQuery("SELECT id, bucketing FROM segments WHERE name = \\$1").
+					WithArgs("segment1").
+					WillReturnRows(pgxmock.NewRows([]string{"id", "bucketing"}).AddRow(int64(3), ""))
+				m.ExpectQuery("INSERT INTO bulk_jobs \\(operation,segment,segment_id,expires_at,actor,reason,total,processed,failed\\) VALUES \\(\\$1,\\$2,\\$3,\\$4,\\$5,\\$6,\\$7,\\$8,\\$9\\) RETURNING id, operation, segment, COALESCE\\(segment_id, 0\\)").
+					WithArgs("add", "segment1", int64(3), &nextYear, "marketing", "campaign", 3, 1, 1).
+					WillReturnRows(pgxmock.NewRows(bulkRows).
+						AddRow(int64(7), "add", "segment1", int64(3), &nextYear, "marketing", "campaign", "pending", 3, 1, 0, 0, 1, "", 0, created, nil, nil))
+				m.ExpectCopyFrom(pgx.Identifier{"bulk_job_rows"}, []string{"job_id", "row_number", "value", "user_id", "error"}).
+					WillReturnResult(3)
+				m.ExpectCommit()
+			},
+			want: entity.BulkJob{ID: 7, Operation: "add", Segment: "segment1", SegmentID: 3, ExpiresAt: &nextYear, Actor: "marketing", Reason: "campaign",
+				Status: "pending", Total: 3, Processed: 1, Failed: 1, CreatedAt: created},
+		},
+		{
+			name: "segment not found",
+			args: args{
+				ctx:    context.Background(),
+				job:    entity.BulkJob{Operation: "delete", Segment: "segment1"},
+				values: []string{"1"},
+			},
+			mockBehavior: func(m pgxmock.PgxPoolIface, args args) {
+				m.ExpectBegin()
+				m.ExpectQuery("SELECT id, bucketing FROM segments").
+					WithArgs("segment1").
+					WillReturnError(pgx.ErrNoRows)
+				m.ExpectRollback()
+			},
+			wantErrIs: repoerrs.ErrNotFound,
+		},
+		{
+			name: "hash auto segment",
+			args: args{
+				ctx:    context.Background(),
+				job:    entity.BulkJob{Operation: "add", Segment: "segment1"},
+				values: []string{"1"},
+			},
+			mockBehavior: func(m pgxmock.PgxPoolIface, args args) {
+				m.ExpectBegin()
+				m.ExpectQuery("SELECT id, bucketing FROM segments").
+					WithArgs("segment1").
+					WillReturnRows(pgxmock.NewRows([]string{"id", "bucketing"}).AddRow(int64(3), entity.BucketingHash))
+				m.ExpectRollback()
+			},
+			wantErrIs: repoerrs.ErrConflict,
+		},
+		{
+			name: "unknown operation",
+			args: args{
+				ctx:    context.Background(),
+				job:    entity.BulkJob{Operation: "move", Segment: "segment1"},
+				values: []string{"1"},
+			},
+			mockBehavior: func(m pgxmock.PgxPoolIface, args args) {},
+			wantErrIs:    repoerrs.ErrInvalidInput,
+		},
+		{
+			name: "expiry in the past",
+			args: args{
+				ctx:    context.Background(),
+				job:    entity.BulkJob{Operation: "add", Segment: "segment1", ExpiresAt: &lastYear},
+				values: []string{"1"},
+			},
+			mockBehavior: func(m pgxmock.PgxPoolIface, args args) {},
+			wantErrIs:    repoerrs.ErrInvalidInput,
+		},
+		{
+			name: "expiry of a delete",
+			args: args{
+				ctx:    context.Background(),
+				job:    entity.BulkJob{Operation: "delete", Segment: "segment1", ExpiresAt: &nextYear},
+				values: []string{"1"},
+			},
+			mockBehavior: func(m pgxmock.PgxPoolIface, args args) {},
+			wantErrIs:    repoerrs.ErrInvalidInput,
+		},
+		{
+			name: "no user ids",
+			args: args{
+				ctx: context.Background(),
+				job: entity.BulkJob{Operation: "add", Segment: "segment1"},
+			},
+			mockBehavior: func(m pgxmock.PgxPoolIface, args args) {},
+			wantErrIs:    repoerrs.ErrInvalidInput,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			poolMock, _ := pgxmock.NewPool()
+			defer poolMock.Close()
+			tc.mockBehavior(poolMock, tc.args)
+
+			got, err := newBulkRepoMock(poolMock).CreateBulkJob(tc.args.ctx, tc.args.job, tc.args.values)
+			if tc.wantErrIs != nil {
+				assert.ErrorIs(t, err, tc.wantErrIs)
+				return
+			}
+			assert.NoError(t, err)
+
+			err = poolMock.ExpectationsWereMet()
+			assert.NoError(t, err)
+			assert.Equal(t, tc.want, got)
+		})
+	}
+}
+
+func TestParseBulkRow(t *testing.T) {
+	assert.Equal(t, entity.BulkRow{Row: 1, Value: "42", UserID: 42}, parseBulkRow(1, " 42 "))
+	assert.Equal(t, entity.BulkRow{Row: 2, Value: "x", Error: "not a user id"}, parseBulkRow(2, "x"))
+	assert.Equal(t, entity.BulkRow{Row: 3, Value: "-1", Error: "not a user id"}, parseBulkRow(3, "-1"))
+}
+
+func TestBulkLogEntry(t *testing.T) {
+	expiresAt := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	job := entity.BulkJob{ID: 7, Segment: "segment1", ExpiresAt: &expiresAt, Actor: "marketing", Reason: "campaign"}
+
+	assert.Equal(t, []any{1, "segment1", "B", "add", "marketing", "bulk", "campaign", "bulk-7", expiresAt},
+		bulkLogEntry(job, 1, "B", entity.OperationAdd))
+	assert.Equal(t, []any{1, "segment1", "B", "delete", "marketing", "bulk", "campaign", "bulk-7", nil},
+		bulkLogEntry(job, 1, "B", entity.OperationDelete))
+}
+
+func TestBulkRepo_ProcessBulkRows(t *testing.T) {
+	type MockBehavior func(m pgxmock.PgxPoolIface, job entity.BulkJob)
+
+	expiresAt := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	pending := func(m pgxmock.PgxPoolIface, rows ...int) {
+		result := pgxmock.NewRows([]string{"row_number", "user_id"})
+		for i, userID := range rows {
+			result.AddRow(i+1, userID)
+		}
+		m.ExpectQuery("SELECT row_number, user_id FROM bulk_job_rows WHERE job_id = \\$1 AND outcome = '' AND error = '' ORDER BY row_number LIMIT 1000 FOR UPDATE").
+			WithArgs(int64(7)).
+			WillReturnRows(result)
+	}
+
+	testCases := []struct {
+		name         string
+		job          entity.BulkJob
+		mockBehavior MockBehavior
+		want         int
+		wantErr      bool
+		wantErrIs    error
+	}{
+		{
+			name: "add",
+			job:  entity.BulkJob{ID: 7, Operation: "add", Segment: "segment1", SegmentID: 3, Actor: "marketing"},
+			mockBehavior: func(m pgxmock.PgxPoolIface, job entity.BulkJob) {
+				m.ExpectBegin()
+				// User 2 doesn't exist, user 1 is in two rows, user 3 is in
+				// another segment of the layer and user 4 in the segment.
+				pending(m, 1, 2, 1, 3, 4)
+				m.ExpectQuery("SELECT name, layer, salt, variants FROM segments WHERE id = \\$1").
+					WithArgs(int64(3)).
+					WillReturnRows(pgxmock.NewRows([]string{"name", "layer", "salt", "variants"}).AddRow("segment1", "layer1", "", []entity.Variant(nil)))
+				m.ExpectQuery("SELECT id FROM users WHERE id = ANY\\(\\$1\\)").
+					WithArgs([]int{1, 2, 1, 3, 4}).
+					WillReturnRows(pgxmock.NewRows([]string{"id"}).AddRow(1).AddRow(3).AddRow(4))
+				m.ExpectQuery("SELECT user_id, segment_name FROM user_segments WHERE layer = \\$1 AND segment_name <> \\$2 AND user_id = ANY\\(\\$3\\)").
+					WithArgs("layer1", "segment1", []int{1, 1, 3, 4}).
+					WillReturnRows(pgxmock.NewRows([]string{"user_id", "segment_name"}).AddRow(3, "segment2"))
+				m.ExpectQuery("INSERT INTO user_segments \\(user_id,segment_name,variant\\) VALUES \\(\\$1,\\$2,\\$3\\),\\(\\$4,\\$5,\\$6\\) "+
+					"ON CONFLICT DO NOTHING RETURNING user_id").
+					WithArgs(1, "segment1", "", 4, "segment1", "").
+					WillReturnRows(pgxmock.NewRows([]string{"user_id"}).AddRow(1))
+				m.ExpectQuery("SELECT user_id FROM user_segments WHERE segment_name = \\$1 AND user_id = ANY\\(\\$2\\) ORDER BY user_id").
+					WithArgs("segment1", []int{4}).
+					WillReturnRows(pgxmock.NewRows([]string{"user_id"}).AddRow(4))
+				m.ExpectCopyFrom(pgx.Identifier{"user_segments_log"}, bulkLogColumns).
+					WillReturnResult(1)
+				m.ExpectExec("UPDATE bulk_job_rows SET outcome = \\$1, error = \\$2 WHERE job_id = \\$3 AND row_number = ANY\\(\\$4\\)").
+					WithArgs("added", "", int64(7), []int{1}).
+					WillReturnResult(pgxmock.NewResult("UPDATE", 1))
+				m.ExpectExec("UPDATE bulk_job_rows").
+					WithArgs("", "user 2 not found", int64(7), []int{2}).
+					WillReturnResult(pgxmock.NewResult("UPDATE", 1))
+				m.ExpectExec("UPDATE bulk_job_rows").
+					WithArgs("already_present", "", int64(7), []int{3, 5}).
+					WillReturnResult(pgxmock.NewResult("UPDATE", 2))
+				m.ExpectExec("UPDATE bulk_job_rows").
+					WithArgs("", `user 3 is already in segment "segment2" of layer "layer1"`, int64(7), []int{4}).
+					WillReturnResult(pgxmock.NewResult("UPDATE", 1))
+				m.ExpectExec("UPDATE bulk_jobs SET processed = processed \\+ \\$1, changed = changed \\+ \\$2, unchanged = unchanged \\+ \\$3, failed = failed \\+ \\$4, "+
+					"run_after = NOW\\(\\) \\+ \\$5 \\* INTERVAL '1 second' WHERE id = \\$6").
+					WithArgs(5, 1, 2, 2, 120, int64(7)).
+					WillReturnResult(pgxmock.NewResult("UPDATE", 1))
+				m.ExpectCommit()
+			},
+			want: 5,
+		},
+		{
+			name: "renamed segment, layer taken meanwhile",
+			job:  entity.BulkJob{ID: 7, Operation: "add", Segment: "segment1", SegmentID: 3},
+			mockBehavior: func(m pgxmock.PgxPoolIface, job entity.BulkJob) {
+				m.ExpectBegin()
+				pending(m, 1, 2)
+				m.ExpectQuery("SELECT name, layer, salt, variants FROM segments").
+					WithArgs(int64(3)).
+					WillReturnRows(pgxmock.NewRows([]string{"name", "layer", "salt", "variants"}).AddRow("segment1-renamed", "layer1", "", []entity.Variant(nil)))
+				m.ExpectQuery("SELECT id FROM users").
+					WithArgs([]int{1, 2}).
+					WillReturnRows(pgxmock.NewRows([]string{"id"}).AddRow(1).AddRow(2))
+				m.ExpectQuery("SELECT user_id, segment_name FROM user_segments").
+					WithArgs("layer1", "segment1-renamed", []int{1, 2}).
+					WillReturnRows(pgxmock.NewRows([]string{"user_id", "segment_name"}))
+				// User 2 joins another segment of the layer before the insert.
+				m.ExpectQuery("INSERT INTO user_segments").
+					WithArgs(1, "segment1-renamed", "", 2, "segment1-renamed", "").
+					WillReturnRows(pgxmock.NewRows([]string{"user_id"}).AddRow(1))
+				m.ExpectQuery("SELECT user_id FROM user_segments").
+					WithArgs("segment1-renamed", []int{2}).
+					WillReturnRows(pgxmock.NewRows([]string{"user_id"}))
+				m.ExpectCopyFrom(pgx.Identifier{"user_segments_log"}, bulkLogColumns).
+					WillReturnResult(1)
+				m.ExpectExec("UPDATE bulk_job_rows").
+					WithArgs("added", "", int64(7), []int{1}).
+					WillReturnResult(pgxmock.NewResult("UPDATE", 1))
+				m.ExpectExec("UPDATE bulk_job_rows").
+					WithArgs("", `user 2 is already in another segment of layer "layer1"`, int64(7), []int{2}).
+					WillReturnResult(pgxmock.NewResult("UPDATE", 1))
+				m.ExpectExec("UPDATE bulk_jobs").
+					WithArgs(2, 1, 0, 1, 120, int64(7)).
+					WillReturnResult(pgxmock.NewResult("UPDATE", 1))
+				m.ExpectCommit()
+			},
+			want: 2,
+		},
+		{
+			name: "add with expiry",
+			job:  entity.BulkJob{ID: 7, Operation: "add", Segment: "segment1", SegmentID: 3, ExpiresAt: &expiresAt},
+			mockBehavior: func(m pgxmock.PgxPoolIface, job entity.BulkJob) {
+				m.ExpectBegin()
+				pending(m, 1, 2)
+				m.ExpectQuery("SELECT name, layer, salt, variants FROM segments").
+					WithArgs(int64(3)).
+					WillReturnRows(pgxmock.NewRows([]string{"name", "layer", "salt", "variants"}).AddRow("segment1", "", "", []entity.Variant(nil)))
+				m.ExpectQuery("SELECT id FROM users").
+					WithArgs([]int{1, 2}).
+					WillReturnRows(pgxmock.NewRows([]string{"id"}).AddRow(1).AddRow(2))
+				m.ExpectQuery("INSERT INTO user_segments \\(user_id,segment_name,variant,expire\\) VALUES \\(\\$1,\\$2,\\$3,\\$4::timestamptz::timestamp\\),\\(\\$5,\\$6,\\$7,\\$8::timestamptz::timestamp\\)").
+					WithArgs(1, "segment1", "", expiresAt, 2, "segment1", "", expiresAt).
+					WillReturnRows(pgxmock.NewRows([]string{"user_id"}).AddRow(1))
+				m.ExpectQuery("SELECT user_id FROM user_segments").
+					WithArgs("segment1", []int{2}).
+					WillReturnRows(pgxmock.NewRows([]string{"user_id"}).AddRow(2))
+				m.ExpectQuery("UPDATE user_segments SET expire = \\$1::timestamptz::timestamp WHERE segment_name = \\$2 AND user_id = ANY\\(\\$3\\) RETURNING user_id, variant").
+					WithArgs(expiresAt, "segment1", []int{2}).
+					WillReturnRows(pgxmock.NewRows([]string{"user_id", "variant"}).AddRow(2, ""))
+				m.ExpectCopyFrom(pgx.Identifier{"user_segments_log"}, bulkLogColumns).
+					WillReturnResult(2)
+				m.ExpectExec("UPDATE bulk_job_rows").
+					WithArgs("added", "", int64(7), []int{1}).
+					WillReturnResult(pgxmock.NewResult("UPDATE", 1))
+				m.ExpectExec("UPDATE bulk_job_rows").
+					WithArgs("already_present", "", int64(7), []int{2}).
+					WillReturnResult(pgxmock.NewResult("UPDATE", 1))
+				m.ExpectExec("UPDATE bulk_jobs").
+					WithArgs(2, 1, 1, 0, 120, int64(7)).
+					WillReturnResult(pgxmock.NewResult("UPDATE", 1))
+				m.ExpectCommit()
+			},
+			want: 2,
+		},
+		{
+			name: "delete",
+			job:  entity.BulkJob{ID: 7, Operation: "delete", Segment: "segment1", SegmentID: 3},
+			mockBehavior: func(m pgxmock.PgxPoolIface, job entity.BulkJob) {
+				m.ExpectBegin()
+				pending(m, 1, 5)
+				m.ExpectQuery("SELECT name, layer, salt, variants FROM segments").
+					WithArgs(int64(3)).
+					WillReturnRows(pgxmock.NewRows([]string{"name", "layer", "salt", "variants"}).AddRow("segment1", "", "", []entity.Variant(nil)))
+				m.ExpectQuery("SELECT id FROM users").
+					WithArgs([]int{1, 5}).
+					WillReturnRows(pgxmock.NewRows([]string{"id"}).AddRow(1).AddRow(5))
+				m.ExpectQuery("DELETE FROM user_segments WHERE segment_name = \\$1 AND user_id = ANY\\(\\$2\\) RETURNING user_id, variant").
+					WithArgs("segment1", []int{1, 5}).
+					WillReturnRows(pgxmock.NewRows([]string{"user_id", "variant"}).AddRow(1, "B"))
+				m.ExpectCopyFrom(pgx.Identifier{"user_segments_log"}, bulkLogColumns).
+					WillReturnResult(1)
+				m.ExpectExec("UPDATE bulk_job_rows").
+					WithArgs("removed", "", int64(7), []int{1}).
+					WillReturnResult(pgxmock.NewResult("UPDATE", 1))
+				m.ExpectExec("UPDATE bulk_job_rows").
+					WithArgs("not_member", "", int64(7), []int{2}).
+					WillReturnResult(pgxmock.NewResult("UPDATE", 1))
+				m.ExpectExec("UPDATE bulk_jobs").
+					WithArgs(2, 1, 1, 0, 120, int64(7)).
+					WillReturnResult(pgxmock.NewResult("UPDATE", 1))
+				m.ExpectCommit()
+			},
+			want: 2,
+		},
+		{
+			name: "no pending rows",
+			job:  entity.BulkJob{ID: 7, Operation: "add", Segment: "segment1", SegmentID: 3},
+			mockBehavior: func(m pgxmock.PgxPoolIface, job entity.BulkJob) {
+				m.ExpectBegin()
+				pending(m)
+				m.ExpectRollback()
+			},
+		},
+		{
+			name: "segment deleted",
+			job:  entity.BulkJob{ID: 7, Operation: "add", Segment: "segment1", SegmentID: 3},
+			mockBehavior: func(m pgxmock.PgxPoolIface, job entity.BulkJob) {
+				m.ExpectBegin()
+				pending(m, 1)
+				m.ExpectQuery("SELECT name, layer, salt, variants FROM segments").
+					WithArgs(int64(3)).
+					WillReturnError(pgx.ErrNoRows)
+				m.ExpectRollback()
+			},
+			wantErr:   true,
+			wantErrIs: repoerrs.ErrNotFound,
+		},
+		{
+			name: "tx.Commit error",
+			job:  entity.BulkJob{ID: 7, Operation: "delete", Segment: "segment1", SegmentID: 3},
+			mockBehavior: func(m pgxmock.PgxPoolIface, job entity.BulkJob) {
+				m.ExpectBegin()
+				pending(m, 2)
+				m.ExpectQuery("SELECT name, layer, salt, variants FROM segments").
+					WithArgs(int64(3)).
+					WillReturnRows(pgxmock.NewRows([]string{"name", "layer", "salt", "variants"}).AddRow("segment1", "", "", []entity.Variant(nil)))
+				m.ExpectQuery("SELECT id FROM users").
+					WithArgs([]int{2}).
+					WillReturnRows(pgxmock.NewRows([]string{"id"}))
+				m.ExpectExec("UPDATE bulk_job_rows").
+					WithArgs("", "user 2 not found", int64(7), []int{1}).
+					WillReturnResult(pgxmock.NewResult("UPDATE", 1))
+				m.ExpectExec("UPDATE bulk_jobs").
+					WithArgs(1, 0, 0, 1, 120, int64(7)).
+					WillReturnResult(pgxmock.NewResult("UPDATE", 1))
+				m.ExpectCommit().WillReturnError(errors.New("commit error"))
+				m.ExpectRollback()
+			},
+			wantErr: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			poolMock, _ := pgxmock.NewPool()
+			defer poolMock.Close()
+			tc.mockBehavior(poolMock, tc.job)
+
+			got, err := newBulkRepoMock(poolMock).ProcessBulkRows(context.Background(), tc.job, 1000, 2*time.Minute)
+			if tc.wantErr {
+				assert.Error(t, err)
+				if tc.wantErrIs != nil {
+					assert.ErrorIs(t, err, tc.wantErrIs)
+				}
+				return
+			}
+			assert.NoError(t, err)
+
+			err = poolMock.ExpectationsWereMet()
+			assert.NoError(t, err)
+			assert.Equal(t, tc.want, got)
+		})
+	}
+}
+
+func TestBulkRepo_GetBulkJobErrors(t *testing.T) {
+	created := time.Date(2023, 1, 1, 15, 0, 0, 0, time.UTC)
+
+	poolMock, _ := pgxmock.NewPool()
+	defer poolMock.Close()
+
+	poolMock.ExpectQuery("SELECT id, operation, segment, COALESCE\\(segment_id, 0\\), expires_at, actor, reason, status, total, processed, changed, unchanged, failed, error, attempts, created_at, started_at, finished_at FROM bulk_jobs WHERE id = \\$1").
+		WithArgs(int64(7)).
+		WillReturnRows(pgxmock.NewRows(bulkRows).
+			AddRow(int64(7), "add", "segment1", int64(3), nil, "", "", "done", 2, 2, 1, 0, 1, "", 1, created, &created, &created))
+	poolMock.ExpectQuery("SELECT row_number, value, COALESCE\\(user_id, 0\\), outcome, error FROM bulk_job_rows WHERE job_id = \\$1 AND error <> '' ORDER BY row_number").
+		WithArgs(int64(7)).
+		WillReturnRows(pgxmock.NewRows([]string{"row_number", "value", "user_id", "outcome", "error"}).
+			AddRow(2, "x", 0, "", "not a user id"))
+
+	got, err := newBulkRepoMock(poolMock).GetBulkJobErrors(context.Background(), 7)
+	assert.NoError(t, err)
+	assert.NoError(t, poolMock.ExpectationsWereMet())
+	assert.Equal(t, []entity.BulkRow{{Row: 2, Value: "x", Error: "not a user id"}}, got)
+
+	poolMock.ExpectQuery("SELECT id, operation").
+		WithArgs(int64(8)).
+		WillReturnError(pgx.ErrNoRows)
+
+	_, err = newBulkRepoMock(poolMock).GetBulkJobErrors(context.Background(), 8)
+	assert.ErrorIs(t, err, repoerrs.ErrNotFound)
+}
@@ -0,0 +1,78 @@
+package postgresdb
+
+import (
+	"encoding/base64"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/realPointer/segments/internal/repo/repoerrs"
+)
+
+// encodeLogCursor returns an opaque cursor pointing at the log entry with the
+// given time and id. Postgres keeps microseconds, so they are enough to find
+// the entry again.
+func encodeLogCursor(operationTime time.Time, id int64) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(fmt.Sprintf("%d.%d", operationTime.UnixMicro(), id)))
+}
+
+func decodeLogCursor(cursor string) (time.Time, int64, error) {
+	invalid := func(err error) (time.Time, int64, error) {
+		return time.Time{}, 0, repoerrs.New(repoerrs.ErrInvalidInput, fmt.Sprintf("invalid cursor %q", cursor), err)
+	}
+
+	raw, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return invalid(err)
+	}
+
+	micros, id, ok := strings.Cut(string(raw), ".")
+	if !ok {
+		return invalid(nil)
+	}
+
+	usec, err := strconv.ParseInt(micros, 10, 64)
+	if err != nil {
+		return invalid(err)
+	}
+	logID, err := strconv.ParseInt(id, 10, 64)
+	if err != nil {
+		return invalid(err)
+	}
+
+	return time.UnixMicro(usec), logID, nil
+}
+
+// encodeFeedCursor returns an opaque cursor pointing at the log entry with
+// the given id written by the transaction xid, as postgres prints it.
+func encodeFeedCursor(xid string, id int64) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(fmt.Sprintf("%s.%d", xid, id)))
+}
+
+func decodeFeedCursor(cursor string) (uint64, int64, error) {
+	invalid := func(err error) (uint64, int64, error) {
+		return 0, 0, repoerrs.New(repoerrs.ErrInvalidInput, fmt.Sprintf("invalid cursor %q", cursor), err)
+	}
+
+	raw, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return invalid(err)
+	}
+
+	xidStr, idStr, ok := strings.Cut(string(raw), ".")
+	if !ok {
+		return invalid(nil)
+	}
+
+	xid, err := strconv.ParseUint(xidStr, 10, 64)
+	if err != nil {
+		return invalid(err)
+	}
+	id, err := strconv.ParseInt(idStr, 10, 64)
+	if err != nil {
+		return invalid(err)
+	}
+
+	return xid, id, nil
+}
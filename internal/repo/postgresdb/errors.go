@@ -0,0 +1,49 @@
+package postgresdb
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+
+	"github.com/realPointer/segments/internal/repo/repoerrs"
+)
+
+// classify maps pgx and postgres errors onto repoerrs kinds. Errors of
+// other kinds are returned unchanged. The message of the kind is fixed, as
+// the detail of a postgres error names tables, columns and values; that stays
+// in the wrapped error.
+func classify(err error) error {
+	if errors.Is(err, pgx.ErrNoRows) {
+		return repoerrs.New(repoerrs.ErrNotFound, "not found", err)
+	}
+
+	var pgErr *pgconn.PgError
+	if !errors.As(err, &pgErr) {
+		return err
+	}
+
+	switch {
+	case pgErr.Code == "23505": // unique_violation
+		return repoerrs.New(repoerrs.ErrAlreadyExists, "already exists", err)
+	case pgErr.Code == "23503": // foreign_key_violation
+		return repoerrs.New(repoerrs.ErrNotFound, "not found", err)
+	case pgErr.Code == "23502", pgErr.Code == "23514", strings.HasPrefix(pgErr.Code, "22"): // not_null, check, data exceptions
+		return repoerrs.New(repoerrs.ErrInvalidInput, "invalid input", err)
+	case pgErr.Code == "40001", pgErr.Code == "40P01": // serialization_failure, deadlock_detected
+		return repoerrs.New(repoerrs.ErrConflict, "conflicting concurrent change, try again", err)
+	}
+
+	return err
+}
+
+// missing works like classify, but names what was not found when err is
+// pgx.ErrNoRows.
+func missing(err error, what string) error {
+	if errors.Is(err, pgx.ErrNoRows) {
+		return repoerrs.New(repoerrs.ErrNotFound, what+" not found", err)
+	}
+
+	return classify(err)
+}
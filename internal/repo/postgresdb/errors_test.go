@@ -0,0 +1,70 @@
+package postgresdb
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/realPointer/segments/internal/repo/repoerrs"
+)
+
+func TestClassify(t *testing.T) {
+	tests := []struct {
+		name      string
+		err       error
+		wantErrIs error
+		wantMsg   string
+	}{
+		{
+			name:      "no rows",
+			err:       pgx.ErrNoRows,
+			wantErrIs: repoerrs.ErrNotFound,
+			wantMsg:   "not found",
+		},
+		{
+			name:      "unique violation",
+			err:       &pgconn.PgError{Code: "23505", Detail: "Key (name)=(AVITO) already exists."},
+			wantErrIs: repoerrs.ErrAlreadyExists,
+			wantMsg:   "already exists",
+		},
+		{
+			name:      "foreign key violation",
+			err:       &pgconn.PgError{Code: "23503", Detail: `Key (segment_name)=(AVITO) is not present in table "segments".`},
+			wantErrIs: repoerrs.ErrNotFound,
+			wantMsg:   "not found",
+		},
+		{
+			name:      "check violation",
+			err:       &pgconn.PgError{Code: "23514", Message: `new row for relation "segments" violates check constraint "segments_percentage_check"`},
+			wantErrIs: repoerrs.ErrInvalidInput,
+			wantMsg:   "invalid input",
+		},
+		{
+			name:      "serialization failure",
+			err:       &pgconn.PgError{Code: "40001", Message: "could not serialize access due to concurrent update"},
+			wantErrIs: repoerrs.ErrConflict,
+			wantMsg:   "conflicting concurrent change, try again",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			err := classify(tc.err)
+			assert.ErrorIs(t, err, tc.wantErrIs)
+			assert.ErrorIs(t, err, tc.err)
+
+			var repoErr *repoerrs.Error
+			require.True(t, errors.As(err, &repoErr))
+			assert.Equal(t, tc.wantMsg, repoErr.Msg)
+		})
+	}
+
+	t.Run("other error", func(t *testing.T) {
+		err := &pgconn.PgError{Code: "42P01"}
+		assert.Same(t, err, classify(err))
+	})
+}
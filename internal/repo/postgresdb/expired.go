@@ -3,7 +3,11 @@ package postgresdb
 import (
 	"context"
 	"fmt"
+	"time"
 
+	"github.com/Masterminds/squirrel"
+
+	"github.com/realPointer/segments/internal/entity"
 	"github.com/realPointer/segments/pkg/postgres"
 )
 
@@ -15,70 +19,91 @@ func NewExpiredRepo(pg *postgres.Postgres) *ExpiredRepo {
 	return &ExpiredRepo{pg}
 }
 
+// DeleteExpiredRows deletes the memberships past their expiry and logs an
+// expiry for each. The deleted rows are what is logged, and a read cut short
+// rolls the deletion back, so no membership goes without its log entry.
 func (r *ExpiredRepo) DeleteExpiredRows(ctx context.Context) (int, error) {
 	tx, err := r.Pool.Begin(ctx)
 	if err != nil {
-		return -1, fmt.Errorf("SegmentRepo.DeleteSegment - r.Pool.Begin: %v", err)
+		return -1, fmt.Errorf("ExpiredRepo.DeleteExpiredRows - r.Pool.Begin: %w", classify(err))
 	}
 	defer func() { _ = tx.Rollback(ctx) }()
 
 	sql, args, _ := r.Builder.
-		Select("user_id, segment_name").
-		From("user_segments").
+		Delete("user_segments").
 		Where("expire IS NOT NULL").
 		Where("expire < NOW()").
+		Suffix("RETURNING user_id, segment_name, variant, expire").
 		ToSql()
 
-	rows, err := r.Pool.Query(ctx, sql, args...)
+	rows, err := tx.Query(ctx, sql, args...)
 	if err != nil {
-		return -1, fmt.Errorf("SegmentRepo.DeleteSegment - tx.Query: %v", err)
+		return -1, fmt.Errorf("ExpiredRepo.DeleteExpiredRows - tx.Query: %w", classify(err))
 	}
+	defer rows.Close()
 
 	type userSegment struct {
 		userID      int
 		segmentName string
+		variant     string
+		expire      time.Time
 	}
 
 	userSegments := make([]userSegment, 0)
 
 	for rows.Next() {
 		var userSegment userSegment
-		err := rows.Scan(&userSegment.userID, &userSegment.segmentName)
+		err := rows.Scan(&userSegment.userID, &userSegment.segmentName, &userSegment.variant, &userSegment.expire)
 		if err != nil {
-			return -1, fmt.Errorf("SegmentRepo.DeleteSegment - rows.Scan: %v", err)
+			return -1, fmt.Errorf("ExpiredRepo.DeleteExpiredRows - rows.Scan: %w", classify(err))
 		}
 
 		userSegments = append(userSegments, userSegment)
 	}
 
-	sql, args, _ = r.Builder.
-		Delete("user_segments").
-		Where("expire IS NOT NULL").
-		Where("expire < NOW()").
-		ToSql()
-
-	_, err = tx.Exec(ctx, sql, args...)
+	err = rows.Err()
 	if err != nil {
-		return -1, fmt.Errorf("SegmentRepo.DeleteSegment - tx.Exec: %v", err)
+		return -1, fmt.Errorf("ExpiredRepo.DeleteExpiredRows - rows.Err: %w", classify(err))
 	}
 
+	// The membership ended when it expired, not when the scheduler noticed,
+	// and is logged as an expiry to tell it apart from removals.
+	// expire is a wall-clock TIMESTAMP, so it is cast back to one and read
+	// in the same time zone as NOW() above.
 	for _, userSegment := range userSegments {
 		sql, args, _ = r.Builder.
 			Insert("user_segments_log").
-			Columns("user_id", "segment_name", "operation").
-			Values(userSegment.userID, userSegment.segmentName, "delete").
+			Columns("user_id", "segment_name", "variant", "operation", "operation_time", "source").
+			Values(userSegment.userID, userSegment.segmentName, userSegment.variant, entity.OperationExpire, squirrel.Expr("?::timestamp", userSegment.expire), entity.SourceExpire).
 			ToSql()
 
 		_, err = tx.Exec(ctx, sql, args...)
 		if err != nil {
-			return -1, fmt.Errorf("SegmentRepo.DeleteSegment - tx.Exec: %v", err)
+			return -1, fmt.Errorf("ExpiredRepo.DeleteExpiredRows - tx.Exec: %w", classify(err))
 		}
 	}
 
 	err = tx.Commit(ctx)
 	if err != nil {
-		return -1, fmt.Errorf("SegmentRepo.DeleteSegment - tx.Commit: %v", err)
+		return -1, fmt.Errorf("ExpiredRepo.DeleteExpiredRows - tx.Commit: %w", classify(err))
 	}
 
 	return len(userSegments), nil
 }
+
+// DeleteExpiredIdempotencyKeys deletes the idempotency keys taken more than
+// a day ago. Such keys are already free to be taken again, deleting them
+// only keeps the table small.
+func (r *ExpiredRepo) DeleteExpiredIdempotencyKeys(ctx context.Context) (int, error) {
+	sql, args, _ := r.Builder.
+		Delete("idempotency_keys").
+		Where("created_at < NOW() - INTERVAL '1 day'").
+		ToSql()
+
+	tag, err := r.Pool.Exec(ctx, sql, args...)
+	if err != nil {
+		return -1, fmt.Errorf("ExpiredRepo.DeleteExpiredIdempotencyKeys - r.Pool.Exec: %w", classify(err))
+	}
+
+	return int(tag.RowsAffected()), nil
+}
@@ -4,9 +4,11 @@ import (
 	"context"
 	"errors"
 	"testing"
+	"time"
 
 	"github.com/Masterminds/squirrel"
 	"github.com/pashagolub/pgxmock/v3"
+	"github.com/realPointer/segments/internal/entity"
 	"github.com/realPointer/segments/pkg/postgres"
 	"github.com/stretchr/testify/assert"
 )
@@ -18,6 +20,8 @@ func TestExpiredRepo_DeleteExpiredRows(t *testing.T) {
 
 	type MockBehavior func(m pgxmock.PgxPoolIface, args args)
 
+	expire := time.Date(2023, 8, 31, 12, 0, 0, 0, time.UTC)
+
 	testCases := []struct {
 		name         string
 		args         args
@@ -32,12 +36,10 @@ func TestExpiredRepo_DeleteExpiredRows(t *testing.T) {
 			},
 			mockBehavior: func(m pgxmock.PgxPoolIface, args args) {
 				m.ExpectBegin()
-				m.ExpectQuery("SELECT user_id, segment_name FROM user_segments WHERE expire IS NOT NULL AND expire < NOW()").
-					WillReturnRows(pgxmock.NewRows([]string{"user_id", "segment_name"}).AddRow(1, "segment1"))
-				m.ExpectExec("DELETE FROM user_segments WHERE expire IS NOT NULL AND expire < NOW()").
-					WillReturnResult(pgxmock.NewResult("DELETE", 1))
+				m.ExpectQuery("DELETE FROM user_segments WHERE expire IS NOT NULL AND expire < NOW\\(\\) RETURNING user_id, segment_name, variant, expire").
+					WillReturnRows(pgxmock.NewRows([]string{"user_id", "segment_name", "variant", "expire"}).AddRow(1, "segment1", "", expire))
 				m.ExpectExec("INSERT INTO user_segments_log").
-					WithArgs(1, "segment1", "delete").
+					WithArgs(1, "segment1", "", entity.OperationExpire, expire, entity.SourceExpire).
 					WillReturnResult(pgxmock.NewResult("INSERT", 1))
 				m.ExpectCommit()
 			},
@@ -62,7 +64,7 @@ func TestExpiredRepo_DeleteExpiredRows(t *testing.T) {
 			},
 			mockBehavior: func(m pgxmock.PgxPoolIface, args args) {
 				m.ExpectBegin()
-				m.ExpectQuery("SELECT user_id, segment_name FROM user_segments WHERE expire IS NOT NULL AND expire < NOW()").
+				m.ExpectQuery("DELETE FROM user_segments WHERE expire IS NOT NULL AND expire < NOW\\(\\) RETURNING user_id, segment_name, variant, expire").
 					WillReturnError(errors.New("query error"))
 				m.ExpectRollback()
 			},
@@ -75,23 +77,21 @@ func TestExpiredRepo_DeleteExpiredRows(t *testing.T) {
 			},
 			mockBehavior: func(m pgxmock.PgxPoolIface, args args) {
 				m.ExpectBegin()
-				m.ExpectQuery("SELECT user_id, segment_name FROM user_segments WHERE expire IS NOT NULL AND expire < NOW()").
-					WillReturnRows(pgxmock.NewRows([]string{"user_id", "segment_name"}).AddRow(1, "segment1").RowError(0, errors.New("rows.Scan error")))
+				m.ExpectQuery("DELETE FROM user_segments WHERE expire IS NOT NULL AND expire < NOW\\(\\) RETURNING user_id, segment_name, variant, expire").
+					WillReturnRows(pgxmock.NewRows([]string{"user_id", "segment_name", "variant", "expire"}).AddRow(1, "segment1", "", expire).RowError(0, errors.New("rows.Scan error")))
 				m.ExpectRollback()
 			},
 			wantErr: true,
 		},
 		{
-			name: "Delete user_segments tx.Exec error",
+			name: "rows.Err error",
 			args: args{
 				ctx: context.Background(),
 			},
 			mockBehavior: func(m pgxmock.PgxPoolIface, args args) {
 				m.ExpectBegin()
-				m.ExpectQuery("SELECT user_id, segment_name FROM user_segments WHERE expire IS NOT NULL AND expire < NOW()").
-					WillReturnRows(pgxmock.NewRows([]string{"user_id", "segment_name"}).AddRow(1, "segment1"))
-				m.ExpectExec("DELETE FROM user_segments WHERE expire IS NOT NULL AND expire < NOW()").
-					WillReturnError(errors.New("tx.Exec error"))
+				m.ExpectQuery("DELETE FROM user_segments WHERE expire IS NOT NULL AND expire < NOW\\(\\) RETURNING user_id, segment_name, variant, expire").
+					WillReturnRows(pgxmock.NewRows([]string{"user_id", "segment_name", "variant", "expire"}).AddRow(1, "segment1", "", expire).RowError(1, errors.New("conn closed")))
 				m.ExpectRollback()
 			},
 			wantErr: true,
@@ -103,12 +103,10 @@ func TestExpiredRepo_DeleteExpiredRows(t *testing.T) {
 			},
 			mockBehavior: func(m pgxmock.PgxPoolIface, args args) {
 				m.ExpectBegin()
-				m.ExpectQuery("SELECT user_id, segment_name FROM user_segments WHERE expire IS NOT NULL AND expire < NOW()").
-					WillReturnRows(pgxmock.NewRows([]string{"user_id", "segment_name"}).AddRow(1, "segment1"))
-				m.ExpectExec("DELETE FROM user_segments WHERE expire IS NOT NULL AND expire < NOW()").
-					WillReturnResult(pgxmock.NewResult("DELETE", 1))
+				m.ExpectQuery("DELETE FROM user_segments WHERE expire IS NOT NULL AND expire < NOW\\(\\) RETURNING user_id, segment_name, variant, expire").
+					WillReturnRows(pgxmock.NewRows([]string{"user_id", "segment_name", "variant", "expire"}).AddRow(1, "segment1", "", expire))
 				m.ExpectExec("INSERT INTO user_segments_log").
-					WithArgs(1, "segment1", "delete").
+					WithArgs(1, "segment1", "", entity.OperationExpire, expire, entity.SourceExpire).
 					WillReturnError(errors.New("tx.Exec error"))
 				m.ExpectRollback()
 			},
@@ -121,12 +119,10 @@ func TestExpiredRepo_DeleteExpiredRows(t *testing.T) {
 			},
 			mockBehavior: func(m pgxmock.PgxPoolIface, args args) {
 				m.ExpectBegin()
-				m.ExpectQuery("SELECT user_id, segment_name FROM user_segments WHERE expire IS NOT NULL AND expire < NOW()").
-					WillReturnRows(pgxmock.NewRows([]string{"user_id", "segment_name"}).AddRow(1, "segment1"))
-				m.ExpectExec("DELETE FROM user_segments WHERE expire IS NOT NULL AND expire < NOW()").
-					WillReturnResult(pgxmock.NewResult("DELETE", 1))
+				m.ExpectQuery("DELETE FROM user_segments WHERE expire IS NOT NULL AND expire < NOW\\(\\) RETURNING user_id, segment_name, variant, expire").
+					WillReturnRows(pgxmock.NewRows([]string{"user_id", "segment_name", "variant", "expire"}).AddRow(1, "segment1", "", expire))
 				m.ExpectExec("INSERT INTO user_segments_log").
-					WithArgs(1, "segment1", "delete").
+					WithArgs(1, "segment1", "", entity.OperationExpire, expire, entity.SourceExpire).
 					WillReturnResult(pgxmock.NewResult("INSERT", 1))
 				m.ExpectCommit().WillReturnError(errors.New("commit error"))
 				m.ExpectRollback()
@@ -160,3 +156,56 @@ func TestExpiredRepo_DeleteExpiredRows(t *testing.T) {
 		})
 	}
 }
+
+func TestExpiredRepo_DeleteExpiredIdempotencyKeys(t *testing.T) {
+	type MockBehavior func(m pgxmock.PgxPoolIface)
+
+	testCases := []struct {
+		name         string
+		mockBehavior MockBehavior
+		want         int
+		wantErr      bool
+	}{
+		{
+			name: "OK",
+			mockBehavior: func(m pgxmock.PgxPoolIface) {
+				m.ExpectExec("DELETE FROM idempotency_keys WHERE created_at < NOW\\(\\) - INTERVAL '1 day'").
+					WillReturnResult(pgxmock.NewResult("DELETE", 2))
+			},
+			want: 2,
+		},
+		{
+			name: "r.Pool.Exec error",
+			mockBehavior: func(m pgxmock.PgxPoolIface) {
+				m.ExpectExec("DELETE FROM idempotency_keys").
+					WillReturnError(errors.New("exec error"))
+			},
+			wantErr: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			poolMock, _ := pgxmock.NewPool()
+			defer poolMock.Close()
+			tc.mockBehavior(poolMock)
+
+			postgresMock := &postgres.Postgres{
+				Builder: squirrel.StatementBuilder.PlaceholderFormat(squirrel.Dollar),
+				Pool:    poolMock,
+			}
+			expiredRepoMock := NewExpiredRepo(postgresMock)
+
+			got, err := expiredRepoMock.DeleteExpiredIdempotencyKeys(context.Background())
+			if tc.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+
+			err = poolMock.ExpectationsWereMet()
+			assert.NoError(t, err)
+			assert.Equal(t, tc.want, got)
+		})
+	}
+}
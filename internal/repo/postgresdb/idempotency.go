@@ -0,0 +1,101 @@
+package postgresdb
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+
+	"github.com/Masterminds/squirrel"
+	"github.com/jackc/pgx/v5"
+
+	"github.com/realPointer/segments/internal/entity"
+	"github.com/realPointer/segments/internal/repo/repoerrs"
+)
+
+// hashSegmentsRequest returns the hex SHA-256 of a request changing the
+// segments of the user, to tell retries apart from other requests reusing
+// their idempotency key.
+func hashSegmentsRequest(userId int, addSegments []entity.AddSegment, removeSegments []string) string {
+	data, _ := json.Marshal(struct {
+		UserID         int                 `json:"user_id"`
+		AddSegments    []entity.AddSegment `json:"add_segments"`
+		RemoveSegments []string            `json:"remove_segments"`
+	}{userId, addSegments, removeSegments})
+	sum := sha256.Sum256(data)
+
+	return hex.EncodeToString(sum[:])
+}
+
+// claimIdempotencyKey takes the idempotency key of the caller for the
+// request in tx. A key taken more than a day ago is free again, whether or
+// not the scheduler has deleted it yet. When the key is already taken, it
+// reports the request as replayed and returns the outcome stored for it,
+// after waiting for the request holding the key to finish. A key taken by a
+// different request is a conflict.
+func (r *UserRepo) claimIdempotencyKey(ctx context.Context, tx pgx.Tx, key, requestHash string) ([]entity.SegmentChange, bool, error) {
+	caller := actor(ctx)
+
+	sql, args, _ := r.Builder.
+		Insert("idempotency_keys").
+		Columns("actor", "key", "request_hash").
+		Values(caller, key, requestHash).
+		Suffix("ON CONFLICT (actor, key) DO UPDATE SET request_hash = EXCLUDED.request_hash, response = NULL, created_at = NOW() " +
+			"WHERE idempotency_keys.created_at < NOW() - INTERVAL '1 day'").
+		ToSql()
+
+	tag, err := tx.Exec(ctx, sql, args...)
+	if err != nil {
+		return nil, false, fmt.Errorf("tx.Exec: %w", classify(err))
+	}
+	if tag.RowsAffected() == 1 {
+		return nil, false, nil
+	}
+
+	sql, args, _ = r.Builder.
+		Select("request_hash", "response").
+		From("idempotency_keys").
+		Where(squirrel.Eq{"actor": caller, "key": key}).
+		ToSql()
+
+	var storedHash string
+	var response []byte
+	err = tx.QueryRow(ctx, sql, args...).Scan(&storedHash, &response)
+	if err != nil {
+		return nil, false, fmt.Errorf("tx.QueryRow: %w", classify(err))
+	}
+	if storedHash != requestHash {
+		return nil, false, repoerrs.New(repoerrs.ErrConflict, fmt.Sprintf("idempotency key %q was used for a different request", key), nil)
+	}
+
+	var changes []entity.SegmentChange
+	err = json.Unmarshal(response, &changes)
+	if err != nil {
+		return nil, false, fmt.Errorf("json.Unmarshal: %w", err)
+	}
+
+	return changes, true, nil
+}
+
+// storeIdempotentResult keeps the outcome of the request holding the
+// idempotency key of the caller, for retries to get it back.
+func (r *UserRepo) storeIdempotentResult(ctx context.Context, tx pgx.Tx, key string, changes []entity.SegmentChange) error {
+	response, err := json.Marshal(changes)
+	if err != nil {
+		return fmt.Errorf("json.Marshal: %w", err)
+	}
+
+	sql, args, _ := r.Builder.
+		Update("idempotency_keys").
+		Set("response", string(response)).
+		Where(squirrel.Eq{"actor": actor(ctx), "key": key}).
+		ToSql()
+
+	_, err = tx.Exec(ctx, sql, args...)
+	if err != nil {
+		return fmt.Errorf("tx.Exec: %w", classify(err))
+	}
+
+	return nil
+}
@@ -0,0 +1,209 @@
+package postgresdb
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/Masterminds/squirrel"
+	"github.com/jackc/pgx/v5"
+
+	"github.com/realPointer/segments/internal/entity"
+	"github.com/realPointer/segments/internal/repo/repoerrs"
+	"github.com/realPointer/segments/pkg/postgres"
+)
+
+var reportColumns = []string{"id", "kind", "COALESCE(user_id, 0)", "segment", "COALESCE(segment_id, 0)", "date_from", "date_to", "format", "status", "url", "error", "attempts", "created_at", "started_at", "finished_at"}
+
+type ReportRepo struct {
+	*postgres.Postgres
+}
+
+func NewReportRepo(pg *postgres.Postgres) *ReportRepo {
+	return &ReportRepo{pg}
+}
+
+func scanReportJob(row pgx.Row) (entity.ReportJob, error) {
+	var job entity.ReportJob
+	err := row.Scan(&job.ID, &job.Kind, &job.UserID, &job.Segment, &job.SegmentID, &job.From, &job.To, &job.Format, &job.Status,
+		&job.URL, &job.Error, &job.Attempts, &job.CreatedAt, &job.StartedAt, &job.FinishedAt)
+
+	return job, err
+}
+
+// CreateReportJob queues a report. The kind defaults to the operations of
+// the user and the format to csv.
+func (r *ReportRepo) CreateReportJob(ctx context.Context, job entity.ReportJob) (entity.ReportJob, error) {
+	err := validateReportJob(&job)
+	if err != nil {
+		return entity.ReportJob{}, fmt.Errorf("ReportRepo.CreateReportJob - %w", err)
+	}
+
+	// Users are checked by the foreign key, segments only here: the job
+	// follows the segment through renames, but outlives it, and a segment
+	// deleted meanwhile fails the job when it runs.
+	var segmentID *int64
+	if job.Kind != entity.ReportUserOperations {
+		sql, args, _ := r.Builder.
+			Select("id").
+			From("segments").
+			Where(squirrel.Eq{"name": job.Segment}).
+			ToSql()
+
+		var id int64
+		err = r.Pool.QueryRow(ctx, sql, args...).Scan(&id)
+		if err != nil {
+			return entity.ReportJob{}, fmt.Errorf("ReportRepo.CreateReportJob - r.Pool.QueryRow: %w", missing(err, fmt.Sprintf("segment %q", job.Segment)))
+		}
+		segmentID = &id
+	}
+
+	var userID *int
+	if job.UserID != 0 {
+		userID = &job.UserID
+	}
+
+	sql, args, _ := r.Builder.
+		Insert("report_jobs").
+		Columns("kind", "user_id", "segment", "segment_id", "date_from", "date_to", "format").
+		Values(job.Kind, userID, job.Segment, segmentID, job.From, job.To, job.Format).
+		Suffix("RETURNING " + strings.Join(reportColumns, ", ")).
+		ToSql()
+
+	job, err = scanReportJob(r.Pool.QueryRow(ctx, sql, args...))
+	if err != nil {
+		return entity.ReportJob{}, fmt.Errorf("ReportRepo.CreateReportJob - r.Pool.QueryRow: %w", classify(err))
+	}
+
+	return job, nil
+}
+
+// validateReportJob fills in the defaults of job and checks that its fields
+// fit its kind.
+func validateReportJob(job *entity.ReportJob) error {
+	invalid := func(msg string) error {
+		return repoerrs.New(repoerrs.ErrInvalidInput, msg, nil)
+	}
+
+	switch job.Format {
+	case "":
+		job.Format = entity.FormatCSV
+	case entity.FormatCSV, entity.FormatJSON, entity.FormatNDJSON:
+	default:
+		return invalid(fmt.Sprintf("unknown format %q, expected %s, %s or %s", job.Format, entity.FormatCSV, entity.FormatJSON, entity.FormatNDJSON))
+	}
+
+	switch job.Kind {
+	case "", entity.ReportUserOperations:
+		job.Kind = entity.ReportUserOperations
+		if job.UserID <= 0 {
+			return invalid("user_id is required")
+		}
+	case entity.ReportSegmentMembers, entity.ReportSegmentOperations, entity.ReportSegmentDaily:
+		if job.Segment == "" {
+			return invalid("segment is required")
+		}
+		if job.UserID != 0 {
+			return invalid(job.Kind + " reports don't take a user_id")
+		}
+		if job.Kind == entity.ReportSegmentMembers && (job.From != nil || job.To != nil) {
+			return invalid("segment_members reports list the current members and don't take a period")
+		}
+	default:
+		return invalid(fmt.Sprintf("unknown kind %q, expected %s, %s, %s or %s", job.Kind,
+			entity.ReportUserOperations, entity.ReportSegmentMembers, entity.ReportSegmentOperations, entity.ReportSegmentDaily))
+	}
+
+	if job.From != nil && job.To != nil && !job.From.Before(*job.To) {
+		return invalid("from must be before to")
+	}
+
+	return nil
+}
+
+func (r *ReportRepo) GetReportJob(ctx context.Context, id int64) (entity.ReportJob, error) {
+	sql, args, _ := r.Builder.
+		Select(reportColumns...).
+		From("report_jobs").
+		Where(squirrel.Eq{"id": id}).
+		ToSql()
+
+	job, err := scanReportJob(r.Pool.QueryRow(ctx, sql, args...))
+	if err != nil {
+		return entity.ReportJob{}, fmt.Errorf("ReportRepo.GetReportJob - r.Pool.QueryRow: %w", missing(err, fmt.Sprintf("report %d", id)))
+	}
+
+	return job, nil
+}
+
+// ClaimReportJob takes the oldest job that is due and leases it for lease.
+// Running jobs whose lease ran out are due again, their worker is assumed to
+// be gone. It reports false when no job is due.
+func (r *ReportRepo) ClaimReportJob(ctx context.Context, lease time.Duration) (entity.ReportJob, bool, error) {
+	sql, args, _ := r.Builder.
+		Update("report_jobs").
+		Set("status", entity.ReportRunning).
+		Set("attempts", squirrel.Expr("attempts + 1")).
+		Set("started_at", squirrel.Expr("NOW()")).
+		Set("run_after", squirrel.Expr("NOW() + ? * INTERVAL '1 second'", int(lease.Seconds()))).
+		Where("id = (SELECT id FROM report_jobs WHERE status IN ('pending', 'running') AND run_after <= NOW() " +
+			"ORDER BY run_after, id LIMIT 1 FOR UPDATE SKIP LOCKED)").
+		Suffix("RETURNING " + strings.Join(reportColumns, ", ")).
+		ToSql()
+
+	job, err := scanReportJob(r.Pool.QueryRow(ctx, sql, args...))
+	if errors.Is(err, pgx.ErrNoRows) {
+		return entity.ReportJob{}, false, nil
+	}
+	if err != nil {
+		return entity.ReportJob{}, false, fmt.Errorf("ReportRepo.ClaimReportJob - r.Pool.QueryRow: %w", classify(err))
+	}
+
+	return job, true, nil
+}
+
+func (r *ReportRepo) CompleteReportJob(ctx context.Context, id int64, url string) error {
+	return r.finish(ctx, "ReportRepo.CompleteReportJob", r.Builder.
+		Update("report_jobs").
+		Set("status", entity.ReportDone).
+		Set("url", url).
+		Set("error", "").
+		Set("finished_at", squirrel.Expr("NOW()")).
+		Where(squirrel.Eq{"id": id}))
+}
+
+// RetryReportJob records why the attempt at the job failed and queues it
+// again after delay.
+func (r *ReportRepo) RetryReportJob(ctx context.Context, id int64, reason string, delay time.Duration) error {
+	return r.finish(ctx, "ReportRepo.RetryReportJob", r.Builder.
+		Update("report_jobs").
+		Set("status", entity.ReportPending).
+		Set("error", reason).
+		Set("run_after", squirrel.Expr("NOW() + ? * INTERVAL '1 second'", int(delay.Seconds()))).
+		Where(squirrel.Eq{"id": id}))
+}
+
+func (r *ReportRepo) FailReportJob(ctx context.Context, id int64, reason string) error {
+	return r.finish(ctx, "ReportRepo.FailReportJob", r.Builder.
+		Update("report_jobs").
+		Set("status", entity.ReportFailed).
+		Set("error", reason).
+		Set("finished_at", squirrel.Expr("NOW()")).
+		Where(squirrel.Eq{"id": id}))
+}
+
+func (r *ReportRepo) finish(ctx context.Context, method string, update squirrel.UpdateBuilder) error {
+	sql, args, _ := update.ToSql()
+
+	tag, err := r.Pool.Exec(ctx, sql, args...)
+	if err != nil {
+		return fmt.Errorf("%s - r.Pool.Exec: %w", method, classify(err))
+	}
+	if tag.RowsAffected() == 0 {
+		return fmt.Errorf("%s - %w", method, repoerrs.New(repoerrs.ErrNotFound, "report not found", nil))
+	}
+
+	return nil
+}
@@ -0,0 +1,311 @@
+package postgresdb
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/Masterminds/squirrel"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/pashagolub/pgxmock/v3"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/realPointer/segments/internal/entity"
+	"github.com/realPointer/segments/internal/repo/repoerrs"
+	"github.com/realPointer/segments/pkg/postgres"
+)
+
+var reportRows = []string{"id", "kind", "user_id", "segment", "segment_id", "date_from", "date_to", "format", "status", "url", "error", "attempts", "created_at", "started_at", "finished_at"}
+
+func newReportRepoMock(poolMock pgxmock.PgxPoolIface) *ReportRepo {
+	return NewReportRepo(&postgres.Postgres{
+		Builder: squirrel.StatementBuilder.PlaceholderFormat(squirrel.Dollar),
+		Pool:    poolMock,
+	})
+}
+
+func TestReportRepo_CreateReportJob(t *testing.T) {
+	type args struct {
+		ctx context.Context
+		job entity.ReportJob
+	}
+
+	type MockBehavior func(m pgxmock.PgxPoolIface, args args)
+
+	from := time.Date(2023, 8, 1, 0, 0, 0, 0, time.UTC)
+	to := from.AddDate(0, 1, 0)
+	created := time.Date(2023, 9, 1, 12, 0, 0, 0, time.UTC)
+	segmentID := int64(3)
+
+	testCases := []struct {
+		name         string
+		args         args
+		mockBehavior MockBehavior
+		want         entity.ReportJob
+		wantErr      bool
+		wantErrIs    error
+	}{
+		{
+			name: "OK",
+			args: args{
+				ctx: context.Background(),
+				job: entity.ReportJob{UserID: 1, Segment: "segment1", From: &from, To: &to},
+			},
+			mockBehavior: func(m pgxmock.PgxPoolIface, args args) {
+				m.ExpectQuery("INSERT INTO report_jobs \\(kind,user_id,segment,segment_id,date_from,date_to,format\\) VALUES \\(\\$1,\\$2,\\$3,\\$4,\\$5,\\$6,\\$7\\) RETURNING id, kind, COALESCE\\(user_id, 0\\), segment, COALESCE\\(segment_id, 0\\)").
+					WithArgs("user_operations", &args.job.UserID, "segment1", (*int64)(nil), &from, &to, "csv").
+					WillReturnRows(pgxmock.NewRows(reportRows).
+						AddRow(int64(7), "user_operations", 1, "segment1", int64(0), &from, &to, "csv", "pending", "", "", 0, created, nil, nil))
+			},
+			want: entity.ReportJob{ID: 7, Kind: "user_operations", UserID: 1, Segment: "segment1", From: &from, To: &to, Format: "csv", Status: "pending", CreatedAt: created},
+		},
+		{
+			name: "segment report",
+			args: args{
+				ctx: context.Background(),
+				job: entity.ReportJob{Kind: "segment_daily", Segment: "segment1", From: &from, Format: "json"},
+			},
+			mockBehavior: func(m pgxmock.PgxPoolIface, args args) {
+				m.ExpectQuery("SELECT id FROM segments WHERE name = \\$1").
+					WithArgs("segment1").
+					WillReturnRows(pgxmock.NewRows([]string{"id"}).AddRow(int64(3)))
+				m.ExpectQuery("INSERT INTO report_jobs").
+					WithArgs("segment_daily", (*int)(nil), "segment1", &segmentID, &from, (*time.Time)(nil), "json").
+					WillReturnRows(pgxmock.NewRows(reportRows).
+						AddRow(int64(8), "segment_daily", 0, "segment1", int64(3), &from, nil, "json", "pending", "", "", 0, created, nil, nil))
+			},
+			want: entity.ReportJob{ID: 8, Kind: "segment_daily", Segment: "segment1", SegmentID: 3, From: &from, Format: "json", Status: "pending", CreatedAt: created},
+		},
+		{
+			name: "segment not found",
+			args: args{
+				ctx: context.Background(),
+				job: entity.ReportJob{Kind: "segment_members", Segment: "segment1"},
+			},
+			mockBehavior: func(m pgxmock.PgxPoolIface, args args) {
+				m.ExpectQuery("SELECT id FROM segments WHERE name = \\$1").
+					WithArgs("segment1").
+					WillReturnError(pgx.ErrNoRows)
+			},
+			wantErr:   true,
+			wantErrIs: repoerrs.ErrNotFound,
+		},
+		{
+			name: "missing user",
+			args: args{
+				ctx: context.Background(),
+				job: entity.ReportJob{Segment: "segment1"},
+			},
+			mockBehavior: func(m pgxmock.PgxPoolIface, args args) {},
+			wantErr:      true,
+			wantErrIs:    repoerrs.ErrInvalidInput,
+		},
+		{
+			name: "members with a period",
+			args: args{
+				ctx: context.Background(),
+				job: entity.ReportJob{Kind: "segment_members", Segment: "segment1", From: &from},
+			},
+			mockBehavior: func(m pgxmock.PgxPoolIface, args args) {},
+			wantErr:      true,
+			wantErrIs:    repoerrs.ErrInvalidInput,
+		},
+		{
+			name: "unknown kind",
+			args: args{
+				ctx: context.Background(),
+				job: entity.ReportJob{Kind: "segment_weekly", Segment: "segment1"},
+			},
+			mockBehavior: func(m pgxmock.PgxPoolIface, args args) {},
+			wantErr:      true,
+			wantErrIs:    repoerrs.ErrInvalidInput,
+		},
+		{
+			name: "unknown format",
+			args: args{
+				ctx: context.Background(),
+				job: entity.ReportJob{UserID: 1, Format: "xlsx"},
+			},
+			mockBehavior: func(m pgxmock.PgxPoolIface, args args) {},
+			wantErr:      true,
+			wantErrIs:    repoerrs.ErrInvalidInput,
+		},
+		{
+			name: "from after to",
+			args: args{
+				ctx: context.Background(),
+				job: entity.ReportJob{UserID: 1, From: &to, To: &from},
+			},
+			mockBehavior: func(m pgxmock.PgxPoolIface, args args) {},
+			wantErr:      true,
+			wantErrIs:    repoerrs.ErrInvalidInput,
+		},
+		{
+			name: "user not found",
+			args: args{
+				ctx: context.Background(),
+				job: entity.ReportJob{UserID: 1, Format: "json"},
+			},
+			mockBehavior: func(m pgxmock.PgxPoolIface, args args) {
+				m.ExpectQuery("INSERT INTO report_jobs").
+					WithArgs("user_operations", &args.job.UserID, "", (*int64)(nil), (*time.Time)(nil), (*time.Time)(nil), "json").
+					WillReturnError(&pgconn.PgError{Code: "23503", ConstraintName: "report_jobs_user_id_fkey"})
+			},
+			wantErr:   true,
+			wantErrIs: repoerrs.ErrNotFound,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			poolMock, _ := pgxmock.NewPool()
+			defer poolMock.Close()
+			tc.mockBehavior(poolMock, tc.args)
+
+			got, err := newReportRepoMock(poolMock).CreateReportJob(tc.args.ctx, tc.args.job)
+			if tc.wantErr {
+				assert.Error(t, err)
+				if tc.wantErrIs != nil {
+					assert.ErrorIs(t, err, tc.wantErrIs)
+				}
+				return
+			}
+			assert.NoError(t, err)
+
+			err = poolMock.ExpectationsWereMet()
+			assert.NoError(t, err)
+			assert.Equal(t, tc.want, got)
+		})
+	}
+}
+
+func TestReportRepo_GetReportJob(t *testing.T) {
+	poolMock, _ := pgxmock.NewPool()
+	defer poolMock.Close()
+
+	poolMock.ExpectQuery("SELECT id, kind, COALESCE\\(user_id, 0\\), segment, COALESCE\\(segment_id, 0\\), date_from, date_to, format, status, url, error, attempts, created_at, started_at, finished_at FROM report_jobs WHERE id = \\$1").
+		WithArgs(int64(7)).
+		WillReturnError(pgx.ErrNoRows)
+
+	_, err := newReportRepoMock(poolMock).GetReportJob(context.Background(), 7)
+	assert.ErrorIs(t, err, repoerrs.ErrNotFound)
+	assert.NoError(t, poolMock.ExpectationsWereMet())
+}
+
+func TestReportRepo_ClaimReportJob(t *testing.T) {
+	type MockBehavior func(m pgxmock.PgxPoolIface)
+
+	created := time.Date(2023, 9, 1, 12, 0, 0, 0, time.UTC)
+	started := created.Add(time.Minute)
+
+	testCases := []struct {
+		name         string
+		mockBehavior MockBehavior
+		want         entity.ReportJob
+		wantOK       bool
+		wantErr      bool
+	}{
+		{
+			name: "OK",
+			mockBehavior: func(m pgxmock.PgxPoolIface) {
+				m.ExpectQuery("UPDATE report_jobs SET status = \\$1, attempts = attempts \\+ 1, started_at = NOW\\(\\), run_after = NOW\\(\\) \\+ \\$2 \\* INTERVAL '1 second' "+
+					"WHERE id = \\(SELECT id FROM report_jobs WHERE status IN \\('pending', 'running'\\) AND run_after <= NOW\\(\\) ORDER BY run_after, id LIMIT 1 FOR UPDATE SKIP LOCKED\\) RETURNING id").
+					WithArgs("running", 600).
+					WillReturnRows(pgxmock.NewRows(reportRows).
+						AddRow(int64(7), "user_operations", 1, "", int64(0), nil, nil, "csv", "running", "", "", 1, created, &started, nil))
+			},
+			want:   entity.ReportJob{ID: 7, Kind: "user_operations", UserID: 1, Format: "csv", Status: "running", Attempts: 1, CreatedAt: created, StartedAt: &started},
+			wantOK: true,
+		},
+		{
+			name: "no job due",
+			mockBehavior: func(m pgxmock.PgxPoolIface) {
+				m.ExpectQuery("UPDATE report_jobs").
+					WithArgs("running", 600).
+					WillReturnError(pgx.ErrNoRows)
+			},
+		},
+		{
+			name: "r.Pool.QueryRow error",
+			mockBehavior: func(m pgxmock.PgxPoolIface) {
+				m.ExpectQuery("UPDATE report_jobs").
+					WithArgs("running", 600).
+					WillReturnError(errors.New("some error"))
+			},
+			wantErr: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			poolMock, _ := pgxmock.NewPool()
+			defer poolMock.Close()
+			tc.mockBehavior(poolMock)
+
+			got, ok, err := newReportRepoMock(poolMock).ClaimReportJob(context.Background(), 10*time.Minute)
+			if tc.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+
+			err = poolMock.ExpectationsWereMet()
+			assert.NoError(t, err)
+			assert.Equal(t, tc.wantOK, ok)
+			assert.Equal(t, tc.want, got)
+		})
+	}
+}
+
+func TestReportRepo_RetryReportJob(t *testing.T) {
+	type MockBehavior func(m pgxmock.PgxPoolIface)
+
+	testCases := []struct {
+		name         string
+		mockBehavior MockBehavior
+		wantErr      bool
+		wantErrIs    error
+	}{
+		{
+			name: "OK",
+			mockBehavior: func(m pgxmock.PgxPoolIface) {
+				m.ExpectExec("UPDATE report_jobs SET status = \\$1, error = \\$2, run_after = NOW\\(\\) \\+ \\$3 \\* INTERVAL '1 second' WHERE id = \\$4").
+					WithArgs("pending", "disk is not available", 60, int64(7)).
+					WillReturnResult(pgxmock.NewResult("UPDATE", 1))
+			},
+		},
+		{
+			name: "report not found",
+			mockBehavior: func(m pgxmock.PgxPoolIface) {
+				m.ExpectExec("UPDATE report_jobs").
+					WithArgs("pending", "disk is not available", 60, int64(7)).
+					WillReturnResult(pgxmock.NewResult("UPDATE", 0))
+			},
+			wantErr:   true,
+			wantErrIs: repoerrs.ErrNotFound,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			poolMock, _ := pgxmock.NewPool()
+			defer poolMock.Close()
+			tc.mockBehavior(poolMock)
+
+			err := newReportRepoMock(poolMock).RetryReportJob(context.Background(), 7, "disk is not available", time.Minute)
+			if tc.wantErr {
+				assert.Error(t, err)
+				if tc.wantErrIs != nil {
+					assert.ErrorIs(t, err, tc.wantErrIs)
+				}
+				return
+			}
+			assert.NoError(t, err)
+
+			err = poolMock.ExpectationsWereMet()
+			assert.NoError(t, err)
+		})
+	}
+}
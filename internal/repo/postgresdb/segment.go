@@ -2,8 +2,19 @@ package postgresdb
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"math/rand"
+	"sort"
+	"strings"
+	"time"
 
+	"github.com/Masterminds/squirrel"
+	"github.com/jackc/pgx/v5"
+
+	"github.com/realPointer/segments/internal/entity"
+	"github.com/realPointer/segments/internal/repo/repoerrs"
+	"github.com/realPointer/segments/pkg/bucketing"
 	"github.com/realPointer/segments/pkg/postgres"
 )
 
@@ -15,118 +26,642 @@ func NewSegmentRepo(pg *postgres.Postgres) *SegmentRepo {
 	return &SegmentRepo{pg}
 }
 
-func (r *SegmentRepo) CreateSegment(ctx context.Context, name string) error {
+var segmentColumns = []string{"id", "name", "description", "owner", "tags", "amount", "bucketing", "salt", "layer", "bucket_offset", "variants", "rule", "created_at", "updated_at"}
+
+type scanner interface {
+	Scan(dest ...any) error
+}
+
+func scanSegment(row scanner) (entity.Segment, error) {
+	var segment entity.Segment
+	err := row.Scan(&segment.ID, &segment.Name, &segment.Description, &segment.Owner, &segment.Tags, &segment.Percentage, &segment.Bucketing, &segment.Salt, &segment.Layer, &segment.BucketOffset, &segment.Variants, &segment.Rule, &segment.CreatedAt, &segment.UpdatedAt)
+
+	return segment, err
+}
+
+func tagsOrEmpty(tags []string) []string {
+	if tags == nil {
+		return []string{}
+	}
+
+	return tags
+}
+
+func variantsOrEmpty(variants []entity.Variant) []entity.Variant {
+	if variants == nil {
+		return []entity.Variant{}
+	}
+
+	return variants
+}
+
+func validateVariants(variants []entity.Variant) error {
+	seen := make(map[string]bool, len(variants))
+	for _, v := range variants {
+		if v.Name == "" {
+			return repoerrs.New(repoerrs.ErrInvalidInput, "variant name must not be empty", nil)
+		}
+		if seen[v.Name] {
+			return repoerrs.New(repoerrs.ErrInvalidInput, fmt.Sprintf("variant %q is listed twice", v.Name), nil)
+		}
+		if v.Weight <= 0 {
+			return repoerrs.New(repoerrs.ErrInvalidInput, fmt.Sprintf("weight of variant %q must be positive", v.Name), nil)
+		}
+		seen[v.Name] = true
+	}
+
+	return nil
+}
+
+// pickVariant returns the variant of an experiment segment the user gets, or
+// an empty string for plain segments.
+func pickVariant(segment entity.Segment, userID int) string {
+	if len(segment.Variants) == 0 {
+		return ""
+	}
+
+	salt := segment.Salt
+	if salt == "" {
+		salt = segment.Name
+	}
+
+	weights := make([]int, len(segment.Variants))
+	for i, v := range segment.Variants {
+		weights[i] = v.Weight
+	}
+
+	return segment.Variants[bucketing.Variant(salt, userID, weights)].Name
+}
+
+func (r *SegmentRepo) CreateSegment(ctx context.Context, segment entity.Segment) error {
+	err := validateVariants(segment.Variants)
+	if err != nil {
+		return fmt.Errorf("SegmentRepo.CreateSegment: %w", err)
+	}
+
+	// Variants are picked by the salt, which is kept so that renaming the
+	// segment doesn't reshuffle them.
+	if len(segment.Variants) > 0 && segment.Salt == "" {
+		segment.Salt = segment.Name
+	}
+
+	if segment.Rule != "" {
+		return r.createRuleSegment(ctx, segment)
+	}
+
 	sql, args, _ := r.Builder.
 		Insert("segments").
-		Columns("name").
-		Values(name).
+		Columns("name", "description", "owner", "tags", "salt", "layer", "variants").
+		Values(segment.Name, segment.Description, segment.Owner, tagsOrEmpty(segment.Tags), segment.Salt, segment.Layer, variantsOrEmpty(segment.Variants)).
 		ToSql()
 
-	_, err := r.Pool.Exec(ctx, sql, args...)
+	_, err = r.Pool.Exec(ctx, sql, args...)
 	if err != nil {
-		return fmt.Errorf("SegmentRepo.CreateSegment - r.Pool.Exec: %v", err)
+		return fmt.Errorf("SegmentRepo.CreateSegment - r.Pool.Exec: %w", classify(err))
 	}
 
 	return nil
 }
 
-func (r *SegmentRepo) CreateSegmentAuto(ctx context.Context, name string, percentage float64) error {
+// createRuleSegment adds a rule segment together with every user matching
+// the rule.
+func (r *SegmentRepo) createRuleSegment(ctx context.Context, segment entity.Segment) error {
+	rule, err := parseRule(segment.Rule)
+	if err != nil {
+		return fmt.Errorf("SegmentRepo.CreateSegment: %w", err)
+	}
+
 	tx, err := r.Pool.Begin(ctx)
 	if err != nil {
-		return fmt.Errorf("SegmentRepo.CreateSegmentAuto - r.Pool.Begin: %v", err)
+		return fmt.Errorf("SegmentRepo.CreateSegment - r.Pool.Begin: %w", classify(err))
 	}
 	defer func() { _ = tx.Rollback(ctx) }()
 
 	sql, args, _ := r.Builder.
 		Insert("segments").
-		Columns("name", "amount").
-		Values(name, percentage).
+		Columns("name", "description", "owner", "tags", "salt", "layer", "variants", "rule").
+		Values(segment.Name, segment.Description, segment.Owner, tagsOrEmpty(segment.Tags), segment.Salt, segment.Layer, variantsOrEmpty(segment.Variants), segment.Rule).
 		ToSql()
 
 	_, err = tx.Exec(ctx, sql, args...)
 	if err != nil {
-		return fmt.Errorf("SegmentRepo.CreateSegmentAuto - r.Pool.Exec: %v", err)
+		return fmt.Errorf("SegmentRepo.CreateSegment - tx.Exec: %w", classify(err))
 	}
 
-	sql, args, _ = r.Builder.
-		Select("id").
-		From("users").
-		OrderBy("RANDOM()").
-		Limit(uint64(float64(r.countUsers(ctx)) * percentage / 100)).
+	users, err := usersWithAttributes(ctx, tx, r.Builder)
+	if err != nil {
+		return fmt.Errorf("SegmentRepo.CreateSegment - usersWithAttributes: %w", err)
+	}
+
+	add, _ := planRuleMembers(rule, users, nil)
+
+	_, err = applyMembers(ctx, tx, r.Builder, segment, entity.SourceRule, add, nil)
+	if err != nil {
+		return fmt.Errorf("SegmentRepo.CreateSegment - applyMembers: %w", err)
+	}
+
+	err = tx.Commit(ctx)
+	if err != nil {
+		return fmt.Errorf("SegmentRepo.CreateSegment - tx.Commit: %w", classify(err))
+	}
+
+	return nil
+}
+
+func (r *SegmentRepo) CreateSegmentAuto(ctx context.Context, segment entity.Segment, percentage float64) error {
+	if percentage <= 0 || percentage > 100 {
+		return fmt.Errorf("SegmentRepo.CreateSegmentAuto: %w", repoerrs.New(repoerrs.ErrInvalidInput, fmt.Sprintf("percentage must be in (0, 100], got %g", percentage), nil))
+	}
+
+	if segment.Bucketing == "" {
+		segment.Bucketing = entity.BucketingHash
+	}
+	if segment.Bucketing != entity.BucketingHash && segment.Bucketing != entity.BucketingRandom {
+		return fmt.Errorf("SegmentRepo.CreateSegmentAuto: %w", repoerrs.New(repoerrs.ErrInvalidInput, fmt.Sprintf("unknown bucketing %q", segment.Bucketing), nil))
+	}
+	err := validateVariants(segment.Variants)
+	if err != nil {
+		return fmt.Errorf("SegmentRepo.CreateSegmentAuto: %w", err)
+	}
+	if segment.Rule != "" {
+		return fmt.Errorf("SegmentRepo.CreateSegmentAuto: %w", repoerrs.New(repoerrs.ErrInvalidInput, "a segment is either auto or rule-based", nil))
+	}
+
+	if segment.Layer != "" {
+		if segment.Bucketing != entity.BucketingHash {
+			return fmt.Errorf("SegmentRepo.CreateSegmentAuto: %w", repoerrs.New(repoerrs.ErrInvalidInput, "segments of a layer must use hash bucketing", nil))
+		}
+		if segment.Salt != "" && segment.Salt != segment.Layer {
+			return fmt.Errorf("SegmentRepo.CreateSegmentAuto: %w", repoerrs.New(repoerrs.ErrInvalidInput, "segments of a layer use the layer name as salt", nil))
+		}
+		segment.Salt = segment.Layer
+	}
+	if segment.Salt == "" {
+		segment.Salt = segment.Name
+	}
+	segment.Percentage = &percentage
+
+	tx, err := r.Pool.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("SegmentRepo.CreateSegmentAuto - r.Pool.Begin: %w", classify(err))
+	}
+	defer func() { _ = tx.Rollback(ctx) }()
+
+	if segment.Layer != "" {
+		taken, err := r.layerRanges(ctx, tx, segment.Layer, segment.Name)
+		if err != nil {
+			return fmt.Errorf("SegmentRepo.CreateSegmentAuto - r.layerRanges: %w", err)
+		}
+
+		offset, ok := bucketing.FreeOffset(taken, bucketing.Threshold(percentage))
+		if !ok {
+			return fmt.Errorf("SegmentRepo.CreateSegmentAuto: %w", repoerrs.New(repoerrs.ErrConflict, fmt.Sprintf("layer %q has no room for another %g%%", segment.Layer, percentage), nil))
+		}
+		segment.BucketOffset = offset
+	}
+
+	sql, args, _ := r.Builder.
+		Insert("segments").
+		Columns("name", "description", "owner", "tags", "amount", "bucketing", "salt", "layer", "bucket_offset", "variants").
+		Values(segment.Name, segment.Description, segment.Owner, tagsOrEmpty(segment.Tags), percentage, segment.Bucketing, segment.Salt, segment.Layer, segment.BucketOffset, variantsOrEmpty(segment.Variants)).
+		ToSql()
+
+	_, err = tx.Exec(ctx, sql, args...)
+	if err != nil {
+		return fmt.Errorf("SegmentRepo.CreateSegmentAuto - r.Pool.Exec: %w", classify(err))
+	}
+
+	users, err := r.userIDs(ctx, tx)
+	if err != nil {
+		return fmt.Errorf("SegmentRepo.CreateSegmentAuto - r.userIDs: %w", err)
+	}
+
+	add, _ := planMembers(segment, users, nil)
+
+	_, err = applyMembers(ctx, tx, r.Builder, segment, entity.SourceAuto, add, nil)
+	if err != nil {
+		return fmt.Errorf("SegmentRepo.CreateSegmentAuto - applyMembers: %w", err)
+	}
+
+	err = tx.Commit(ctx)
+	if err != nil {
+		return fmt.Errorf("SegmentRepo.CreateSegmentAuto - tx.Commit: %w", classify(err))
+	}
+
+	return nil
+}
+
+// RebalanceAutoSegments brings every auto segment back to its share of all
+// users and logs every change. Hash segments get exactly the users whose
+// bucket is in range, random ones get missing members picked at random among
+// the rest of the users and extra ones dropped at random. It returns the
+// number of memberships added or removed.
+func (r *SegmentRepo) RebalanceAutoSegments(ctx context.Context) (int, error) {
+	tx, err := r.Pool.Begin(ctx)
+	if err != nil {
+		return -1, fmt.Errorf("SegmentRepo.RebalanceAutoSegments - r.Pool.Begin: %w", classify(err))
+	}
+	defer func() { _ = tx.Rollback(ctx) }()
+
+	sql, args, _ := r.Builder.
+		Select(segmentColumns...).
+		From("segments").
+		Where("amount IS NOT NULL").
+		OrderBy("name").
+		Suffix("FOR UPDATE").
 		ToSql()
 
 	rows, err := tx.Query(ctx, sql, args...)
 	if err != nil {
-		return fmt.Errorf("SegmentRepo.CreateSegmentAuto - tx.Query: %v", err)
+		return -1, fmt.Errorf("SegmentRepo.RebalanceAutoSegments - tx.Query: %w", classify(err))
 	}
+	defer rows.Close()
 
-	var userIDs []int
+	var segments []entity.Segment
 	for rows.Next() {
-		var userID int
-		err := rows.Scan(&userID)
+		segment, err := scanSegment(rows)
 		if err != nil {
-			return fmt.Errorf("SegmentRepo.CreateSegmentAuto - rows.Scan: %v", err)
+			return -1, fmt.Errorf("SegmentRepo.RebalanceAutoSegments - rows.Scan: %w", classify(err))
 		}
 
-		userIDs = append(userIDs, userID)
+		segments = append(segments, segment)
 	}
 
-	for _, userID := range userIDs {
-		sql, args, _ = r.Builder.
-			Insert("user_segments").
-			Columns("user_id", "segment_name").
-			Values(userID, name).
-			ToSql()
+	err = rows.Err()
+	if err != nil {
+		return -1, fmt.Errorf("SegmentRepo.RebalanceAutoSegments - rows.Err: %w", classify(err))
+	}
 
-		_, err := tx.Exec(ctx, sql, args...)
+	if len(segments) == 0 {
+		return 0, nil
+	}
+
+	users, err := r.userIDs(ctx, tx)
+	if err != nil {
+		return -1, fmt.Errorf("SegmentRepo.RebalanceAutoSegments - r.userIDs: %w", err)
+	}
+
+	changed := 0
+	for _, segment := range segments {
+		n, err := r.rebalance(ctx, tx, segment, users)
 		if err != nil {
-			return fmt.Errorf("SegmentRepo.CreateSegmentAuto - tx.Exec1: %v", err)
+			return -1, fmt.Errorf("SegmentRepo.RebalanceAutoSegments - r.rebalance: %w", err)
 		}
 
-		sql, args, _ = r.Builder.
-			Insert("user_segments_log").
-			Columns("user_id", "segment_name", "operation").
-			Values(userID, name, "add").
-			ToSql()
+		changed += n
+	}
+
+	err = tx.Commit(ctx)
+	if err != nil {
+		return -1, fmt.Errorf("SegmentRepo.RebalanceAutoSegments - tx.Commit: %w", classify(err))
+	}
+
+	return changed, nil
+}
+
+// rebalance brings a single auto segment to its target membership.
+func (r *SegmentRepo) rebalance(ctx context.Context, tx pgx.Tx, segment entity.Segment, users []int) (int, error) {
+	members, err := r.members(ctx, tx, segment.Name)
+	if err != nil {
+		return 0, err
+	}
+
+	add, remove := planMembers(segment, users, members)
+
+	return applyMembers(ctx, tx, r.Builder, segment, entity.SourceAuto, add, remove)
+}
+
+// RecomputeRuleSegments brings every rule segment back to the users whose
+// attributes match its rule and logs every change. It returns the number of
+// memberships added or removed.
+func (r *SegmentRepo) RecomputeRuleSegments(ctx context.Context) (int, error) {
+	tx, err := r.Pool.Begin(ctx)
+	if err != nil {
+		return -1, fmt.Errorf("SegmentRepo.RecomputeRuleSegments - r.Pool.Begin: %w", classify(err))
+	}
+	defer func() { _ = tx.Rollback(ctx) }()
+
+	sql, args, _ := r.Builder.
+		Select(segmentColumns...).
+		From("segments").
+		Where("rule <> ''").
+		OrderBy("name").
+		Suffix("FOR UPDATE").
+		ToSql()
+
+	rows, err := tx.Query(ctx, sql, args...)
+	if err != nil {
+		return -1, fmt.Errorf("SegmentRepo.RecomputeRuleSegments - tx.Query: %w", classify(err))
+	}
+	defer rows.Close()
+
+	var segments []entity.Segment
+	for rows.Next() {
+		segment, err := scanSegment(rows)
+		if err != nil {
+			return -1, fmt.Errorf("SegmentRepo.RecomputeRuleSegments - rows.Scan: %w", classify(err))
+		}
+
+		segments = append(segments, segment)
+	}
+
+	err = rows.Err()
+	if err != nil {
+		return -1, fmt.Errorf("SegmentRepo.RecomputeRuleSegments - rows.Err: %w", classify(err))
+	}
 
-		_, err = tx.Exec(ctx, sql, args...)
+	if len(segments) == 0 {
+		return 0, nil
+	}
+
+	users, err := usersWithAttributes(ctx, tx, r.Builder)
+	if err != nil {
+		return -1, fmt.Errorf("SegmentRepo.RecomputeRuleSegments - usersWithAttributes: %w", err)
+	}
+
+	changed := 0
+	for _, segment := range segments {
+		rule, err := parseRule(segment.Rule)
+		if err != nil {
+			return -1, fmt.Errorf("SegmentRepo.RecomputeRuleSegments - segment %q: %w", segment.Name, err)
+		}
+
+		members, err := r.members(ctx, tx, segment.Name)
 		if err != nil {
-			return fmt.Errorf("SegmentRepo.CreateSegmentAuto - tx.Exec2: %v", err)
+			return -1, fmt.Errorf("SegmentRepo.RecomputeRuleSegments - r.members: %w", err)
 		}
+
+		add, remove := planRuleMembers(rule, users, members)
+
+		n, err := applyMembers(ctx, tx, r.Builder, segment, entity.SourceRule, add, remove)
+		if err != nil {
+			return -1, fmt.Errorf("SegmentRepo.RecomputeRuleSegments - applyMembers: %w", err)
+		}
+
+		changed += n
 	}
 
 	err = tx.Commit(ctx)
 	if err != nil {
-		return fmt.Errorf("SegmentRepo.CreateSegmentAuto - tx.Commit: %v", err)
+		return -1, fmt.Errorf("SegmentRepo.RecomputeRuleSegments - tx.Commit: %w", classify(err))
 	}
 
-	return nil
+	return changed, nil
+}
+
+func (r *SegmentRepo) members(ctx context.Context, tx pgx.Tx, name string) ([]int, error) {
+	sql, args, _ := r.Builder.
+		Select("user_id").
+		From("user_segments").
+		Where(squirrel.Eq{"segment_name": name}).
+		ToSql()
+
+	members, err := collectIDs(tx.Query(ctx, sql, args...))
+	if err != nil {
+		return nil, fmt.Errorf("tx.Query: %w", err)
+	}
+
+	return members, nil
+}
+
+// layerRanges locks the layer and returns the bucket ranges taken by its auto
+// segments other than the given one.
+func (r *SegmentRepo) layerRanges(ctx context.Context, tx pgx.Tx, layer, except string) ([][2]int, error) {
+	_, err := tx.Exec(ctx, "SELECT pg_advisory_xact_lock(hashtext($1))", "layer:"+layer)
+	if err != nil {
+		return nil, fmt.Errorf("tx.Exec: %w", classify(err))
+	}
+
+	sql, args, _ := r.Builder.
+		Select("bucket_offset", "amount").
+		From("segments").
+		Where(squirrel.Eq{"layer": layer}).
+		Where(squirrel.NotEq{"name": except}).
+		Where("amount IS NOT NULL").
+		ToSql()
+
+	rows, err := tx.Query(ctx, sql, args...)
+	if err != nil {
+		return nil, fmt.Errorf("tx.Query: %w", classify(err))
+	}
+	defer rows.Close()
+
+	var taken [][2]int
+	for rows.Next() {
+		var offset int
+		var percentage float64
+		err := rows.Scan(&offset, &percentage)
+		if err != nil {
+			return nil, fmt.Errorf("rows.Scan: %w", classify(err))
+		}
+
+		taken = append(taken, [2]int{offset, offset + bucketing.Threshold(percentage)})
+	}
+
+	err = rows.Err()
+	if err != nil {
+		return nil, fmt.Errorf("rows.Err: %w", classify(err))
+	}
+
+	return taken, nil
 }
 
-func (r *SegmentRepo) countUsers(ctx context.Context) int {
+func (r *SegmentRepo) userIDs(ctx context.Context, tx pgx.Tx) ([]int, error) {
 	sql, args, _ := r.Builder.
-		Select("count(*)").
+		Select("id").
 		From("users").
+		OrderBy("id").
+		ToSql()
+
+	ids, err := collectIDs(tx.Query(ctx, sql, args...))
+	if err != nil {
+		return nil, fmt.Errorf("tx.Query: %w", err)
+	}
+
+	return ids, nil
+}
+
+func collectIDs(rows pgx.Rows, err error) ([]int, error) {
+	if err != nil {
+		return nil, classify(err)
+	}
+	defer rows.Close()
+
+	var ids []int
+	for rows.Next() {
+		var id int
+		err := rows.Scan(&id)
+		if err != nil {
+			return nil, classify(err)
+		}
+
+		ids = append(ids, id)
+	}
+
+	return ids, classify(rows.Err())
+}
+
+// checkManualChange rejects manual and bulk changes to the members of hash
+// auto segments: their members follow the buckets, so the next rebalance
+// would undo the change.
+func checkManualChange(segment, bucketing string) error {
+	if bucketing != entity.BucketingHash {
+		return nil
+	}
+
+	return repoerrs.New(repoerrs.ErrConflict, fmt.Sprintf("members of segment %q follow its hash buckets and can't be changed by hand", segment), nil)
+}
+
+// planMembers returns the users to add to and to remove from an auto segment
+// so that it matches its percentage of users.
+func planMembers(segment entity.Segment, users, members []int) (add, remove []int) {
+	isMember := make(map[int]bool, len(members))
+	for _, id := range members {
+		isMember[id] = true
+	}
+
+	if segment.Bucketing == entity.BucketingHash {
+		inRange := make(map[int]bool, len(users))
+		for _, id := range users {
+			if bucketing.InRange(segment.Salt, id, segment.BucketOffset, *segment.Percentage) {
+				inRange[id] = true
+				if !isMember[id] {
+					add = append(add, id)
+				}
+			}
+		}
+		for _, id := range members {
+			if !inRange[id] {
+				remove = append(remove, id)
+			}
+		}
+
+		return add, remove
+	}
+
+	target := int(float64(len(users)) * *segment.Percentage / 100)
+
+	switch {
+	case len(members) < target:
+		candidates := make([]int, 0, len(users)-len(members))
+		for _, id := range users {
+			if !isMember[id] {
+				candidates = append(candidates, id)
+			}
+		}
+		rand.Shuffle(len(candidates), func(i, j int) { candidates[i], candidates[j] = candidates[j], candidates[i] })
+		add = candidates[:min(target-len(members), len(candidates))]
+		sort.Ints(add)
+	case len(members) > target:
+		remove = append(remove, members...)
+		rand.Shuffle(len(remove), func(i, j int) { remove[i], remove[j] = remove[j], remove[i] })
+		remove = remove[:len(members)-target]
+		sort.Ints(remove)
+	}
+
+	return add, remove
+}
+
+// applyMembers removes and adds users of a segment and logs every change as
+// made through source. Users that already are in another segment of the
+// same layer are skipped. It returns the number of memberships changed.
+func applyMembers(ctx context.Context, tx pgx.Tx, b squirrel.StatementBuilderType, segment entity.Segment, source string, add, remove []int) (int, error) {
+	changed := 0
+
+	for _, userID := range remove {
+		sql, args, _ := b.
+			Delete("user_segments").
+			Where(squirrel.Eq{"user_id": userID, "segment_name": segment.Name}).
+			Suffix("RETURNING variant").
+			ToSql()
+
+		var variant string
+		err := tx.QueryRow(ctx, sql, args...).Scan(&variant)
+		if err != nil {
+			return 0, fmt.Errorf("tx.QueryRow: %w", classify(err))
+		}
+
+		err = logOperation(ctx, tx, b, userID, segment.Name, variant, entity.OperationDelete, source)
+		if err != nil {
+			return 0, err
+		}
+		changed++
+	}
+
+	for _, userID := range add {
+		variant := pickVariant(segment, userID)
+
+		sql, args, _ := b.
+			Insert("user_segments").
+			Columns("user_id", "segment_name", "variant").
+			Values(userID, segment.Name, variant).
+			Suffix("ON CONFLICT DO NOTHING").
+			ToSql()
+
+		tag, err := tx.Exec(ctx, sql, args...)
+		if err != nil {
+			return 0, fmt.Errorf("tx.Exec1: %w", classify(err))
+		}
+		if tag.RowsAffected() == 0 {
+			continue
+		}
+
+		err = logOperation(ctx, tx, b, userID, segment.Name, variant, entity.OperationAdd, source)
+		if err != nil {
+			return 0, err
+		}
+		changed++
+	}
+
+	return changed, nil
+}
+
+// actor is who made the change: the caller of the request, if any.
+func actor(ctx context.Context) string {
+	caller, _ := entity.CallerFrom(ctx)
+
+	return caller.Name
+}
+
+// logOperation records a change of the membership of the user made through
+// source, by the caller and for the reason ctx carries.
+func logOperation(ctx context.Context, tx pgx.Tx, b squirrel.StatementBuilderType, userID int, name, variant, operation, source string) error {
+	return logExpiry(ctx, tx, b, userID, name, variant, operation, source, nil)
+}
+
+// logExpiry is logOperation for changes setting when the membership expires,
+// nil when it doesn't.
+func logExpiry(ctx context.Context, tx pgx.Tx, b squirrel.StatementBuilderType, userID int, name, variant, operation, source string, expiresAt *time.Time) error {
+	columns := []string{"user_id", "segment_name", "variant", "operation", "actor", "source", "reason"}
+	values := []any{userID, name, variant, operation, actor(ctx), source, entity.ReasonFrom(ctx)}
+	if expiresAt != nil {
+		columns = append(columns, "expires_at")
+		values = append(values, *expiresAt)
+	}
+
+	sql, args, _ := b.
+		Insert("user_segments_log").
+		Columns(columns...).
+		Values(values...).
 		ToSql()
 
-	var count int
-	err := r.Pool.QueryRow(ctx, sql, args...).Scan(&count)
+	_, err := tx.Exec(ctx, sql, args...)
 	if err != nil {
-		return 0
+		return fmt.Errorf("tx.Exec2: %w", classify(err))
 	}
 
-	return count
+	return nil
 }
 
 func (r *SegmentRepo) DeleteSegment(ctx context.Context, name string) error {
 	tx, err := r.Pool.Begin(ctx)
 	if err != nil {
-		return fmt.Errorf("SegmentRepo.DeleteSegment - r.Pool.Begin: %v", err)
+		return fmt.Errorf("SegmentRepo.DeleteSegment - r.Pool.Begin: %w", classify(err))
 	}
 	defer func() { _ = tx.Rollback(ctx) }()
 
 	sql, args, _ := r.Builder.
-		Select("us.user_id").
+		Select("us.user_id", "us.variant").
 		From("user_segments as us").
 		Join("segments as s on us.segment_name = s.name").
 		Where("s.name = $1", name).
@@ -134,29 +669,33 @@ func (r *SegmentRepo) DeleteSegment(ctx context.Context, name string) error {
 
 	rows, err := tx.Query(ctx, sql, args...)
 	if err != nil {
-		return fmt.Errorf("SegmentRepo.DeleteSegment - tx.Query: %v", err)
+		return fmt.Errorf("SegmentRepo.DeleteSegment - tx.Query: %w", classify(err))
 	}
+	defer rows.Close()
 
+	var members []entity.UserSegment
 	var userIDs []int
 	for rows.Next() {
 		var userID int
-		err := rows.Scan(&userID)
+		var member entity.UserSegment
+		err := rows.Scan(&userID, &member.Variant)
 		if err != nil {
-			return fmt.Errorf("SegmentRepo.DeleteSegment - rows.Scan: %v", err)
+			return fmt.Errorf("SegmentRepo.DeleteSegment - rows.Scan: %w", classify(err))
 		}
 
 		userIDs = append(userIDs, userID)
+		members = append(members, member)
 	}
 
-	for _, userID := range userIDs {
-		sql, args, _ = r.Builder.
-			Insert("user_segments_log").
-			Columns("user_id", "segment_name", "operation").
-			Values(userID, name, "delete").
-			ToSql()
-		_, err := tx.Exec(ctx, sql, args...)
+	err = rows.Err()
+	if err != nil {
+		return fmt.Errorf("SegmentRepo.DeleteSegment - rows.Err: %w", classify(err))
+	}
+
+	for i, userID := range userIDs {
+		err := logOperation(ctx, tx, r.Builder, userID, name, members[i].Variant, entity.OperationDelete, entity.SourceSegmentDelete)
 		if err != nil {
-			return fmt.Errorf("SegmentRepo.DeleteSegment - tx.Exec1: %v", err)
+			return fmt.Errorf("SegmentRepo.DeleteSegment - logOperation: %w", err)
 		}
 	}
 
@@ -165,37 +704,51 @@ func (r *SegmentRepo) DeleteSegment(ctx context.Context, name string) error {
 		Where("name = $1", name).
 		ToSql()
 
-	_, err = tx.Exec(ctx, sql, args...)
+	tag, err := tx.Exec(ctx, sql, args...)
 	if err != nil {
-		return fmt.Errorf("SegmentRepo.DeleteSegment - tx.Exec2: %v", err)
+		return fmt.Errorf("SegmentRepo.DeleteSegment - tx.Exec2: %w", classify(err))
+	}
+	if tag.RowsAffected() == 0 {
+		return fmt.Errorf("SegmentRepo.DeleteSegment - tx.Exec2: %w", repoerrs.New(repoerrs.ErrNotFound, fmt.Sprintf("segment %q not found", name), nil))
 	}
 
 	err = tx.Commit(ctx)
 	if err != nil {
-		return fmt.Errorf("SegmentRepo.DeleteSegment - tx.Commit: %v", err)
+		return fmt.Errorf("SegmentRepo.DeleteSegment - tx.Commit: %w", classify(err))
 	}
 
 	return nil
 }
 
-func (r *SegmentRepo) GetSegments(ctx context.Context) ([]string, error) {
-	sql, args, _ := r.Builder.
-		Select("name").
+func (r *SegmentRepo) GetSegments(ctx context.Context, filter entity.SegmentFilter) ([]entity.Segment, error) {
+	builder := r.Builder.
+		Select(segmentColumns...).
 		From("segments").
-		ToSql()
+		OrderBy("name")
+
+	if filter.Owner != "" {
+		builder = builder.Where(squirrel.Eq{"owner": filter.Owner})
+	}
+	if filter.Tag != "" {
+		builder = builder.Where("? = ANY(tags)", filter.Tag)
+	}
+	if filter.Layer != "" {
+		builder = builder.Where(squirrel.Eq{"layer": filter.Layer})
+	}
+
+	sql, args, _ := builder.ToSql()
 
 	rows, err := r.Pool.Query(ctx, sql, args...)
 	if err != nil {
-		return nil, fmt.Errorf("SegmentRepo.GetSegments - r.Pool.Query: %v", err)
+		return nil, fmt.Errorf("SegmentRepo.GetSegments - r.Pool.Query: %w", classify(err))
 	}
 	defer rows.Close()
 
-	var segments []string
+	var segments []entity.Segment
 	for rows.Next() {
-		var segment string
-		err := rows.Scan(&segment)
+		segment, err := scanSegment(rows)
 		if err != nil {
-			return nil, fmt.Errorf("SegmentRepo.GetSegments - rows.Scan: %v", err)
+			return nil, fmt.Errorf("SegmentRepo.GetSegments - rows.Scan: %w", classify(err))
 		}
 
 		segments = append(segments, segment)
@@ -203,3 +756,283 @@ func (r *SegmentRepo) GetSegments(ctx context.Context) ([]string, error) {
 
 	return segments, nil
 }
+
+// GetSegment returns the segment by its current name or, if there is none,
+// by the name it had before the latest rename.
+func (r *SegmentRepo) GetSegment(ctx context.Context, name string) (entity.Segment, error) {
+	sql, args, _ := r.Builder.
+		Select(segmentColumns...).
+		From("segments").
+		Where("name = $1", name).
+		ToSql()
+
+	segment, err := scanSegment(r.Pool.QueryRow(ctx, sql, args...))
+	if err == nil {
+		return segment, nil
+	}
+	if !errors.Is(err, pgx.ErrNoRows) {
+		return entity.Segment{}, fmt.Errorf("SegmentRepo.GetSegment - r.Pool.QueryRow: %w", classify(err))
+	}
+
+	sql, args, _ = r.Builder.
+		Select(segmentColumns...).
+		From("segments").
+		Where("id = (SELECT segment_id FROM segment_aliases WHERE name = $1 ORDER BY renamed_at DESC LIMIT 1)", name).
+		ToSql()
+
+	segment, err = scanSegment(r.Pool.QueryRow(ctx, sql, args...))
+	if err != nil {
+		return entity.Segment{}, fmt.Errorf("SegmentRepo.GetSegment - r.Pool.QueryRow2: %w", missing(err, fmt.Sprintf("segment %q", name)))
+	}
+
+	return segment, nil
+}
+
+// UpdateSegment changes the given fields of a segment. A new percentage or
+// salt of an auto segment is applied to its members right away.
+func (r *SegmentRepo) UpdateSegment(ctx context.Context, name string, update entity.SegmentUpdate) (entity.Segment, error) {
+	if update.Description == nil && update.Owner == nil && update.Tags == nil && update.Percentage == nil && update.Salt == nil {
+		return entity.Segment{}, fmt.Errorf("SegmentRepo.UpdateSegment: %w", repoerrs.New(repoerrs.ErrInvalidInput, "nothing to update", nil))
+	}
+	if update.Percentage != nil && (*update.Percentage <= 0 || *update.Percentage > 100) {
+		return entity.Segment{}, fmt.Errorf("SegmentRepo.UpdateSegment: %w", repoerrs.New(repoerrs.ErrInvalidInput, fmt.Sprintf("percentage must be in (0, 100], got %g", *update.Percentage), nil))
+	}
+	if update.Salt != nil && *update.Salt == "" {
+		return entity.Segment{}, fmt.Errorf("SegmentRepo.UpdateSegment: %w", repoerrs.New(repoerrs.ErrInvalidInput, "salt must not be empty", nil))
+	}
+
+	tx, err := r.Pool.Begin(ctx)
+	if err != nil {
+		return entity.Segment{}, fmt.Errorf("SegmentRepo.UpdateSegment - r.Pool.Begin: %w", classify(err))
+	}
+	defer func() { _ = tx.Rollback(ctx) }()
+
+	builder := r.Builder.
+		Update("segments").
+		Set("updated_at", squirrel.Expr("NOW()")).
+		Where(squirrel.Eq{"name": name}).
+		Suffix("RETURNING " + strings.Join(segmentColumns, ", "))
+
+	if update.Description != nil {
+		builder = builder.Set("description", *update.Description)
+	}
+	if update.Owner != nil {
+		builder = builder.Set("owner", *update.Owner)
+	}
+	if update.Tags != nil {
+		builder = builder.Set("tags", tagsOrEmpty(*update.Tags))
+	}
+	if update.Percentage != nil {
+		builder = builder.Set("amount", *update.Percentage)
+	}
+	if update.Salt != nil {
+		builder = builder.Set("salt", *update.Salt)
+	}
+
+	sql, args, _ := builder.ToSql()
+
+	segment, err := scanSegment(tx.QueryRow(ctx, sql, args...))
+	if err != nil {
+		return entity.Segment{}, fmt.Errorf("SegmentRepo.UpdateSegment - tx.QueryRow: %w", missing(err, fmt.Sprintf("segment %q", name)))
+	}
+
+	if update.Percentage != nil || update.Salt != nil {
+		if segment.Bucketing == "" {
+			return entity.Segment{}, fmt.Errorf("SegmentRepo.UpdateSegment: %w", repoerrs.New(repoerrs.ErrInvalidInput, fmt.Sprintf("segment %q is not an auto segment", name), nil))
+		}
+
+		if segment.Layer != "" {
+			if update.Salt != nil {
+				return entity.Segment{}, fmt.Errorf("SegmentRepo.UpdateSegment: %w", repoerrs.New(repoerrs.ErrInvalidInput, "segments of a layer use the layer name as salt", nil))
+			}
+
+			taken, err := r.layerRanges(ctx, tx, segment.Layer, segment.Name)
+			if err != nil {
+				return entity.Segment{}, fmt.Errorf("SegmentRepo.UpdateSegment - r.layerRanges: %w", err)
+			}
+
+			end := segment.BucketOffset + bucketing.Threshold(*segment.Percentage)
+			for _, t := range taken {
+				if segment.BucketOffset < t[1] && t[0] < end {
+					return entity.Segment{}, fmt.Errorf("SegmentRepo.UpdateSegment: %w", repoerrs.New(repoerrs.ErrConflict, fmt.Sprintf("segment %q can't grow to %g%%, its buckets overlap another segment of layer %q", name, *segment.Percentage, segment.Layer), nil))
+				}
+			}
+			if end > bucketing.Buckets {
+				return entity.Segment{}, fmt.Errorf("SegmentRepo.UpdateSegment: %w", repoerrs.New(repoerrs.ErrConflict, fmt.Sprintf("segment %q can't grow to %g%% within layer %q", name, *segment.Percentage, segment.Layer), nil))
+			}
+		}
+
+		users, err := r.userIDs(ctx, tx)
+		if err != nil {
+			return entity.Segment{}, fmt.Errorf("SegmentRepo.UpdateSegment - r.userIDs: %w", err)
+		}
+
+		_, err = r.rebalance(ctx, tx, segment, users)
+		if err != nil {
+			return entity.Segment{}, fmt.Errorf("SegmentRepo.UpdateSegment - r.rebalance: %w", err)
+		}
+	}
+
+	err = tx.Commit(ctx)
+	if err != nil {
+		return entity.Segment{}, fmt.Errorf("SegmentRepo.UpdateSegment - tx.Commit: %w", classify(err))
+	}
+
+	return segment, nil
+}
+
+// RenameSegment changes the name of a segment. Memberships follow the new
+// name, the old one is kept as an alias and log entries stay linked to the
+// segment by its id.
+func (r *SegmentRepo) RenameSegment(ctx context.Context, name, newName string) (entity.Segment, error) {
+	if newName == "" || newName == name {
+		return entity.Segment{}, fmt.Errorf("SegmentRepo.RenameSegment: %w", repoerrs.New(repoerrs.ErrInvalidInput, "new name must be non-empty and differ from the current one", nil))
+	}
+
+	tx, err := r.Pool.Begin(ctx)
+	if err != nil {
+		return entity.Segment{}, fmt.Errorf("SegmentRepo.RenameSegment - r.Pool.Begin: %w", classify(err))
+	}
+	defer func() { _ = tx.Rollback(ctx) }()
+
+	sql, args, _ := r.Builder.
+		Update("segments").
+		Set("name", newName).
+		Set("updated_at", squirrel.Expr("NOW()")).
+		Where(squirrel.Eq{"name": name}).
+		Suffix("RETURNING " + strings.Join(segmentColumns, ", ")).
+		ToSql()
+
+	segment, err := scanSegment(tx.QueryRow(ctx, sql, args...))
+	if err != nil {
+		return entity.Segment{}, fmt.Errorf("SegmentRepo.RenameSegment - tx.QueryRow: %w", missing(err, fmt.Sprintf("segment %q", name)))
+	}
+
+	sql, args, _ = r.Builder.
+		Insert("segment_aliases").
+		Columns("name", "segment_id").
+		Values(name, segment.ID).
+		Suffix("ON CONFLICT (name, segment_id) DO UPDATE SET renamed_at = NOW()").
+		ToSql()
+
+	_, err = tx.Exec(ctx, sql, args...)
+	if err != nil {
+		return entity.Segment{}, fmt.Errorf("SegmentRepo.RenameSegment - tx.Exec: %w", classify(err))
+	}
+
+	err = tx.Commit(ctx)
+	if err != nil {
+		return entity.Segment{}, fmt.Errorf("SegmentRepo.RenameSegment - tx.Commit: %w", classify(err))
+	}
+
+	return segment, nil
+}
+
+// StreamSegmentMembers calls fn for every current member of the segment with
+// the given id, ordered by user id, as they are read. expire is a wall-clock
+// TIMESTAMP, so it is read as an instant the same way GetUserSegments does.
+func (r *SegmentRepo) StreamSegmentMembers(ctx context.Context, segmentID int64, fn func(entity.SegmentMember) error) error {
+	name, err := r.segmentName(ctx, segmentID)
+	if err != nil {
+		return fmt.Errorf("SegmentRepo.StreamSegmentMembers - %w", err)
+	}
+
+	sql, args, _ := r.Builder.
+		Select("user_id", "variant", "expire::timestamptz").
+		From("user_segments").
+		Where("segment_name = ?", name).
+		OrderBy("user_id").
+		ToSql()
+
+	rows, err := r.Pool.Query(ctx, sql, args...)
+	if err != nil {
+		return fmt.Errorf("SegmentRepo.StreamSegmentMembers - r.Pool.Query: %w", classify(err))
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var member entity.SegmentMember
+		err := rows.Scan(&member.UserID, &member.Variant, &member.Expire)
+		if err != nil {
+			return fmt.Errorf("SegmentRepo.StreamSegmentMembers - rows.Scan: %w", classify(err))
+		}
+
+		err = fn(member)
+		if err != nil {
+			return fmt.Errorf("SegmentRepo.StreamSegmentMembers - fn: %w", err)
+		}
+	}
+
+	err = rows.Err()
+	if err != nil {
+		return fmt.Errorf("SegmentRepo.StreamSegmentMembers - rows.Err: %w", classify(err))
+	}
+
+	return nil
+}
+
+// StreamSegmentOperations calls fn for every operation of all users on the
+// segment with the given id, under any name it had, ordered by time, as they
+// are read. Zero bounds don't filter, from is inclusive and to exclusive.
+func (r *SegmentRepo) StreamSegmentOperations(ctx context.Context, segmentID int64, from, to time.Time, fn func(entity.Operation) error) error {
+	_, err := r.segmentName(ctx, segmentID)
+	if err != nil {
+		return fmt.Errorf("SegmentRepo.StreamSegmentOperations - %w", err)
+	}
+
+	query := r.Builder.
+		Select(operationColumns...).
+		From("user_segments_log AS l").
+		LeftJoin("segments AS s ON s.id = l.segment_id").
+		Where("l.segment_id = ?", segmentID)
+	if !from.IsZero() {
+		query = query.Where("l.operation_time >= ?", from)
+	}
+	if !to.IsZero() {
+		query = query.Where("l.operation_time < ?", to)
+	}
+	sql, args, _ := query.OrderBy("l.operation_time", "l.id").ToSql()
+
+	rows, err := r.Pool.Query(ctx, sql, args...)
+	if err != nil {
+		return fmt.Errorf("SegmentRepo.StreamSegmentOperations - r.Pool.Query: %w", classify(err))
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var o entity.Operation
+		err := rows.Scan(operationFields(&o)...)
+		if err != nil {
+			return fmt.Errorf("SegmentRepo.StreamSegmentOperations - rows.Scan: %w", classify(err))
+		}
+
+		err = fn(o)
+		if err != nil {
+			return fmt.Errorf("SegmentRepo.StreamSegmentOperations - fn: %w", err)
+		}
+	}
+
+	err = rows.Err()
+	if err != nil {
+		return fmt.Errorf("SegmentRepo.StreamSegmentOperations - rows.Err: %w", classify(err))
+	}
+
+	return nil
+}
+
+// segmentName returns the current name of the segment with the given id.
+func (r *SegmentRepo) segmentName(ctx context.Context, id int64) (string, error) {
+	sql, args, _ := r.Builder.
+		Select("name").
+		From("segments").
+		Where("id = ?", id).
+		ToSql()
+
+	var name string
+	err := r.Pool.QueryRow(ctx, sql, args...).Scan(&name)
+	if err != nil {
+		return "", fmt.Errorf("r.Pool.QueryRow: %w", missing(err, "segment"))
+	}
+
+	return name, nil
+}
@@ -4,18 +4,21 @@ import (
 	"context"
 	"errors"
 	"testing"
+	"time"
 
 	"github.com/Masterminds/squirrel"
 	"github.com/jackc/pgx/v5/pgconn"
 	"github.com/pashagolub/pgxmock/v3"
+	"github.com/realPointer/segments/internal/entity"
+	"github.com/realPointer/segments/internal/repo/repoerrs"
 	"github.com/realPointer/segments/pkg/postgres"
 	"github.com/stretchr/testify/assert"
 )
 
 func TestSegmentRepo_CreateSegment(t *testing.T) {
 	type args struct {
-		ctx  context.Context
-		name string
+		ctx     context.Context
+		segment entity.Segment
 	}
 
 	type MockBehavior func(m pgxmock.PgxPoolIface, args args)
@@ -25,44 +28,138 @@ func TestSegmentRepo_CreateSegment(t *testing.T) {
 		args         args
 		mockBehavior MockBehavior
 		wantErr      bool
+		wantErrIs    error
 	}{
 		{
 			name: "OK",
 			args: args{
-				ctx:  context.Background(),
-				name: "test_segment",
+				ctx: context.Background(),
+				segment: entity.Segment{
+					Name:        "test_segment",
+					Description: "discount for new users",
+					Owner:       "growth",
+					Tags:        []string{"promo", "q3"},
+				},
 			},
 			mockBehavior: func(m pgxmock.PgxPoolIface, args args) {
 				m.ExpectExec("INSERT INTO segments").
-					WithArgs(args.name).
+					WithArgs(args.segment.Name, args.segment.Description, args.segment.Owner, args.segment.Tags, "", args.segment.Layer, []entity.Variant{}).
+					WillReturnResult(pgxmock.NewResult("INSERT", 1))
+			},
+			wantErr: false,
+		},
+		{
+			name: "OK, experiment with variants",
+			args: args{
+				ctx: context.Background(),
+				segment: entity.Segment{
+					Name:     "test_segment",
+					Variants: []entity.Variant{{Name: "control", Weight: 50}, {Name: "treatment", Weight: 50}},
+				},
+			},
+			mockBehavior: func(m pgxmock.PgxPoolIface, args args) {
+				m.ExpectExec("INSERT INTO segments").
+					WithArgs(args.segment.Name, "", "", []string{}, args.segment.Name, "", args.segment.Variants).
 					WillReturnResult(pgxmock.NewResult("INSERT", 1))
 			},
 			wantErr: false,
 		},
+		{
+			name: "OK, rule segment",
+			args: args{
+				ctx: context.Background(),
+				segment: entity.Segment{
+					Name: "ru_mobile",
+					Rule: `country == "RU" && platform in ["ios", "android"]`,
+				},
+			},
+			mockBehavior: func(m pgxmock.PgxPoolIface, args args) {
+				m.ExpectBegin()
+				m.ExpectExec("INSERT INTO segments \\(name,description,owner,tags,salt,layer,variants,rule\\)").
+					WithArgs(args.segment.Name, "", "", []string{}, "", "", []entity.Variant{}, args.segment.Rule).
+					WillReturnResult(pgxmock.NewResult("INSERT", 1))
+				m.ExpectQuery("SELECT id, country, platform, (.+), properties FROM users ORDER BY id").
+					WillReturnRows(pgxmock.NewRows([]string{"id", "country", "platform", "signup_date", "properties"}).
+						AddRow(1, "RU", "ios", "", map[string]any{}).
+						AddRow(2, "RU", "web", "", map[string]any{}).
+						AddRow(3, "KZ", "android", "", map[string]any{}).
+						AddRow(4, "RU", "android", "2023-08-31", map[string]any{}))
+				for _, userID := range []int{1, 4} {
+					m.ExpectExec("INSERT INTO user_segments \\(user_id,segment_name,variant\\)").
+						WithArgs(userID, args.segment.Name, "").
+						WillReturnResult(pgxmock.NewResult("INSERT", 1))
+					m.ExpectExec("INSERT INTO user_segments_log").
+						WithArgs(userID, args.segment.Name, "", "add", "", entity.SourceRule, "").
+						WillReturnResult(pgxmock.NewResult("INSERT", 1))
+				}
+				m.ExpectCommit()
+			},
+			wantErr: false,
+		},
+		{
+			name: "invalid rule",
+			args: args{
+				ctx: context.Background(),
+				segment: entity.Segment{
+					Name: "ru_mobile",
+					Rule: `country = "RU"`,
+				},
+			},
+			mockBehavior: func(m pgxmock.PgxPoolIface, args args) {},
+			wantErr:      true,
+			wantErrIs:    repoerrs.ErrInvalidInput,
+		},
+		{
+			name: "variant without weight",
+			args: args{
+				ctx: context.Background(),
+				segment: entity.Segment{
+					Name:     "test_segment",
+					Variants: []entity.Variant{{Name: "control", Weight: 50}, {Name: "treatment"}},
+				},
+			},
+			mockBehavior: func(m pgxmock.PgxPoolIface, args args) {},
+			wantErr:      true,
+			wantErrIs:    repoerrs.ErrInvalidInput,
+		},
+		{
+			name: "duplicate variant",
+			args: args{
+				ctx: context.Background(),
+				segment: entity.Segment{
+					Name:     "test_segment",
+					Variants: []entity.Variant{{Name: "control", Weight: 50}, {Name: "control", Weight: 50}},
+				},
+			},
+			mockBehavior: func(m pgxmock.PgxPoolIface, args args) {},
+			wantErr:      true,
+			wantErrIs:    repoerrs.ErrInvalidInput,
+		},
 		{
 			name: "segment already exists",
 			args: args{
-				ctx:  context.Background(),
-				name: "test_segment",
+				ctx:     context.Background(),
+				segment: entity.Segment{Name: "test_segment"},
 			},
 			mockBehavior: func(m pgxmock.PgxPoolIface, args args) {
 				m.ExpectExec("INSERT INTO segments").
-					WithArgs(args.name).
+					WithArgs(args.segment.Name, "", "", []string{}, "", "", []entity.Variant{}).
 					WillReturnError(&pgconn.PgError{
 						Code: "23505",
 					})
 			},
-			wantErr: true,
+			wantErr:   true,
+			wantErrIs: repoerrs.ErrAlreadyExists,
 		},
 		{
 			name: "unexpected error",
 			args: args{
-				ctx:  context.Background(),
-				name: "test_segment",
+				ctx:     context.Background(),
+				segment: entity.Segment{Name: "test_segment"},
 			},
 			mockBehavior: func(m pgxmock.PgxPoolIface, args args) {
 				m.ExpectExec("INSERT INTO segments").
-					WithArgs(args.name).
+					WithArgs(args.segment.Name, "", "", []string{}, "", "", []entity.Variant{}).
 					WillReturnError(errors.New("some error"))
 			},
 			wantErr: true,
@@ -81,9 +178,12 @@ func TestSegmentRepo_CreateSegment(t *testing.T) {
 			}
 			segmentRepoMock := NewSegmentRepo(postgresMock)
 
-			err := segmentRepoMock.CreateSegment(tc.args.ctx, tc.args.name)
+			err := segmentRepoMock.CreateSegment(tc.args.ctx, tc.args.segment)
 			if tc.wantErr {
 				assert.Error(t, err)
+				if tc.wantErrIs != nil {
+					assert.ErrorIs(t, err, tc.wantErrIs)
+				}
 				return
 			}
 			assert.NoError(t, err)
@@ -98,6 +198,8 @@ func TestSegmentRepo_CreateSegmentAuto(t *testing.T) {
 	type args struct {
 		ctx        context.Context
 		name       string
+		layer      string
+		rule       string
 		percentage float64
 	}
 
@@ -108,43 +210,134 @@ func TestSegmentRepo_CreateSegmentAuto(t *testing.T) {
 		args         args
 		mockBehavior MockBehavior
 		wantErr      bool
+		wantErrIs    error
 	}{
 		{
 			name: "OK",
 			args: args{
 				ctx:        context.Background(),
 				name:       "test_segment",
-				percentage: 10,
+				percentage: 24,
 			},
 			mockBehavior: func(m pgxmock.PgxPoolIface, args args) {
 				m.ExpectBegin()
 				m.ExpectExec("INSERT INTO segments").
-					WithArgs(args.name, args.percentage).
+					WithArgs(args.name, "", "", []string{}, args.percentage, entity.BucketingHash, args.name, "", 0, []entity.Variant{}).
 					WillReturnResult(pgxmock.NewResult("INSERT", 1))
 				m.ExpectQuery("SELECT id").
 					WillReturnRows(pgxmock.NewRows([]string{"id"}).AddRow(1).AddRow(2))
 				m.ExpectExec("INSERT INTO user_segments").
-					WithArgs(1, args.name).
+					WithArgs(1, args.name, "").
 					WillReturnResult(pgxmock.NewResult("INSERT", 1))
 				m.ExpectExec("INSERT INTO user_segments_log").
-					WithArgs(1, args.name, "add").
+					WithArgs(1, args.name, "", "add", "", entity.SourceAuto, "").
 					WillReturnResult(pgxmock.NewResult("INSERT", 1))
 				m.ExpectExec("INSERT INTO user_segments").
-					WithArgs(2, args.name).
+					WithArgs(2, args.name, "").
 					WillReturnResult(pgxmock.NewResult("INSERT", 1))
 				m.ExpectExec("INSERT INTO user_segments_log").
-					WithArgs(2, args.name, "add").
+					WithArgs(2, args.name, "", "add", "", entity.SourceAuto, "").
+					WillReturnResult(pgxmock.NewResult("INSERT", 1))
+				m.ExpectCommit()
+			},
+			wantErr: false,
+		},
+		{
+			name: "auto segment with a rule",
+			args: args{
+				ctx:        context.Background(),
+				name:       "test_segment",
+				rule:       `country == "RU"`,
+				percentage: 24,
+			},
+			mockBehavior: func(m pgxmock.PgxPoolIface, args args) {},
+			wantErr:      true,
+			wantErrIs:    repoerrs.ErrInvalidInput,
+		},
+		{
+			name: "OK, in layer",
+			args: args{
+				ctx:        context.Background(),
+				name:       "test_segment",
+				layer:      "checkout",
+				percentage: 30,
+			},
+			mockBehavior: func(m pgxmock.PgxPoolIface, args args) {
+				m.ExpectBegin()
+				m.ExpectExec("SELECT pg_advisory_xact_lock").
+					WithArgs("layer:checkout").
+					WillReturnResult(pgxmock.NewResult("SELECT", 1))
+				m.ExpectQuery("SELECT bucket_offset, amount FROM segments WHERE layer = \\$1 AND name <> \\$2 AND amount IS NOT NULL").
+					WithArgs(args.layer, args.name).
+					WillReturnRows(pgxmock.NewRows([]string{"bucket_offset", "amount"}).AddRow(0, 20.0))
+				m.ExpectExec("INSERT INTO segments").
+					WithArgs(args.name, "", "", []string{}, args.percentage, entity.BucketingHash, args.layer, args.layer, 2000, []entity.Variant{}).
 					WillReturnResult(pgxmock.NewResult("INSERT", 1))
+				m.ExpectQuery("SELECT id").
+					WillReturnRows(pgxmock.NewRows([]string{"id"}))
 				m.ExpectCommit()
 			},
 			wantErr: false,
 		},
+		{
+			name: "layer is full",
+			args: args{
+				ctx:        context.Background(),
+				name:       "test_segment",
+				layer:      "checkout",
+				percentage: 30,
+			},
+			mockBehavior: func(m pgxmock.PgxPoolIface, args args) {
+				m.ExpectBegin()
+				m.ExpectExec("SELECT pg_advisory_xact_lock").
+					WithArgs("layer:checkout").
+					WillReturnResult(pgxmock.NewResult("SELECT", 1))
+				m.ExpectQuery("SELECT bucket_offset, amount FROM segments").
+					WithArgs(args.layer, args.name).
+					WillReturnRows(pgxmock.NewRows([]string{"bucket_offset", "amount"}).AddRow(0, 50.0).AddRow(5000, 25.0))
+				m.ExpectRollback()
+			},
+			wantErr:   true,
+			wantErrIs: repoerrs.ErrConflict,
+		},
+		{
+			name: "layer read cut short",
+			args: args{
+				ctx:        context.Background(),
+				name:       "test_segment",
+				layer:      "checkout",
+				percentage: 30,
+			},
+			mockBehavior: func(m pgxmock.PgxPoolIface, args args) {
+				m.ExpectBegin()
+				m.ExpectExec("SELECT pg_advisory_xact_lock").
+					WithArgs("layer:checkout").
+					WillReturnResult(pgxmock.NewResult("SELECT", 1))
+				m.ExpectQuery("SELECT bucket_offset, amount FROM segments").
+					WithArgs(args.layer, args.name).
+					WillReturnRows(pgxmock.NewRows([]string{"bucket_offset", "amount"}).AddRow(0, 20.0).RowError(1, &pgconn.PgError{Code: "40001"}))
+				m.ExpectRollback()
+			},
+			wantErr:   true,
+			wantErrIs: repoerrs.ErrConflict,
+		},
+		{
+			name: "invalid percentage",
+			args: args{
+				ctx:        context.Background(),
+				name:       "test_segment",
+				percentage: 120,
+			},
+			mockBehavior: func(m pgxmock.PgxPoolIface, args args) {},
+			wantErr:      true,
+			wantErrIs:    repoerrs.ErrInvalidInput,
+		},
 		{
 			name: "transaction error",
 			args: args{
 				ctx:        context.Background(),
 				name:       "test_segment",
-				percentage: 10,
+				percentage: 24,
 			},
 			mockBehavior: func(m pgxmock.PgxPoolIface, args args) {
 				m.ExpectBegin().WillReturnError(errors.New("some error"))
@@ -157,30 +350,31 @@ func TestSegmentRepo_CreateSegmentAuto(t *testing.T) {
 			args: args{
 				ctx:        context.Background(),
 				name:       "test_segment",
-				percentage: 10,
+				percentage: 24,
 			},
 			mockBehavior: func(m pgxmock.PgxPoolIface, args args) {
 				m.ExpectBegin()
 				m.ExpectExec("INSERT INTO segments").
-					WithArgs(args.name, args.percentage).
+					WithArgs(args.name, "", "", []string{}, args.percentage, entity.BucketingHash, args.name, "", 0, []entity.Variant{}).
 					WillReturnError(&pgconn.PgError{
 						Code: "23505",
 					})
 				m.ExpectRollback()
 			},
-			wantErr: true,
+			wantErr:   true,
+			wantErrIs: repoerrs.ErrAlreadyExists,
 		},
 		{
 			name: "r.Pool.Exec error",
 			args: args{
 				ctx:        context.Background(),
 				name:       "test_segment",
-				percentage: 10,
+				percentage: 24,
 			},
 			mockBehavior: func(m pgxmock.PgxPoolIface, args args) {
 				m.ExpectBegin()
 				m.ExpectExec("INSERT INTO segments").
-					WithArgs(args.name, args.percentage).
+					WithArgs(args.name, "", "", []string{}, args.percentage, entity.BucketingHash, args.name, "", 0, []entity.Variant{}).
 					WillReturnError(errors.New("some error"))
 				m.ExpectRollback()
 			},
@@ -191,12 +385,12 @@ func TestSegmentRepo_CreateSegmentAuto(t *testing.T) {
 			args: args{
 				ctx:        context.Background(),
 				name:       "test_segment",
-				percentage: 10,
+				percentage: 24,
 			},
 			mockBehavior: func(m pgxmock.PgxPoolIface, args args) {
 				m.ExpectBegin()
 				m.ExpectExec("INSERT INTO segments").
-					WithArgs(args.name, args.percentage).
+					WithArgs(args.name, "", "", []string{}, args.percentage, entity.BucketingHash, args.name, "", 0, []entity.Variant{}).
 					WillReturnResult(pgxmock.NewResult("INSERT", 1))
 				m.ExpectQuery("SELECT id").
 					WillReturnError(errors.New("some error"))
@@ -209,12 +403,12 @@ func TestSegmentRepo_CreateSegmentAuto(t *testing.T) {
 			args: args{
 				ctx:        context.Background(),
 				name:       "test_segment",
-				percentage: 10,
+				percentage: 24,
 			},
 			mockBehavior: func(m pgxmock.PgxPoolIface, args args) {
 				m.ExpectBegin()
 				m.ExpectExec("INSERT INTO segments").
-					WithArgs(args.name, args.percentage).
+					WithArgs(args.name, "", "", []string{}, args.percentage, entity.BucketingHash, args.name, "", 0, []entity.Variant{}).
 					WillReturnResult(pgxmock.NewResult("INSERT", 1))
 				m.ExpectQuery("SELECT id").
 					WillReturnRows(pgxmock.NewRows([]string{"id"}).AddRow(1).RowError(0, errors.New("rows.Scan error")))
@@ -227,17 +421,17 @@ func TestSegmentRepo_CreateSegmentAuto(t *testing.T) {
 			args: args{
 				ctx:        context.Background(),
 				name:       "test_segment",
-				percentage: 10,
+				percentage: 24,
 			},
 			mockBehavior: func(m pgxmock.PgxPoolIface, args args) {
 				m.ExpectBegin()
 				m.ExpectExec("INSERT INTO segments").
-					WithArgs(args.name, args.percentage).
+					WithArgs(args.name, "", "", []string{}, args.percentage, entity.BucketingHash, args.name, "", 0, []entity.Variant{}).
 					WillReturnResult(pgxmock.NewResult("INSERT", 1))
 				m.ExpectQuery("SELECT id").
 					WillReturnRows(pgxmock.NewRows([]string{"id"}).AddRow(1).AddRow(2))
 				m.ExpectExec("INSERT INTO user_segments").
-					WithArgs(1, args.name).
+					WithArgs(1, args.name, "").
 					WillReturnError(errors.New("some error"))
 				m.ExpectRollback()
 			},
@@ -248,20 +442,20 @@ func TestSegmentRepo_CreateSegmentAuto(t *testing.T) {
 			args: args{
 				ctx:        context.Background(),
 				name:       "test_segment",
-				percentage: 10,
+				percentage: 24,
 			},
 			mockBehavior: func(m pgxmock.PgxPoolIface, args args) {
 				m.ExpectBegin()
 				m.ExpectExec("INSERT INTO segments").
-					WithArgs(args.name, args.percentage).
+					WithArgs(args.name, "", "", []string{}, args.percentage, entity.BucketingHash, args.name, "", 0, []entity.Variant{}).
 					WillReturnResult(pgxmock.NewResult("INSERT", 1))
 				m.ExpectQuery("SELECT id").
 					WillReturnRows(pgxmock.NewRows([]string{"id"}).AddRow(1).AddRow(2))
 				m.ExpectExec("INSERT INTO user_segments").
-					WithArgs(1, args.name).
+					WithArgs(1, args.name, "").
 					WillReturnResult(pgxmock.NewResult("INSERT", 1))
 				m.ExpectExec("INSERT INTO user_segments_log").
-					WithArgs(1, args.name, "add").
+					WithArgs(1, args.name, "", "add", "", entity.SourceAuto, "").
 					WillReturnError(errors.New("some error"))
 				m.ExpectRollback()
 			},
@@ -272,26 +466,26 @@ func TestSegmentRepo_CreateSegmentAuto(t *testing.T) {
 			args: args{
 				ctx:        context.Background(),
 				name:       "test_segment",
-				percentage: 10,
+				percentage: 24,
 			},
 			mockBehavior: func(m pgxmock.PgxPoolIface, args args) {
 				m.ExpectBegin()
 				m.ExpectExec("INSERT INTO segments").
-					WithArgs(args.name, args.percentage).
+					WithArgs(args.name, "", "", []string{}, args.percentage, entity.BucketingHash, args.name, "", 0, []entity.Variant{}).
 					WillReturnResult(pgxmock.NewResult("INSERT", 1))
 				m.ExpectQuery("SELECT id").
 					WillReturnRows(pgxmock.NewRows([]string{"id"}).AddRow(1).AddRow(2))
 				m.ExpectExec("INSERT INTO user_segments").
-					WithArgs(1, args.name).
+					WithArgs(1, args.name, "").
 					WillReturnResult(pgxmock.NewResult("INSERT", 1))
 				m.ExpectExec("INSERT INTO user_segments_log").
-					WithArgs(1, args.name, "add").
+					WithArgs(1, args.name, "", "add", "", entity.SourceAuto, "").
 					WillReturnResult(pgxmock.NewResult("INSERT", 1))
 				m.ExpectExec("INSERT INTO user_segments").
-					WithArgs(2, args.name).
+					WithArgs(2, args.name, "").
 					WillReturnResult(pgxmock.NewResult("INSERT", 1))
 				m.ExpectExec("INSERT INTO user_segments_log").
-					WithArgs(2, args.name, "add").
+					WithArgs(2, args.name, "", "add", "", entity.SourceAuto, "").
 					WillReturnResult(pgxmock.NewResult("INSERT", 1))
 				m.ExpectCommit().WillReturnError(errors.New("some error"))
 				m.ExpectRollback()
@@ -312,9 +506,12 @@ func TestSegmentRepo_CreateSegmentAuto(t *testing.T) {
 			}
 			segmentRepoMock := NewSegmentRepo(postgresMock)
 
-			err := segmentRepoMock.CreateSegmentAuto(tc.args.ctx, tc.args.name, tc.args.percentage)
+			err := segmentRepoMock.CreateSegmentAuto(tc.args.ctx, entity.Segment{Name: tc.args.name, Layer: tc.args.layer, Rule: tc.args.rule}, tc.args.percentage)
 			if tc.wantErr {
 				assert.Error(t, err)
+				if tc.wantErrIs != nil {
+					assert.ErrorIs(t, err, tc.wantErrIs)
+				}
 				return
 			}
 			assert.NoError(t, err)
@@ -325,56 +522,107 @@ func TestSegmentRepo_CreateSegmentAuto(t *testing.T) {
 	}
 }
 
-func TestSegmentRepo_countUsers(t *testing.T) {
-	type args struct {
-		ctx context.Context
-	}
-
-	type MockBehavior func(m pgxmock.PgxPoolIface, args args)
+func TestPlanMembers(t *testing.T) {
+	percentage := 24.0
+	half := 50.0
 
 	testCases := []struct {
-		name         string
-		args         args
-		mockBehavior MockBehavior
-		want         int
+		name       string
+		segment    entity.Segment
+		users      []int
+		members    []int
+		wantAdd    []int
+		wantRemove []int
 	}{
 		{
-			name: "OK",
-			args: args{
-				ctx: context.Background(),
-			},
-			mockBehavior: func(m pgxmock.PgxPoolIface, args args) {
-				m.ExpectQuery("SELECT count").
-					WillReturnRows(pgxmock.NewRows([]string{"count"}).AddRow(10))
-			},
-			want: 10,
+			name:    "hash, new segment",
+			segment: entity.Segment{Name: "test_segment", Percentage: &percentage, Bucketing: entity.BucketingHash, Salt: "test_segment"},
+			users:   []int{1, 2, 3, 4, 5, 6, 7, 8, 9, 10},
+			wantAdd: []int{1, 2, 4, 7},
 		},
 		{
-			name: "unexpected error",
-			args: args{
-				ctx: context.Background(),
-			},
-			mockBehavior: func(m pgxmock.PgxPoolIface, args args) {
-				m.ExpectQuery("SELECT count").
-					WillReturnError(errors.New("some error"))
-			},
-			want: 0,
+			name:       "hash, members out of range are removed",
+			segment:    entity.Segment{Name: "test_segment", Percentage: &percentage, Bucketing: entity.BucketingHash, Salt: "test_segment"},
+			users:      []int{1, 2, 3, 4, 5, 6, 7, 8, 9, 10},
+			members:    []int{1, 3, 4},
+			wantAdd:    []int{2, 7},
+			wantRemove: []int{3},
+		},
+		{
+			name:    "random, up to target",
+			segment: entity.Segment{Name: "test_segment", Percentage: &half, Bucketing: entity.BucketingRandom},
+			users:   []int{1, 2, 3, 4},
+			members: []int{1, 2},
+		},
+		{
+			name:    "random, missing members",
+			segment: entity.Segment{Name: "test_segment", Percentage: &half, Bucketing: entity.BucketingRandom},
+			users:   []int{1, 2, 3, 4},
+			members: []int{1},
+			wantAdd: []int{-1},
+		},
+		{
+			name:       "random, extra members",
+			segment:    entity.Segment{Name: "test_segment", Percentage: &half, Bucketing: entity.BucketingRandom},
+			users:      []int{1, 2},
+			members:    []int{1, 2},
+			wantRemove: []int{-1},
 		},
 	}
 
 	for _, tc := range testCases {
 		t.Run(tc.name, func(t *testing.T) {
-			poolMock, _ := pgxmock.NewPool()
-			defer poolMock.Close()
-			tc.mockBehavior(poolMock, tc.args)
+			add, remove := planMembers(tc.segment, tc.users, tc.members)
 
-			postgresMock := &postgres.Postgres{
-				Builder: squirrel.StatementBuilder.PlaceholderFormat(squirrel.Dollar),
-				Pool:    poolMock,
+			// Random picks can't be predicted, -1 stands for any one user.
+			if len(tc.wantAdd) == 1 && tc.wantAdd[0] == -1 {
+				assert.Len(t, add, 1)
+				assert.NotContains(t, tc.members, add[0])
+			} else {
+				assert.Equal(t, tc.wantAdd, add)
 			}
-			segmentRepoMock := NewSegmentRepo(postgresMock)
 
-			got := segmentRepoMock.countUsers(tc.args.ctx)
+			if len(tc.wantRemove) == 1 && tc.wantRemove[0] == -1 {
+				assert.Len(t, remove, 1)
+				assert.Contains(t, tc.members, remove[0])
+			} else {
+				assert.Equal(t, tc.wantRemove, remove)
+			}
+		})
+	}
+}
+
+func TestPickVariant(t *testing.T) {
+	variants := []entity.Variant{{Name: "control", Weight: 50}, {Name: "treatment", Weight: 50}}
+
+	testCases := []struct {
+		name    string
+		segment entity.Segment
+		want    []string
+	}{
+		{
+			name:    "no variants",
+			segment: entity.Segment{Name: "test_segment"},
+			want:    []string{"", "", "", ""},
+		},
+		{
+			name:    "salt defaults to the name",
+			segment: entity.Segment{Name: "test_segment", Variants: variants},
+			want:    []string{"control", "control", "treatment", "treatment"},
+		},
+		{
+			name:    "salt",
+			segment: entity.Segment{Name: "other_segment", Salt: "auto_segment", Variants: variants},
+			want:    []string{"treatment", "control", "treatment", "treatment"},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var got []string
+			for userID := 1; userID <= 4; userID++ {
+				got = append(got, pickVariant(tc.segment, userID))
+			}
 
 			assert.Equal(t, tc.want, got)
 		})
@@ -394,6 +642,7 @@ func TestSegmentRepo_DeleteSegment(t *testing.T) {
 		args         args
 		mockBehavior MockBehavior
 		wantErr      bool
+		wantErrIs    error
 	}{
 		{
 			name: "OK",
@@ -405,12 +654,12 @@ func TestSegmentRepo_DeleteSegment(t *testing.T) {
 				m.ExpectBegin()
 				m.ExpectQuery("SELECT us.user_id").
 					WithArgs(args.name).
-					WillReturnRows(pgxmock.NewRows([]string{"user_id"}).AddRow(1).AddRow(2))
+					WillReturnRows(pgxmock.NewRows([]string{"user_id", "variant"}).AddRow(1, "").AddRow(2, ""))
 				m.ExpectExec("user_segments_log").
-					WithArgs(1, args.name, "delete").
+					WithArgs(1, args.name, "", "delete", "", entity.SourceSegmentDelete, "").
 					WillReturnResult(pgxmock.NewResult("INSERT", 1))
 				m.ExpectExec("user_segments_log").
-					WithArgs(2, args.name, "delete").
+					WithArgs(2, args.name, "", "delete", "", entity.SourceSegmentDelete, "").
 					WillReturnResult(pgxmock.NewResult("INSERT", 1))
 				m.ExpectExec("DELETE FROM segments").
 					WithArgs(args.name).
@@ -419,6 +668,41 @@ func TestSegmentRepo_DeleteSegment(t *testing.T) {
 			},
 			wantErr: false,
 		},
+		{
+			name: "segment does not exist",
+			args: args{
+				ctx:  context.Background(),
+				name: "test_segment",
+			},
+			mockBehavior: func(m pgxmock.PgxPoolIface, args args) {
+				m.ExpectBegin()
+				m.ExpectQuery("SELECT us.user_id").
+					WithArgs(args.name).
+					WillReturnRows(pgxmock.NewRows([]string{"user_id", "variant"}))
+				m.ExpectExec("DELETE FROM segments").
+					WithArgs(args.name).
+					WillReturnResult(pgxmock.NewResult("DELETE", 0))
+				m.ExpectRollback()
+			},
+			wantErr:   true,
+			wantErrIs: repoerrs.ErrNotFound,
+		},
+		{
+			name: "members read cut short",
+			args: args{
+				ctx:  context.Background(),
+				name: "test_segment",
+			},
+			mockBehavior: func(m pgxmock.PgxPoolIface, args args) {
+				m.ExpectBegin()
+				m.ExpectQuery("SELECT us.user_id").
+					WithArgs(args.name).
+					WillReturnRows(pgxmock.NewRows([]string{"user_id", "variant"}).AddRow(1, "").RowError(1, &pgconn.PgError{Code: "40001"}))
+				m.ExpectRollback()
+			},
+			wantErr:   true,
+			wantErrIs: repoerrs.ErrConflict,
+		},
 		{
 			name: "transaction error",
 			args: args{
@@ -472,7 +756,7 @@ func TestSegmentRepo_DeleteSegment(t *testing.T) {
 				m.ExpectBegin()
 				m.ExpectQuery("SELECT us.user_id").
 					WithArgs(args.name).
-					WillReturnRows(pgxmock.NewRows([]string{"user_id"}).AddRow(1).RowError(0, errors.New("rows.Scan error")))
+					WillReturnRows(pgxmock.NewRows([]string{"user_id", "variant"}).AddRow(1, "").RowError(0, errors.New("rows.Scan error")))
 				m.ExpectRollback()
 			},
 			wantErr: true,
@@ -487,9 +771,9 @@ func TestSegmentRepo_DeleteSegment(t *testing.T) {
 				m.ExpectBegin()
 				m.ExpectQuery("SELECT us.user_id").
 					WithArgs(args.name).
-					WillReturnRows(pgxmock.NewRows([]string{"user_id"}).AddRow(1).AddRow(2))
+					WillReturnRows(pgxmock.NewRows([]string{"user_id", "variant"}).AddRow(1, "").AddRow(2, ""))
 				m.ExpectExec("user_segments_log").
-					WithArgs(1, args.name, "delete").
+					WithArgs(1, args.name, "", "delete", "", entity.SourceSegmentDelete, "").
 					WillReturnError(errors.New("some error"))
 				m.ExpectRollback()
 			},
@@ -505,12 +789,12 @@ func TestSegmentRepo_DeleteSegment(t *testing.T) {
 				m.ExpectBegin()
 				m.ExpectQuery("SELECT us.user_id").
 					WithArgs(args.name).
-					WillReturnRows(pgxmock.NewRows([]string{"user_id"}).AddRow(1).AddRow(2))
+					WillReturnRows(pgxmock.NewRows([]string{"user_id", "variant"}).AddRow(1, "").AddRow(2, ""))
 				m.ExpectExec("user_segments_log").
-					WithArgs(1, args.name, "delete").
+					WithArgs(1, args.name, "", "delete", "", entity.SourceSegmentDelete, "").
 					WillReturnResult(pgxmock.NewResult("INSERT", 1))
 				m.ExpectExec("user_segments_log").
-					WithArgs(2, args.name, "delete").
+					WithArgs(2, args.name, "", "delete", "", entity.SourceSegmentDelete, "").
 					WillReturnResult(pgxmock.NewResult("INSERT", 1))
 				m.ExpectExec("DELETE FROM segments").
 					WithArgs(args.name).
@@ -529,12 +813,12 @@ func TestSegmentRepo_DeleteSegment(t *testing.T) {
 				m.ExpectBegin()
 				m.ExpectQuery("SELECT us.user_id").
 					WithArgs(args.name).
-					WillReturnRows(pgxmock.NewRows([]string{"user_id"}).AddRow(1).AddRow(2))
+					WillReturnRows(pgxmock.NewRows([]string{"user_id", "variant"}).AddRow(1, "").AddRow(2, ""))
 				m.ExpectExec("user_segments_log").
-					WithArgs(1, args.name, "delete").
+					WithArgs(1, args.name, "", "delete", "", entity.SourceSegmentDelete, "").
 					WillReturnResult(pgxmock.NewResult("INSERT", 1))
 				m.ExpectExec("user_segments_log").
-					WithArgs(2, args.name, "delete").
+					WithArgs(2, args.name, "", "delete", "", entity.SourceSegmentDelete, "").
 					WillReturnResult(pgxmock.NewResult("INSERT", 1))
 				m.ExpectExec("DELETE FROM segments").
 					WithArgs(args.name).
@@ -561,6 +845,9 @@ func TestSegmentRepo_DeleteSegment(t *testing.T) {
 			err := segmentRepoMock.DeleteSegment(tc.args.ctx, tc.args.name)
 			if tc.wantErr {
 				assert.Error(t, err)
+				if tc.wantErrIs != nil {
+					assert.ErrorIs(t, err, tc.wantErrIs)
+				}
 				return
 			}
 			assert.NoError(t, err)
@@ -573,16 +860,21 @@ func TestSegmentRepo_DeleteSegment(t *testing.T) {
 
 func TestSegmentRepo_GetSegments(t *testing.T) {
 	type args struct {
-		ctx context.Context
+		ctx    context.Context
+		filter entity.SegmentFilter
 	}
 
 	type MockBehavior func(m pgxmock.PgxPoolIface, args args)
 
+	created := time.Date(2023, time.August, 31, 14, 0, 0, 0, time.UTC)
+	percentage := 30.0
+	columns := []string{"id", "name", "description", "owner", "tags", "amount", "bucketing", "salt", "layer", "bucket_offset", "variants", "rule", "created_at", "updated_at"}
+
 	testCases := []struct {
 		name         string
 		args         args
 		mockBehavior MockBehavior
-		want         []string
+		want         []entity.Segment
 		wantErr      bool
 	}{
 		{
@@ -591,10 +883,12 @@ func TestSegmentRepo_GetSegments(t *testing.T) {
 				ctx: context.Background(),
 			},
 			mockBehavior: func(m pgxmock.PgxPoolIface, args args) {
-				m.ExpectQuery("SELECT name FROM segments").
-					WillReturnRows(pgxmock.NewRows([]string{"name"}).AddRow("test_segment"))
+				m.ExpectQuery("SELECT id, name, description, owner, tags, amount, bucketing, salt, layer, bucket_offset, variants, rule, created_at, updated_at FROM segments ORDER BY name").
+					WillReturnRows(pgxmock.NewRows(columns).AddRow(int64(1), "test_segment", "desc", "growth", []string{"promo"}, (*float64)(nil), "", "", "", 0, []entity.Variant(nil), "", created, created))
+			},
+			want: []entity.Segment{
+				{ID: 1, Name: "test_segment", Description: "desc", Owner: "growth", Tags: []string{"promo"}, CreatedAt: created, UpdatedAt: created},
 			},
-			want:    []string{"test_segment"},
 			wantErr: false,
 		},
 		{
@@ -603,15 +897,33 @@ func TestSegmentRepo_GetSegments(t *testing.T) {
 				ctx: context.Background(),
 			},
 			mockBehavior: func(m pgxmock.PgxPoolIface, args args) {
-				rows := pgxmock.NewRows([]string{"name"}).
-					AddRow("test_segment_1").
-					AddRow("test_segment_2").
-					AddRow("test_segment_3")
+				rows := pgxmock.NewRows(columns).
+					AddRow(int64(1), "test_segment_1", "", "", []string{}, (*float64)(nil), "", "", "", 0, []entity.Variant(nil), "", created, created).
+					AddRow(int64(1), "test_segment_2", "", "", []string{}, &percentage, "", "", "", 0, []entity.Variant(nil), "", created, created)
 
-				m.ExpectQuery("SELECT name FROM segments").
+				m.ExpectQuery("SELECT (.+) FROM segments").
 					WillReturnRows(rows)
 			},
-			want:    []string{"test_segment_1", "test_segment_2", "test_segment_3"},
+			want: []entity.Segment{
+				{ID: 1, Name: "test_segment_1", Tags: []string{}, CreatedAt: created, UpdatedAt: created},
+				{ID: 1, Name: "test_segment_2", Tags: []string{}, Percentage: &percentage, CreatedAt: created, UpdatedAt: created},
+			},
+			wantErr: false,
+		},
+		{
+			name: "filter by owner and tag",
+			args: args{
+				ctx:    context.Background(),
+				filter: entity.SegmentFilter{Owner: "growth", Tag: "promo"},
+			},
+			mockBehavior: func(m pgxmock.PgxPoolIface, args args) {
+				m.ExpectQuery(`SELECT (.+) FROM segments WHERE owner = \$1 AND \$2 = ANY\(tags\) ORDER BY name`).
+					WithArgs("growth", "promo").
+					WillReturnRows(pgxmock.NewRows(columns).AddRow(int64(1), "test_segment", "", "growth", []string{"promo"}, (*float64)(nil), "", "", "", 0, []entity.Variant(nil), "", created, created))
+			},
+			want: []entity.Segment{
+				{ID: 1, Name: "test_segment", Owner: "growth", Tags: []string{"promo"}, CreatedAt: created, UpdatedAt: created},
+			},
 			wantErr: false,
 		},
 		{
@@ -620,8 +932,8 @@ func TestSegmentRepo_GetSegments(t *testing.T) {
 				ctx: context.Background(),
 			},
 			mockBehavior: func(m pgxmock.PgxPoolIface, args args) {
-				m.ExpectQuery("SELECT name FROM segments").
-					WillReturnRows(pgxmock.NewRows([]string{"name"}))
+				m.ExpectQuery("SELECT (.+) FROM segments").
+					WillReturnRows(pgxmock.NewRows(columns))
 			},
 			want:    nil,
 			wantErr: false,
@@ -632,11 +944,11 @@ func TestSegmentRepo_GetSegments(t *testing.T) {
 				ctx: context.Background(),
 			},
 			mockBehavior: func(m pgxmock.PgxPoolIface, args args) {
-				rows := pgxmock.NewRows([]string{"segment"}).
-					AddRow("segment1").
-					AddRow("segment2").
+				rows := pgxmock.NewRows(columns).
+					AddRow(int64(1), "segment1", "", "", []string{}, (*float64)(nil), "", "", "", 0, []entity.Variant(nil), "", created, created).
+					AddRow(int64(1), "segment2", "", "", []string{}, (*float64)(nil), "", "", "", 0, []entity.Variant(nil), "", created, created).
 					RowError(1, errors.New("rows.Scan error"))
-				m.ExpectQuery("SELECT name FROM segments").WillReturnRows(rows)
+				m.ExpectQuery("SELECT (.+) FROM segments").WillReturnRows(rows)
 			},
 			want:    nil,
 			wantErr: true,
@@ -647,7 +959,7 @@ func TestSegmentRepo_GetSegments(t *testing.T) {
 				ctx: context.Background(),
 			},
 			mockBehavior: func(m pgxmock.PgxPoolIface, args args) {
-				m.ExpectQuery("SELECT name FROM segments").
+				m.ExpectQuery("SELECT (.+) FROM segments").
 					WillReturnError(errors.New("some error"))
 			},
 			want:    nil,
@@ -667,7 +979,7 @@ func TestSegmentRepo_GetSegments(t *testing.T) {
 			}
 			segmentRepoMock := NewSegmentRepo(postgresMock)
 
-			got, err := segmentRepoMock.GetSegments(tc.args.ctx)
+			got, err := segmentRepoMock.GetSegments(tc.args.ctx, tc.args.filter)
 			if tc.wantErr {
 				assert.Error(t, err)
 				return
@@ -680,3 +992,758 @@ func TestSegmentRepo_GetSegments(t *testing.T) {
 		})
 	}
 }
+
+func TestSegmentRepo_GetSegment(t *testing.T) {
+	created := time.Date(2023, time.August, 31, 14, 0, 0, 0, time.UTC)
+	columns := []string{"id", "name", "description", "owner", "tags", "amount", "bucketing", "salt", "layer", "bucket_offset", "variants", "rule", "created_at", "updated_at"}
+
+	testCases := []struct {
+		name         string
+		mockBehavior func(m pgxmock.PgxPoolIface)
+		want         entity.Segment
+		wantErr      bool
+		wantErrIs    error
+	}{
+		{
+			name: "OK",
+			mockBehavior: func(m pgxmock.PgxPoolIface) {
+				m.ExpectQuery("SELECT (.+) FROM segments WHERE name = \\$1").
+					WithArgs("test_segment").
+					WillReturnRows(pgxmock.NewRows(columns).AddRow(int64(1), "test_segment", "desc", "growth", []string{"promo"}, (*float64)(nil), "", "", "", 0, []entity.Variant(nil), "", created, created))
+			},
+			want:    entity.Segment{ID: 1, Name: "test_segment", Description: "desc", Owner: "growth", Tags: []string{"promo"}, CreatedAt: created, UpdatedAt: created},
+			wantErr: false,
+		},
+		{
+			name: "found by former name",
+			mockBehavior: func(m pgxmock.PgxPoolIface) {
+				m.ExpectQuery("SELECT (.+) FROM segments WHERE name = \\$1").
+					WithArgs("test_segment").
+					WillReturnRows(pgxmock.NewRows(columns))
+				m.ExpectQuery("SELECT (.+) FROM segments WHERE id = \\(SELECT segment_id FROM segment_aliases").
+					WithArgs("test_segment").
+					WillReturnRows(pgxmock.NewRows(columns).AddRow(int64(1), "renamed_segment", "", "", []string{}, (*float64)(nil), "", "", "", 0, []entity.Variant(nil), "", created, created))
+			},
+			want:    entity.Segment{ID: 1, Name: "renamed_segment", Tags: []string{}, CreatedAt: created, UpdatedAt: created},
+			wantErr: false,
+		},
+		{
+			name: "not found",
+			mockBehavior: func(m pgxmock.PgxPoolIface) {
+				m.ExpectQuery("SELECT (.+) FROM segments WHERE name = \\$1").
+					WithArgs("test_segment").
+					WillReturnRows(pgxmock.NewRows(columns))
+				m.ExpectQuery("SELECT (.+) FROM segments WHERE id = \\(SELECT segment_id FROM segment_aliases").
+					WithArgs("test_segment").
+					WillReturnRows(pgxmock.NewRows(columns))
+			},
+			wantErr:   true,
+			wantErrIs: repoerrs.ErrNotFound,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			poolMock, _ := pgxmock.NewPool()
+			defer poolMock.Close()
+			tc.mockBehavior(poolMock)
+
+			postgresMock := &postgres.Postgres{
+				Builder: squirrel.StatementBuilder.PlaceholderFormat(squirrel.Dollar),
+				Pool:    poolMock,
+			}
+			segmentRepoMock := NewSegmentRepo(postgresMock)
+
+			got, err := segmentRepoMock.GetSegment(context.Background(), "test_segment")
+			if tc.wantErr {
+				assert.ErrorIs(t, err, tc.wantErrIs)
+				return
+			}
+			assert.NoError(t, err)
+
+			err = poolMock.ExpectationsWereMet()
+			assert.NoError(t, err)
+			assert.Equal(t, tc.want, got)
+		})
+	}
+}
+
+func TestSegmentRepo_UpdateSegment(t *testing.T) {
+	created := time.Date(2023, time.August, 31, 14, 0, 0, 0, time.UTC)
+	updated := created.Add(time.Hour)
+	columns := []string{"id", "name", "description", "owner", "tags", "amount", "bucketing", "salt", "layer", "bucket_offset", "variants", "rule", "created_at", "updated_at"}
+	description := "new description"
+	tags := []string{"promo"}
+	percentage := 24.0
+	invalidPercentage := 0.0
+	salt := "new salt"
+
+	testCases := []struct {
+		name         string
+		update       entity.SegmentUpdate
+		mockBehavior func(m pgxmock.PgxPoolIface)
+		want         entity.Segment
+		wantErr      bool
+		wantErrIs    error
+	}{
+		{
+			name:   "OK",
+			update: entity.SegmentUpdate{Description: &description, Tags: &tags},
+			mockBehavior: func(m pgxmock.PgxPoolIface) {
+				m.ExpectBegin()
+				m.ExpectQuery("UPDATE segments SET updated_at = NOW\\(\\), description = \\$1, tags = \\$2 WHERE name = \\$3 RETURNING").
+					WithArgs(description, tags, "test_segment").
+					WillReturnRows(pgxmock.NewRows(columns).AddRow(int64(1), "test_segment", description, "growth", tags, (*float64)(nil), "", "", "", 0, []entity.Variant(nil), "", created, updated))
+				m.ExpectCommit()
+			},
+			want:    entity.Segment{ID: 1, Name: "test_segment", Description: description, Owner: "growth", Tags: tags, CreatedAt: created, UpdatedAt: updated},
+			wantErr: false,
+		},
+		{
+			name:   "ramp up keeps current members",
+			update: entity.SegmentUpdate{Percentage: &percentage},
+			mockBehavior: func(m pgxmock.PgxPoolIface) {
+				m.ExpectBegin()
+				m.ExpectQuery("UPDATE segments SET updated_at = NOW\\(\\), amount = \\$1 WHERE name = \\$2 RETURNING").
+					WithArgs(percentage, "test_segment").
+					WillReturnRows(pgxmock.NewRows(columns).AddRow(int64(1), "test_segment", "", "", []string{}, &percentage, entity.BucketingHash, "test_segment", "", 0, []entity.Variant(nil), "", created, updated))
+				m.ExpectQuery("SELECT id FROM users ORDER BY id").
+					WillReturnRows(pgxmock.NewRows([]string{"id"}).AddRow(1).AddRow(2).AddRow(3).AddRow(4))
+				m.ExpectQuery("SELECT user_id FROM user_segments WHERE segment_name = \\$1").
+					WithArgs("test_segment").
+					WillReturnRows(pgxmock.NewRows([]string{"user_id"}).AddRow(2))
+				for _, userID := range []int{1, 4} {
+					m.ExpectExec("INSERT INTO user_segments \\(user_id,segment_name,variant\\)").
+						WithArgs(userID, "test_segment", "").
+						WillReturnResult(pgxmock.NewResult("INSERT", 1))
+					m.ExpectExec("INSERT INTO user_segments_log").
+						WithArgs(userID, "test_segment", "", "add", "", entity.SourceAuto, "").
+						WillReturnResult(pgxmock.NewResult("INSERT", 1))
+				}
+				m.ExpectCommit()
+			},
+			want:    entity.Segment{ID: 1, Name: "test_segment", Tags: []string{}, Percentage: &percentage, Bucketing: entity.BucketingHash, Salt: "test_segment", CreatedAt: created, UpdatedAt: updated},
+			wantErr: false,
+		},
+		{
+			name:   "new salt reshuffles members",
+			update: entity.SegmentUpdate{Salt: &salt},
+			mockBehavior: func(m pgxmock.PgxPoolIface) {
+				m.ExpectBegin()
+				m.ExpectQuery("UPDATE segments SET updated_at = NOW\\(\\), salt = \\$1 WHERE name = \\$2 RETURNING").
+					WithArgs(salt, "test_segment").
+					WillReturnRows(pgxmock.NewRows(columns).AddRow(int64(1), "test_segment", "", "", []string{}, &percentage, entity.BucketingHash, salt, "", 0, []entity.Variant(nil), "", created, updated))
+				m.ExpectQuery("SELECT id FROM users").
+					WillReturnRows(pgxmock.NewRows([]string{"id"}))
+				m.ExpectQuery("SELECT user_id FROM user_segments").
+					WithArgs("test_segment").
+					WillReturnRows(pgxmock.NewRows([]string{"user_id"}).AddRow(2))
+				m.ExpectQuery("DELETE FROM user_segments (.+) RETURNING variant").
+					WithArgs("test_segment", 2).
+					WillReturnRows(pgxmock.NewRows([]string{"variant"}).AddRow(""))
+				m.ExpectExec("INSERT INTO user_segments_log").
+					WithArgs(2, "test_segment", "", "delete", "", entity.SourceAuto, "").
+					WillReturnResult(pgxmock.NewResult("INSERT", 1))
+				m.ExpectCommit()
+			},
+			want:    entity.Segment{ID: 1, Name: "test_segment", Tags: []string{}, Percentage: &percentage, Bucketing: entity.BucketingHash, Salt: salt, CreatedAt: created, UpdatedAt: updated},
+			wantErr: false,
+		},
+		{
+			name:   "grow into another segment of the layer",
+			update: entity.SegmentUpdate{Percentage: &percentage},
+			mockBehavior: func(m pgxmock.PgxPoolIface) {
+				m.ExpectBegin()
+				m.ExpectQuery("UPDATE segments").
+					WithArgs(percentage, "test_segment").
+					WillReturnRows(pgxmock.NewRows(columns).AddRow(int64(1), "test_segment", "", "", []string{}, &percentage, entity.BucketingHash, "checkout", "checkout", 0, []entity.Variant(nil), "", created, updated))
+				m.ExpectExec("SELECT pg_advisory_xact_lock").
+					WithArgs("layer:checkout").
+					WillReturnResult(pgxmock.NewResult("SELECT", 1))
+				m.ExpectQuery("SELECT bucket_offset, amount FROM segments").
+					WithArgs("checkout", "test_segment").
+					WillReturnRows(pgxmock.NewRows([]string{"bucket_offset", "amount"}).AddRow(2000, 10.0))
+				m.ExpectRollback()
+			},
+			wantErr:   true,
+			wantErrIs: repoerrs.ErrConflict,
+		},
+		{
+			name:   "not an auto segment",
+			update: entity.SegmentUpdate{Percentage: &percentage},
+			mockBehavior: func(m pgxmock.PgxPoolIface) {
+				m.ExpectBegin()
+				m.ExpectQuery("UPDATE segments").
+					WithArgs(percentage, "test_segment").
+					WillReturnRows(pgxmock.NewRows(columns).AddRow(int64(1), "test_segment", "", "", []string{}, &percentage, "", "", "", 0, []entity.Variant(nil), "", created, updated))
+				m.ExpectRollback()
+			},
+			wantErr:   true,
+			wantErrIs: repoerrs.ErrInvalidInput,
+		},
+		{
+			name:         "invalid percentage",
+			update:       entity.SegmentUpdate{Percentage: &invalidPercentage},
+			mockBehavior: func(m pgxmock.PgxPoolIface) {},
+			wantErr:      true,
+			wantErrIs:    repoerrs.ErrInvalidInput,
+		},
+		{
+			name:         "nothing to update",
+			update:       entity.SegmentUpdate{},
+			mockBehavior: func(m pgxmock.PgxPoolIface) {},
+			wantErr:      true,
+			wantErrIs:    repoerrs.ErrInvalidInput,
+		},
+		{
+			name:   "not found",
+			update: entity.SegmentUpdate{Description: &description},
+			mockBehavior: func(m pgxmock.PgxPoolIface) {
+				m.ExpectBegin()
+				m.ExpectQuery("UPDATE segments").
+					WithArgs(description, "test_segment").
+					WillReturnRows(pgxmock.NewRows(columns))
+				m.ExpectRollback()
+			},
+			wantErr:   true,
+			wantErrIs: repoerrs.ErrNotFound,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			poolMock, _ := pgxmock.NewPool()
+			defer poolMock.Close()
+			tc.mockBehavior(poolMock)
+
+			postgresMock := &postgres.Postgres{
+				Builder: squirrel.StatementBuilder.PlaceholderFormat(squirrel.Dollar),
+				Pool:    poolMock,
+			}
+			segmentRepoMock := NewSegmentRepo(postgresMock)
+
+			got, err := segmentRepoMock.UpdateSegment(context.Background(), "test_segment", tc.update)
+			if tc.wantErr {
+				assert.ErrorIs(t, err, tc.wantErrIs)
+				return
+			}
+			assert.NoError(t, err)
+
+			err = poolMock.ExpectationsWereMet()
+			assert.NoError(t, err)
+			assert.Equal(t, tc.want, got)
+		})
+	}
+}
+
+func TestSegmentRepo_RenameSegment(t *testing.T) {
+	created := time.Date(2023, time.August, 31, 14, 0, 0, 0, time.UTC)
+	columns := []string{"id", "name", "description", "owner", "tags", "amount", "bucketing", "salt", "layer", "bucket_offset", "variants", "rule", "created_at", "updated_at"}
+
+	type args struct {
+		name    string
+		newName string
+	}
+
+	testCases := []struct {
+		name         string
+		args         args
+		mockBehavior func(m pgxmock.PgxPoolIface, args args)
+		want         entity.Segment
+		wantErr      bool
+		wantErrIs    error
+	}{
+		{
+			name: "OK",
+			args: args{name: "old_segment", newName: "new_segment"},
+			mockBehavior: func(m pgxmock.PgxPoolIface, args args) {
+				m.ExpectBegin()
+				m.ExpectQuery("UPDATE segments SET name = \\$1, updated_at = NOW\\(\\) WHERE name = \\$2 RETURNING").
+					WithArgs(args.newName, args.name).
+					WillReturnRows(pgxmock.NewRows(columns).AddRow(int64(7), args.newName, "", "", []string{}, (*float64)(nil), "", "", "", 0, []entity.Variant(nil), "", created, created))
+				m.ExpectExec("INSERT INTO segment_aliases").
+					WithArgs(args.name, int64(7)).
+					WillReturnResult(pgxmock.NewResult("INSERT", 1))
+				m.ExpectCommit()
+			},
+			want:    entity.Segment{ID: 7, Name: "new_segment", Tags: []string{}, CreatedAt: created, UpdatedAt: created},
+			wantErr: false,
+		},
+		{
+			name:         "same name",
+			args:         args{name: "old_segment", newName: "old_segment"},
+			mockBehavior: func(m pgxmock.PgxPoolIface, args args) {},
+			wantErr:      true,
+			wantErrIs:    repoerrs.ErrInvalidInput,
+		},
+		{
+			name: "segment not found",
+			args: args{name: "old_segment", newName: "new_segment"},
+			mockBehavior: func(m pgxmock.PgxPoolIface, args args) {
+				m.ExpectBegin()
+				m.ExpectQuery("UPDATE segments").
+					WithArgs(args.newName, args.name).
+					WillReturnRows(pgxmock.NewRows(columns))
+				m.ExpectRollback()
+			},
+			wantErr:   true,
+			wantErrIs: repoerrs.ErrNotFound,
+		},
+		{
+			name: "new name is taken",
+			args: args{name: "old_segment", newName: "new_segment"},
+			mockBehavior: func(m pgxmock.PgxPoolIface, args args) {
+				m.ExpectBegin()
+				m.ExpectQuery("UPDATE segments").
+					WithArgs(args.newName, args.name).
+					WillReturnError(&pgconn.PgError{
+						Code: "23505",
+					})
+				m.ExpectRollback()
+			},
+			wantErr:   true,
+			wantErrIs: repoerrs.ErrAlreadyExists,
+		},
+		{
+			name: "tx.Exec error",
+			args: args{name: "old_segment", newName: "new_segment"},
+			mockBehavior: func(m pgxmock.PgxPoolIface, args args) {
+				m.ExpectBegin()
+				m.ExpectQuery("UPDATE segments").
+					WithArgs(args.newName, args.name).
+					WillReturnRows(pgxmock.NewRows(columns).AddRow(int64(7), args.newName, "", "", []string{}, (*float64)(nil), "", "", "", 0, []entity.Variant(nil), "", created, created))
+				m.ExpectExec("INSERT INTO segment_aliases").
+					WithArgs(args.name, int64(7)).
+					WillReturnError(errors.New("some error"))
+				m.ExpectRollback()
+			},
+			wantErr: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			poolMock, _ := pgxmock.NewPool()
+			defer poolMock.Close()
+			tc.mockBehavior(poolMock, tc.args)
+
+			postgresMock := &postgres.Postgres{
+				Builder: squirrel.StatementBuilder.PlaceholderFormat(squirrel.Dollar),
+				Pool:    poolMock,
+			}
+			segmentRepoMock := NewSegmentRepo(postgresMock)
+
+			got, err := segmentRepoMock.RenameSegment(context.Background(), tc.args.name, tc.args.newName)
+			if tc.wantErr {
+				assert.Error(t, err)
+				if tc.wantErrIs != nil {
+					assert.ErrorIs(t, err, tc.wantErrIs)
+				}
+				return
+			}
+			assert.NoError(t, err)
+
+			err = poolMock.ExpectationsWereMet()
+			assert.NoError(t, err)
+			assert.Equal(t, tc.want, got)
+		})
+	}
+}
+
+func TestSegmentRepo_RebalanceAutoSegments(t *testing.T) {
+	created := time.Date(2023, time.August, 31, 14, 0, 0, 0, time.UTC)
+	columns := []string{"id", "name", "description", "owner", "tags", "amount", "bucketing", "salt", "layer", "bucket_offset", "variants", "rule", "created_at", "updated_at"}
+	percentage := 24.0
+	half := 50.0
+
+	type MockBehavior func(m pgxmock.PgxPoolIface)
+
+	testCases := []struct {
+		name         string
+		mockBehavior MockBehavior
+		want         int
+		wantErr      bool
+	}{
+		{
+			name: "no auto segments",
+			mockBehavior: func(m pgxmock.PgxPoolIface) {
+				m.ExpectBegin()
+				m.ExpectQuery("SELECT (.+) FROM segments WHERE amount IS NOT NULL ORDER BY name FOR UPDATE").
+					WillReturnRows(pgxmock.NewRows(columns))
+				m.ExpectRollback()
+			},
+			want:    0,
+			wantErr: false,
+		},
+		{
+			name: "OK",
+			mockBehavior: func(m pgxmock.PgxPoolIface) {
+				m.ExpectBegin()
+				m.ExpectQuery("SELECT (.+) FROM segments WHERE amount IS NOT NULL").
+					WillReturnRows(pgxmock.NewRows(columns).
+						AddRow(int64(1), "test_segment", "", "", []string{}, &percentage, entity.BucketingHash, "test_segment", "", 0, []entity.Variant(nil), "", created, created).
+						AddRow(int64(2), "random_segment", "", "", []string{}, &half, entity.BucketingRandom, "random_segment", "", 0, []entity.Variant(nil), "", created, created))
+				m.ExpectQuery("SELECT id FROM users ORDER BY id").
+					WillReturnRows(pgxmock.NewRows([]string{"id"}).AddRow(1).AddRow(2).AddRow(3).AddRow(4))
+
+				m.ExpectQuery("SELECT user_id FROM user_segments WHERE segment_name = \\$1").
+					WithArgs("test_segment").
+					WillReturnRows(pgxmock.NewRows([]string{"user_id"}).AddRow(2).AddRow(3))
+				m.ExpectQuery("DELETE FROM user_segments WHERE segment_name = \\$1 AND user_id = \\$2 RETURNING variant").
+					WithArgs("test_segment", 3).
+					WillReturnRows(pgxmock.NewRows([]string{"variant"}).AddRow(""))
+				m.ExpectExec("INSERT INTO user_segments_log").
+					WithArgs(3, "test_segment", "", "delete", "", entity.SourceAuto, "").
+					WillReturnResult(pgxmock.NewResult("INSERT", 1))
+				m.ExpectExec("INSERT INTO user_segments \\(user_id,segment_name,variant\\) VALUES \\(\\$1,\\$2,\\$3\\) ON CONFLICT DO NOTHING").
+					WithArgs(1, "test_segment", "").
+					WillReturnResult(pgxmock.NewResult("INSERT", 1))
+				m.ExpectExec("INSERT INTO user_segments_log").
+					WithArgs(1, "test_segment", "", "add", "", entity.SourceAuto, "").
+					WillReturnResult(pgxmock.NewResult("INSERT", 1))
+				// User 4 is already in another segment of the layer.
+				m.ExpectExec("INSERT INTO user_segments \\(user_id,segment_name,variant\\)").
+					WithArgs(4, "test_segment", "").
+					WillReturnResult(pgxmock.NewResult("INSERT", 0))
+
+				m.ExpectQuery("SELECT user_id FROM user_segments WHERE segment_name = \\$1").
+					WithArgs("random_segment").
+					WillReturnRows(pgxmock.NewRows([]string{"user_id"}).AddRow(1).AddRow(2))
+				m.ExpectCommit()
+			},
+			want:    2,
+			wantErr: false,
+		},
+		{
+			name: "tx.Query error",
+			mockBehavior: func(m pgxmock.PgxPoolIface) {
+				m.ExpectBegin()
+				m.ExpectQuery("SELECT (.+) FROM segments").
+					WillReturnError(errors.New("some error"))
+				m.ExpectRollback()
+			},
+			want:    -1,
+			wantErr: true,
+		},
+		{
+			name: "rows.Err error",
+			mockBehavior: func(m pgxmock.PgxPoolIface) {
+				m.ExpectBegin()
+				m.ExpectQuery("SELECT (.+) FROM segments").
+					WillReturnRows(pgxmock.NewRows(columns).RowError(0, errors.New("connection reset")))
+				m.ExpectRollback()
+			},
+			want:    -1,
+			wantErr: true,
+		},
+		{
+			name: "log error",
+			mockBehavior: func(m pgxmock.PgxPoolIface) {
+				m.ExpectBegin()
+				m.ExpectQuery("SELECT (.+) FROM segments").
+					WillReturnRows(pgxmock.NewRows(columns).
+						AddRow(int64(1), "test_segment", "", "", []string{}, &percentage, entity.BucketingHash, "test_segment", "", 0, []entity.Variant(nil), "", created, created))
+				m.ExpectQuery("SELECT id FROM users").
+					WillReturnRows(pgxmock.NewRows([]string{"id"}).AddRow(1))
+				m.ExpectQuery("SELECT user_id FROM user_segments").
+					WithArgs("test_segment").
+					WillReturnRows(pgxmock.NewRows([]string{"user_id"}))
+				m.ExpectExec("INSERT INTO user_segments \\(user_id,segment_name,variant\\)").
+					WithArgs(1, "test_segment", "").
+					WillReturnResult(pgxmock.NewResult("INSERT", 1))
+				m.ExpectExec("INSERT INTO user_segments_log").
+					WithArgs(1, "test_segment", "", "add", "", entity.SourceAuto, "").
+					WillReturnError(errors.New("some error"))
+				m.ExpectRollback()
+			},
+			want:    -1,
+			wantErr: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			poolMock, _ := pgxmock.NewPool()
+			defer poolMock.Close()
+			tc.mockBehavior(poolMock)
+
+			postgresMock := &postgres.Postgres{
+				Builder: squirrel.StatementBuilder.PlaceholderFormat(squirrel.Dollar),
+				Pool:    poolMock,
+			}
+			segmentRepoMock := NewSegmentRepo(postgresMock)
+
+			got, err := segmentRepoMock.RebalanceAutoSegments(context.Background())
+			assert.Equal(t, tc.want, got)
+			if tc.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+
+			err = poolMock.ExpectationsWereMet()
+			assert.NoError(t, err)
+		})
+	}
+}
+
+func TestSegmentRepo_RecomputeRuleSegments(t *testing.T) {
+	created := time.Date(2023, time.August, 31, 14, 0, 0, 0, time.UTC)
+	columns := []string{"id", "name", "description", "owner", "tags", "amount", "bucketing", "salt", "layer", "bucket_offset", "variants", "rule", "created_at", "updated_at"}
+	userColumns := []string{"id", "country", "platform", "signup_date", "properties"}
+
+	type MockBehavior func(m pgxmock.PgxPoolIface)
+
+	testCases := []struct {
+		name         string
+		mockBehavior MockBehavior
+		want         int
+		wantErr      bool
+	}{
+		{
+			name: "no rule segments",
+			mockBehavior: func(m pgxmock.PgxPoolIface) {
+				m.ExpectBegin()
+				m.ExpectQuery("SELECT (.+) FROM segments WHERE rule <> '' ORDER BY name FOR UPDATE").
+					WillReturnRows(pgxmock.NewRows(columns))
+				m.ExpectRollback()
+			},
+			want:    0,
+			wantErr: false,
+		},
+		{
+			name: "OK",
+			mockBehavior: func(m pgxmock.PgxPoolIface) {
+				m.ExpectBegin()
+				m.ExpectQuery("SELECT (.+) FROM segments WHERE rule <> ''").
+					WillReturnRows(pgxmock.NewRows(columns).
+						AddRow(int64(1), "ru_mobile", "", "", []string{}, (*float64)(nil), "", "", "", 0, []entity.Variant(nil), `country == "RU" && platform in ["ios", "android"]`, created, created).
+						AddRow(int64(2), "pro", "", "", []string{}, (*float64)(nil), "", "", "", 0, []entity.Variant(nil), `properties.plan == "pro"`, created, created))
+				m.ExpectQuery("SELECT id, country, platform, (.+), properties FROM users ORDER BY id").
+					WillReturnRows(pgxmock.NewRows(userColumns).
+						AddRow(1, "RU", "ios", "", map[string]any{"plan": "pro"}).
+						AddRow(2, "RU", "web", "", map[string]any{}).
+						AddRow(3, "RU", "android", "", map[string]any{"plan": "free"}))
+
+				m.ExpectQuery("SELECT user_id FROM user_segments WHERE segment_name = \\$1").
+					WithArgs("ru_mobile").
+					WillReturnRows(pgxmock.NewRows([]string{"user_id"}).AddRow(1).AddRow(2))
+				m.ExpectQuery("DELETE FROM user_segments WHERE segment_name = \\$1 AND user_id = \\$2 RETURNING variant").
+					WithArgs("ru_mobile", 2).
+					WillReturnRows(pgxmock.NewRows([]string{"variant"}).AddRow(""))
+				m.ExpectExec("INSERT INTO user_segments_log").
+					WithArgs(2, "ru_mobile", "", "delete", "", entity.SourceRule, "").
+					WillReturnResult(pgxmock.NewResult("INSERT", 1))
+				m.ExpectExec("INSERT INTO user_segments \\(user_id,segment_name,variant\\)").
+					WithArgs(3, "ru_mobile", "").
+					WillReturnResult(pgxmock.NewResult("INSERT", 1))
+				m.ExpectExec("INSERT INTO user_segments_log").
+					WithArgs(3, "ru_mobile", "", "add", "", entity.SourceRule, "").
+					WillReturnResult(pgxmock.NewResult("INSERT", 1))
+
+				m.ExpectQuery("SELECT user_id FROM user_segments WHERE segment_name = \\$1").
+					WithArgs("pro").
+					WillReturnRows(pgxmock.NewRows([]string{"user_id"}).AddRow(1))
+				m.ExpectCommit()
+			},
+			want:    2,
+			wantErr: false,
+		},
+		{
+			name: "tx.Query error",
+			mockBehavior: func(m pgxmock.PgxPoolIface) {
+				m.ExpectBegin()
+				m.ExpectQuery("SELECT (.+) FROM segments").
+					WillReturnError(errors.New("some error"))
+				m.ExpectRollback()
+			},
+			want:    -1,
+			wantErr: true,
+		},
+		{
+			name: "rows.Err error",
+			mockBehavior: func(m pgxmock.PgxPoolIface) {
+				m.ExpectBegin()
+				m.ExpectQuery("SELECT (.+) FROM segments").
+					WillReturnRows(pgxmock.NewRows(columns).RowError(0, errors.New("connection reset")))
+				m.ExpectRollback()
+			},
+			want:    -1,
+			wantErr: true,
+		},
+		{
+			name: "users read cut short",
+			mockBehavior: func(m pgxmock.PgxPoolIface) {
+				m.ExpectBegin()
+				m.ExpectQuery("SELECT (.+) FROM segments").
+					WillReturnRows(pgxmock.NewRows(columns).
+						AddRow(int64(1), "ru_mobile", "", "", []string{}, (*float64)(nil), "", "", "", 0, []entity.Variant(nil), `country == "RU"`, created, created))
+				m.ExpectQuery("SELECT (.+) FROM users").
+					WillReturnRows(pgxmock.NewRows(userColumns).
+						AddRow(1, "RU", "ios", "", map[string]any{}).
+						RowError(1, errors.New("connection reset")))
+				m.ExpectRollback()
+			},
+			want:    -1,
+			wantErr: true,
+		},
+		{
+			name: "users query error",
+			mockBehavior: func(m pgxmock.PgxPoolIface) {
+				m.ExpectBegin()
+				m.ExpectQuery("SELECT (.+) FROM segments").
+					WillReturnRows(pgxmock.NewRows(columns).
+						AddRow(int64(1), "ru_mobile", "", "", []string{}, (*float64)(nil), "", "", "", 0, []entity.Variant(nil), `country == "RU"`, created, created))
+				m.ExpectQuery("SELECT (.+) FROM users").
+					WillReturnError(errors.New("some error"))
+				m.ExpectRollback()
+			},
+			want:    -1,
+			wantErr: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			poolMock, _ := pgxmock.NewPool()
+			defer poolMock.Close()
+			tc.mockBehavior(poolMock)
+
+			postgresMock := &postgres.Postgres{
+				Builder: squirrel.StatementBuilder.PlaceholderFormat(squirrel.Dollar),
+				Pool:    poolMock,
+			}
+			segmentRepoMock := NewSegmentRepo(postgresMock)
+
+			got, err := segmentRepoMock.RecomputeRuleSegments(context.Background())
+			assert.Equal(t, tc.want, got)
+			if tc.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+
+			err = poolMock.ExpectationsWereMet()
+			assert.NoError(t, err)
+		})
+	}
+}
+
+func TestSegmentRepo_StreamSegmentMembers(t *testing.T) {
+	type MockBehavior func(m pgxmock.PgxPoolIface)
+
+	expire := time.Date(2023, 9, 30, 0, 0, 0, 0, time.UTC)
+	fnErr := errors.New("client gone")
+
+	testCases := []struct {
+		name         string
+		mockBehavior MockBehavior
+		want         []entity.SegmentMember
+		wantErr      bool
+		wantErrIs    error
+	}{
+		{
+			name: "OK",
+			mockBehavior: func(m pgxmock.PgxPoolIface) {
+				m.ExpectQuery("SELECT name FROM segments WHERE id = \\$1").
+					WithArgs(int64(3)).
+					WillReturnRows(pgxmock.NewRows([]string{"name"}).AddRow("renamed_segment"))
+				m.ExpectQuery("SELECT user_id, variant, expire::timestamptz FROM user_segments WHERE segment_name = \\$1 ORDER BY user_id").
+					WithArgs("renamed_segment").
+					WillReturnRows(pgxmock.NewRows([]string{"user_id", "variant", "expire"}).
+						AddRow(1, "", nil).
+						AddRow(2, "B", &expire))
+			},
+			want: []entity.SegmentMember{{UserID: 1}, {UserID: 2, Variant: "B", Expire: &expire}},
+		},
+		{
+			name: "segment not found",
+			mockBehavior: func(m pgxmock.PgxPoolIface) {
+				m.ExpectQuery("SELECT name FROM segments WHERE id = \\$1").
+					WithArgs(int64(3)).
+					WillReturnRows(pgxmock.NewRows([]string{"name"}))
+			},
+			wantErr:   true,
+			wantErrIs: repoerrs.ErrNotFound,
+		},
+		{
+			name: "fn fails",
+			mockBehavior: func(m pgxmock.PgxPoolIface) {
+				m.ExpectQuery("SELECT name FROM segments WHERE id = \\$1").
+					WithArgs(int64(3)).
+					WillReturnRows(pgxmock.NewRows([]string{"name"}).AddRow("renamed_segment"))
+				m.ExpectQuery("FROM user_segments WHERE segment_name = \\$1").
+					WithArgs("renamed_segment").
+					WillReturnRows(pgxmock.NewRows([]string{"user_id", "variant", "expire"}).
+						AddRow(2, "B", &expire))
+			},
+			wantErr:   true,
+			wantErrIs: fnErr,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			poolMock, _ := pgxmock.NewPool()
+			defer poolMock.Close()
+			tc.mockBehavior(poolMock)
+
+			postgresMock := &postgres.Postgres{
+				Builder: squirrel.StatementBuilder.PlaceholderFormat(squirrel.Dollar),
+				Pool:    poolMock,
+			}
+			segmentRepoMock := NewSegmentRepo(postgresMock)
+
+			var got []entity.SegmentMember
+			err := segmentRepoMock.StreamSegmentMembers(context.Background(), 3, func(member entity.SegmentMember) error {
+				if tc.wantErrIs == fnErr {
+					return fnErr
+				}
+				got = append(got, member)
+				return nil
+			})
+			if tc.wantErr {
+				assert.ErrorIs(t, err, tc.wantErrIs)
+				return
+			}
+			assert.NoError(t, err)
+
+			err = poolMock.ExpectationsWereMet()
+			assert.NoError(t, err)
+			assert.Equal(t, tc.want, got)
+		})
+	}
+}
+
+func TestSegmentRepo_StreamSegmentOperations(t *testing.T) {
+	poolMock, _ := pgxmock.NewPool()
+	defer poolMock.Close()
+
+	from := time.Date(2023, 8, 1, 0, 0, 0, 0, time.UTC)
+	to := from.AddDate(0, 1, 0)
+	added := from.Add(time.Hour)
+
+	poolMock.ExpectQuery("SELECT name FROM segments WHERE id = \\$1").
+		WithArgs(int64(3)).
+		WillReturnRows(pgxmock.NewRows([]string{"name"}).AddRow("test_segment"))
+	poolMock.ExpectQuery("FROM user_segments_log AS l LEFT JOIN segments AS s ON s.id = l.segment_id "+
+		"WHERE l.segment_id = \\$1 AND l.operation_time >= \\$2 AND l.operation_time < \\$3 ORDER BY l.operation_time, l.id").
+		WithArgs(int64(3), from, to).
+		WillReturnRows(pgxmock.NewRows([]string{"user_id", "segment", "variant", "operation", "operation_time", "actor", "source", "reason", "batch_id", "expires_at"}).
+			AddRow(1, "test_segment", "", "add", added, "", "", "", "", nil))
+
+	postgresMock := &postgres.Postgres{
+		Builder: squirrel.StatementBuilder.PlaceholderFormat(squirrel.Dollar),
+		Pool:    poolMock,
+	}
+	segmentRepoMock := NewSegmentRepo(postgresMock)
+
+	var got []entity.Operation
+	err := segmentRepoMock.StreamSegmentOperations(context.Background(), 3, from, to, func(o entity.Operation) error {
+		got = append(got, o)
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.NoError(t, poolMock.ExpectationsWereMet())
+	assert.Equal(t, []entity.Operation{{UserID: 1, Segment: "test_segment", Operation: "add", Time: added}}, got)
+}
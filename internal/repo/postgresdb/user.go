@@ -2,10 +2,18 @@ package postgresdb
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"math/rand"
+	"strconv"
 	"time"
 
+	"github.com/Masterminds/squirrel"
+	"github.com/jackc/pgx/v5"
+
 	"github.com/realPointer/segments/internal/entity"
+	"github.com/realPointer/segments/internal/repo/repoerrs"
+	"github.com/realPointer/segments/pkg/bucketing"
 	"github.com/realPointer/segments/pkg/postgres"
 )
 
@@ -25,55 +33,368 @@ type TimeProvider interface {
 	Now() time.Time
 }
 
-func (r *UserRepo) CreateUser(ctx context.Context, userId int) error {
+// CreateUser adds a user and enrolls them into every auto segment they fall
+// into: by bucket for hash segments and with the probability of the
+// percentage for random ones, so auto segments keep their share as new users
+// come in. Experiment segments also assign the user one of their variants.
+// The user also joins every rule segment their attributes match.
+func (r *UserRepo) CreateUser(ctx context.Context, userId int, attrs entity.UserAttributes) error {
+	date, err := signupDate(attrs)
+	if err != nil {
+		return fmt.Errorf("UserRepo.CreateUser: %w", err)
+	}
+
+	tx, err := r.Pool.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("UserRepo.CreateUser - r.Pool.Begin: %w", classify(err))
+	}
+	defer func() { _ = tx.Rollback(ctx) }()
+
 	sql, args, _ := r.Builder.
 		Insert("users").
-		Columns("id").
-		Values(userId).
+		Columns("id", "country", "platform", "signup_date", "properties").
+		Values(userId, attrs.Country, attrs.Platform, date, propertiesOrEmpty(attrs.Properties)).
+		ToSql()
+
+	_, err = tx.Exec(ctx, sql, args...)
+	if err != nil {
+		return fmt.Errorf("UserRepo.CreateUser - tx.Exec: %w", classify(err))
+	}
+
+	sql, args, _ = r.Builder.
+		Select("name", "amount", "bucketing", "salt", "bucket_offset", "variants").
+		From("segments").
+		Where("amount IS NOT NULL").
 		ToSql()
 
-	_, err := r.Pool.Exec(ctx, sql, args...)
+	rows, err := tx.Query(ctx, sql, args...)
 	if err != nil {
-		return fmt.Errorf("UserRepo.CreateUser - r.Pool.Exec: %v", err)
+		return fmt.Errorf("UserRepo.CreateUser - tx.Query: %w", classify(err))
+	}
+	defer rows.Close()
+
+	var segments []entity.Segment
+	for rows.Next() {
+		var segment entity.Segment
+		var percentage float64
+		err := rows.Scan(&segment.Name, &percentage, &segment.Bucketing, &segment.Salt, &segment.BucketOffset, &segment.Variants)
+		if err != nil {
+			return fmt.Errorf("UserRepo.CreateUser - rows.Scan: %w", classify(err))
+		}
+
+		var enrolled bool
+		if segment.Bucketing == entity.BucketingHash {
+			enrolled = bucketing.InRange(segment.Salt, userId, segment.BucketOffset, percentage)
+		} else {
+			enrolled = rand.Float64()*100 < percentage
+		}
+
+		if enrolled {
+			segments = append(segments, segment)
+		}
+	}
+
+	err = rows.Err()
+	if err != nil {
+		return fmt.Errorf("UserRepo.CreateUser - rows.Err: %w", classify(err))
+	}
+
+	for _, segment := range segments {
+		variant := pickVariant(segment, userId)
+
+		sql, args, _ = r.Builder.
+			Insert("user_segments").
+			Columns("user_id", "segment_name", "variant").
+			Values(userId, segment.Name, variant).
+			ToSql()
+
+		_, err = tx.Exec(ctx, sql, args...)
+		if err != nil {
+			return fmt.Errorf("UserRepo.CreateUser - tx.Exec2: %w", classify(err))
+		}
+
+		err = logOperation(ctx, tx, r.Builder, userId, segment.Name, variant, entity.OperationAdd, entity.SourceAuto)
+		if err != nil {
+			return fmt.Errorf("UserRepo.CreateUser - logOperation: %w", err)
+		}
+	}
+
+	err = r.syncRuleSegments(ctx, tx, userId, attrs)
+	if err != nil {
+		return fmt.Errorf("UserRepo.CreateUser - r.syncRuleSegments: %w", err)
+	}
+
+	err = tx.Commit(ctx)
+	if err != nil {
+		return fmt.Errorf("UserRepo.CreateUser - tx.Commit: %w", classify(err))
 	}
 
 	return nil
 }
 
-func (r *UserRepo) GetUserSegments(ctx context.Context, userId int) ([]string, error) {
+// SetUserAttributes replaces the attributes of a user and moves the user in
+// or out of rule segments accordingly.
+func (r *UserRepo) SetUserAttributes(ctx context.Context, userId int, attrs entity.UserAttributes) error {
+	date, err := signupDate(attrs)
+	if err != nil {
+		return fmt.Errorf("UserRepo.SetUserAttributes: %w", err)
+	}
+
+	tx, err := r.Pool.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("UserRepo.SetUserAttributes - r.Pool.Begin: %w", classify(err))
+	}
+	defer func() { _ = tx.Rollback(ctx) }()
+
+	sql, args, _ := r.Builder.
+		Update("users").
+		Set("country", attrs.Country).
+		Set("platform", attrs.Platform).
+		Set("signup_date", date).
+		Set("properties", propertiesOrEmpty(attrs.Properties)).
+		Where(squirrel.Eq{"id": userId}).
+		ToSql()
+
+	tag, err := tx.Exec(ctx, sql, args...)
+	if err != nil {
+		return fmt.Errorf("UserRepo.SetUserAttributes - tx.Exec: %w", classify(err))
+	}
+	if tag.RowsAffected() == 0 {
+		return fmt.Errorf("UserRepo.SetUserAttributes: %w", repoerrs.New(repoerrs.ErrNotFound, fmt.Sprintf("user %d not found", userId), nil))
+	}
+
+	err = r.syncRuleSegments(ctx, tx, userId, attrs)
+	if err != nil {
+		return fmt.Errorf("UserRepo.SetUserAttributes - r.syncRuleSegments: %w", err)
+	}
+
+	err = tx.Commit(ctx)
+	if err != nil {
+		return fmt.Errorf("UserRepo.SetUserAttributes - tx.Commit: %w", classify(err))
+	}
+
+	return nil
+}
+
+func (r *UserRepo) GetUserAttributes(ctx context.Context, userId int) (entity.UserAttributes, error) {
+	sql, args, _ := r.Builder.
+		Select(attributeColumns...).
+		From("users").
+		Where(squirrel.Eq{"id": userId}).
+		ToSql()
+
+	var attrs entity.UserAttributes
+	err := r.Pool.QueryRow(ctx, sql, args...).Scan(&attrs.Country, &attrs.Platform, &attrs.SignupDate, &attrs.Properties)
+	if err != nil {
+		return entity.UserAttributes{}, fmt.Errorf("UserRepo.GetUserAttributes - r.Pool.QueryRow: %w", missing(err, fmt.Sprintf("user %d", userId)))
+	}
+
+	return attrs, nil
+}
+
+// syncRuleSegments adds the user to the rule segments matching attrs and
+// removes them from the ones that no longer match.
+func (r *UserRepo) syncRuleSegments(ctx context.Context, tx pgx.Tx, userId int, attrs entity.UserAttributes) error {
 	sql, args, _ := r.Builder.
+		Select("name", "salt", "variants", "rule").
+		From("segments").
+		Where("rule <> ''").
+		ToSql()
+
+	rows, err := tx.Query(ctx, sql, args...)
+	if err != nil {
+		return fmt.Errorf("tx.Query: %w", classify(err))
+	}
+	defer rows.Close()
+
+	var segments []entity.Segment
+	for rows.Next() {
+		var segment entity.Segment
+		err := rows.Scan(&segment.Name, &segment.Salt, &segment.Variants, &segment.Rule)
+		if err != nil {
+			return fmt.Errorf("rows.Scan: %w", classify(err))
+		}
+
+		segments = append(segments, segment)
+	}
+
+	err = rows.Err()
+	if err != nil {
+		return fmt.Errorf("rows.Err: %w", classify(err))
+	}
+
+	if len(segments) == 0 {
+		return nil
+	}
+
+	sql, args, _ = r.Builder.
 		Select("us.segment_name").
+		From("user_segments AS us").
+		Join("segments AS s ON s.name = us.segment_name").
+		Where(squirrel.Eq{"us.user_id": userId}).
+		Where("s.rule <> ''").
+		ToSql()
+
+	rows, err = tx.Query(ctx, sql, args...)
+	if err != nil {
+		return fmt.Errorf("tx.Query2: %w", classify(err))
+	}
+	defer rows.Close()
+
+	isMember := make(map[string]bool)
+	for rows.Next() {
+		var name string
+		err := rows.Scan(&name)
+		if err != nil {
+			return fmt.Errorf("rows.Scan2: %w", classify(err))
+		}
+
+		isMember[name] = true
+	}
+
+	err = rows.Err()
+	if err != nil {
+		return fmt.Errorf("rows.Err2: %w", classify(err))
+	}
+
+	env := ruleAttrs(userId, attrs)
+	for _, segment := range segments {
+		rule, err := parseRule(segment.Rule)
+		if err != nil {
+			return fmt.Errorf("segment %q: %w", segment.Name, err)
+		}
+
+		var add, remove []int
+		switch matches := rule.Match(env); {
+		case matches && !isMember[segment.Name]:
+			add = []int{userId}
+		case !matches && isMember[segment.Name]:
+			remove = []int{userId}
+		default:
+			continue
+		}
+
+		_, err = applyMembers(ctx, tx, r.Builder, segment, entity.SourceRule, add, remove)
+		if err != nil {
+			return fmt.Errorf("applyMembers: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// GetUserSegments returns the segments of the user. expire is a wall-clock
+// TIMESTAMP compared with NOW(), so it is read as an instant in the same
+// time zone.
+func (r *UserRepo) GetUserSegments(ctx context.Context, userId int) ([]entity.UserSegment, error) {
+	sql, args, _ := r.Builder.
+		Select("us.segment_name", "us.variant", "us.expire::timestamptz").
 		From("user_segments as us").
 		Where("us.user_id = $1", userId).
 		ToSql()
 
 	rows, err := r.Pool.Query(ctx, sql, args...)
 	if err != nil {
-		return nil, fmt.Errorf("UserRepo.GetUserSegments - r.Pool.Query: %v", err)
+		return nil, fmt.Errorf("UserRepo.GetUserSegments - r.Pool.Query: %w", classify(err))
 	}
 	defer rows.Close()
 
-	var segments []string
+	var segments []entity.UserSegment
 	for rows.Next() {
-		var segment string
-		err := rows.Scan(&segment)
+		var segment entity.UserSegment
+		err := rows.Scan(&segment.Name, &segment.Variant, &segment.ExpiresAt)
 		if err != nil {
-			return nil, fmt.Errorf("UserRepo.GetUserSegments - rows.Scan: %v", err)
+			return nil, fmt.Errorf("UserRepo.GetUserSegments - rows.Scan: %w", classify(err))
 		}
 
 		segments = append(segments, segment)
 	}
 
+	err = rows.Err()
+	if err != nil {
+		return nil, fmt.Errorf("UserRepo.GetUserSegments - rows.Err: %w", classify(err))
+	}
+
+	return segments, nil
+}
+
+// GetUserSegmentsAt rebuilds the segments of the user at the given moment
+// from user_segments_log: a segment counts if its latest entry up to that
+// moment, TTL changes aside, is an add. Entries are matched to segments by
+// id so that renames keep their history, falling back to the name for
+// entries of segments that predate ids.
+func (r *UserRepo) GetUserSegmentsAt(ctx context.Context, userId int, at time.Time) ([]entity.UserSegment, error) {
+	latest := r.Builder.
+		Select("DISTINCT ON (l.segment_id, l.segment_name_key) l.segment_name", "l.variant", "l.operation").
+		FromSelect(r.Builder.
+			Select("l.segment_id", "CASE WHEN l.segment_id IS NULL THEN l.segment_name END AS segment_name_key",
+				"COALESCE(s.name, l.segment_name) AS segment_name", "l.variant", "l.operation", "l.operation_time", "l.id").
+			From("user_segments_log AS l").
+			LeftJoin("segments AS s ON s.id = l.segment_id").
+			Where("l.user_id = ?", userId).
+			Where("l.operation_time <= ?", at).
+			Where("l.operation <> 'ttl'"), "l").
+		OrderBy("l.segment_id", "l.segment_name_key", "l.operation_time DESC", "l.id DESC")
+
+	sql, args, _ := r.Builder.
+		Select("latest.segment_name", "latest.variant").
+		FromSelect(latest, "latest").
+		Where("latest.operation = 'add'").
+		OrderBy("latest.segment_name").
+		ToSql()
+
+	rows, err := r.Pool.Query(ctx, sql, args...)
+	if err != nil {
+		return nil, fmt.Errorf("UserRepo.GetUserSegmentsAt - r.Pool.Query: %w", classify(err))
+	}
+	defer rows.Close()
+
+	var segments []entity.UserSegment
+	for rows.Next() {
+		var segment entity.UserSegment
+		err := rows.Scan(&segment.Name, &segment.Variant)
+		if err != nil {
+			return nil, fmt.Errorf("UserRepo.GetUserSegmentsAt - rows.Scan: %w", classify(err))
+		}
+
+		segments = append(segments, segment)
+	}
+
+	err = rows.Err()
+	if err != nil {
+		return nil, fmt.Errorf("UserRepo.GetUserSegmentsAt - rows.Err: %w", classify(err))
+	}
+
 	return segments, nil
 }
 
-func (r *UserRepo) AddOrRemoveUserSegments(ctx context.Context, userId int, addSegments []entity.AddSegment, removeSegments []string) error {
+// AddOrRemoveUserSegments removes the user from removeSegments, then adds
+// them to addSegments, and returns the outcome for every segment. Adding a
+// segment the user is already in keeps the membership, moving its expiry
+// when one is given, and removing one they aren't in changes nothing; only
+// actual changes are logged. With an idempotency key, the outcome is stored
+// along with the changes and a retry with the same key returns it instead of
+// applying the request again.
+func (r *UserRepo) AddOrRemoveUserSegments(ctx context.Context, userId int, addSegments []entity.AddSegment, removeSegments []string, idempotencyKey string) ([]entity.SegmentChange, error) {
 	tx, err := r.Pool.Begin(ctx)
 	if err != nil {
-		return fmt.Errorf("UserRepo.AddOrRemoveUserSegments - r.Pool.Begin: %v", err)
+		return nil, fmt.Errorf("UserRepo.AddOrRemoveUserSegments - r.Pool.Begin: %w", classify(err))
 	}
 	defer func() { _ = tx.Rollback(ctx) }()
 
+	var requestHash string
+	if idempotencyKey != "" {
+		requestHash = hashSegmentsRequest(userId, addSegments, removeSegments)
+
+		changes, replayed, err := r.claimIdempotencyKey(ctx, tx, idempotencyKey, requestHash)
+		if err != nil {
+			return nil, fmt.Errorf("UserRepo.AddOrRemoveUserSegments - claimIdempotencyKey: %w", err)
+		}
+		if replayed {
+			return changes, nil
+		}
+	}
+
 	sql, args, _ := r.Builder.
 		Select("id").
 		From("users").
@@ -83,169 +404,596 @@ func (r *UserRepo) AddOrRemoveUserSegments(ctx context.Context, userId int, addS
 	var userCheckID int
 	err = tx.QueryRow(ctx, sql, args...).Scan(&userCheckID)
 	if err != nil {
-		return fmt.Errorf("UserRepo.AddOrRemoveUserSegments - tx.QueryRow: %v", err)
+		return nil, fmt.Errorf("UserRepo.AddOrRemoveUserSegments - tx.QueryRow: %w", missing(err, fmt.Sprintf("user %d", userId)))
+	}
+
+	changes := make([]entity.SegmentChange, 0, len(removeSegments)+len(addSegments))
+
+	for _, segment := range removeSegments {
+		sql, args, _ = r.Builder.
+			Select("bucketing").
+			From("segments").
+			Where("name = $1", segment).
+			ToSql()
+
+		var bucketing string
+		err = tx.QueryRow(ctx, sql, args...).Scan(&bucketing)
+		if err != nil {
+			return nil, fmt.Errorf("UserRepo.AddOrRemoveUserSegments - tx.QueryRow2: %w", missing(err, fmt.Sprintf("segment %q", segment)))
+		}
+
+		err = checkManualChange(segment, bucketing)
+		if err != nil {
+			return nil, fmt.Errorf("UserRepo.AddOrRemoveUserSegments: %w", err)
+		}
+
+		sql, args, _ = r.Builder.
+			Delete("user_segments").
+			Where("user_id = $1", userId).
+			Where("segment_name = $2", segment).
+			Suffix("RETURNING variant").
+			ToSql()
+
+		var variant string
+		err = tx.QueryRow(ctx, sql, args...).Scan(&variant)
+		if errors.Is(err, pgx.ErrNoRows) {
+			changes = append(changes, entity.SegmentChange{Segment: segment, Outcome: entity.OutcomeNotMember})
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("UserRepo.AddOrRemoveUserSegments - tx.QueryRow4: %w", classify(err))
+		}
+
+		err = logOperation(ctx, tx, r.Builder, userId, segment, variant, entity.OperationDelete, entity.SourceManual)
+		if err != nil {
+			return nil, fmt.Errorf("UserRepo.AddOrRemoveUserSegments - logOperation: %w", err)
+		}
+
+		changes = append(changes, entity.SegmentChange{Segment: segment, Outcome: entity.OutcomeRemoved})
 	}
 
 	for _, segment := range addSegments {
 		sql, args, _ = r.Builder.
-			Select("name").
+			Select("layer", "salt", "variants", "bucketing").
 			From("segments").
 			Where("name = $1", segment.Name).
 			ToSql()
 
-		var segmentCheckName string
-		err = tx.QueryRow(ctx, sql, args...).Scan(&segmentCheckName)
+		target := entity.Segment{Name: segment.Name}
+		err = tx.QueryRow(ctx, sql, args...).Scan(&target.Layer, &target.Salt, &target.Variants, &target.Bucketing)
+		if err != nil {
+			return nil, fmt.Errorf("UserRepo.AddOrRemoveUserSegments - tx.QueryRow2: %w", missing(err, fmt.Sprintf("segment %q", segment.Name)))
+		}
+
+		err = checkManualChange(segment.Name, target.Bucketing)
 		if err != nil {
-			return fmt.Errorf("UserRepo.AddOrRemoveUserSegments - tx.QueryRow2: %v", err)
+			return nil, fmt.Errorf("UserRepo.AddOrRemoveUserSegments: %w", err)
 		}
 
-		if segment.Expire == "" {
+		variant, err := chooseVariant(target, segment.Variant, userId)
+		if err != nil {
+			return nil, fmt.Errorf("UserRepo.AddOrRemoveUserSegments: %w", err)
+		}
+
+		layer := target.Layer
+		if layer != "" {
 			sql, args, _ = r.Builder.
-				Insert("user_segments").
-				Columns("user_id", "segment_name").
-				Values(userId, segment.Name).
+				Select("segment_name").
+				From("user_segments").
+				Where("user_id = $1", userId).
+				Where("layer = $2", layer).
+				Where("segment_name <> $3", segment.Name).
 				ToSql()
 
-			_, err := tx.Exec(ctx, sql, args...)
-			if err != nil {
-				return fmt.Errorf("UserRepo.AddOrRemoveUserSegments - tx.Exec1: %v", err)
+			var other string
+			err = tx.QueryRow(ctx, sql, args...).Scan(&other)
+			if err == nil {
+				return nil, fmt.Errorf("UserRepo.AddOrRemoveUserSegments: %w", repoerrs.New(repoerrs.ErrConflict, fmt.Sprintf("user %d is already in segment %q of layer %q", userId, other, layer), nil))
 			}
-		} else {
-
-			expire, err := time.ParseDuration(segment.Expire)
-			if err != nil {
-				return fmt.Errorf("UserRepo.AddOrRemoveUserSegments - time.ParseDuration: %v", err)
+			if !errors.Is(err, pgx.ErrNoRows) {
+				return nil, fmt.Errorf("UserRepo.AddOrRemoveUserSegments - tx.QueryRow3: %w", classify(err))
 			}
+		}
+
+		expiresAt, err := r.expiresAt(segment.Name, segment.Expire, segment.ExpiresAt)
+		if err != nil {
+			return nil, fmt.Errorf("UserRepo.AddOrRemoveUserSegments: %w", err)
+		}
 
+		if expiresAt == nil {
 			sql, args, _ = r.Builder.
 				Insert("user_segments").
-				Columns("user_id", "segment_name", "expire").
-				Values(userId, segment.Name, r.tp.Now().Add(expire)).
+				Columns("user_id", "segment_name", "variant").
+				Values(userId, segment.Name, variant).
+				Suffix("ON CONFLICT (user_id, segment_name) DO NOTHING").
 				ToSql()
+		} else {
+			sql, args, _ = r.Builder.
+				Insert("user_segments").
+				Columns("user_id", "segment_name", "variant", "expire").
+				Values(userId, segment.Name, variant, expireValue(expiresAt)).
+				Suffix("ON CONFLICT (user_id, segment_name) DO NOTHING").
+				ToSql()
+		}
+
+		tag, err := tx.Exec(ctx, sql, args...)
+		if err != nil {
+			return nil, fmt.Errorf("UserRepo.AddOrRemoveUserSegments - tx.Exec1: %w", classify(err))
+		}
 
-			_, err = tx.Exec(ctx, sql, args...)
+		if tag.RowsAffected() == 0 {
+			change, err := r.keepMembership(ctx, tx, userId, segment.Name, segment.Variant, expiresAt)
 			if err != nil {
-				return fmt.Errorf("UserRepo.AddOrRemoveUserSegments - tx.Exec1: %v", err)
+				return nil, fmt.Errorf("UserRepo.AddOrRemoveUserSegments - keepMembership: %w", err)
 			}
-		}
 
-		sql, args, _ = r.Builder.
-			Insert("user_segments_log").
-			Columns("user_id", "segment_name", "operation").
-			Values(userId, segment.Name, "add").
-			ToSql()
+			changes = append(changes, change)
+			continue
+		}
 
-		_, err = tx.Exec(ctx, sql, args...)
+		err = logExpiry(ctx, tx, r.Builder, userId, segment.Name, variant, entity.OperationAdd, entity.SourceManual, expiresAt)
 		if err != nil {
-			return fmt.Errorf("UserRepo.AddOrRemoveUserSegments - tx.Exec2: %v", err)
+			return nil, fmt.Errorf("UserRepo.AddOrRemoveUserSegments - logExpiry: %w", err)
 		}
-	}
 
-	for _, segment := range removeSegments {
-		sql, args, _ = r.Builder.
-			Select("name").
-			From("segments").
-			Where("name = $1", segment).
-			ToSql()
+		changes = append(changes, entity.SegmentChange{Segment: segment.Name, Outcome: entity.OutcomeAdded, Variant: variant, ExpiresAt: expiresAt})
+	}
 
-		var segmentCheckName string
-		err = tx.QueryRow(ctx, sql, args...).Scan(&segmentCheckName)
+	if idempotencyKey != "" {
+		err = r.storeIdempotentResult(ctx, tx, idempotencyKey, changes)
 		if err != nil {
-			return fmt.Errorf("UserRepo.AddOrRemoveUserSegments - tx.QueryRow2: %v", err)
+			return nil, fmt.Errorf("UserRepo.AddOrRemoveUserSegments - storeIdempotentResult: %w", err)
 		}
+	}
 
-		sql, args, _ = r.Builder.
-			Delete("user_segments").
-			Where("user_id = $1", userId).
-			Where("segment_name = $2", segment).
-			ToSql()
+	err = tx.Commit(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("UserRepo.AddOrRemoveUserSegments - tx.Commit: %w", classify(err))
+	}
 
-		_, err := tx.Exec(ctx, sql, args...)
-		if err != nil {
-			return fmt.Errorf("UserRepo.AddOrRemoveUserSegments - tx.Exec3: %v", err)
+	return changes, nil
+}
+
+// keepMembership returns the outcome of adding the user to a segment they
+// are already in. The variant stays as it is, so requesting another one is a
+// conflict. The expiry moves to expiresAt when it is given, which is logged
+// as a TTL change.
+func (r *UserRepo) keepMembership(ctx context.Context, tx pgx.Tx, userId int, segment, variant string, expiresAt *time.Time) (entity.SegmentChange, error) {
+	change := entity.SegmentChange{Segment: segment, Outcome: entity.OutcomeAlreadyPresent}
+
+	sql, args, _ := r.Builder.
+		Select("variant", "expire::timestamptz").
+		From("user_segments").
+		Where(squirrel.Eq{"user_id": userId, "segment_name": segment}).
+		ToSql()
+
+	err := tx.QueryRow(ctx, sql, args...).Scan(&change.Variant, &change.ExpiresAt)
+	if err != nil {
+		return change, fmt.Errorf("tx.QueryRow: %w", classify(err))
+	}
+
+	if variant != "" && variant != change.Variant {
+		return change, repoerrs.New(repoerrs.ErrConflict, fmt.Sprintf("user %d is already in variant %q of segment %q", userId, change.Variant, segment), nil)
+	}
+	if expiresAt == nil {
+		return change, nil
+	}
+
+	sql, args, _ = r.Builder.
+		Update("user_segments").
+		Set("expire", expireValue(expiresAt)).
+		Where(squirrel.Eq{"user_id": userId, "segment_name": segment}).
+		ToSql()
+
+	_, err = tx.Exec(ctx, sql, args...)
+	if err != nil {
+		return change, fmt.Errorf("tx.Exec: %w", classify(err))
+	}
+	change.ExpiresAt = expiresAt
+
+	err = logExpiry(ctx, tx, r.Builder, userId, segment, change.Variant, entity.OperationTTL, entity.SourceManual, expiresAt)
+	if err != nil {
+		return change, fmt.Errorf("logExpiry: %w", err)
+	}
+
+	return change, nil
+}
+
+// chooseVariant returns the variant requested for the user or, when none is
+// requested, the one the user is bucketed into.
+func chooseVariant(segment entity.Segment, requested string, userID int) (string, error) {
+	if requested == "" {
+		return pickVariant(segment, userID), nil
+	}
+
+	for _, v := range segment.Variants {
+		if v.Name == requested {
+			return requested, nil
 		}
+	}
 
-		sql, args, _ = r.Builder.
-			Insert("user_segments_log").
-			Columns("user_id", "segment_name", "operation").
-			Values(userId, segment, "delete").
-			ToSql()
+	return "", repoerrs.New(repoerrs.ErrInvalidInput, fmt.Sprintf("segment %q has no variant %q", segment.Name, requested), nil)
+}
 
-		_, err = tx.Exec(ctx, sql, args...)
+// expiresAt returns when a membership of the segment expires: after expire,
+// a duration, or at expiresAt, nil when neither is given. Expiries that
+// aren't in the future are invalid.
+func (r *UserRepo) expiresAt(segment, expire string, expiresAt *time.Time) (*time.Time, error) {
+	now := r.tp.Now()
+	switch {
+	case expire != "" && expiresAt != nil:
+		return nil, repoerrs.New(repoerrs.ErrInvalidInput, fmt.Sprintf("expire and expires_at of segment %q can't be combined", segment), nil)
+	case expire != "":
+		d, err := time.ParseDuration(expire)
 		if err != nil {
-			return fmt.Errorf("UserRepo.AddOrRemoveUserSegments - tx.Exec4: %v", err)
+			return nil, repoerrs.New(repoerrs.ErrInvalidInput, fmt.Sprintf("invalid expire %q of segment %q", expire, segment), err)
 		}
+		t := now.Add(d)
+		expiresAt = &t
+	case expiresAt == nil:
+		return nil, nil
+	}
+
+	if !expiresAt.After(now) {
+		return nil, repoerrs.New(repoerrs.ErrInvalidInput, fmt.Sprintf("expiry %s of segment %q is not in the future", expiresAt.Format(time.RFC3339), segment), nil)
+	}
+
+	return expiresAt, nil
+}
+
+// expireValue is t as a value of user_segments.expire. The column is a
+// wall-clock TIMESTAMP compared with NOW(), so t is converted to the time
+// zone of the session.
+func expireValue(t *time.Time) any {
+	if t == nil {
+		return nil
+	}
+
+	return squirrel.Expr("?::timestamptz::timestamp", *t)
+}
+
+// SetUserSegmentExpiry moves the expiry of the membership of the user in the
+// segment, or clears it when expiry sets none, and logs the change.
+func (r *UserRepo) SetUserSegmentExpiry(ctx context.Context, userId int, segment string, expiry entity.Expiry) (entity.UserSegment, error) {
+	expiresAt, err := r.expiresAt(segment, expiry.Expire, expiry.ExpiresAt)
+	if err != nil {
+		return entity.UserSegment{}, fmt.Errorf("UserRepo.SetUserSegmentExpiry: %w", err)
+	}
+
+	tx, err := r.Pool.Begin(ctx)
+	if err != nil {
+		return entity.UserSegment{}, fmt.Errorf("UserRepo.SetUserSegmentExpiry - r.Pool.Begin: %w", classify(err))
+	}
+	defer func() { _ = tx.Rollback(ctx) }()
+
+	sql, args, _ := r.Builder.
+		Update("user_segments").
+		Set("expire", expireValue(expiresAt)).
+		Where(squirrel.Eq{"user_id": userId, "segment_name": segment}).
+		Suffix("RETURNING variant").
+		ToSql()
+
+	userSegment := entity.UserSegment{Name: segment, ExpiresAt: expiresAt}
+	err = tx.QueryRow(ctx, sql, args...).Scan(&userSegment.Variant)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return entity.UserSegment{}, fmt.Errorf("UserRepo.SetUserSegmentExpiry: %w", repoerrs.New(repoerrs.ErrNotFound, fmt.Sprintf("user %d is not in segment %q", userId, segment), nil))
+	}
+	if err != nil {
+		return entity.UserSegment{}, fmt.Errorf("UserRepo.SetUserSegmentExpiry - tx.QueryRow: %w", classify(err))
+	}
+
+	err = logExpiry(ctx, tx, r.Builder, userId, segment, userSegment.Variant, entity.OperationTTL, entity.SourceManual, expiresAt)
+	if err != nil {
+		return entity.UserSegment{}, fmt.Errorf("UserRepo.SetUserSegmentExpiry - logExpiry: %w", err)
 	}
 
 	err = tx.Commit(ctx)
 	if err != nil {
-		return fmt.Errorf("UserRepo.AddOrRemoveUserSegments - tx.Commit: %v", err)
+		return entity.UserSegment{}, fmt.Errorf("UserRepo.SetUserSegmentExpiry - tx.Commit: %w", classify(err))
 	}
 
-	return nil
+	return userSegment, nil
+}
+
+var operationColumns = []string{"l.user_id", "COALESCE(s.name, l.segment_name)", "l.variant", "l.operation", "l.operation_time", "l.actor", "l.source", "l.reason", "l.batch_id", "l.expires_at"}
+
+// operationFields returns where to scan operationColumns into o.
+func operationFields(o *entity.Operation) []any {
+	return []any{&o.UserID, &o.Segment, &o.Variant, &o.Operation, &o.Time, &o.Actor, &o.Source, &o.Reason, &o.Batch, &o.ExpiresAt}
 }
 
-func (r *UserRepo) GetUserOperations(ctx context.Context, userId int) ([]string, error) {
+func (r *UserRepo) GetUserOperations(ctx context.Context, userId int) ([]entity.Operation, error) {
 	sql, args, _ := r.Builder.
-		Select("user_id", "segment_name", "operation", "operation_time").
-		From("user_segments_log").
-		Where("user_id = $1", userId).
+		Select(operationColumns...).
+		From("user_segments_log AS l").
+		LeftJoin("segments AS s ON s.id = l.segment_id").
+		Where("l.user_id = $1", userId).
+		OrderBy("l.operation_time", "l.id").
 		ToSql()
 
 	rows, err := r.Pool.Query(ctx, sql, args...)
 	if err != nil {
-		return nil, fmt.Errorf("UserRepo.GetUserOperations - r.Pool.Query: %v", err)
+		return nil, fmt.Errorf("UserRepo.GetUserOperations - r.Pool.Query: %w", classify(err))
 	}
-	defer rows.Close()
 
-	var operations []string
-	for rows.Next() {
-		var userID int
-		var segmentName, operation string
-		var operationTime time.Time
-		err := rows.Scan(&userID, &segmentName, &operation, &operationTime)
-		if err != nil {
-			return nil, fmt.Errorf("UserRepo.GetUserOperations - rows.Scan: %v", err)
-		}
-
-		operations = append(operations, fmt.Sprintf("(%d, %s, %s, %s)", userID, segmentName, operation, operationTime))
+	operations, err := scanOperations(rows)
+	if err != nil {
+		return nil, fmt.Errorf("UserRepo.GetUserOperations - %w", err)
 	}
 
 	return operations, nil
 }
 
-func (r *UserRepo) GetUserOperationsByMonth(ctx context.Context, userId int, yearMonth string) ([]string, error) {
+func (r *UserRepo) GetUserOperationsByMonth(ctx context.Context, userId int, yearMonth string) ([]entity.Operation, error) {
 	startDate, err := time.Parse("2006-01", yearMonth)
 	if err != nil {
-		return nil, fmt.Errorf("UserRepo.GetUserOperationsByMonth - time.Parse: %v", err)
+		return nil, fmt.Errorf("UserRepo.GetUserOperationsByMonth - time.Parse: %w", repoerrs.New(repoerrs.ErrInvalidInput, fmt.Sprintf("invalid month %q, expected YYYY-MM", yearMonth), err))
 	}
 	endDate := startDate.AddDate(0, 1, 0).Add(-time.Nanosecond)
 
 	sql, args, _ := r.Builder.
-		Select("user_id", "segment_name", "operation", "operation_time").
-		From("user_segments_log").
-		Where("user_id = $1", userId).
-		Where("operation_time >= $2", startDate).
-		Where("operation_time <= $3", endDate).
+		Select(operationColumns...).
+		From("user_segments_log AS l").
+		LeftJoin("segments AS s ON s.id = l.segment_id").
+		Where("l.user_id = $1", userId).
+		Where("l.operation_time >= $2", startDate).
+		Where("l.operation_time <= $3", endDate).
+		OrderBy("l.operation_time", "l.id").
 		ToSql()
 
 	rows, err := r.Pool.Query(ctx, sql, args...)
 	if err != nil {
-		return nil, fmt.Errorf("UserRepo.GetUserOperationsByMonth - r.Pool.Query: %v", err)
+		return nil, fmt.Errorf("UserRepo.GetUserOperationsByMonth - r.Pool.Query: %w", classify(err))
+	}
+
+	operations, err := scanOperations(rows)
+	if err != nil {
+		return nil, fmt.Errorf("UserRepo.GetUserOperationsByMonth - %w", err)
+	}
+
+	return operations, nil
+}
+
+// GetUserOperationsPage returns the operations of the user matching filter,
+// ordered by time, and the cursor of the next page, empty on the last one.
+// Pages are found by the position of the last entry rather than by offset,
+// so deep pages cost as much as the first one.
+func (r *UserRepo) GetUserOperationsPage(ctx context.Context, userId int, filter entity.OperationFilter) ([]entity.Operation, string, error) {
+	builder, err := r.userOperations(userId, filter)
+	if err != nil {
+		return nil, "", fmt.Errorf("UserRepo.GetUserOperationsPage - %w", err)
+	}
+
+	order, after := "ASC", ">"
+	if filter.Desc {
+		order, after = "DESC", "<"
+	}
+	if filter.Cursor != "" {
+		operationTime, id, err := decodeLogCursor(filter.Cursor)
+		if err != nil {
+			return nil, "", fmt.Errorf("UserRepo.GetUserOperationsPage - decodeLogCursor: %w", err)
+		}
+		builder = builder.Where("(l.operation_time, l.id) "+after+" (?, ?)", operationTime, id)
+	}
+	builder = builder.OrderBy("l.operation_time "+order, "l.id "+order)
+	if filter.Limit > 0 {
+		builder = builder.Limit(uint64(filter.Limit) + 1)
+	}
+
+	sql, args, _ := builder.ToSql()
+
+	rows, err := r.Pool.Query(ctx, sql, args...)
+	if err != nil {
+		return nil, "", fmt.Errorf("UserRepo.GetUserOperationsPage - r.Pool.Query: %w", classify(err))
+	}
+	defer rows.Close()
+
+	var operations []entity.Operation
+	var ids []int64
+	for rows.Next() {
+		var o entity.Operation
+		var id int64
+		err := rows.Scan(append(operationFields(&o), &id)...)
+		if err != nil {
+			return nil, "", fmt.Errorf("UserRepo.GetUserOperationsPage - rows.Scan: %w", classify(err))
+		}
+
+		operations = append(operations, o)
+		ids = append(ids, id)
+	}
+
+	err = rows.Err()
+	if err != nil {
+		return nil, "", fmt.Errorf("UserRepo.GetUserOperationsPage - rows.Err: %w", classify(err))
+	}
+
+	var next string
+	if filter.Limit > 0 && len(operations) > filter.Limit {
+		operations = operations[:filter.Limit]
+		next = encodeLogCursor(operations[filter.Limit-1].Time, ids[filter.Limit-1])
+	}
+
+	return operations, next, nil
+}
+
+// StreamUserOperations calls fn for every operation of the user matching the
+// filter, oldest first, as they are read. Cursor, Desc and Limit of the
+// filter are ignored.
+func (r *UserRepo) StreamUserOperations(ctx context.Context, userId int, filter entity.OperationFilter, fn func(entity.Operation) error) error {
+	builder, err := r.userOperations(userId, filter)
+	if err != nil {
+		return fmt.Errorf("UserRepo.StreamUserOperations - %w", err)
+	}
+
+	sql, args, _ := builder.OrderBy("l.operation_time", "l.id").ToSql()
+
+	rows, err := r.Pool.Query(ctx, sql, args...)
+	if err != nil {
+		return fmt.Errorf("UserRepo.StreamUserOperations - r.Pool.Query: %w", classify(err))
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var o entity.Operation
+		var id int64
+		err := rows.Scan(append(operationFields(&o), &id)...)
+		if err != nil {
+			return fmt.Errorf("UserRepo.StreamUserOperations - rows.Scan: %w", classify(err))
+		}
+
+		err = fn(o)
+		if err != nil {
+			return fmt.Errorf("UserRepo.StreamUserOperations - fn: %w", err)
+		}
+	}
+
+	err = rows.Err()
+	if err != nil {
+		return fmt.Errorf("UserRepo.StreamUserOperations - rows.Err: %w", classify(err))
+	}
+
+	return nil
+}
+
+// userOperations selects the operations of the user matching the bounds,
+// segment and operation of the filter, with the ids of their log entries.
+func (r *UserRepo) userOperations(userId int, filter entity.OperationFilter) (squirrel.SelectBuilder, error) {
+	builder := r.Builder.
+		Select(operationColumns...).
+		Column("l.id").
+		From("user_segments_log AS l").
+		LeftJoin("segments AS s ON s.id = l.segment_id").
+		Where(squirrel.Eq{"l.user_id": userId})
+
+	if !filter.From.IsZero() {
+		builder = builder.Where("l.operation_time >= ?", filter.From)
+	}
+	if !filter.To.IsZero() {
+		builder = builder.Where("l.operation_time < ?", filter.To)
+	}
+	if filter.Segment != "" {
+		builder = builder.Where("COALESCE(s.name, l.segment_name) = ?", filter.Segment)
+	}
+	if filter.Operation != "" {
+		switch filter.Operation {
+		case entity.OperationAdd, entity.OperationDelete, entity.OperationExpire, entity.OperationTTL:
+		default:
+			return builder, repoerrs.New(repoerrs.ErrInvalidInput,
+				fmt.Sprintf("unknown operation %q, expected %s, %s, %s or %s", filter.Operation, entity.OperationAdd, entity.OperationDelete, entity.OperationExpire, entity.OperationTTL), nil)
+		}
+		builder = builder.Where(squirrel.Eq{"l.operation": filter.Operation})
+	}
+	if filter.Source != "" {
+		err := checkSource(filter.Source)
+		if err != nil {
+			return builder, err
+		}
+		builder = builder.Where(squirrel.Eq{"l.source": filter.Source})
+	}
+
+	return builder, nil
+}
+
+func checkSource(source string) error {
+	switch source {
+	case entity.SourceManual, entity.SourceAuto, entity.SourceExpire, entity.SourceSegmentDelete, entity.SourceRule, entity.SourceBulk:
+		return nil
+	}
+
+	return repoerrs.New(repoerrs.ErrInvalidInput, fmt.Sprintf("unknown source %q, expected %s, %s, %s, %s, %s or %s", source,
+		entity.SourceManual, entity.SourceAuto, entity.SourceExpire, entity.SourceSegmentDelete, entity.SourceRule, entity.SourceBulk), nil)
+}
+
+// StreamOperations calls fn for the operations of all users matching filter,
+// in cursor order, as they are read from the database. It stops at the first
+// error fn returns. Entries of transactions that may still be running are
+// held back, so that no entry can later appear before those already passed
+// to fn.
+func (r *UserRepo) StreamOperations(ctx context.Context, filter entity.FeedFilter, fn func(entity.FeedEntry) error) error {
+	builder := r.Builder.
+		Select("l.xid::text", "l.id").
+		Columns(operationColumns...).
+		From("user_segments_log AS l").
+		LeftJoin("segments AS s ON s.id = l.segment_id").
+		Where("l.xid < pg_snapshot_xmin(pg_current_snapshot())")
+
+	if filter.After != "" {
+		xid, id, err := decodeFeedCursor(filter.After)
+		if err != nil {
+			return fmt.Errorf("UserRepo.StreamOperations - decodeFeedCursor: %w", err)
+		}
+		builder = builder.Where("(l.xid, l.id) > (?::text::xid8, ?)", strconv.FormatUint(xid, 10), id)
+	}
+	if !filter.From.IsZero() {
+		builder = builder.Where("l.operation_time >= ?", filter.From)
+	}
+	if !filter.To.IsZero() {
+		builder = builder.Where("l.operation_time < ?", filter.To)
+	}
+	if filter.Segment != "" {
+		builder = builder.Where("COALESCE(s.name, l.segment_name) = ?", filter.Segment)
+	}
+	if filter.Source != "" {
+		err := checkSource(filter.Source)
+		if err != nil {
+			return fmt.Errorf("UserRepo.StreamOperations: %w", err)
+		}
+		builder = builder.Where(squirrel.Eq{"l.source": filter.Source})
+	}
+	builder = builder.OrderBy("l.xid", "l.id")
+	if filter.Limit > 0 {
+		builder = builder.Limit(uint64(filter.Limit))
+	}
+
+	sql, args, _ := builder.ToSql()
+
+	rows, err := r.Pool.Query(ctx, sql, args...)
+	if err != nil {
+		return fmt.Errorf("UserRepo.StreamOperations - r.Pool.Query: %w", classify(err))
 	}
 	defer rows.Close()
 
-	var operations []string
 	for rows.Next() {
-		var userID int
-		var segmentName, operation string
-		var operationTime time.Time
-		err := rows.Scan(&userID, &segmentName, &operation, &operationTime)
+		var xid string
+		var id int64
+		var o entity.Operation
+		err := rows.Scan(append([]any{&xid, &id}, operationFields(&o)...)...)
 		if err != nil {
-			return nil, fmt.Errorf("UserRepo.GetUserOperationsByMonth - rows.Scan: %v", err)
+			return fmt.Errorf("UserRepo.StreamOperations - rows.Scan: %w", classify(err))
 		}
 
-		operations = append(operations, fmt.Sprintf("(%d, %s, %s, %s)", userID, segmentName, operation, operationTime))
+		err = fn(entity.FeedEntry{Cursor: encodeFeedCursor(xid, id), Operation: o})
+		if err != nil {
+			return fmt.Errorf("UserRepo.StreamOperations - fn: %w", err)
+		}
+	}
+
+	err = rows.Err()
+	if err != nil {
+		return fmt.Errorf("UserRepo.StreamOperations - rows.Err: %w", classify(err))
+	}
+
+	return nil
+}
+
+// scanOperations reads rows of operationColumns and closes them.
+func scanOperations(rows pgx.Rows) ([]entity.Operation, error) {
+	defer rows.Close()
+
+	var operations []entity.Operation
+	for rows.Next() {
+		var o entity.Operation
+		err := rows.Scan(operationFields(&o)...)
+		if err != nil {
+			return nil, fmt.Errorf("rows.Scan: %w", classify(err))
+		}
+
+		operations = append(operations, o)
+	}
+
+	err := rows.Err()
+	if err != nil {
+		return nil, fmt.Errorf("rows.Err: %w", classify(err))
 	}
 
 	return operations, nil
@@ -3,14 +3,15 @@ package postgresdb
 import (
 	"context"
 	"errors"
-	"fmt"
 	"testing"
 	"time"
 
 	"github.com/Masterminds/squirrel"
+	"github.com/jackc/pgx/v5"
 	"github.com/jackc/pgx/v5/pgconn"
 	"github.com/pashagolub/pgxmock/v3"
 	"github.com/realPointer/segments/internal/entity"
+	"github.com/realPointer/segments/internal/repo/repoerrs"
 	"github.com/realPointer/segments/pkg/postgres"
 	"github.com/stretchr/testify/assert"
 )
@@ -25,6 +26,7 @@ func TestUserRepo_CreateUser(t *testing.T) {
 	type args struct {
 		ctx    context.Context
 		userId int
+		attrs  entity.UserAttributes
 	}
 
 	type MockBehavior func(m pgxmock.PgxPoolIface, args args)
@@ -34,6 +36,7 @@ func TestUserRepo_CreateUser(t *testing.T) {
 		args         args
 		mockBehavior MockBehavior
 		wantErr      bool
+		wantErrIs    error
 	}{
 		{
 			name: "OK",
@@ -42,26 +45,120 @@ func TestUserRepo_CreateUser(t *testing.T) {
 				userId: 1,
 			},
 			mockBehavior: func(m pgxmock.PgxPoolIface, args args) {
+				m.ExpectBegin()
 				m.ExpectExec("INSERT INTO users").
-					WithArgs(args.userId).
+					WithArgs(args.userId, "", "", nil, map[string]any{}).
 					WillReturnResult(pgxmock.NewResult("INSERT", 1))
+				m.ExpectQuery("SELECT name, amount, bucketing, salt, bucket_offset, variants FROM segments WHERE amount IS NOT NULL").
+					WillReturnRows(pgxmock.NewRows([]string{"name", "amount", "bucketing", "salt", "bucket_offset", "variants"}).
+						AddRow("test_segment", 10.0, entity.BucketingHash, "test_segment", 0, []entity.Variant(nil)))
+				m.ExpectQuery("SELECT name, salt, variants, rule FROM segments WHERE rule <> ''").
+					WillReturnRows(pgxmock.NewRows([]string{"name", "salt", "variants", "rule"}))
+				m.ExpectCommit()
 			},
 			wantErr: false,
 		},
 		{
-			name: "user already exists",
+			name: "OK, enrolled into auto segments",
+			args: args{
+				ctx:    context.Background(),
+				userId: 1,
+			},
+			mockBehavior: func(m pgxmock.PgxPoolIface, args args) {
+				m.ExpectBegin()
+				m.ExpectExec("INSERT INTO users").
+					WithArgs(args.userId, "", "", nil, map[string]any{}).
+					WillReturnResult(pgxmock.NewResult("INSERT", 1))
+				m.ExpectQuery("SELECT name, amount, bucketing, salt, bucket_offset, variants FROM segments").
+					WillReturnRows(pgxmock.NewRows([]string{"name", "amount", "bucketing", "salt", "bucket_offset", "variants"}).
+						AddRow("test_segment", 10.0, entity.BucketingHash, "test_segment", 0, []entity.Variant(nil)).
+						AddRow("auto_segment", 16.0, entity.BucketingHash, "auto_segment", 0, []entity.Variant(nil)).
+						AddRow("random_segment", 100.0, entity.BucketingRandom, "random_segment", 0, []entity.Variant(nil)))
+				m.ExpectExec("INSERT INTO user_segments").
+					WithArgs(args.userId, "auto_segment", "").
+					WillReturnResult(pgxmock.NewResult("INSERT", 1))
+				m.ExpectExec("INSERT INTO user_segments_log").
+					WithArgs(args.userId, "auto_segment", "", "add", "", entity.SourceAuto, "").
+					WillReturnResult(pgxmock.NewResult("INSERT", 1))
+				m.ExpectExec("INSERT INTO user_segments").
+					WithArgs(args.userId, "random_segment", "").
+					WillReturnResult(pgxmock.NewResult("INSERT", 1))
+				m.ExpectExec("INSERT INTO user_segments_log").
+					WithArgs(args.userId, "random_segment", "", "add", "", entity.SourceAuto, "").
+					WillReturnResult(pgxmock.NewResult("INSERT", 1))
+				m.ExpectQuery("SELECT name, salt, variants, rule FROM segments WHERE rule <> ''").
+					WillReturnRows(pgxmock.NewRows([]string{"name", "salt", "variants", "rule"}))
+				m.ExpectCommit()
+			},
+			wantErr: false,
+		},
+		{
+			name: "OK, joins matching rule segments",
 			args: args{
 				ctx:    context.Background(),
 				userId: 1,
+				attrs: entity.UserAttributes{
+					Country:    "RU",
+					Platform:   "ios",
+					SignupDate: "2023-08-31",
+					Properties: map[string]any{"plan": "pro"},
+				},
 			},
 			mockBehavior: func(m pgxmock.PgxPoolIface, args args) {
+				m.ExpectBegin()
 				m.ExpectExec("INSERT INTO users").
+					WithArgs(args.userId, "RU", "ios", time.Date(2023, 8, 31, 0, 0, 0, 0, time.UTC), args.attrs.Properties).
+					WillReturnResult(pgxmock.NewResult("INSERT", 1))
+				m.ExpectQuery("SELECT name, amount, bucketing, salt, bucket_offset, variants FROM segments").
+					WillReturnRows(pgxmock.NewRows([]string{"name", "amount", "bucketing", "salt", "bucket_offset", "variants"}))
+				m.ExpectQuery("SELECT name, salt, variants, rule FROM segments WHERE rule <> ''").
+					WillReturnRows(pgxmock.NewRows([]string{"name", "salt", "variants", "rule"}).
+						AddRow("ru_mobile", "", []entity.Variant(nil), `country == "RU" && platform in ["ios", "android"]`).
+						AddRow("kz", "", []entity.Variant(nil), `country == "KZ"`).
+						AddRow("pro", "", []entity.Variant(nil), `properties.plan == "pro"`))
+				m.ExpectQuery("SELECT us.segment_name FROM user_segments AS us JOIN segments AS s ON s.name = us.segment_name WHERE us.user_id = \\$1 AND s.rule <> ''").
 					WithArgs(args.userId).
+					WillReturnRows(pgxmock.NewRows([]string{"segment_name"}))
+				for _, name := range []string{"ru_mobile", "pro"} {
+					m.ExpectExec("INSERT INTO user_segments \\(user_id,segment_name,variant\\) VALUES \\(\\$1,\\$2,\\$3\\) ON CONFLICT DO NOTHING").
+						WithArgs(args.userId, name, "").
+						WillReturnResult(pgxmock.NewResult("INSERT", 1))
+					m.ExpectExec("INSERT INTO user_segments_log").
+						WithArgs(args.userId, name, "", "add", "", entity.SourceRule, "").
+						WillReturnResult(pgxmock.NewResult("INSERT", 1))
+				}
+				m.ExpectCommit()
+			},
+			wantErr: false,
+		},
+		{
+			name: "invalid signup date",
+			args: args{
+				ctx:    context.Background(),
+				userId: 1,
+				attrs:  entity.UserAttributes{SignupDate: "31.08.2023"},
+			},
+			mockBehavior: func(m pgxmock.PgxPoolIface, args args) {},
+			wantErr:      true,
+			wantErrIs:    repoerrs.ErrInvalidInput,
+		},
+		{
+			name: "user already exists",
+			args: args{
+				ctx:    context.Background(),
+				userId: 1,
+			},
+			mockBehavior: func(m pgxmock.PgxPoolIface, args args) {
+				m.ExpectBegin()
+				m.ExpectExec("INSERT INTO users").
+					WithArgs(args.userId, "", "", nil, map[string]any{}).
 					WillReturnError(&pgconn.PgError{
 						Code: "23505",
 					})
+				m.ExpectRollback()
 			},
-			wantErr: true,
+			wantErr:   true,
+			wantErrIs: repoerrs.ErrAlreadyExists,
 		},
 		{
 			name: "unexpected error",
@@ -70,9 +167,56 @@ func TestUserRepo_CreateUser(t *testing.T) {
 				userId: 1,
 			},
 			mockBehavior: func(m pgxmock.PgxPoolIface, args args) {
+				m.ExpectBegin()
 				m.ExpectExec("INSERT INTO users").
-					WithArgs(args.userId).
+					WithArgs(args.userId, "", "", nil, map[string]any{}).
+					WillReturnError(errors.New("some error"))
+				m.ExpectRollback()
+			},
+			wantErr: true,
+		},
+		{
+			name: "rows.Err error",
+			args: args{
+				ctx:    context.Background(),
+				userId: 1,
+			},
+			mockBehavior: func(m pgxmock.PgxPoolIface, args args) {
+				m.ExpectBegin()
+				m.ExpectExec("INSERT INTO users").
+					WithArgs(args.userId, "", "", nil, map[string]any{}).
+					WillReturnResult(pgxmock.NewResult("INSERT", 1))
+				m.ExpectQuery("SELECT name, amount, bucketing, salt, bucket_offset, variants FROM segments").
+					WillReturnRows(pgxmock.NewRows([]string{"name", "amount", "bucketing", "salt", "bucket_offset", "variants"}).
+						RowError(0, &pgconn.PgError{Code: "40001"}))
+				m.ExpectRollback()
+			},
+			wantErr:   true,
+			wantErrIs: repoerrs.ErrConflict,
+		},
+		{
+			name: "log error",
+			args: args{
+				ctx:    context.Background(),
+				userId: 1,
+			},
+			mockBehavior: func(m pgxmock.PgxPoolIface, args args) {
+				m.ExpectBegin()
+				m.ExpectExec("INSERT INTO users").
+					WithArgs(args.userId, "", "", nil, map[string]any{}).
+					WillReturnResult(pgxmock.NewResult("INSERT", 1))
+				m.ExpectQuery("SELECT name, amount, bucketing, salt, bucket_offset, variants FROM segments").
+					WillReturnRows(pgxmock.NewRows([]string{"name", "amount", "bucketing", "salt", "bucket_offset", "variants"}).
+						AddRow("test_segment", 10.0, entity.BucketingHash, "test_segment", 0, []entity.Variant(nil)).
+						AddRow("auto_segment", 16.0, entity.BucketingHash, "auto_segment", 0, []entity.Variant(nil)).
+						AddRow("random_segment", 100.0, entity.BucketingRandom, "random_segment", 0, []entity.Variant(nil)))
+				m.ExpectExec("INSERT INTO user_segments").
+					WithArgs(args.userId, "auto_segment", "").
+					WillReturnResult(pgxmock.NewResult("INSERT", 1))
+				m.ExpectExec("INSERT INTO user_segments_log").
+					WithArgs(args.userId, "auto_segment", "", "add", "", entity.SourceAuto, "").
 					WillReturnError(errors.New("some error"))
+				m.ExpectRollback()
 			},
 			wantErr: true,
 		},
@@ -90,9 +234,12 @@ func TestUserRepo_CreateUser(t *testing.T) {
 			}
 			userRepoMock := NewUserRepo(postgresMock, MockTimeProvider{})
 
-			err := userRepoMock.CreateUser(tc.args.ctx, tc.args.userId)
+			err := userRepoMock.CreateUser(tc.args.ctx, tc.args.userId, tc.args.attrs)
 			if tc.wantErr {
 				assert.Error(t, err)
+				if tc.wantErrIs != nil {
+					assert.ErrorIs(t, err, tc.wantErrIs)
+				}
 				return
 			}
 			assert.NoError(t, err)
@@ -104,6 +251,8 @@ func TestUserRepo_CreateUser(t *testing.T) {
 }
 
 func TestUserRepo_GetUserSegments(t *testing.T) {
+	expiresAt := time.Date(2023, 9, 1, 12, 0, 0, 0, time.UTC)
+
 	type args struct {
 		ctx    context.Context
 		userId int
@@ -115,7 +264,7 @@ func TestUserRepo_GetUserSegments(t *testing.T) {
 		name         string
 		args         args
 		mockBehavior MockBehavior
-		want         []string
+		want         []entity.UserSegment
 		wantErr      bool
 	}{
 		{
@@ -125,11 +274,13 @@ func TestUserRepo_GetUserSegments(t *testing.T) {
 				userId: 1,
 			},
 			mockBehavior: func(m pgxmock.PgxPoolIface, args args) {
-				m.ExpectQuery("SELECT us.segment_name").
+				m.ExpectQuery("SELECT us.segment_name, us.variant, us.expire::timestamptz").
 					WithArgs(args.userId).
-					WillReturnRows(pgxmock.NewRows([]string{"segment_name"}).AddRow("segment1"))
+					WillReturnRows(pgxmock.NewRows([]string{"segment_name", "variant", "expire"}).
+						AddRow("segment1", "", nil).
+						AddRow("segment2", "b", &expiresAt))
 			},
-			want:    []string{"segment1"},
+			want:    []entity.UserSegment{{Name: "segment1"}, {Name: "segment2", Variant: "b", ExpiresAt: &expiresAt}},
 			wantErr: false,
 		},
 		{
@@ -141,9 +292,9 @@ func TestUserRepo_GetUserSegments(t *testing.T) {
 			mockBehavior: func(m pgxmock.PgxPoolIface, args args) {
 				m.ExpectQuery("SELECT us.segment_name").
 					WithArgs(args.userId).
-					WillReturnRows(pgxmock.NewRows([]string{"segment_name"}))
+					WillReturnRows(pgxmock.NewRows([]string{"segment_name", "variant", "expire"}))
 			},
-			want:    []string(nil),
+			want:    []entity.UserSegment(nil),
 			wantErr: false,
 		},
 		{
@@ -169,7 +320,21 @@ func TestUserRepo_GetUserSegments(t *testing.T) {
 			mockBehavior: func(m pgxmock.PgxPoolIface, args args) {
 				m.ExpectQuery("SELECT us.segment_name").
 					WithArgs(args.userId).
-					WillReturnRows(pgxmock.NewRows([]string{"segment_name"}).AddRow("segment1").RowError(0, errors.New("rows.Scan error")))
+					WillReturnRows(pgxmock.NewRows([]string{"segment_name", "variant", "expire"}).AddRow("segment1", "", nil).RowError(0, errors.New("rows.Scan error")))
+			},
+			want:    nil,
+			wantErr: true,
+		},
+		{
+			name: "rows.Err error",
+			args: args{
+				ctx:    context.Background(),
+				userId: 1,
+			},
+			mockBehavior: func(m pgxmock.PgxPoolIface, args args) {
+				m.ExpectQuery("SELECT us.segment_name").
+					WithArgs(args.userId).
+					WillReturnRows(pgxmock.NewRows([]string{"segment_name", "variant", "expire"}).AddRow("segment1", "", nil).RowError(1, errors.New("conn closed")))
 			},
 			want:    nil,
 			wantErr: true,
@@ -202,6 +367,130 @@ func TestUserRepo_GetUserSegments(t *testing.T) {
 	}
 }
 
+func TestUserRepo_GetUserSegmentsAt(t *testing.T) {
+	type args struct {
+		ctx    context.Context
+		userId int
+		at     time.Time
+	}
+
+	type MockBehavior func(m pgxmock.PgxPoolIface, args args)
+
+	at := time.Date(2023, 8, 15, 12, 0, 0, 0, time.UTC)
+	query := "SELECT latest.segment_name, latest.variant FROM \\(SELECT DISTINCT ON \\(l.segment_id, l.segment_name_key\\) .* " +
+		"FROM user_segments_log AS l LEFT JOIN segments AS s ON s.id = l.segment_id WHERE l.user_id = \\$1 AND l.operation_time <= \\$2 AND l.operation <> 'ttl'\\) AS l " +
+		"ORDER BY l.segment_id, l.segment_name_key, l.operation_time DESC, l.id DESC\\) AS latest WHERE latest.operation = 'add'"
+
+	testCases := []struct {
+		name         string
+		args         args
+		mockBehavior MockBehavior
+		want         []entity.UserSegment
+		wantErr      bool
+	}{
+		{
+			name: "OK",
+			args: args{
+				ctx:    context.Background(),
+				userId: 1,
+				at:     at,
+			},
+			mockBehavior: func(m pgxmock.PgxPoolIface, args args) {
+				m.ExpectQuery(query).
+					WithArgs(args.userId, args.at).
+					WillReturnRows(pgxmock.NewRows([]string{"segment_name", "variant"}).AddRow("segment1", "").AddRow("segment2", "b"))
+			},
+			want:    []entity.UserSegment{{Name: "segment1"}, {Name: "segment2", Variant: "b"}},
+			wantErr: false,
+		},
+		{
+			name: "no segments",
+			args: args{
+				ctx:    context.Background(),
+				userId: 1,
+				at:     at,
+			},
+			mockBehavior: func(m pgxmock.PgxPoolIface, args args) {
+				m.ExpectQuery(query).
+					WithArgs(args.userId, args.at).
+					WillReturnRows(pgxmock.NewRows([]string{"segment_name", "variant"}))
+			},
+			want:    []entity.UserSegment(nil),
+			wantErr: false,
+		},
+		{
+			name: "unexpected error",
+			args: args{
+				ctx:    context.Background(),
+				userId: 1,
+				at:     at,
+			},
+			mockBehavior: func(m pgxmock.PgxPoolIface, args args) {
+				m.ExpectQuery(query).
+					WithArgs(args.userId, args.at).
+					WillReturnError(errors.New("some error"))
+			},
+			want:    nil,
+			wantErr: true,
+		},
+		{
+			name: "rows.Scan error",
+			args: args{
+				ctx:    context.Background(),
+				userId: 1,
+				at:     at,
+			},
+			mockBehavior: func(m pgxmock.PgxPoolIface, args args) {
+				m.ExpectQuery(query).
+					WithArgs(args.userId, args.at).
+					WillReturnRows(pgxmock.NewRows([]string{"segment_name", "variant"}).AddRow("segment1", "").RowError(0, errors.New("rows.Scan error")))
+			},
+			want:    nil,
+			wantErr: true,
+		},
+		{
+			name: "rows.Err error",
+			args: args{
+				ctx:    context.Background(),
+				userId: 1,
+				at:     at,
+			},
+			mockBehavior: func(m pgxmock.PgxPoolIface, args args) {
+				m.ExpectQuery(query).
+					WithArgs(args.userId, args.at).
+					WillReturnRows(pgxmock.NewRows([]string{"segment_name", "variant"}).AddRow("segment1", "").RowError(1, errors.New("conn closed")))
+			},
+			want:    nil,
+			wantErr: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			poolMock, _ := pgxmock.NewPool()
+			defer poolMock.Close()
+			tc.mockBehavior(poolMock, tc.args)
+
+			postgresMock := &postgres.Postgres{
+				Builder: squirrel.StatementBuilder.PlaceholderFormat(squirrel.Dollar),
+				Pool:    poolMock,
+			}
+			userRepoMock := NewUserRepo(postgresMock, MockTimeProvider{})
+
+			got, err := userRepoMock.GetUserSegmentsAt(tc.args.ctx, tc.args.userId, tc.args.at)
+			if tc.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+
+			err = poolMock.ExpectationsWereMet()
+			assert.NoError(t, err)
+			assert.Equal(t, tc.want, got)
+		})
+	}
+}
+
 func TestUserRepo_GetUserOperations(t *testing.T) {
 	type args struct {
 		ctx    context.Context
@@ -214,7 +503,7 @@ func TestUserRepo_GetUserOperations(t *testing.T) {
 		name         string
 		args         args
 		mockBehavior MockBehavior
-		want         []string
+		want         []entity.Operation
 		wantErr      bool
 	}{
 		{
@@ -225,11 +514,12 @@ func TestUserRepo_GetUserOperations(t *testing.T) {
 			},
 			mockBehavior: func(m pgxmock.PgxPoolIface, args args) {
 				operationTime := time.Unix(1672531200, 0)
-				m.ExpectQuery("SELECT user_id, segment_name, operation, operation_time").
+				m.ExpectQuery("SELECT l.user_id, COALESCE\\(s.name, l.segment_name\\), l.variant, l.operation, l.operation_time, l.actor, l.source, l.reason, l.batch_id, l.expires_at FROM user_segments_log AS l LEFT JOIN segments AS s ON s.id = l.segment_id .* ORDER BY l.operation_time, l.id").
 					WithArgs(args.userId).
-					WillReturnRows(pgxmock.NewRows([]string{"user_id", "segment_name", "operation", "operation_time"}).AddRow(1, "segment1", "add", operationTime))
+					WillReturnRows(pgxmock.NewRows([]string{"user_id", "segment_name", "variant", "operation", "operation_time", "actor", "source", "reason", "batch_id", "expires_at"}).AddRow(1, "segment1", "", "add", operationTime, "marketing", "manual", "autumn campaign", "740", nil))
 			},
-			want:    []string{fmt.Sprintf("(1, segment1, add, %s)", time.Unix(1672531200, 0))},
+			want: []entity.Operation{{UserID: 1, Segment: "segment1", Operation: "add", Time: time.Unix(1672531200, 0),
+				Actor: "marketing", Source: "manual", Reason: "autumn campaign", Batch: "740"}},
 			wantErr: false,
 		},
 		{
@@ -239,11 +529,11 @@ func TestUserRepo_GetUserOperations(t *testing.T) {
 				userId: 1,
 			},
 			mockBehavior: func(m pgxmock.PgxPoolIface, args args) {
-				m.ExpectQuery("SELECT user_id, segment_name, operation, operation_time").
+				m.ExpectQuery("SELECT l.user_id, COALESCE\\(s.name, l.segment_name\\), l.variant, l.operation, l.operation_time, l.actor, l.source, l.reason, l.batch_id, l.expires_at FROM user_segments_log AS l LEFT JOIN segments AS s ON s.id = l.segment_id .* ORDER BY l.operation_time, l.id").
 					WithArgs(args.userId).
-					WillReturnRows(pgxmock.NewRows([]string{"user_id", "segment_name", "operation", "operation_time"}))
+					WillReturnRows(pgxmock.NewRows([]string{"user_id", "segment_name", "variant", "operation", "operation_time", "actor", "source", "reason", "batch_id", "expires_at"}))
 			},
-			want:    []string(nil),
+			want:    []entity.Operation(nil),
 			wantErr: false,
 		},
 		{
@@ -253,7 +543,7 @@ func TestUserRepo_GetUserOperations(t *testing.T) {
 				userId: 1,
 			},
 			mockBehavior: func(m pgxmock.PgxPoolIface, args args) {
-				m.ExpectQuery("SELECT user_id, segment_name, operation, operation_time").
+				m.ExpectQuery("SELECT l.user_id, COALESCE\\(s.name, l.segment_name\\), l.variant, l.operation, l.operation_time, l.actor, l.source, l.reason, l.batch_id, l.expires_at FROM user_segments_log AS l LEFT JOIN segments AS s ON s.id = l.segment_id .* ORDER BY l.operation_time, l.id").
 					WithArgs(args.userId).
 					WillReturnError(errors.New("some error"))
 			},
@@ -268,9 +558,9 @@ func TestUserRepo_GetUserOperations(t *testing.T) {
 			},
 			mockBehavior: func(m pgxmock.PgxPoolIface, args args) {
 				operationTime := time.Unix(1672531200, 0)
-				m.ExpectQuery("SELECT user_id, segment_name, operation, operation_time").
+				m.ExpectQuery("SELECT l.user_id, COALESCE\\(s.name, l.segment_name\\), l.variant, l.operation, l.operation_time, l.actor, l.source, l.reason, l.batch_id, l.expires_at FROM user_segments_log AS l LEFT JOIN segments AS s ON s.id = l.segment_id .* ORDER BY l.operation_time, l.id").
 					WithArgs(args.userId).
-					WillReturnRows(pgxmock.NewRows([]string{"user_id", "segment_name", "operation", "operation_time"}).AddRow(1, "segment1", "add", operationTime).RowError(0, errors.New("rows.Scan error")))
+					WillReturnRows(pgxmock.NewRows([]string{"user_id", "segment_name", "variant", "operation", "operation_time", "actor", "source", "reason", "batch_id", "expires_at"}).AddRow(1, "segment1", "", "add", operationTime, "", "", "", "", nil).RowError(0, errors.New("rows.Scan error")))
 			},
 			want:    nil,
 			wantErr: true,
@@ -316,8 +606,9 @@ func TestUserRepo_GetUserOperationsByMonth(t *testing.T) {
 		name         string
 		args         args
 		mockBehavior MockBehavior
-		want         []string
+		want         []entity.Operation
 		wantErr      bool
+		wantErrIs    error
 	}{
 		{
 			name: "OK",
@@ -328,11 +619,11 @@ func TestUserRepo_GetUserOperationsByMonth(t *testing.T) {
 			},
 			mockBehavior: func(m pgxmock.PgxPoolIface, args args) {
 				operationTime := time.Date(2023, 1, 1, 0, 15, 23, 0, time.UTC)
-				m.ExpectQuery("SELECT user_id, segment_name, operation, operation_time").
+				m.ExpectQuery("SELECT l.user_id, COALESCE\\(s.name, l.segment_name\\), l.variant, l.operation, l.operation_time, l.actor, l.source, l.reason, l.batch_id, l.expires_at FROM user_segments_log AS l LEFT JOIN segments AS s ON s.id = l.segment_id .* ORDER BY l.operation_time, l.id").
 					WithArgs(args.userId, time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC), time.Date(2023, 2, 1, 0, 0, 0, 0, time.UTC).Add(-time.Nanosecond)).
-					WillReturnRows(pgxmock.NewRows([]string{"user_id", "segment_name", "operation", "operation_time"}).AddRow(1, "segment1", "add", operationTime))
+					WillReturnRows(pgxmock.NewRows([]string{"user_id", "segment_name", "variant", "operation", "operation_time", "actor", "source", "reason", "batch_id", "expires_at"}).AddRow(1, "segment1", "", "add", operationTime, "", "", "", "", nil))
 			},
-			want:    []string{fmt.Sprintf("(1, segment1, add, %s)", time.Date(2023, 1, 1, 0, 15, 23, 0, time.UTC))},
+			want:    []entity.Operation{{UserID: 1, Segment: "segment1", Operation: "add", Time: time.Date(2023, 1, 1, 0, 15, 23, 0, time.UTC)}},
 			wantErr: false,
 		},
 		{
@@ -343,11 +634,11 @@ func TestUserRepo_GetUserOperationsByMonth(t *testing.T) {
 				yearMonth: "2023-01",
 			},
 			mockBehavior: func(m pgxmock.PgxPoolIface, args args) {
-				m.ExpectQuery("SELECT user_id, segment_name, operation, operation_time").
+				m.ExpectQuery("SELECT l.user_id, COALESCE\\(s.name, l.segment_name\\), l.variant, l.operation, l.operation_time, l.actor, l.source, l.reason, l.batch_id, l.expires_at FROM user_segments_log AS l LEFT JOIN segments AS s ON s.id = l.segment_id .* ORDER BY l.operation_time, l.id").
 					WithArgs(args.userId, time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC), time.Date(2023, 2, 1, 0, 0, 0, 0, time.UTC).Add(-time.Nanosecond)).
-					WillReturnRows(pgxmock.NewRows([]string{"user_id", "segment_name", "operation", "operation_time"}))
+					WillReturnRows(pgxmock.NewRows([]string{"user_id", "segment_name", "variant", "operation", "operation_time", "actor", "source", "reason", "batch_id", "expires_at"}))
 			},
-			want:    []string(nil),
+			want:    []entity.Operation(nil),
 			wantErr: false,
 		},
 		{
@@ -359,12 +650,13 @@ func TestUserRepo_GetUserOperationsByMonth(t *testing.T) {
 			},
 			mockBehavior: func(m pgxmock.PgxPoolIface, args args) {
 				operationTime := time.Date(2023, 1, 1, 0, 15, 23, 0, time.UTC)
-				m.ExpectQuery("SELECT user_id, segment_name, operation, operation_time").
+				m.ExpectQuery("SELECT l.user_id, COALESCE\\(s.name, l.segment_name\\), l.variant, l.operation, l.operation_time, l.actor, l.source, l.reason, l.batch_id, l.expires_at FROM user_segments_log AS l LEFT JOIN segments AS s ON s.id = l.segment_id .* ORDER BY l.operation_time, l.id").
 					WithArgs(args.userId, time.Date(2023, 13, 1, 0, 0, 0, 0, time.UTC), time.Date(2023, 14, 1, 0, 0, 0, 0, time.UTC).Add(-time.Nanosecond)).
-					WillReturnRows(pgxmock.NewRows([]string{"user_id", "segment_name", "operation", "operation_time"}).AddRow(1, "segment1", "add", operationTime))
+					WillReturnRows(pgxmock.NewRows([]string{"user_id", "segment_name", "variant", "operation", "operation_time", "actor", "source", "reason", "batch_id", "expires_at"}).AddRow(1, "segment1", "", "add", operationTime, "", "", "", "", nil))
 			},
-			want:    nil,
-			wantErr: true,
+			want:      nil,
+			wantErr:   true,
+			wantErrIs: repoerrs.ErrInvalidInput,
 		},
 		{
 			name: "unexpected error",
@@ -374,7 +666,7 @@ func TestUserRepo_GetUserOperationsByMonth(t *testing.T) {
 				yearMonth: "2023-01",
 			},
 			mockBehavior: func(m pgxmock.PgxPoolIface, args args) {
-				m.ExpectQuery("SELECT user_id, segment_name, operation, operation_time").
+				m.ExpectQuery("SELECT l.user_id, COALESCE\\(s.name, l.segment_name\\), l.variant, l.operation, l.operation_time, l.actor, l.source, l.reason, l.batch_id, l.expires_at FROM user_segments_log AS l LEFT JOIN segments AS s ON s.id = l.segment_id .* ORDER BY l.operation_time, l.id").
 					WithArgs(args.userId, time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC), time.Date(2023, 2, 1, 0, 0, 0, 0, time.UTC).Add(-time.Nanosecond)).
 					WillReturnError(errors.New("some error"))
 			},
@@ -390,9 +682,9 @@ func TestUserRepo_GetUserOperationsByMonth(t *testing.T) {
 			},
 			mockBehavior: func(m pgxmock.PgxPoolIface, args args) {
 				operationTime := time.Date(2023, 1, 1, 0, 15, 23, 0, time.UTC)
-				m.ExpectQuery("SELECT user_id, segment_name, operation, operation_time").
+				m.ExpectQuery("SELECT l.user_id, COALESCE\\(s.name, l.segment_name\\), l.variant, l.operation, l.operation_time, l.actor, l.source, l.reason, l.batch_id, l.expires_at FROM user_segments_log AS l LEFT JOIN segments AS s ON s.id = l.segment_id .* ORDER BY l.operation_time, l.id").
 					WithArgs(args.userId, time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC), time.Date(2023, 2, 1, 0, 0, 0, 0, time.UTC).Add(-time.Nanosecond)).
-					WillReturnRows(pgxmock.NewRows([]string{"user_id", "segment_name", "operation", "operation_time"}).AddRow(1, "segment1", "add", operationTime).RowError(0, errors.New("rows.Scan error")))
+					WillReturnRows(pgxmock.NewRows([]string{"user_id", "segment_name", "variant", "operation", "operation_time", "actor", "source", "reason", "batch_id", "expires_at"}).AddRow(1, "segment1", "", "add", operationTime, "", "", "", "", nil).RowError(0, errors.New("rows.Scan error")))
 			},
 			want:    nil,
 			wantErr: true,
@@ -414,6 +706,9 @@ func TestUserRepo_GetUserOperationsByMonth(t *testing.T) {
 			got, err := userRepoMock.GetUserOperationsByMonth(tc.args.ctx, tc.args.userId, tc.args.yearMonth)
 			if tc.wantErr {
 				assert.Error(t, err)
+				if tc.wantErrIs != nil {
+					assert.ErrorIs(t, err, tc.wantErrIs)
+				}
 				return
 			}
 			assert.NoError(t, err)
@@ -425,119 +720,632 @@ func TestUserRepo_GetUserOperationsByMonth(t *testing.T) {
 	}
 }
 
-func TestUserRepo_AddOrRemoveUserSegments(t *testing.T) {
+func TestUserRepo_GetUserOperationsPage(t *testing.T) {
 	type args struct {
-		ctx            context.Context
-		userId         int
-		addSegments    []entity.AddSegment
-		removeSegments []string
+		ctx    context.Context
+		userId int
+		filter entity.OperationFilter
 	}
 
 	type MockBehavior func(m pgxmock.PgxPoolIface, args args)
 
+	columns := []string{"user_id", "segment_name", "variant", "operation", "operation_time", "actor", "source", "reason", "batch_id", "expires_at", "id"}
+	first := time.Date(2023, 1, 1, 0, 15, 23, 0, time.UTC)
+	second := time.Date(2023, 1, 2, 10, 0, 0, 0, time.UTC)
+	from := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	to := time.Date(2023, 2, 1, 0, 0, 0, 0, time.UTC)
+
 	testCases := []struct {
 		name         string
 		args         args
 		mockBehavior MockBehavior
+		want         []entity.Operation
+		wantNext     string
 		wantErr      bool
+		wantErrIs    error
 	}{
 		{
-			name: "add 1 segment without expire time",
+			name: "OK",
 			args: args{
 				ctx:    context.Background(),
 				userId: 1,
-				addSegments: []entity.AddSegment{
-					{
-						Name: "segment1",
-					},
-				},
 			},
 			mockBehavior: func(m pgxmock.PgxPoolIface, args args) {
-				m.ExpectBegin()
-				m.ExpectQuery("SELECT id").
+				m.ExpectQuery("SELECT l.user_id, COALESCE\\(s.name, l.segment_name\\), l.variant, l.operation, l.operation_time, l.actor, l.source, l.reason, l.batch_id, l.expires_at, l.id FROM user_segments_log AS l LEFT JOIN segments AS s ON s.id = l.segment_id WHERE l.user_id = \\$1 ORDER BY l.operation_time ASC, l.id ASC$").
 					WithArgs(args.userId).
-					WillReturnRows(pgxmock.NewRows([]string{"id"}).AddRow(1))
-				m.ExpectQuery("SELECT name").
-					WithArgs(args.addSegments[0].Name).
-					WillReturnRows(pgxmock.NewRows([]string{"name"}).AddRow(args.addSegments[0].Name))
-				m.ExpectExec("INSERT INTO user_segments").
-					WithArgs(args.userId, args.addSegments[0].Name).
-					WillReturnResult(pgxmock.NewResult("INSERT", 1))
-				m.ExpectExec("INSERT INTO user_segments_log").
-					WithArgs(args.userId, args.addSegments[0].Name, "add").
-					WillReturnResult(pgxmock.NewResult("INSERT", 1))
-				m.ExpectCommit()
+					WillReturnRows(pgxmock.NewRows(columns).AddRow(1, "segment1", "", "add", first, "", "", "", "", nil, int64(7)))
 			},
-			wantErr: false,
+			want: []entity.Operation{{UserID: 1, Segment: "segment1", Operation: "add", Time: first}},
 		},
 		{
-			name: "add 1 segment with expire time",
+			name: "next page",
 			args: args{
 				ctx:    context.Background(),
 				userId: 1,
-				addSegments: []entity.AddSegment{
-					{
-						Name:   "segment1",
-						Expire: "1h",
-					},
-				},
+				filter: entity.OperationFilter{Limit: 1},
 			},
 			mockBehavior: func(m pgxmock.PgxPoolIface, args args) {
-				m.ExpectBegin()
-				m.ExpectQuery("SELECT id").
+				m.ExpectQuery("WHERE l.user_id = \\$1 ORDER BY l.operation_time ASC, l.id ASC LIMIT 2").
 					WithArgs(args.userId).
-					WillReturnRows(pgxmock.NewRows([]string{"id"}).AddRow(1))
-				m.ExpectQuery("SELECT name").
-					WithArgs(args.addSegments[0].Name).
-					WillReturnRows(pgxmock.NewRows([]string{"name"}).AddRow(args.addSegments[0].Name))
-				expireTime := time.Date(2023, time.January, 1, 15, 30, 12, 345, time.UTC).Add(time.Hour)
-				m.ExpectExec("INSERT INTO user_segments").
-					WithArgs(args.userId, args.addSegments[0].Name, expireTime).
-					WillReturnResult(pgxmock.NewResult("INSERT", 1))
-				m.ExpectExec("INSERT INTO user_segments_log").
-					WithArgs(args.userId, args.addSegments[0].Name, "add").
-					WillReturnResult(pgxmock.NewResult("INSERT", 1))
-				m.ExpectCommit()
+					WillReturnRows(pgxmock.NewRows(columns).
+						AddRow(1, "segment1", "", "add", first, "", "", "", "", nil, int64(7)).
+						AddRow(1, "segment1", "", "delete", second, "", "", "", "", nil, int64(9)))
 			},
-			wantErr: false,
+			want:     []entity.Operation{{UserID: 1, Segment: "segment1", Operation: "add", Time: first}},
+			wantNext: encodeLogCursor(first, 7),
 		},
 		{
-			name: "remove 1 segment",
+			name: "filters",
 			args: args{
 				ctx:    context.Background(),
 				userId: 1,
-				removeSegments: []string{
-					"segment1",
-				},
+				filter: entity.OperationFilter{From: from, To: to, Segment: "segment1", Operation: "delete", Source: "expire", Desc: true, Limit: 10, Cursor: encodeLogCursor(second, 9)},
 			},
 			mockBehavior: func(m pgxmock.PgxPoolIface, args args) {
-				m.ExpectBegin()
-				m.ExpectQuery("SELECT id").
-					WithArgs(args.userId).
-					WillReturnRows(pgxmock.NewRows([]string{"id"}).AddRow(1))
-				m.ExpectQuery("SELECT name").
-					WithArgs(args.removeSegments[0]).
-					WillReturnRows(pgxmock.NewRows([]string{"name"}).AddRow(args.removeSegments[0]))
-				m.ExpectExec("DELETE FROM user_segments").
-					WithArgs(args.userId, args.removeSegments[0]).
-					WillReturnResult(pgxmock.NewResult("DELETE", 1))
-				m.ExpectExec("INSERT INTO user_segments_log").
-					WithArgs(args.userId, args.removeSegments[0], "delete").
-					WillReturnResult(pgxmock.NewResult("INSERT", 1))
-				m.ExpectCommit()
+				m.ExpectQuery("WHERE l.user_id = \\$1 AND l.operation_time >= \\$2 AND l.operation_time < \\$3 AND COALESCE\\(s.name, l.segment_name\\) = \\$4 "+
+					"AND l.operation = \\$5 AND l.source = \\$6 AND \\(l.operation_time, l.id\\) < \\(\\$7, \\$8\\) ORDER BY l.operation_time DESC, l.id DESC LIMIT 11").
+					WithArgs(args.userId, from, to, "segment1", "delete", "expire", second.Local(), int64(9)).
+					WillReturnRows(pgxmock.NewRows(columns).AddRow(1, "segment1", "", "delete", first, "", "", "", "", nil, int64(7)))
 			},
-			wantErr: false,
+			want: []entity.Operation{{UserID: 1, Segment: "segment1", Operation: "delete", Time: first}},
 		},
 		{
-			name: "add 1 segment and remove 1 segment",
+			name: "unknown operation",
 			args: args{
 				ctx:    context.Background(),
 				userId: 1,
-				addSegments: []entity.AddSegment{
-					{
-						Name: "segment1",
-					},
-				},
+				filter: entity.OperationFilter{Operation: "rename"},
+			},
+			mockBehavior: func(m pgxmock.PgxPoolIface, args args) {},
+			wantErr:      true,
+			wantErrIs:    repoerrs.ErrInvalidInput,
+		},
+		{
+			name: "unknown source",
+			args: args{
+				ctx:    context.Background(),
+				userId: 1,
+				filter: entity.OperationFilter{Source: "import"},
+			},
+			mockBehavior: func(m pgxmock.PgxPoolIface, args args) {},
+			wantErr:      true,
+			wantErrIs:    repoerrs.ErrInvalidInput,
+		},
+		{
+			name: "invalid cursor",
+			args: args{
+				ctx:    context.Background(),
+				userId: 1,
+				filter: entity.OperationFilter{Cursor: "not a cursor"},
+			},
+			mockBehavior: func(m pgxmock.PgxPoolIface, args args) {},
+			wantErr:      true,
+			wantErrIs:    repoerrs.ErrInvalidInput,
+		},
+		{
+			name: "unexpected error",
+			args: args{
+				ctx:    context.Background(),
+				userId: 1,
+			},
+			mockBehavior: func(m pgxmock.PgxPoolIface, args args) {
+				m.ExpectQuery("SELECT l.user_id").
+					WithArgs(args.userId).
+					WillReturnError(errors.New("some error"))
+			},
+			wantErr: true,
+		},
+		{
+			name: "rows.Scan error",
+			args: args{
+				ctx:    context.Background(),
+				userId: 1,
+			},
+			mockBehavior: func(m pgxmock.PgxPoolIface, args args) {
+				m.ExpectQuery("SELECT l.user_id").
+					WithArgs(args.userId).
+					WillReturnRows(pgxmock.NewRows(columns).AddRow(1, "segment1", "", "add", first, "", "", "", "", nil, int64(7)).RowError(0, errors.New("rows.Scan error")))
+			},
+			wantErr: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			poolMock, _ := pgxmock.NewPool()
+			defer poolMock.Close()
+			tc.mockBehavior(poolMock, tc.args)
+
+			postgresMock := &postgres.Postgres{
+				Builder: squirrel.StatementBuilder.PlaceholderFormat(squirrel.Dollar),
+				Pool:    poolMock,
+			}
+			userRepoMock := NewUserRepo(postgresMock, MockTimeProvider{})
+
+			got, next, err := userRepoMock.GetUserOperationsPage(tc.args.ctx, tc.args.userId, tc.args.filter)
+			if tc.wantErr {
+				assert.Error(t, err)
+				if tc.wantErrIs != nil {
+					assert.ErrorIs(t, err, tc.wantErrIs)
+				}
+				return
+			}
+			assert.NoError(t, err)
+
+			err = poolMock.ExpectationsWereMet()
+			assert.NoError(t, err)
+			assert.Equal(t, tc.want, got)
+			assert.Equal(t, tc.wantNext, next)
+		})
+	}
+}
+
+func TestUserRepo_StreamUserOperations(t *testing.T) {
+	type MockBehavior func(m pgxmock.PgxPoolIface)
+
+	columns := []string{"user_id", "segment_name", "variant", "operation", "operation_time", "actor", "source", "reason", "batch_id", "expires_at", "id"}
+	first := time.Date(2023, 1, 1, 0, 15, 23, 0, time.UTC)
+	second := time.Date(2023, 1, 2, 10, 0, 0, 0, time.UTC)
+	from := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	to := time.Date(2023, 2, 1, 0, 0, 0, 0, time.UTC)
+	fnErr := errors.New("client gone")
+
+	testCases := []struct {
+		name         string
+		filter       entity.OperationFilter
+		mockBehavior MockBehavior
+		fnErr        error
+		want         []entity.Operation
+		wantErr      bool
+		wantErrIs    error
+	}{
+		{
+			name:   "OK",
+			filter: entity.OperationFilter{From: from, To: to, Segment: "segment1", Desc: true, Limit: 1},
+			mockBehavior: func(m pgxmock.PgxPoolIface) {
+				m.ExpectQuery("WHERE l.user_id = \\$1 AND l.operation_time >= \\$2 AND l.operation_time < \\$3 AND COALESCE\\(s.name, l.segment_name\\) = \\$4 "+
+					"ORDER BY l.operation_time, l.id$").
+					WithArgs(1, from, to, "segment1").
+					WillReturnRows(pgxmock.NewRows(columns).
+						AddRow(1, "segment1", "", "add", first, "", "", "", "", nil, int64(7)).
+						AddRow(1, "segment1", "", "delete", second, "", "", "", "", nil, int64(9)))
+			},
+			want: []entity.Operation{
+				{UserID: 1, Segment: "segment1", Operation: "add", Time: first},
+				{UserID: 1, Segment: "segment1", Operation: "delete", Time: second},
+			},
+		},
+		{
+			name:         "unknown operation",
+			filter:       entity.OperationFilter{Operation: "rename"},
+			mockBehavior: func(m pgxmock.PgxPoolIface) {},
+			wantErr:      true,
+			wantErrIs:    repoerrs.ErrInvalidInput,
+		},
+		{
+			name: "fn error",
+			mockBehavior: func(m pgxmock.PgxPoolIface) {
+				m.ExpectQuery("SELECT l.user_id").
+					WithArgs(1).
+					WillReturnRows(pgxmock.NewRows(columns).AddRow(1, "segment1", "", "add", first, "", "", "", "", nil, int64(7)))
+			},
+			fnErr:     fnErr,
+			wantErr:   true,
+			wantErrIs: fnErr,
+		},
+		{
+			name: "unexpected error",
+			mockBehavior: func(m pgxmock.PgxPoolIface) {
+				m.ExpectQuery("SELECT l.user_id").
+					WithArgs(1).
+					WillReturnError(errors.New("some error"))
+			},
+			wantErr: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			poolMock, _ := pgxmock.NewPool()
+			defer poolMock.Close()
+			tc.mockBehavior(poolMock)
+
+			postgresMock := &postgres.Postgres{
+				Builder: squirrel.StatementBuilder.PlaceholderFormat(squirrel.Dollar),
+				Pool:    poolMock,
+			}
+			userRepoMock := NewUserRepo(postgresMock, MockTimeProvider{})
+
+			var got []entity.Operation
+			err := userRepoMock.StreamUserOperations(context.Background(), 1, tc.filter, func(o entity.Operation) error {
+				got = append(got, o)
+				return tc.fnErr
+			})
+			if tc.wantErr {
+				assert.Error(t, err)
+				if tc.wantErrIs != nil {
+					assert.ErrorIs(t, err, tc.wantErrIs)
+				}
+				return
+			}
+			assert.NoError(t, err)
+
+			err = poolMock.ExpectationsWereMet()
+			assert.NoError(t, err)
+			assert.Equal(t, tc.want, got)
+		})
+	}
+}
+
+func TestUserRepo_StreamOperations(t *testing.T) {
+	type args struct {
+		ctx    context.Context
+		filter entity.FeedFilter
+	}
+
+	type MockBehavior func(m pgxmock.PgxPoolIface, args args)
+
+	columns := []string{"xid", "id", "user_id", "segment_name", "variant", "operation", "operation_time", "actor", "source", "reason", "batch_id", "expires_at"}
+	operationTime := time.Date(2023, 1, 1, 0, 15, 23, 0, time.UTC)
+	from := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	to := time.Date(2023, 1, 2, 0, 0, 0, 0, time.UTC)
+	fnErr := errors.New("client gone")
+
+	testCases := []struct {
+		name         string
+		args         args
+		mockBehavior MockBehavior
+		fnErr        error
+		want         []entity.FeedEntry
+		wantErr      bool
+		wantErrIs    error
+	}{
+		{
+			name: "OK",
+			args: args{
+				ctx: context.Background(),
+			},
+			mockBehavior: func(m pgxmock.PgxPoolIface, args args) {
+				m.ExpectQuery("SELECT l.xid::text, l.id, l.user_id, COALESCE\\(s.name, l.segment_name\\), l.variant, l.operation, l.operation_time, l.actor, l.source, l.reason, l.batch_id, l.expires_at " +
+					"FROM user_segments_log AS l LEFT JOIN segments AS s ON s.id = l.segment_id WHERE l.xid < pg_snapshot_xmin\\(pg_current_snapshot\\(\\)\\) ORDER BY l.xid, l.id$").
+					WillReturnRows(pgxmock.NewRows(columns).
+						AddRow("740", int64(7), 1, "segment1", "", "add", operationTime, "", "", "", "", nil).
+						AddRow("741", int64(5), 2, "segment1", "", "add", operationTime, "", "", "", "", nil))
+			},
+			want: []entity.FeedEntry{
+				{Cursor: encodeFeedCursor("740", 7), Operation: entity.Operation{UserID: 1, Segment: "segment1", Operation: "add", Time: operationTime}},
+				{Cursor: encodeFeedCursor("741", 5), Operation: entity.Operation{UserID: 2, Segment: "segment1", Operation: "add", Time: operationTime}},
+			},
+		},
+		{
+			name: "filters",
+			args: args{
+				ctx:    context.Background(),
+				filter: entity.FeedFilter{After: encodeFeedCursor("740", 7), From: from, To: to, Segment: "segment1", Source: "rule", Limit: 100},
+			},
+			mockBehavior: func(m pgxmock.PgxPoolIface, args args) {
+				m.ExpectQuery("WHERE l.xid < pg_snapshot_xmin\\(pg_current_snapshot\\(\\)\\) AND \\(l.xid, l.id\\) > \\(\\$1::text::xid8, \\$2\\) "+
+					"AND l.operation_time >= \\$3 AND l.operation_time < \\$4 AND COALESCE\\(s.name, l.segment_name\\) = \\$5 AND l.source = \\$6 ORDER BY l.xid, l.id LIMIT 100").
+					WithArgs("740", int64(7), from, to, "segment1", "rule").
+					WillReturnRows(pgxmock.NewRows(columns))
+			},
+		},
+		{
+			name: "invalid cursor",
+			args: args{
+				ctx:    context.Background(),
+				filter: entity.FeedFilter{After: "not a cursor"},
+			},
+			mockBehavior: func(m pgxmock.PgxPoolIface, args args) {},
+			wantErr:      true,
+			wantErrIs:    repoerrs.ErrInvalidInput,
+		},
+		{
+			name: "fn error",
+			args: args{
+				ctx: context.Background(),
+			},
+			mockBehavior: func(m pgxmock.PgxPoolIface, args args) {
+				m.ExpectQuery("SELECT l.xid::text").
+					WillReturnRows(pgxmock.NewRows(columns).AddRow("740", int64(7), 1, "segment1", "", "add", operationTime, "", "", "", "", nil))
+			},
+			fnErr:     fnErr,
+			wantErr:   true,
+			wantErrIs: fnErr,
+		},
+		{
+			name: "unexpected error",
+			args: args{
+				ctx: context.Background(),
+			},
+			mockBehavior: func(m pgxmock.PgxPoolIface, args args) {
+				m.ExpectQuery("SELECT l.xid::text").
+					WillReturnError(errors.New("some error"))
+			},
+			wantErr: true,
+		},
+		{
+			name: "rows.Scan error",
+			args: args{
+				ctx: context.Background(),
+			},
+			mockBehavior: func(m pgxmock.PgxPoolIface, args args) {
+				m.ExpectQuery("SELECT l.xid::text").
+					WillReturnRows(pgxmock.NewRows(columns).AddRow("740", int64(7), 1, "segment1", "", "add", operationTime, "", "", "", "", nil).RowError(0, errors.New("rows.Scan error")))
+			},
+			wantErr: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			poolMock, _ := pgxmock.NewPool()
+			defer poolMock.Close()
+			tc.mockBehavior(poolMock, tc.args)
+
+			postgresMock := &postgres.Postgres{
+				Builder: squirrel.StatementBuilder.PlaceholderFormat(squirrel.Dollar),
+				Pool:    poolMock,
+			}
+			userRepoMock := NewUserRepo(postgresMock, MockTimeProvider{})
+
+			var got []entity.FeedEntry
+			err := userRepoMock.StreamOperations(tc.args.ctx, tc.args.filter, func(entry entity.FeedEntry) error {
+				got = append(got, entry)
+				return tc.fnErr
+			})
+			if tc.wantErr {
+				assert.Error(t, err)
+				if tc.wantErrIs != nil {
+					assert.ErrorIs(t, err, tc.wantErrIs)
+				}
+				return
+			}
+			assert.NoError(t, err)
+
+			err = poolMock.ExpectationsWereMet()
+			assert.NoError(t, err)
+			assert.Equal(t, tc.want, got)
+		})
+	}
+}
+
+func TestUserRepo_AddOrRemoveUserSegments(t *testing.T) {
+	experimentVariants := []entity.Variant{{Name: "control", Weight: 50}, {Name: "treatment", Weight: 50}}
+	inAnHour := time.Date(2023, time.January, 1, 15, 30, 12, 345, time.UTC).Add(time.Hour)
+	campaignEnd := time.Date(2023, 12, 31, 23, 59, 59, 0, time.UTC)
+	past := time.Date(2022, 12, 31, 0, 0, 0, 0, time.UTC)
+
+	type args struct {
+		ctx            context.Context
+		userId         int
+		addSegments    []entity.AddSegment
+		removeSegments []string
+		idempotencyKey string
+	}
+
+	type MockBehavior func(m pgxmock.PgxPoolIface, args args)
+
+	testCases := []struct {
+		name         string
+		args         args
+		mockBehavior MockBehavior
+		want         []entity.SegmentChange
+		wantErr      bool
+		wantErrIs    error
+	}{
+		{
+			name: "add 1 segment without expire time",
+			args: args{
+				ctx:    context.Background(),
+				userId: 1,
+				addSegments: []entity.AddSegment{
+					{
+						Name: "segment1",
+					},
+				},
+			},
+			mockBehavior: func(m pgxmock.PgxPoolIface, args args) {
+				m.ExpectBegin()
+				m.ExpectQuery("SELECT id").
+					WithArgs(args.userId).
+					WillReturnRows(pgxmock.NewRows([]string{"id"}).AddRow(1))
+				m.ExpectQuery("SELECT layer").
+					WithArgs(args.addSegments[0].Name).
+					WillReturnRows(pgxmock.NewRows([]string{"layer", "salt", "variants", "bucketing"}).AddRow("", "", []entity.Variant(nil), ""))
+				m.ExpectExec("INSERT INTO user_segments").
+					WithArgs(args.userId, args.addSegments[0].Name, "").
+					WillReturnResult(pgxmock.NewResult("INSERT", 1))
+				m.ExpectExec("INSERT INTO user_segments_log").
+					WithArgs(args.userId, args.addSegments[0].Name, "", "add", "", entity.SourceManual, "").
+					WillReturnResult(pgxmock.NewResult("INSERT", 1))
+				m.ExpectCommit()
+			},
+			want:    []entity.SegmentChange{{Segment: "segment1", Outcome: entity.OutcomeAdded}},
+			wantErr: false,
+		},
+		{
+			name: "caller and reason recorded",
+			args: args{
+				ctx:    entity.WithReason(entity.WithCaller(context.Background(), entity.Caller{Name: "marketing", Role: entity.RoleAssigner}), "autumn campaign"),
+				userId: 1,
+				addSegments: []entity.AddSegment{
+					{
+						Name: "segment1",
+					},
+				},
+			},
+			mockBehavior: func(m pgxmock.PgxPoolIface, args args) {
+				m.ExpectBegin()
+				m.ExpectQuery("SELECT id").
+					WithArgs(args.userId).
+					WillReturnRows(pgxmock.NewRows([]string{"id"}).AddRow(1))
+				m.ExpectQuery("SELECT layer").
+					WithArgs(args.addSegments[0].Name).
+					WillReturnRows(pgxmock.NewRows([]string{"layer", "salt", "variants", "bucketing"}).AddRow("", "", []entity.Variant(nil), ""))
+				m.ExpectExec("INSERT INTO user_segments").
+					WithArgs(args.userId, args.addSegments[0].Name, "").
+					WillReturnResult(pgxmock.NewResult("INSERT", 1))
+				m.ExpectExec("INSERT INTO user_segments_log \\(user_id,segment_name,variant,operation,actor,source,reason\\)").
+					WithArgs(args.userId, args.addSegments[0].Name, "", "add", "marketing", entity.SourceManual, "autumn campaign").
+					WillReturnResult(pgxmock.NewResult("INSERT", 1))
+				m.ExpectCommit()
+			},
+			want:    []entity.SegmentChange{{Segment: "segment1", Outcome: entity.OutcomeAdded}},
+			wantErr: false,
+		},
+		{
+			name: "add 1 segment with expire time",
+			args: args{
+				ctx:    context.Background(),
+				userId: 1,
+				addSegments: []entity.AddSegment{
+					{
+						Name:   "segment1",
+						Expire: "1h",
+					},
+				},
+			},
+			mockBehavior: func(m pgxmock.PgxPoolIface, args args) {
+				m.ExpectBegin()
+				m.ExpectQuery("SELECT id").
+					WithArgs(args.userId).
+					WillReturnRows(pgxmock.NewRows([]string{"id"}).AddRow(1))
+				m.ExpectQuery("SELECT layer").
+					WithArgs(args.addSegments[0].Name).
+					WillReturnRows(pgxmock.NewRows([]string{"layer", "salt", "variants", "bucketing"}).AddRow("", "", []entity.Variant(nil), ""))
+				expireTime := time.Date(2023, time.January, 1, 15, 30, 12, 345, time.UTC).Add(time.Hour)
+				m.ExpectExec("INSERT INTO user_segments").
+					WithArgs(args.userId, args.addSegments[0].Name, "", expireTime).
+					WillReturnResult(pgxmock.NewResult("INSERT", 1))
+				m.ExpectExec("INSERT INTO user_segments_log").
+					WithArgs(args.userId, args.addSegments[0].Name, "", "add", "", entity.SourceManual, "", expireTime).
+					WillReturnResult(pgxmock.NewResult("INSERT", 1))
+				m.ExpectCommit()
+			},
+			want:    []entity.SegmentChange{{Segment: "segment1", Outcome: entity.OutcomeAdded, ExpiresAt: &inAnHour}},
+			wantErr: false,
+		},
+		{
+			name: "add 1 segment until expires_at",
+			args: args{
+				ctx:    context.Background(),
+				userId: 1,
+				addSegments: []entity.AddSegment{
+					{
+						Name:      "segment1",
+						ExpiresAt: &campaignEnd,
+					},
+				},
+			},
+			mockBehavior: func(m pgxmock.PgxPoolIface, args args) {
+				m.ExpectBegin()
+				m.ExpectQuery("SELECT id").
+					WithArgs(args.userId).
+					WillReturnRows(pgxmock.NewRows([]string{"id"}).AddRow(1))
+				m.ExpectQuery("SELECT layer").
+					WithArgs(args.addSegments[0].Name).
+					WillReturnRows(pgxmock.NewRows([]string{"layer", "salt", "variants", "bucketing"}).AddRow("", "", []entity.Variant(nil), ""))
+				m.ExpectExec("INSERT INTO user_segments \\(user_id,segment_name,variant,expire\\) VALUES \\(\\$1,\\$2,\\$3,\\$4::timestamptz::timestamp\\)").
+					WithArgs(args.userId, args.addSegments[0].Name, "", campaignEnd).
+					WillReturnResult(pgxmock.NewResult("INSERT", 1))
+				m.ExpectExec("INSERT INTO user_segments_log \\(user_id,segment_name,variant,operation,actor,source,reason,expires_at\\)").
+					WithArgs(args.userId, args.addSegments[0].Name, "", "add", "", entity.SourceManual, "", campaignEnd).
+					WillReturnResult(pgxmock.NewResult("INSERT", 1))
+				m.ExpectCommit()
+			},
+			want:    []entity.SegmentChange{{Segment: "segment1", Outcome: entity.OutcomeAdded, ExpiresAt: &campaignEnd}},
+			wantErr: false,
+		},
+		{
+			name: "expire combined with expires_at",
+			args: args{
+				ctx:    context.Background(),
+				userId: 1,
+				addSegments: []entity.AddSegment{
+					{
+						Name:      "segment1",
+						Expire:    "1h",
+						ExpiresAt: &campaignEnd,
+					},
+				},
+			},
+			mockBehavior: func(m pgxmock.PgxPoolIface, args args) {
+				m.ExpectBegin()
+				m.ExpectQuery("SELECT id").
+					WithArgs(args.userId).
+					WillReturnRows(pgxmock.NewRows([]string{"id"}).AddRow(1))
+				m.ExpectQuery("SELECT layer").
+					WithArgs(args.addSegments[0].Name).
+					WillReturnRows(pgxmock.NewRows([]string{"layer", "salt", "variants", "bucketing"}).AddRow("", "", []entity.Variant(nil), ""))
+				m.ExpectRollback()
+			},
+			wantErr:   true,
+			wantErrIs: repoerrs.ErrInvalidInput,
+		},
+		{
+			name: "expires_at in the past",
+			args: args{
+				ctx:    context.Background(),
+				userId: 1,
+				addSegments: []entity.AddSegment{
+					{
+						Name:      "segment1",
+						ExpiresAt: &past,
+					},
+				},
+			},
+			mockBehavior: func(m pgxmock.PgxPoolIface, args args) {
+				m.ExpectBegin()
+				m.ExpectQuery("SELECT id").
+					WithArgs(args.userId).
+					WillReturnRows(pgxmock.NewRows([]string{"id"}).AddRow(1))
+				m.ExpectQuery("SELECT layer").
+					WithArgs(args.addSegments[0].Name).
+					WillReturnRows(pgxmock.NewRows([]string{"layer", "salt", "variants", "bucketing"}).AddRow("", "", []entity.Variant(nil), ""))
+				m.ExpectRollback()
+			},
+			wantErr:   true,
+			wantErrIs: repoerrs.ErrInvalidInput,
+		},
+		{
+			name: "remove 1 segment",
+			args: args{
+				ctx:    context.Background(),
+				userId: 1,
+				removeSegments: []string{
+					"segment1",
+				},
+			},
+			mockBehavior: func(m pgxmock.PgxPoolIface, args args) {
+				m.ExpectBegin()
+				m.ExpectQuery("SELECT id").
+					WithArgs(args.userId).
+					WillReturnRows(pgxmock.NewRows([]string{"id"}).AddRow(1))
+				m.ExpectQuery("SELECT bucketing").
+					WithArgs(args.removeSegments[0]).
+					WillReturnRows(pgxmock.NewRows([]string{"bucketing"}).AddRow(""))
+				m.ExpectQuery("DELETE FROM user_segments (.+) RETURNING variant").
+					WithArgs(args.userId, args.removeSegments[0]).
+					WillReturnRows(pgxmock.NewRows([]string{"variant"}).AddRow(""))
+				m.ExpectExec("INSERT INTO user_segments_log").
+					WithArgs(args.userId, args.removeSegments[0], "", "delete", "", entity.SourceManual, "").
+					WillReturnResult(pgxmock.NewResult("INSERT", 1))
+				m.ExpectCommit()
+			},
+			want:    []entity.SegmentChange{{Segment: "segment1", Outcome: entity.OutcomeRemoved}},
+			wantErr: false,
+		},
+		{
+			name: "add 1 segment and remove 1 segment",
+			args: args{
+				ctx:    context.Background(),
+				userId: 1,
+				addSegments: []entity.AddSegment{
+					{
+						Name: "segment1",
+					},
+				},
 				removeSegments: []string{
 					"segment2",
 				},
@@ -547,30 +1355,206 @@ func TestUserRepo_AddOrRemoveUserSegments(t *testing.T) {
 				m.ExpectQuery("SELECT id").
 					WithArgs(args.userId).
 					WillReturnRows(pgxmock.NewRows([]string{"id"}).AddRow(1))
-				m.ExpectQuery("SELECT name").
+				m.ExpectQuery("SELECT bucketing").
+					WithArgs(args.removeSegments[0]).
+					WillReturnRows(pgxmock.NewRows([]string{"bucketing"}).AddRow(""))
+				m.ExpectQuery("DELETE FROM user_segments (.+) RETURNING variant").
+					WithArgs(args.userId, args.removeSegments[0]).
+					WillReturnRows(pgxmock.NewRows([]string{"variant"}).AddRow(""))
+				m.ExpectExec("INSERT INTO user_segments_log").
+					WithArgs(args.userId, args.removeSegments[0], "", "delete", "", entity.SourceManual, "").
+					WillReturnResult(pgxmock.NewResult("INSERT", 1))
+				m.ExpectQuery("SELECT layer").
+					WithArgs(args.addSegments[0].Name).
+					WillReturnRows(pgxmock.NewRows([]string{"layer", "salt", "variants", "bucketing"}).AddRow("", "", []entity.Variant(nil), ""))
+				m.ExpectExec("INSERT INTO user_segments").
+					WithArgs(args.userId, args.addSegments[0].Name, "").
+					WillReturnResult(pgxmock.NewResult("INSERT", 1))
+				m.ExpectExec("INSERT INTO user_segments_log").
+					WithArgs(args.userId, args.addSegments[0].Name, "", "add", "", entity.SourceManual, "").
+					WillReturnResult(pgxmock.NewResult("INSERT", 1))
+				m.ExpectCommit()
+			},
+			want:    []entity.SegmentChange{{Segment: "segment2", Outcome: entity.OutcomeRemoved}, {Segment: "segment1", Outcome: entity.OutcomeAdded}},
+			wantErr: false,
+		},
+		{
+			name: "add 2 segments, first without expire time and second with",
+			args: args{
+				ctx:    context.Background(),
+				userId: 1,
+				addSegments: []entity.AddSegment{
+					{
+						Name: "segment1",
+					},
+					{
+						Name:   "segment2",
+						Expire: "1h",
+					},
+				},
+			},
+			mockBehavior: func(m pgxmock.PgxPoolIface, args args) {
+				m.ExpectBegin()
+				m.ExpectQuery("SELECT id").
+					WithArgs(args.userId).
+					WillReturnRows(pgxmock.NewRows([]string{"id"}).AddRow(1))
+				m.ExpectQuery("SELECT layer").
+					WithArgs(args.addSegments[0].Name).
+					WillReturnRows(pgxmock.NewRows([]string{"layer", "salt", "variants", "bucketing"}).AddRow("", "", []entity.Variant(nil), ""))
+				m.ExpectExec("INSERT INTO user_segments").
+					WithArgs(args.userId, args.addSegments[0].Name, "").
+					WillReturnResult(pgxmock.NewResult("INSERT", 1))
+				m.ExpectExec("INSERT INTO user_segments_log").
+					WithArgs(args.userId, args.addSegments[0].Name, "", "add", "", entity.SourceManual, "").
+					WillReturnResult(pgxmock.NewResult("INSERT", 1))
+				expireTime := time.Date(2023, time.January, 1, 15, 30, 12, 345, time.UTC).Add(time.Hour)
+				m.ExpectQuery("SELECT layer").
+					WithArgs(args.addSegments[1].Name).
+					WillReturnRows(pgxmock.NewRows([]string{"layer", "salt", "variants", "bucketing"}).AddRow("", "", []entity.Variant(nil), ""))
+				m.ExpectExec("INSERT INTO user_segments").
+					WithArgs(args.userId, args.addSegments[1].Name, "", expireTime).
+					WillReturnResult(pgxmock.NewResult("INSERT", 1))
+				m.ExpectExec("INSERT INTO user_segments_log").
+					WithArgs(args.userId, args.addSegments[1].Name, "", "add", "", entity.SourceManual, "", expireTime).
+					WillReturnResult(pgxmock.NewResult("INSERT", 1))
+				m.ExpectCommit()
+			},
+			want:    []entity.SegmentChange{{Segment: "segment1", Outcome: entity.OutcomeAdded}, {Segment: "segment2", Outcome: entity.OutcomeAdded, ExpiresAt: &inAnHour}},
+			wantErr: false,
+		},
+		{
+			name: "remove 2 segments",
+			args: args{
+				ctx:    context.Background(),
+				userId: 1,
+				removeSegments: []string{
+					"segment1",
+					"segment2",
+				},
+			},
+			mockBehavior: func(m pgxmock.PgxPoolIface, args args) {
+				m.ExpectBegin()
+				m.ExpectQuery("SELECT id").
+					WithArgs(args.userId).
+					WillReturnRows(pgxmock.NewRows([]string{"id"}).AddRow(1))
+				m.ExpectQuery("SELECT bucketing").
+					WithArgs(args.removeSegments[0]).
+					WillReturnRows(pgxmock.NewRows([]string{"bucketing"}).AddRow(""))
+				m.ExpectQuery("DELETE FROM user_segments (.+) RETURNING variant").
+					WithArgs(args.userId, args.removeSegments[0]).
+					WillReturnRows(pgxmock.NewRows([]string{"variant"}).AddRow(""))
+				m.ExpectExec("INSERT INTO user_segments_log").
+					WithArgs(args.userId, args.removeSegments[0], "", "delete", "", entity.SourceManual, "").
+					WillReturnResult(pgxmock.NewResult("INSERT", 1))
+				m.ExpectQuery("SELECT bucketing").
+					WithArgs(args.removeSegments[1]).
+					WillReturnRows(pgxmock.NewRows([]string{"bucketing"}).AddRow(""))
+				m.ExpectQuery("DELETE FROM user_segments (.+) RETURNING variant").
+					WithArgs(args.userId, args.removeSegments[1]).
+					WillReturnRows(pgxmock.NewRows([]string{"variant"}).AddRow(""))
+				m.ExpectExec("INSERT INTO user_segments_log").
+					WithArgs(args.userId, args.removeSegments[1], "", "delete", "", entity.SourceManual, "").
+					WillReturnResult(pgxmock.NewResult("INSERT", 1))
+				m.ExpectCommit()
+			},
+			want:    []entity.SegmentChange{{Segment: "segment1", Outcome: entity.OutcomeRemoved}, {Segment: "segment2", Outcome: entity.OutcomeRemoved}},
+			wantErr: false,
+		},
+		{
+			name: "add 1 segment and remove 1 segment with same name",
+			args: args{
+				ctx:    context.Background(),
+				userId: 1,
+				addSegments: []entity.AddSegment{
+					{
+						Name: "segment1",
+					},
+				},
+				removeSegments: []string{
+					"segment1",
+				},
+			},
+			mockBehavior: func(m pgxmock.PgxPoolIface, args args) {
+				m.ExpectBegin()
+				m.ExpectQuery("SELECT id").
+					WithArgs(args.userId).
+					WillReturnRows(pgxmock.NewRows([]string{"id"}).AddRow(1))
+				m.ExpectQuery("SELECT bucketing").
+					WithArgs(args.removeSegments[0]).
+					WillReturnRows(pgxmock.NewRows([]string{"bucketing"}).AddRow(""))
+				m.ExpectQuery("DELETE FROM user_segments (.+) RETURNING variant").
+					WithArgs(args.userId, args.removeSegments[0]).
+					WillReturnRows(pgxmock.NewRows([]string{"variant"}).AddRow(""))
+				m.ExpectExec("INSERT INTO user_segments_log").
+					WithArgs(args.userId, args.removeSegments[0], "", "delete", "", entity.SourceManual, "").
+					WillReturnResult(pgxmock.NewResult("INSERT", 1))
+				m.ExpectQuery("SELECT layer").
+					WithArgs(args.addSegments[0].Name).
+					WillReturnRows(pgxmock.NewRows([]string{"layer", "salt", "variants", "bucketing"}).AddRow("", "", []entity.Variant(nil), ""))
+				m.ExpectExec("INSERT INTO user_segments").
+					WithArgs(args.userId, args.addSegments[0].Name, "").
+					WillReturnResult(pgxmock.NewResult("INSERT", 1))
+				m.ExpectExec("INSERT INTO user_segments_log").
+					WithArgs(args.userId, args.addSegments[0].Name, "", "add", "", entity.SourceManual, "").
+					WillReturnResult(pgxmock.NewResult("INSERT", 1))
+				m.ExpectCommit()
+			},
+			want:    []entity.SegmentChange{{Segment: "segment1", Outcome: entity.OutcomeRemoved}, {Segment: "segment1", Outcome: entity.OutcomeAdded}},
+			wantErr: false,
+		},
+		{
+			name: "r.Pool.Begin error",
+			args: args{
+				ctx: context.Background(),
+			},
+			mockBehavior: func(m pgxmock.PgxPoolIface, args args) {
+				m.ExpectBegin().WillReturnError(errors.New("some error"))
+				m.ExpectRollback()
+			},
+			wantErr: true,
+		},
+		{
+			name: "user not found",
+			args: args{
+				ctx:    context.Background(),
+				userId: 1,
+			},
+			mockBehavior: func(m pgxmock.PgxPoolIface, args args) {
+				m.ExpectBegin()
+				m.ExpectQuery("SELECT id").
+					WithArgs(args.userId).
+					WillReturnRows(pgxmock.NewRows([]string{"id"}))
+				m.ExpectRollback()
+			},
+			wantErr:   true,
+			wantErrIs: repoerrs.ErrNotFound,
+		},
+		{
+			name: "segment not found",
+			args: args{
+				ctx:    context.Background(),
+				userId: 1,
+				addSegments: []entity.AddSegment{
+					{
+						Name: "segment1",
+					},
+				},
+			},
+			mockBehavior: func(m pgxmock.PgxPoolIface, args args) {
+				m.ExpectBegin()
+				m.ExpectQuery("SELECT id").
+					WithArgs(args.userId).
+					WillReturnRows(pgxmock.NewRows([]string{"id"}).AddRow(1))
+				m.ExpectQuery("SELECT layer").
 					WithArgs(args.addSegments[0].Name).
-					WillReturnRows(pgxmock.NewRows([]string{"name"}).AddRow(args.addSegments[0].Name))
-				m.ExpectExec("INSERT INTO user_segments").
-					WithArgs(args.userId, args.addSegments[0].Name).
-					WillReturnResult(pgxmock.NewResult("INSERT", 1))
-				m.ExpectExec("INSERT INTO user_segments_log").
-					WithArgs(args.userId, args.addSegments[0].Name, "add").
-					WillReturnResult(pgxmock.NewResult("INSERT", 1))
-				m.ExpectQuery("SELECT name").
-					WithArgs(args.removeSegments[0]).
-					WillReturnRows(pgxmock.NewRows([]string{"name"}).AddRow(args.removeSegments[0]))
-				m.ExpectExec("DELETE FROM user_segments").
-					WithArgs(args.userId, args.removeSegments[0]).
-					WillReturnResult(pgxmock.NewResult("DELETE", 1))
-				m.ExpectExec("INSERT INTO user_segments_log").
-					WithArgs(args.userId, args.removeSegments[0], "delete").
-					WillReturnResult(pgxmock.NewResult("INSERT", 1))
-				m.ExpectCommit()
+					WillReturnRows(pgxmock.NewRows([]string{"layer", "salt", "variants", "bucketing"}))
+				m.ExpectRollback()
 			},
-			wantErr: false,
+			wantErr:   true,
+			wantErrIs: repoerrs.ErrNotFound,
 		},
 		{
-			name: "add 2 segments, first without expire time and second with",
+			name: "segment already added",
 			args: args{
 				ctx:    context.Background(),
 				userId: 1,
@@ -578,8 +1562,34 @@ func TestUserRepo_AddOrRemoveUserSegments(t *testing.T) {
 					{
 						Name: "segment1",
 					},
+				},
+			},
+			mockBehavior: func(m pgxmock.PgxPoolIface, args args) {
+				m.ExpectBegin()
+				m.ExpectQuery("SELECT id").
+					WithArgs(args.userId).
+					WillReturnRows(pgxmock.NewRows([]string{"id"}).AddRow(1))
+				m.ExpectQuery("SELECT layer").
+					WithArgs(args.addSegments[0].Name).
+					WillReturnRows(pgxmock.NewRows([]string{"layer", "salt", "variants", "bucketing"}).AddRow("", "", []entity.Variant(nil), ""))
+				m.ExpectExec("INSERT INTO user_segments (.+) ON CONFLICT \\(user_id, segment_name\\) DO NOTHING").
+					WithArgs(args.userId, args.addSegments[0].Name, "").
+					WillReturnResult(pgxmock.NewResult("INSERT", 0))
+				m.ExpectQuery("SELECT variant, expire::timestamptz FROM user_segments WHERE segment_name = \\$1 AND user_id = \\$2").
+					WithArgs(args.addSegments[0].Name, args.userId).
+					WillReturnRows(pgxmock.NewRows([]string{"variant", "expire"}).AddRow("B", &campaignEnd))
+				m.ExpectCommit()
+			},
+			want: []entity.SegmentChange{{Segment: "segment1", Outcome: entity.OutcomeAlreadyPresent, Variant: "B", ExpiresAt: &campaignEnd}},
+		},
+		{
+			name: "segment already added with new expiry",
+			args: args{
+				ctx:    context.Background(),
+				userId: 1,
+				addSegments: []entity.AddSegment{
 					{
-						Name:   "segment2",
+						Name:   "segment1",
 						Expire: "1h",
 					},
 				},
@@ -589,37 +1599,35 @@ func TestUserRepo_AddOrRemoveUserSegments(t *testing.T) {
 				m.ExpectQuery("SELECT id").
 					WithArgs(args.userId).
 					WillReturnRows(pgxmock.NewRows([]string{"id"}).AddRow(1))
-				m.ExpectQuery("SELECT name").
+				m.ExpectQuery("SELECT layer").
 					WithArgs(args.addSegments[0].Name).
-					WillReturnRows(pgxmock.NewRows([]string{"name"}).AddRow(args.addSegments[0].Name))
-				m.ExpectExec("INSERT INTO user_segments").
-					WithArgs(args.userId, args.addSegments[0].Name).
-					WillReturnResult(pgxmock.NewResult("INSERT", 1))
-				m.ExpectExec("INSERT INTO user_segments_log").
-					WithArgs(args.userId, args.addSegments[0].Name, "add").
-					WillReturnResult(pgxmock.NewResult("INSERT", 1))
-				expireTime := time.Date(2023, time.January, 1, 15, 30, 12, 345, time.UTC).Add(time.Hour)
-				m.ExpectQuery("SELECT name").
-					WithArgs(args.addSegments[1].Name).
-					WillReturnRows(pgxmock.NewRows([]string{"name"}).AddRow(args.addSegments[1].Name))
+					WillReturnRows(pgxmock.NewRows([]string{"layer", "salt", "variants", "bucketing"}).AddRow("", "", []entity.Variant(nil), ""))
 				m.ExpectExec("INSERT INTO user_segments").
-					WithArgs(args.userId, args.addSegments[1].Name, expireTime).
-					WillReturnResult(pgxmock.NewResult("INSERT", 1))
+					WithArgs(args.userId, args.addSegments[0].Name, "", inAnHour).
+					WillReturnResult(pgxmock.NewResult("INSERT", 0))
+				m.ExpectQuery("SELECT variant, expire::timestamptz FROM user_segments").
+					WithArgs(args.addSegments[0].Name, args.userId).
+					WillReturnRows(pgxmock.NewRows([]string{"variant", "expire"}).AddRow("", nil))
+				m.ExpectExec("UPDATE user_segments SET expire = \\$1::timestamptz::timestamp WHERE segment_name = \\$2 AND user_id = \\$3").
+					WithArgs(inAnHour, args.addSegments[0].Name, args.userId).
+					WillReturnResult(pgxmock.NewResult("UPDATE", 1))
 				m.ExpectExec("INSERT INTO user_segments_log").
-					WithArgs(args.userId, args.addSegments[1].Name, "add").
+					WithArgs(args.userId, args.addSegments[0].Name, "", entity.OperationTTL, "", entity.SourceManual, "", inAnHour).
 					WillReturnResult(pgxmock.NewResult("INSERT", 1))
 				m.ExpectCommit()
 			},
-			wantErr: false,
+			want: []entity.SegmentChange{{Segment: "segment1", Outcome: entity.OutcomeAlreadyPresent, ExpiresAt: &inAnHour}},
 		},
 		{
-			name: "remove 2 segments",
+			name: "segment already added in another variant",
 			args: args{
 				ctx:    context.Background(),
 				userId: 1,
-				removeSegments: []string{
-					"segment1",
-					"segment2",
+				addSegments: []entity.AddSegment{
+					{
+						Name:    "segment1",
+						Variant: "A",
+					},
 				},
 			},
 			mockBehavior: func(m pgxmock.PgxPoolIface, args args) {
@@ -627,30 +1635,159 @@ func TestUserRepo_AddOrRemoveUserSegments(t *testing.T) {
 				m.ExpectQuery("SELECT id").
 					WithArgs(args.userId).
 					WillReturnRows(pgxmock.NewRows([]string{"id"}).AddRow(1))
-				m.ExpectQuery("SELECT name").
+				m.ExpectQuery("SELECT layer").
+					WithArgs(args.addSegments[0].Name).
+					WillReturnRows(pgxmock.NewRows([]string{"layer", "salt", "variants", "bucketing"}).
+						AddRow("", "", []entity.Variant{{Name: "A", Weight: 50}, {Name: "B", Weight: 50}}, ""))
+				m.ExpectExec("INSERT INTO user_segments").
+					WithArgs(args.userId, args.addSegments[0].Name, "A").
+					WillReturnResult(pgxmock.NewResult("INSERT", 0))
+				m.ExpectQuery("SELECT variant, expire::timestamptz FROM user_segments").
+					WithArgs(args.addSegments[0].Name, args.userId).
+					WillReturnRows(pgxmock.NewRows([]string{"variant", "expire"}).AddRow("B", nil))
+				m.ExpectRollback()
+			},
+			wantErr:   true,
+			wantErrIs: repoerrs.ErrConflict,
+		},
+		{
+			name: "add to hash auto segment",
+			args: args{
+				ctx:         context.Background(),
+				userId:      1,
+				addSegments: []entity.AddSegment{{Name: "segment1"}},
+			},
+			mockBehavior: func(m pgxmock.PgxPoolIface, args args) {
+				m.ExpectBegin()
+				m.ExpectQuery("SELECT id").
+					WithArgs(args.userId).
+					WillReturnRows(pgxmock.NewRows([]string{"id"}).AddRow(1))
+				m.ExpectQuery("SELECT layer, salt, variants, bucketing").
+					WithArgs(args.addSegments[0].Name).
+					WillReturnRows(pgxmock.NewRows([]string{"layer", "salt", "variants", "bucketing"}).AddRow("", "segment1", []entity.Variant(nil), entity.BucketingHash))
+				m.ExpectRollback()
+			},
+			wantErr:   true,
+			wantErrIs: repoerrs.ErrConflict,
+		},
+		{
+			name: "remove from hash auto segment",
+			args: args{
+				ctx:            context.Background(),
+				userId:         1,
+				removeSegments: []string{"segment1"},
+			},
+			mockBehavior: func(m pgxmock.PgxPoolIface, args args) {
+				m.ExpectBegin()
+				m.ExpectQuery("SELECT id").
+					WithArgs(args.userId).
+					WillReturnRows(pgxmock.NewRows([]string{"id"}).AddRow(1))
+				m.ExpectQuery("SELECT bucketing").
+					WithArgs(args.removeSegments[0]).
+					WillReturnRows(pgxmock.NewRows([]string{"bucketing"}).AddRow(entity.BucketingHash))
+				m.ExpectRollback()
+			},
+			wantErr:   true,
+			wantErrIs: repoerrs.ErrConflict,
+		},
+		{
+			name: "remove segment the user is not in",
+			args: args{
+				ctx:            context.Background(),
+				userId:         1,
+				removeSegments: []string{"segment1"},
+			},
+			mockBehavior: func(m pgxmock.PgxPoolIface, args args) {
+				m.ExpectBegin()
+				m.ExpectQuery("SELECT id").
+					WithArgs(args.userId).
+					WillReturnRows(pgxmock.NewRows([]string{"id"}).AddRow(1))
+				m.ExpectQuery("SELECT bucketing").
 					WithArgs(args.removeSegments[0]).
-					WillReturnRows(pgxmock.NewRows([]string{"name"}).AddRow(args.removeSegments[0]))
-				m.ExpectExec("DELETE FROM user_segments").
+					WillReturnRows(pgxmock.NewRows([]string{"bucketing"}).AddRow(""))
+				m.ExpectQuery("DELETE FROM user_segments (.+) RETURNING variant").
 					WithArgs(args.userId, args.removeSegments[0]).
-					WillReturnResult(pgxmock.NewResult("DELETE", 1))
-				m.ExpectExec("INSERT INTO user_segments_log").
-					WithArgs(args.userId, args.removeSegments[0], "delete").
+					WillReturnRows(pgxmock.NewRows([]string{"variant"}))
+				m.ExpectCommit()
+			},
+			want: []entity.SegmentChange{{Segment: "segment1", Outcome: entity.OutcomeNotMember}},
+		},
+		{
+			name: "idempotency key taken",
+			args: args{
+				ctx:            entity.WithCaller(context.Background(), entity.Caller{Name: "marketing", Role: entity.RoleAssigner}),
+				userId:         1,
+				removeSegments: []string{"segment1"},
+				idempotencyKey: "retry-1",
+			},
+			mockBehavior: func(m pgxmock.PgxPoolIface, args args) {
+				m.ExpectBegin()
+				m.ExpectExec("INSERT INTO idempotency_keys \\(actor,key,request_hash\\) VALUES \\(\\$1,\\$2,\\$3\\) ON CONFLICT \\(actor, key\\) DO UPDATE SET (.+) WHERE idempotency_keys.created_at < NOW\\(\\) - INTERVAL '1 day'").
+					WithArgs("marketing", args.idempotencyKey, hashSegmentsRequest(args.userId, args.addSegments, args.removeSegments)).
 					WillReturnResult(pgxmock.NewResult("INSERT", 1))
-				m.ExpectQuery("SELECT name").
-					WithArgs(args.removeSegments[1]).
-					WillReturnRows(pgxmock.NewRows([]string{"name"}).AddRow(args.removeSegments[1]))
-				m.ExpectExec("DELETE FROM user_segments").
-					WithArgs(args.userId, args.removeSegments[1]).
-					WillReturnResult(pgxmock.NewResult("DELETE", 1))
+				m.ExpectQuery("SELECT id").
+					WithArgs(args.userId).
+					WillReturnRows(pgxmock.NewRows([]string{"id"}).AddRow(1))
+				m.ExpectQuery("SELECT bucketing").
+					WithArgs(args.removeSegments[0]).
+					WillReturnRows(pgxmock.NewRows([]string{"bucketing"}).AddRow(""))
+				m.ExpectQuery("DELETE FROM user_segments (.+) RETURNING variant").
+					WithArgs(args.userId, args.removeSegments[0]).
+					WillReturnRows(pgxmock.NewRows([]string{"variant"}).AddRow(""))
 				m.ExpectExec("INSERT INTO user_segments_log").
-					WithArgs(args.userId, args.removeSegments[1], "delete").
+					WithArgs(args.userId, args.removeSegments[0], "", "delete", "marketing", entity.SourceManual, "").
 					WillReturnResult(pgxmock.NewResult("INSERT", 1))
+				m.ExpectExec("UPDATE idempotency_keys SET response = \\$1 WHERE actor = \\$2 AND key = \\$3").
+					WithArgs(`[{"segment":"segment1","outcome":"removed"}]`, "marketing", args.idempotencyKey).
+					WillReturnResult(pgxmock.NewResult("UPDATE", 1))
 				m.ExpectCommit()
 			},
-			wantErr: false,
+			want: []entity.SegmentChange{{Segment: "segment1", Outcome: entity.OutcomeRemoved}},
 		},
 		{
-			name: "add 1 segment and remove 1 segment with same name",
+			name: "idempotency key replayed",
+			args: args{
+				ctx:            context.Background(),
+				userId:         1,
+				removeSegments: []string{"segment1"},
+				idempotencyKey: "retry-1",
+			},
+			mockBehavior: func(m pgxmock.PgxPoolIface, args args) {
+				hash := hashSegmentsRequest(args.userId, args.addSegments, args.removeSegments)
+				m.ExpectBegin()
+				m.ExpectExec("INSERT INTO idempotency_keys").
+					WithArgs("", args.idempotencyKey, hash).
+					WillReturnResult(pgxmock.NewResult("INSERT", 0))
+				m.ExpectQuery("SELECT request_hash, response FROM idempotency_keys WHERE actor = \\$1 AND key = \\$2").
+					WithArgs("", args.idempotencyKey).
+					WillReturnRows(pgxmock.NewRows([]string{"request_hash", "response"}).AddRow(hash, []byte(`[{"segment":"segment1","outcome":"removed"}]`)))
+				m.ExpectRollback()
+			},
+			want: []entity.SegmentChange{{Segment: "segment1", Outcome: entity.OutcomeRemoved}},
+		},
+		{
+			name: "idempotency key of another request",
+			args: args{
+				ctx:            context.Background(),
+				userId:         1,
+				removeSegments: []string{"segment1"},
+				idempotencyKey: "retry-1",
+			},
+			mockBehavior: func(m pgxmock.PgxPoolIface, args args) {
+				m.ExpectBegin()
+				m.ExpectExec("INSERT INTO idempotency_keys").
+					WithArgs("", args.idempotencyKey, hashSegmentsRequest(args.userId, args.addSegments, args.removeSegments)).
+					WillReturnResult(pgxmock.NewResult("INSERT", 0))
+				m.ExpectQuery("SELECT request_hash, response FROM idempotency_keys").
+					WithArgs("", args.idempotencyKey).
+					WillReturnRows(pgxmock.NewRows([]string{"request_hash", "response"}).AddRow(hashSegmentsRequest(2, nil, args.removeSegments), []byte(`[]`)))
+				m.ExpectRollback()
+			},
+			wantErr:   true,
+			wantErrIs: repoerrs.ErrConflict,
+		},
+		{
+			name: "INSERT into user_segments unique violation",
 			args: args{
 				ctx:    context.Background(),
 				userId: 1,
@@ -659,65 +1796,65 @@ func TestUserRepo_AddOrRemoveUserSegments(t *testing.T) {
 						Name: "segment1",
 					},
 				},
-				removeSegments: []string{
-					"segment1",
-				},
 			},
 			mockBehavior: func(m pgxmock.PgxPoolIface, args args) {
 				m.ExpectBegin()
 				m.ExpectQuery("SELECT id").
 					WithArgs(args.userId).
 					WillReturnRows(pgxmock.NewRows([]string{"id"}).AddRow(1))
-				m.ExpectQuery("SELECT name").
+				m.ExpectQuery("SELECT layer").
 					WithArgs(args.addSegments[0].Name).
-					WillReturnRows(pgxmock.NewRows([]string{"name"}).AddRow(args.addSegments[0].Name))
+					WillReturnRows(pgxmock.NewRows([]string{"layer", "salt", "variants", "bucketing"}).AddRow("", "", []entity.Variant(nil), ""))
 				m.ExpectExec("INSERT INTO user_segments").
-					WithArgs(args.userId, args.addSegments[0].Name).
-					WillReturnResult(pgxmock.NewResult("INSERT", 1))
-				m.ExpectExec("INSERT INTO user_segments_log").
-					WithArgs(args.userId, args.addSegments[0].Name, "add").
-					WillReturnResult(pgxmock.NewResult("INSERT", 1))
-				m.ExpectQuery("SELECT name").
-					WithArgs(args.removeSegments[0]).
-					WillReturnRows(pgxmock.NewRows([]string{"name"}).AddRow(args.removeSegments[0]))
-				m.ExpectExec("DELETE FROM user_segments").
-					WithArgs(args.userId, args.removeSegments[0]).
-					WillReturnResult(pgxmock.NewResult("DELETE", 1))
-				m.ExpectExec("INSERT INTO user_segments_log").
-					WithArgs(args.userId, args.removeSegments[0], "delete").
-					WillReturnResult(pgxmock.NewResult("INSERT", 1))
-				m.ExpectCommit()
+					WithArgs(args.userId, args.addSegments[0].Name, "").
+					WillReturnError(&pgconn.PgError{
+						Code: "23505",
+					})
+				m.ExpectRollback()
 			},
-			wantErr: false,
+			wantErr:   true,
+			wantErrIs: repoerrs.ErrAlreadyExists,
 		},
 		{
-			name: "r.Pool.Begin error",
+			name: "SELECT id tx.QueryRow error",
 			args: args{
-				ctx: context.Background(),
+				ctx:    context.Background(),
+				userId: 1,
 			},
 			mockBehavior: func(m pgxmock.PgxPoolIface, args args) {
-				m.ExpectBegin().WillReturnError(errors.New("some error"))
+				m.ExpectBegin()
+				m.ExpectQuery("SELECT id").
+					WithArgs(args.userId).
+					WillReturnError(errors.New("some error"))
 				m.ExpectRollback()
 			},
 			wantErr: true,
 		},
 		{
-			name: "SELECT id tx.QueryRow error",
+			name: "SELECT name in addSegments tx.QueryRow2 error",
 			args: args{
 				ctx:    context.Background(),
 				userId: 1,
+				addSegments: []entity.AddSegment{
+					{
+						Name: "segment1",
+					},
+				},
 			},
 			mockBehavior: func(m pgxmock.PgxPoolIface, args args) {
 				m.ExpectBegin()
 				m.ExpectQuery("SELECT id").
 					WithArgs(args.userId).
+					WillReturnRows(pgxmock.NewRows([]string{"id"}).AddRow(1))
+				m.ExpectQuery("SELECT layer").
+					WithArgs(args.addSegments[0].Name).
 					WillReturnError(errors.New("some error"))
 				m.ExpectRollback()
 			},
 			wantErr: true,
 		},
 		{
-			name: "SELECT name in addSegments tx.QueryRow2 error",
+			name: "INSERT into user_segments in addSegments without expire tx.Exec1 error",
 			args: args{
 				ctx:    context.Background(),
 				userId: 1,
@@ -728,43 +1865,178 @@ func TestUserRepo_AddOrRemoveUserSegments(t *testing.T) {
 				},
 			},
 			mockBehavior: func(m pgxmock.PgxPoolIface, args args) {
+				segmentName := args.addSegments[0].Name
 				m.ExpectBegin()
 				m.ExpectQuery("SELECT id").
 					WithArgs(args.userId).
 					WillReturnRows(pgxmock.NewRows([]string{"id"}).AddRow(1))
-				m.ExpectQuery("SELECT name").
-					WithArgs(args.addSegments[0].Name).
+				m.ExpectQuery("SELECT bucketing").
+					WithArgs(segmentName).
+					WillReturnRows(pgxmock.NewRows([]string{"bucketing"}).AddRow(""))
+				m.ExpectExec("INSERT INTO user_segments").
+					WithArgs(args.userId, segmentName, "").
 					WillReturnError(errors.New("some error"))
 				m.ExpectRollback()
 			},
-			wantErr: true,
+			wantErr: true,
+		},
+		{
+			name: "add experiment segment, variant by bucket",
+			args: args{
+				ctx:    context.Background(),
+				userId: 1,
+				addSegments: []entity.AddSegment{
+					{
+						Name: "auto_segment",
+					},
+				},
+			},
+			mockBehavior: func(m pgxmock.PgxPoolIface, args args) {
+				m.ExpectBegin()
+				m.ExpectQuery("SELECT id").
+					WithArgs(args.userId).
+					WillReturnRows(pgxmock.NewRows([]string{"id"}).AddRow(1))
+				m.ExpectQuery("SELECT layer, salt, variants").
+					WithArgs("auto_segment").
+					WillReturnRows(pgxmock.NewRows([]string{"layer", "salt", "variants", "bucketing"}).AddRow("", "auto_segment", experimentVariants, ""))
+				m.ExpectExec("INSERT INTO user_segments").
+					WithArgs(args.userId, "auto_segment", "treatment").
+					WillReturnResult(pgxmock.NewResult("INSERT", 1))
+				m.ExpectExec("INSERT INTO user_segments_log").
+					WithArgs(args.userId, "auto_segment", "treatment", "add", "", entity.SourceManual, "").
+					WillReturnResult(pgxmock.NewResult("INSERT", 1))
+				m.ExpectCommit()
+			},
+			want:    []entity.SegmentChange{{Segment: "auto_segment", Outcome: entity.OutcomeAdded, Variant: "treatment"}},
+			wantErr: false,
+		},
+		{
+			name: "add experiment segment with requested variant",
+			args: args{
+				ctx:    context.Background(),
+				userId: 1,
+				addSegments: []entity.AddSegment{
+					{
+						Name:    "auto_segment",
+						Variant: "control",
+					},
+				},
+			},
+			mockBehavior: func(m pgxmock.PgxPoolIface, args args) {
+				m.ExpectBegin()
+				m.ExpectQuery("SELECT id").
+					WithArgs(args.userId).
+					WillReturnRows(pgxmock.NewRows([]string{"id"}).AddRow(1))
+				m.ExpectQuery("SELECT layer, salt, variants").
+					WithArgs("auto_segment").
+					WillReturnRows(pgxmock.NewRows([]string{"layer", "salt", "variants", "bucketing"}).AddRow("", "auto_segment", experimentVariants, ""))
+				m.ExpectExec("INSERT INTO user_segments").
+					WithArgs(args.userId, "auto_segment", "control").
+					WillReturnResult(pgxmock.NewResult("INSERT", 1))
+				m.ExpectExec("INSERT INTO user_segments_log").
+					WithArgs(args.userId, "auto_segment", "control", "add", "", entity.SourceManual, "").
+					WillReturnResult(pgxmock.NewResult("INSERT", 1))
+				m.ExpectCommit()
+			},
+			want:    []entity.SegmentChange{{Segment: "auto_segment", Outcome: entity.OutcomeAdded, Variant: "control"}},
+			wantErr: false,
+		},
+		{
+			name: "add experiment segment with unknown variant",
+			args: args{
+				ctx:    context.Background(),
+				userId: 1,
+				addSegments: []entity.AddSegment{
+					{
+						Name:    "auto_segment",
+						Variant: "unknown",
+					},
+				},
+			},
+			mockBehavior: func(m pgxmock.PgxPoolIface, args args) {
+				m.ExpectBegin()
+				m.ExpectQuery("SELECT id").
+					WithArgs(args.userId).
+					WillReturnRows(pgxmock.NewRows([]string{"id"}).AddRow(1))
+				m.ExpectQuery("SELECT layer, salt, variants").
+					WithArgs("auto_segment").
+					WillReturnRows(pgxmock.NewRows([]string{"layer", "salt", "variants", "bucketing"}).AddRow("", "auto_segment", experimentVariants, ""))
+				m.ExpectRollback()
+			},
+			wantErr:   true,
+			wantErrIs: repoerrs.ErrInvalidInput,
+		},
+		{
+			name: "add segment of a layer the user is already in",
+			args: args{
+				ctx:    context.Background(),
+				userId: 1,
+				addSegments: []entity.AddSegment{
+					{
+						Name: "experiment_b",
+					},
+				},
+			},
+			mockBehavior: func(m pgxmock.PgxPoolIface, args args) {
+				m.ExpectBegin()
+				m.ExpectQuery("SELECT id").
+					WithArgs(args.userId).
+					WillReturnRows(pgxmock.NewRows([]string{"id"}).AddRow(1))
+				m.ExpectQuery("SELECT layer").
+					WithArgs("experiment_b").
+					WillReturnRows(pgxmock.NewRows([]string{"layer", "salt", "variants", "bucketing"}).AddRow("checkout", "", []entity.Variant(nil), ""))
+				m.ExpectQuery("SELECT segment_name FROM user_segments WHERE user_id = \\$1 AND layer = \\$2 AND segment_name <> \\$3").
+					WithArgs(args.userId, "checkout", "experiment_b").
+					WillReturnRows(pgxmock.NewRows([]string{"segment_name"}).AddRow("experiment_a"))
+				m.ExpectRollback()
+			},
+			wantErr:   true,
+			wantErrIs: repoerrs.ErrConflict,
 		},
 		{
-			name: "INSERT into user_segments in addSegments without expire tx.Exec1 error",
+			name: "move between segments of a layer",
 			args: args{
 				ctx:    context.Background(),
 				userId: 1,
 				addSegments: []entity.AddSegment{
 					{
-						Name: "segment1",
+						Name: "experiment_b",
 					},
 				},
+				removeSegments: []string{
+					"experiment_a",
+				},
 			},
 			mockBehavior: func(m pgxmock.PgxPoolIface, args args) {
-				segmentName := args.addSegments[0].Name
 				m.ExpectBegin()
 				m.ExpectQuery("SELECT id").
 					WithArgs(args.userId).
 					WillReturnRows(pgxmock.NewRows([]string{"id"}).AddRow(1))
-				m.ExpectQuery("SELECT name").
-					WithArgs(segmentName).
-					WillReturnRows(pgxmock.NewRows([]string{"name"}).AddRow(segmentName))
+				m.ExpectQuery("SELECT bucketing").
+					WithArgs("experiment_a").
+					WillReturnRows(pgxmock.NewRows([]string{"bucketing"}).AddRow(""))
+				m.ExpectQuery("DELETE FROM user_segments (.+) RETURNING variant").
+					WithArgs(args.userId, "experiment_a").
+					WillReturnRows(pgxmock.NewRows([]string{"variant"}).AddRow(""))
+				m.ExpectExec("INSERT INTO user_segments_log").
+					WithArgs(args.userId, "experiment_a", "", "delete", "", entity.SourceManual, "").
+					WillReturnResult(pgxmock.NewResult("INSERT", 1))
+				m.ExpectQuery("SELECT layer").
+					WithArgs("experiment_b").
+					WillReturnRows(pgxmock.NewRows([]string{"layer", "salt", "variants", "bucketing"}).AddRow("checkout", "", []entity.Variant(nil), ""))
+				m.ExpectQuery("SELECT segment_name FROM user_segments").
+					WithArgs(args.userId, "checkout", "experiment_b").
+					WillReturnRows(pgxmock.NewRows([]string{"segment_name"}))
 				m.ExpectExec("INSERT INTO user_segments").
-					WithArgs(args.userId, segmentName).
-					WillReturnError(errors.New("some error"))
-				m.ExpectRollback()
+					WithArgs(args.userId, "experiment_b", "").
+					WillReturnResult(pgxmock.NewResult("INSERT", 1))
+				m.ExpectExec("INSERT INTO user_segments_log").
+					WithArgs(args.userId, "experiment_b", "", "add", "", entity.SourceManual, "").
+					WillReturnResult(pgxmock.NewResult("INSERT", 1))
+				m.ExpectCommit()
 			},
-			wantErr: true,
+			want:    []entity.SegmentChange{{Segment: "experiment_a", Outcome: entity.OutcomeRemoved}, {Segment: "experiment_b", Outcome: entity.OutcomeAdded}},
+			wantErr: false,
 		},
 		{
 			name: "time.ParseDuration error in addSegments with expire",
@@ -784,12 +2056,13 @@ func TestUserRepo_AddOrRemoveUserSegments(t *testing.T) {
 				m.ExpectQuery("SELECT id").
 					WithArgs(args.userId).
 					WillReturnRows(pgxmock.NewRows([]string{"id"}).AddRow(1))
-				m.ExpectQuery("SELECT name").
+				m.ExpectQuery("SELECT layer").
 					WithArgs(segmentName).
-					WillReturnRows(pgxmock.NewRows([]string{"name"}).AddRow(segmentName))
+					WillReturnRows(pgxmock.NewRows([]string{"layer", "salt", "variants", "bucketing"}).AddRow("", "", []entity.Variant(nil), ""))
 				m.ExpectRollback()
 			},
-			wantErr: true,
+			wantErr:   true,
+			wantErrIs: repoerrs.ErrInvalidInput,
 		},
 		{
 			name: "INSERT into user_segments in addSegments with expire tx.Exec1 error",
@@ -809,12 +2082,12 @@ func TestUserRepo_AddOrRemoveUserSegments(t *testing.T) {
 				m.ExpectQuery("SELECT id").
 					WithArgs(args.userId).
 					WillReturnRows(pgxmock.NewRows([]string{"id"}).AddRow(1))
-				m.ExpectQuery("SELECT name").
+				m.ExpectQuery("SELECT bucketing").
 					WithArgs(segmentName).
-					WillReturnRows(pgxmock.NewRows([]string{"name"}).AddRow(segmentName))
+					WillReturnRows(pgxmock.NewRows([]string{"bucketing"}).AddRow(""))
 				expireTime := time.Date(2023, time.January, 1, 15, 30, 12, 345, time.UTC).Add(time.Hour)
 				m.ExpectExec("INSERT INTO user_segments").
-					WithArgs(args.userId, args.addSegments[0].Name, expireTime).
+					WithArgs(args.userId, args.addSegments[0].Name, "", expireTime).
 					WillReturnError(errors.New("some error"))
 				m.ExpectRollback()
 			},
@@ -836,14 +2109,14 @@ func TestUserRepo_AddOrRemoveUserSegments(t *testing.T) {
 				m.ExpectQuery("SELECT id").
 					WithArgs(args.userId).
 					WillReturnRows(pgxmock.NewRows([]string{"id"}).AddRow(1))
-				m.ExpectQuery("SELECT name").
+				m.ExpectQuery("SELECT layer").
 					WithArgs(args.addSegments[0].Name).
-					WillReturnRows(pgxmock.NewRows([]string{"name"}).AddRow(args.addSegments[0].Name))
+					WillReturnRows(pgxmock.NewRows([]string{"layer", "salt", "variants", "bucketing"}).AddRow("", "", []entity.Variant(nil), ""))
 				m.ExpectExec("INSERT INTO user_segments").
-					WithArgs(args.userId, args.addSegments[0].Name).
+					WithArgs(args.userId, args.addSegments[0].Name, "").
 					WillReturnResult(pgxmock.NewResult("INSERT", 1))
 				m.ExpectExec("INSERT INTO user_segments_log").
-					WithArgs(args.userId, args.addSegments[0].Name, "add").
+					WithArgs(args.userId, args.addSegments[0].Name, "", "add", "", entity.SourceManual, "").
 					WillReturnError(errors.New("some error"))
 				m.ExpectRollback()
 			},
@@ -863,7 +2136,7 @@ func TestUserRepo_AddOrRemoveUserSegments(t *testing.T) {
 				m.ExpectQuery("SELECT id").
 					WithArgs(args.userId).
 					WillReturnRows(pgxmock.NewRows([]string{"id"}).AddRow(1))
-				m.ExpectQuery("SELECT name").
+				m.ExpectQuery("SELECT bucketing").
 					WithArgs(args.removeSegments[0]).
 					WillReturnError(errors.New("some error"))
 				m.ExpectRollback()
@@ -871,7 +2144,7 @@ func TestUserRepo_AddOrRemoveUserSegments(t *testing.T) {
 			wantErr: true,
 		},
 		{
-			name: "DELETE user_segments in removeSegments tx.Exec3 error",
+			name: "DELETE user_segments in removeSegments tx.QueryRow4 error",
 			args: args{
 				ctx:    context.Background(),
 				userId: 1,
@@ -884,10 +2157,10 @@ func TestUserRepo_AddOrRemoveUserSegments(t *testing.T) {
 				m.ExpectQuery("SELECT id").
 					WithArgs(args.userId).
 					WillReturnRows(pgxmock.NewRows([]string{"id"}).AddRow(1))
-				m.ExpectQuery("SELECT name").
+				m.ExpectQuery("SELECT bucketing").
 					WithArgs(args.removeSegments[0]).
-					WillReturnRows(pgxmock.NewRows([]string{"name"}).AddRow(args.removeSegments[0]))
-				m.ExpectExec("DELETE FROM user_segments").
+					WillReturnRows(pgxmock.NewRows([]string{"bucketing"}).AddRow(""))
+				m.ExpectQuery("DELETE FROM user_segments").
 					WithArgs(args.userId, args.removeSegments[0]).
 					WillReturnError(errors.New("some error"))
 				m.ExpectRollback()
@@ -908,14 +2181,14 @@ func TestUserRepo_AddOrRemoveUserSegments(t *testing.T) {
 				m.ExpectQuery("SELECT id").
 					WithArgs(args.userId).
 					WillReturnRows(pgxmock.NewRows([]string{"id"}).AddRow(1))
-				m.ExpectQuery("SELECT name").
+				m.ExpectQuery("SELECT bucketing").
 					WithArgs(args.removeSegments[0]).
-					WillReturnRows(pgxmock.NewRows([]string{"name"}).AddRow(args.removeSegments[0]))
-				m.ExpectExec("DELETE FROM user_segments").
+					WillReturnRows(pgxmock.NewRows([]string{"bucketing"}).AddRow(""))
+				m.ExpectQuery("DELETE FROM user_segments (.+) RETURNING variant").
 					WithArgs(args.userId, args.removeSegments[0]).
-					WillReturnResult(pgxmock.NewResult("DELETE", 1))
+					WillReturnRows(pgxmock.NewRows([]string{"variant"}).AddRow(""))
 				m.ExpectExec("INSERT INTO user_segments_log").
-					WithArgs(args.userId, args.removeSegments[0], "delete").
+					WithArgs(args.userId, args.removeSegments[0], "", "delete", "", entity.SourceManual, "").
 					WillReturnError(errors.New("some error"))
 				m.ExpectRollback()
 			},
@@ -950,15 +2223,412 @@ func TestUserRepo_AddOrRemoveUserSegments(t *testing.T) {
 			}
 			userRepoMock := NewUserRepo(postgresMock, MockTimeProvider{})
 
-			err := userRepoMock.AddOrRemoveUserSegments(tc.args.ctx, tc.args.userId, tc.args.addSegments, tc.args.removeSegments)
+			got, err := userRepoMock.AddOrRemoveUserSegments(tc.args.ctx, tc.args.userId, tc.args.addSegments, tc.args.removeSegments, tc.args.idempotencyKey)
+			if tc.wantErr {
+				assert.Error(t, err)
+				if tc.wantErrIs != nil {
+					assert.ErrorIs(t, err, tc.wantErrIs)
+				}
+				return
+			}
+			assert.NoError(t, err)
+
+			err = poolMock.ExpectationsWereMet()
+			assert.NoError(t, err)
+			assert.Equal(t, tc.want, got)
+		})
+	}
+}
+
+func TestUserRepo_SetUserSegmentExpiry(t *testing.T) {
+	campaignEnd := time.Date(2023, 12, 31, 23, 59, 59, 0, time.UTC)
+	inAnHour := time.Date(2023, time.January, 1, 15, 30, 12, 345, time.UTC).Add(time.Hour)
+
+	type args struct {
+		ctx     context.Context
+		userId  int
+		segment string
+		expiry  entity.Expiry
+	}
+
+	type MockBehavior func(m pgxmock.PgxPoolIface, args args)
+
+	testCases := []struct {
+		name         string
+		args         args
+		mockBehavior MockBehavior
+		want         entity.UserSegment
+		wantErr      bool
+		wantErrIs    error
+	}{
+		{
+			name: "extend until expires_at",
+			args: args{
+				ctx:     entity.WithReason(context.Background(), "campaign prolonged"),
+				userId:  1,
+				segment: "segment1",
+				expiry:  entity.Expiry{ExpiresAt: &campaignEnd},
+			},
+			mockBehavior: func(m pgxmock.PgxPoolIface, args args) {
+				m.ExpectBegin()
+				m.ExpectQuery("UPDATE user_segments SET expire = \\$1::timestamptz::timestamp WHERE segment_name = \\$2 AND user_id = \\$3 RETURNING variant").
+					WithArgs(campaignEnd, args.segment, args.userId).
+					WillReturnRows(pgxmock.NewRows([]string{"variant"}).AddRow("B"))
+				m.ExpectExec("INSERT INTO user_segments_log \\(user_id,segment_name,variant,operation,actor,source,reason,expires_at\\)").
+					WithArgs(args.userId, args.segment, "B", entity.OperationTTL, "", entity.SourceManual, "campaign prolonged", campaignEnd).
+					WillReturnResult(pgxmock.NewResult("INSERT", 1))
+				m.ExpectCommit()
+			},
+			want: entity.UserSegment{Name: "segment1", Variant: "B", ExpiresAt: &campaignEnd},
+		},
+		{
+			name: "expire from now",
+			args: args{
+				ctx:     context.Background(),
+				userId:  1,
+				segment: "segment1",
+				expiry:  entity.Expiry{Expire: "1h"},
+			},
+			mockBehavior: func(m pgxmock.PgxPoolIface, args args) {
+				m.ExpectBegin()
+				m.ExpectQuery("UPDATE user_segments SET expire").
+					WithArgs(inAnHour, args.segment, args.userId).
+					WillReturnRows(pgxmock.NewRows([]string{"variant"}).AddRow(""))
+				m.ExpectExec("INSERT INTO user_segments_log").
+					WithArgs(args.userId, args.segment, "", entity.OperationTTL, "", entity.SourceManual, "", inAnHour).
+					WillReturnResult(pgxmock.NewResult("INSERT", 1))
+				m.ExpectCommit()
+			},
+			want: entity.UserSegment{Name: "segment1", ExpiresAt: &inAnHour},
+		},
+		{
+			name: "clear",
+			args: args{
+				ctx:     context.Background(),
+				userId:  1,
+				segment: "segment1",
+			},
+			mockBehavior: func(m pgxmock.PgxPoolIface, args args) {
+				m.ExpectBegin()
+				m.ExpectQuery("UPDATE user_segments SET expire = \\$1 WHERE").
+					WithArgs(nil, args.segment, args.userId).
+					WillReturnRows(pgxmock.NewRows([]string{"variant"}).AddRow(""))
+				m.ExpectExec("INSERT INTO user_segments_log \\(user_id,segment_name,variant,operation,actor,source,reason\\)").
+					WithArgs(args.userId, args.segment, "", entity.OperationTTL, "", entity.SourceManual, "").
+					WillReturnResult(pgxmock.NewResult("INSERT", 1))
+				m.ExpectCommit()
+			},
+			want: entity.UserSegment{Name: "segment1"},
+		},
+		{
+			name: "not a member",
+			args: args{
+				ctx:     context.Background(),
+				userId:  1,
+				segment: "segment1",
+				expiry:  entity.Expiry{Expire: "1h"},
+			},
+			mockBehavior: func(m pgxmock.PgxPoolIface, args args) {
+				m.ExpectBegin()
+				m.ExpectQuery("UPDATE user_segments SET expire").
+					WithArgs(inAnHour, args.segment, args.userId).
+					WillReturnError(pgx.ErrNoRows)
+				m.ExpectRollback()
+			},
+			wantErr:   true,
+			wantErrIs: repoerrs.ErrNotFound,
+		},
+		{
+			name: "invalid expire",
+			args: args{
+				ctx:     context.Background(),
+				userId:  1,
+				segment: "segment1",
+				expiry:  entity.Expiry{Expire: "a month"},
+			},
+			mockBehavior: func(m pgxmock.PgxPoolIface, args args) {},
+			wantErr:      true,
+			wantErrIs:    repoerrs.ErrInvalidInput,
+		},
+		{
+			name: "log error",
+			args: args{
+				ctx:     context.Background(),
+				userId:  1,
+				segment: "segment1",
+				expiry:  entity.Expiry{Expire: "1h"},
+			},
+			mockBehavior: func(m pgxmock.PgxPoolIface, args args) {
+				m.ExpectBegin()
+				m.ExpectQuery("UPDATE user_segments SET expire").
+					WithArgs(inAnHour, args.segment, args.userId).
+					WillReturnRows(pgxmock.NewRows([]string{"variant"}).AddRow(""))
+				m.ExpectExec("INSERT INTO user_segments_log").
+					WillReturnError(errors.New("some error"))
+				m.ExpectRollback()
+			},
+			wantErr: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			poolMock, _ := pgxmock.NewPool()
+			defer poolMock.Close()
+			tc.mockBehavior(poolMock, tc.args)
+
+			postgresMock := &postgres.Postgres{
+				Builder: squirrel.StatementBuilder.PlaceholderFormat(squirrel.Dollar),
+				Pool:    poolMock,
+			}
+			userRepoMock := NewUserRepo(postgresMock, MockTimeProvider{})
+
+			got, err := userRepoMock.SetUserSegmentExpiry(tc.args.ctx, tc.args.userId, tc.args.segment, tc.args.expiry)
+			if tc.wantErr {
+				assert.Error(t, err)
+				if tc.wantErrIs != nil {
+					assert.ErrorIs(t, err, tc.wantErrIs)
+				}
+				return
+			}
+			assert.NoError(t, err)
+
+			err = poolMock.ExpectationsWereMet()
+			assert.NoError(t, err)
+			assert.Equal(t, tc.want, got)
+		})
+	}
+}
+
+func TestUserRepo_SetUserAttributes(t *testing.T) {
+	type args struct {
+		ctx    context.Context
+		userId int
+		attrs  entity.UserAttributes
+	}
+
+	type MockBehavior func(m pgxmock.PgxPoolIface, args args)
+
+	testCases := []struct {
+		name         string
+		args         args
+		mockBehavior MockBehavior
+		wantErr      bool
+		wantErrIs    error
+	}{
+		{
+			name: "OK, moves between rule segments",
+			args: args{
+				ctx:    context.Background(),
+				userId: 1,
+				attrs:  entity.UserAttributes{Country: "KZ", Platform: "ios"},
+			},
+			mockBehavior: func(m pgxmock.PgxPoolIface, args args) {
+				m.ExpectBegin()
+				m.ExpectExec("UPDATE users SET country = \\$1, platform = \\$2, signup_date = \\$3, properties = \\$4 WHERE id = \\$5").
+					WithArgs("KZ", "ios", nil, map[string]any{}, args.userId).
+					WillReturnResult(pgxmock.NewResult("UPDATE", 1))
+				m.ExpectQuery("SELECT name, salt, variants, rule FROM segments WHERE rule <> ''").
+					WillReturnRows(pgxmock.NewRows([]string{"name", "salt", "variants", "rule"}).
+						AddRow("ru", "", []entity.Variant(nil), `country == "RU"`).
+						AddRow("kz", "", []entity.Variant(nil), `country == "KZ"`).
+						AddRow("ios", "", []entity.Variant(nil), `platform == "ios"`))
+				m.ExpectQuery("SELECT us.segment_name FROM user_segments AS us").
+					WithArgs(args.userId).
+					WillReturnRows(pgxmock.NewRows([]string{"segment_name"}).AddRow("ru").AddRow("ios"))
+				m.ExpectQuery("DELETE FROM user_segments (.+) RETURNING variant").
+					WithArgs("ru", args.userId).
+					WillReturnRows(pgxmock.NewRows([]string{"variant"}).AddRow(""))
+				m.ExpectExec("INSERT INTO user_segments_log").
+					WithArgs(args.userId, "ru", "", "delete", "", entity.SourceRule, "").
+					WillReturnResult(pgxmock.NewResult("INSERT", 1))
+				m.ExpectExec("INSERT INTO user_segments").
+					WithArgs(args.userId, "kz", "").
+					WillReturnResult(pgxmock.NewResult("INSERT", 1))
+				m.ExpectExec("INSERT INTO user_segments_log").
+					WithArgs(args.userId, "kz", "", "add", "", entity.SourceRule, "").
+					WillReturnResult(pgxmock.NewResult("INSERT", 1))
+				m.ExpectCommit()
+			},
+			wantErr: false,
+		},
+		{
+			name: "OK, no rule segments",
+			args: args{
+				ctx:    context.Background(),
+				userId: 1,
+				attrs:  entity.UserAttributes{Country: "RU", SignupDate: "2023-08-31"},
+			},
+			mockBehavior: func(m pgxmock.PgxPoolIface, args args) {
+				m.ExpectBegin()
+				m.ExpectExec("UPDATE users").
+					WithArgs("RU", "", time.Date(2023, 8, 31, 0, 0, 0, 0, time.UTC), map[string]any{}, args.userId).
+					WillReturnResult(pgxmock.NewResult("UPDATE", 1))
+				m.ExpectQuery("SELECT name, salt, variants, rule FROM segments").
+					WillReturnRows(pgxmock.NewRows([]string{"name", "salt", "variants", "rule"}))
+				m.ExpectCommit()
+			},
+			wantErr: false,
+		},
+		{
+			name: "user not found",
+			args: args{
+				ctx:    context.Background(),
+				userId: 1,
+			},
+			mockBehavior: func(m pgxmock.PgxPoolIface, args args) {
+				m.ExpectBegin()
+				m.ExpectExec("UPDATE users").
+					WithArgs("", "", nil, map[string]any{}, args.userId).
+					WillReturnResult(pgxmock.NewResult("UPDATE", 0))
+				m.ExpectRollback()
+			},
+			wantErr:   true,
+			wantErrIs: repoerrs.ErrNotFound,
+		},
+		{
+			name: "invalid signup date",
+			args: args{
+				ctx:    context.Background(),
+				userId: 1,
+				attrs:  entity.UserAttributes{SignupDate: "2023-13-01"},
+			},
+			mockBehavior: func(m pgxmock.PgxPoolIface, args args) {},
+			wantErr:      true,
+			wantErrIs:    repoerrs.ErrInvalidInput,
+		},
+		{
+			name: "memberships read cut short",
+			args: args{
+				ctx:    context.Background(),
+				userId: 1,
+				attrs:  entity.UserAttributes{Country: "RU"},
+			},
+			mockBehavior: func(m pgxmock.PgxPoolIface, args args) {
+				m.ExpectBegin()
+				m.ExpectExec("UPDATE users").
+					WithArgs("RU", "", nil, map[string]any{}, args.userId).
+					WillReturnResult(pgxmock.NewResult("UPDATE", 1))
+				m.ExpectQuery("SELECT name, salt, variants, rule FROM segments").
+					WillReturnRows(pgxmock.NewRows([]string{"name", "salt", "variants", "rule"}).
+						AddRow("ru", "", []entity.Variant(nil), `country == "RU"`))
+				m.ExpectQuery("SELECT us.segment_name FROM user_segments AS us").
+					WithArgs(args.userId).
+					WillReturnRows(pgxmock.NewRows([]string{"segment_name"}).RowError(0, &pgconn.PgError{Code: "40001"}))
+				m.ExpectRollback()
+			},
+			wantErr:   true,
+			wantErrIs: repoerrs.ErrConflict,
+		},
+		{
+			name: "stored rule is broken",
+			args: args{
+				ctx:    context.Background(),
+				userId: 1,
+			},
+			mockBehavior: func(m pgxmock.PgxPoolIface, args args) {
+				m.ExpectBegin()
+				m.ExpectExec("UPDATE users").
+					WithArgs("", "", nil, map[string]any{}, args.userId).
+					WillReturnResult(pgxmock.NewResult("UPDATE", 1))
+				m.ExpectQuery("SELECT name, salt, variants, rule FROM segments").
+					WillReturnRows(pgxmock.NewRows([]string{"name", "salt", "variants", "rule"}).
+						AddRow("ru", "", []entity.Variant(nil), `country = "RU"`))
+				m.ExpectQuery("SELECT us.segment_name FROM user_segments AS us").
+					WithArgs(args.userId).
+					WillReturnRows(pgxmock.NewRows([]string{"segment_name"}))
+				m.ExpectRollback()
+			},
+			wantErr: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			poolMock, _ := pgxmock.NewPool()
+			defer poolMock.Close()
+			tc.mockBehavior(poolMock, tc.args)
+
+			postgresMock := &postgres.Postgres{
+				Builder: squirrel.StatementBuilder.PlaceholderFormat(squirrel.Dollar),
+				Pool:    poolMock,
+			}
+			userRepoMock := NewUserRepo(postgresMock, MockTimeProvider{})
+
+			err := userRepoMock.SetUserAttributes(tc.args.ctx, tc.args.userId, tc.args.attrs)
+			if tc.wantErr {
+				assert.Error(t, err)
+				if tc.wantErrIs != nil {
+					assert.ErrorIs(t, err, tc.wantErrIs)
+				}
+				return
+			}
+			assert.NoError(t, err)
+
+			err = poolMock.ExpectationsWereMet()
+			assert.NoError(t, err)
+		})
+	}
+}
+
+func TestUserRepo_GetUserAttributes(t *testing.T) {
+	type MockBehavior func(m pgxmock.PgxPoolIface)
+
+	testCases := []struct {
+		name         string
+		mockBehavior MockBehavior
+		want         entity.UserAttributes
+		wantErr      bool
+		wantErrIs    error
+	}{
+		{
+			name: "OK",
+			mockBehavior: func(m pgxmock.PgxPoolIface) {
+				m.ExpectQuery("SELECT country, platform, COALESCE\\(to_char\\(signup_date, 'YYYY-MM-DD'\\), ''\\), properties FROM users WHERE id = \\$1").
+					WithArgs(1).
+					WillReturnRows(pgxmock.NewRows([]string{"country", "platform", "signup_date", "properties"}).
+						AddRow("RU", "ios", "2023-08-31", map[string]any{"plan": "pro"}))
+			},
+			want:    entity.UserAttributes{Country: "RU", Platform: "ios", SignupDate: "2023-08-31", Properties: map[string]any{"plan": "pro"}},
+			wantErr: false,
+		},
+		{
+			name: "user not found",
+			mockBehavior: func(m pgxmock.PgxPoolIface) {
+				m.ExpectQuery("SELECT (.+) FROM users").
+					WithArgs(1).
+					WillReturnRows(pgxmock.NewRows([]string{"country", "platform", "signup_date", "properties"}))
+			},
+			wantErr:   true,
+			wantErrIs: repoerrs.ErrNotFound,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			poolMock, _ := pgxmock.NewPool()
+			defer poolMock.Close()
+			tc.mockBehavior(poolMock)
+
+			postgresMock := &postgres.Postgres{
+				Builder: squirrel.StatementBuilder.PlaceholderFormat(squirrel.Dollar),
+				Pool:    poolMock,
+			}
+			userRepoMock := NewUserRepo(postgresMock, MockTimeProvider{})
+
+			got, err := userRepoMock.GetUserAttributes(context.Background(), 1)
 			if tc.wantErr {
 				assert.Error(t, err)
+				if tc.wantErrIs != nil {
+					assert.ErrorIs(t, err, tc.wantErrIs)
+				}
 				return
 			}
 			assert.NoError(t, err)
 
 			err = poolMock.ExpectationsWereMet()
 			assert.NoError(t, err)
+			assert.Equal(t, tc.want, got)
 		})
 	}
 }
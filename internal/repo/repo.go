@@ -9,66 +9,86 @@ import (
 	"github.com/realPointer/segments/pkg/postgres"
 )
 
+//go:generate mockgen -source=repo.go -destination=mocks/mock.go
+
 type User interface {
-	CreateUser(ctx context.Context, userId int) error
-	GetUserSegments(ctx context.Context, userId int) ([]string, error)
-	AddOrRemoveUserSegments(ctx context.Context, userId int, addSegments []entity.AddSegment, removeSegments []string) error
-	GetUserOperations(ctx context.Context, userId int) ([]string, error)
-	GetUserOperationsByMonth(ctx context.Context, userId int, yearMonth string) ([]string, error)
+	CreateUser(ctx context.Context, userId int, attrs entity.UserAttributes) error
+	SetUserAttributes(ctx context.Context, userId int, attrs entity.UserAttributes) error
+	GetUserAttributes(ctx context.Context, userId int) (entity.UserAttributes, error)
+	GetUserSegments(ctx context.Context, userId int) ([]entity.UserSegment, error)
+	GetUserSegmentsAt(ctx context.Context, userId int, at time.Time) ([]entity.UserSegment, error)
+	AddOrRemoveUserSegments(ctx context.Context, userId int, addSegments []entity.AddSegment, removeSegments []string, idempotencyKey string) ([]entity.SegmentChange, error)
+	SetUserSegmentExpiry(ctx context.Context, userId int, segment string, expiry entity.Expiry) (entity.UserSegment, error)
+	GetUserOperations(ctx context.Context, userId int) ([]entity.Operation, error)
+	GetUserOperationsByMonth(ctx context.Context, userId int, yearMonth string) ([]entity.Operation, error)
+	GetUserOperationsPage(ctx context.Context, userId int, filter entity.OperationFilter) ([]entity.Operation, string, error)
+	StreamUserOperations(ctx context.Context, userId int, filter entity.OperationFilter, fn func(entity.Operation) error) error
+	StreamOperations(ctx context.Context, filter entity.FeedFilter, fn func(entity.FeedEntry) error) error
 }
 
 type Segment interface {
-	CreateSegment(ctx context.Context, name string) error
-	CreateSegmentAuto(ctx context.Context, name string, percentage float64) error
+	CreateSegment(ctx context.Context, segment entity.Segment) error
+	CreateSegmentAuto(ctx context.Context, segment entity.Segment, percentage float64) error
 	DeleteSegment(ctx context.Context, name string) error
-	GetSegments(ctx context.Context) ([]string, error)
+	GetSegments(ctx context.Context, filter entity.SegmentFilter) ([]entity.Segment, error)
+	GetSegment(ctx context.Context, name string) (entity.Segment, error)
+	UpdateSegment(ctx context.Context, name string, update entity.SegmentUpdate) (entity.Segment, error)
+	RenameSegment(ctx context.Context, name, newName string) (entity.Segment, error)
+	RebalanceAutoSegments(ctx context.Context) (int, error)
+	RecomputeRuleSegments(ctx context.Context) (int, error)
+	StreamSegmentMembers(ctx context.Context, segmentID int64, fn func(entity.SegmentMember) error) error
+	StreamSegmentOperations(ctx context.Context, segmentID int64, from, to time.Time, fn func(entity.Operation) error) error
 }
 
 type Expired interface {
 	DeleteExpiredRows(ctx context.Context) (int, error)
+	DeleteExpiredIdempotencyKeys(ctx context.Context) (int, error)
+}
+
+type Report interface {
+	CreateReportJob(ctx context.Context, job entity.ReportJob) (entity.ReportJob, error)
+	GetReportJob(ctx context.Context, id int64) (entity.ReportJob, error)
+	ClaimReportJob(ctx context.Context, lease time.Duration) (entity.ReportJob, bool, error)
+	CompleteReportJob(ctx context.Context, id int64, url string) error
+	RetryReportJob(ctx context.Context, id int64, reason string, delay time.Duration) error
+	FailReportJob(ctx context.Context, id int64, reason string) error
+}
+
+type Bulk interface {
+	CreateBulkJob(ctx context.Context, job entity.BulkJob, values []string) (entity.BulkJob, error)
+	GetBulkJob(ctx context.Context, id int64) (entity.BulkJob, error)
+	GetBulkJobErrors(ctx context.Context, id int64) ([]entity.BulkRow, error)
+	ClaimBulkJob(ctx context.Context, lease time.Duration) (entity.BulkJob, bool, error)
+	ProcessBulkRows(ctx context.Context, job entity.BulkJob, limit int, lease time.Duration) (int, error)
+	CompleteBulkJob(ctx context.Context, id int64) error
+	RetryBulkJob(ctx context.Context, id int64, reason string, delay time.Duration) error
+	FailBulkJob(ctx context.Context, id int64, reason string) error
+}
+
+type APIKey interface {
+	CreateAPIKey(ctx context.Context, key entity.APIKey, hash string) (entity.APIKey, error)
+	GetAPIKeyByHash(ctx context.Context, hash string) (entity.APIKey, error)
+	GetAPIKeys(ctx context.Context) ([]entity.APIKey, error)
+	DeleteAPIKey(ctx context.Context, id int64) error
 }
 
 type Repositories struct {
 	User
 	Segment
 	Expired
+	Report
+	Bulk
+	APIKey
 }
 
 func NewRepositories(pg *postgres.Postgres) *Repositories {
-	_, err := pg.Pool.Exec(context.Background(), `
-	CREATE TABLE IF NOT EXISTS users (
-		id INTEGER PRIMARY KEY NOT NULL
-	);
-
-	CREATE TABLE IF NOT EXISTS segments (
-		name VARCHAR(255) PRIMARY KEY NOT NULL,
-		amount FLOAT
-	);
-
-	CREATE TABLE IF NOT EXISTS user_segments (
-		user_id INTEGER NOT NULL,
-		segment_name VARCHAR(255) NOT NULL,
-		expire TIMESTAMP DEFAULT NULL,
-		CONSTRAINT user_segments_pkey PRIMARY KEY (user_id, segment_name),
-		CONSTRAINT user_segments_user_id_fkey FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE,
-		CONSTRAINT user_segments_segment_name_fkey FOREIGN KEY (segment_name) REFERENCES segments (name) ON DELETE CASCADE
-	);
-
-	CREATE TABLE IF NOT EXISTS user_segments_log (
-		user_id INTEGER NOT NULL,
-		segment_name VARCHAR(255) NOT NULL,
-		operation VARCHAR(20) NOT NULL,
-		operation_time TIMESTAMP DEFAULT NOW()
-	);`)
-
-	if err != nil {
-		panic(err)
-	}
-
 	return &Repositories{
 		User:    postgresdb.NewUserRepo(pg, RealTimeProvider{}),
 		Segment: postgresdb.NewSegmentRepo(pg),
 		Expired: postgresdb.NewExpiredRepo(pg),
+		Report:  postgresdb.NewReportRepo(pg),
+		Bulk:    postgresdb.NewBulkRepo(pg, RealTimeProvider{}),
+		APIKey:  postgresdb.NewAPIKeyRepo(pg),
 	}
 }
 
@@ -0,0 +1,41 @@
+// Package repoerrs defines the kinds of errors repositories report, so the
+// layers above can react to them without knowing about postgres.
+package repoerrs
+
+import "errors"
+
+var (
+	ErrNotFound      = errors.New("not found")
+	ErrAlreadyExists = errors.New("already exists")
+	ErrInvalidInput  = errors.New("invalid input")
+	ErrConflict      = errors.New("conflict")
+)
+
+// Error is a repository error of a known kind. Msg explains it in terms a
+// client can act on, Err keeps the underlying cause.
+type Error struct {
+	Kind error
+	Msg  string
+	Err  error
+}
+
+// New -.
+func New(kind error, msg string, err error) *Error {
+	return &Error{Kind: kind, Msg: msg, Err: err}
+}
+
+func (e *Error) Error() string {
+	if e.Err == nil {
+		return e.Msg
+	}
+
+	return e.Msg + ": " + e.Err.Error()
+}
+
+func (e *Error) Unwrap() []error {
+	if e.Err == nil {
+		return []error{e.Kind}
+	}
+
+	return []error{e.Kind, e.Err}
+}
@@ -11,6 +11,7 @@ package mock_service
 import (
 	context "context"
 	reflect "reflect"
+	time "time"
 
 	entity "github.com/realPointer/segments/internal/entity"
 	gomock "go.uber.org/mock/gomock"
@@ -40,38 +41,54 @@ func (m *MockUser) EXPECT() *MockUserMockRecorder {
 }
 
 // AddOrRemoveUserSegments mocks base method.
-func (m *MockUser) AddOrRemoveUserSegments(ctx context.Context, userId int, addSegments []entity.AddSegment, removeSegments []string) error {
+func (m *MockUser) AddOrRemoveUserSegments(ctx context.Context, userId int, addSegments []entity.AddSegment, removeSegments []string, idempotencyKey string) ([]entity.SegmentChange, error) {
 	m.ctrl.T.Helper()
-	ret := m.ctrl.Call(m, "AddOrRemoveUserSegments", ctx, userId, addSegments, removeSegments)
-	ret0, _ := ret[0].(error)
-	return ret0
+	ret := m.ctrl.Call(m, "AddOrRemoveUserSegments", ctx, userId, addSegments, removeSegments, idempotencyKey)
+	ret0, _ := ret[0].([]entity.SegmentChange)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
 }
 
 // AddOrRemoveUserSegments indicates an expected call of AddOrRemoveUserSegments.
-func (mr *MockUserMockRecorder) AddOrRemoveUserSegments(ctx, userId, addSegments, removeSegments any) *gomock.Call {
+func (mr *MockUserMockRecorder) AddOrRemoveUserSegments(ctx, userId, addSegments, removeSegments, idempotencyKey any) *gomock.Call {
 	mr.mock.ctrl.T.Helper()
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "AddOrRemoveUserSegments", reflect.TypeOf((*MockUser)(nil).AddOrRemoveUserSegments), ctx, userId, addSegments, removeSegments)
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "AddOrRemoveUserSegments", reflect.TypeOf((*MockUser)(nil).AddOrRemoveUserSegments), ctx, userId, addSegments, removeSegments, idempotencyKey)
 }
 
 // CreateUser mocks base method.
-func (m *MockUser) CreateUser(ctx context.Context, userId int) error {
+func (m *MockUser) CreateUser(ctx context.Context, userId int, attrs entity.UserAttributes) error {
 	m.ctrl.T.Helper()
-	ret := m.ctrl.Call(m, "CreateUser", ctx, userId)
+	ret := m.ctrl.Call(m, "CreateUser", ctx, userId, attrs)
 	ret0, _ := ret[0].(error)
 	return ret0
 }
 
 // CreateUser indicates an expected call of CreateUser.
-func (mr *MockUserMockRecorder) CreateUser(ctx, userId any) *gomock.Call {
+func (mr *MockUserMockRecorder) CreateUser(ctx, userId, attrs any) *gomock.Call {
 	mr.mock.ctrl.T.Helper()
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "CreateUser", reflect.TypeOf((*MockUser)(nil).CreateUser), ctx, userId)
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "CreateUser", reflect.TypeOf((*MockUser)(nil).CreateUser), ctx, userId, attrs)
+}
+
+// GetUserAttributes mocks base method.
+func (m *MockUser) GetUserAttributes(ctx context.Context, userId int) (entity.UserAttributes, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetUserAttributes", ctx, userId)
+	ret0, _ := ret[0].(entity.UserAttributes)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetUserAttributes indicates an expected call of GetUserAttributes.
+func (mr *MockUserMockRecorder) GetUserAttributes(ctx, userId any) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetUserAttributes", reflect.TypeOf((*MockUser)(nil).GetUserAttributes), ctx, userId)
 }
 
 // GetUserOperations mocks base method.
-func (m *MockUser) GetUserOperations(ctx context.Context, userId int) ([]string, error) {
+func (m *MockUser) GetUserOperations(ctx context.Context, userId int) ([]entity.Operation, error) {
 	m.ctrl.T.Helper()
 	ret := m.ctrl.Call(m, "GetUserOperations", ctx, userId)
-	ret0, _ := ret[0].([]string)
+	ret0, _ := ret[0].([]entity.Operation)
 	ret1, _ := ret[1].(error)
 	return ret0, ret1
 }
@@ -83,10 +100,10 @@ func (mr *MockUserMockRecorder) GetUserOperations(ctx, userId any) *gomock.Call
 }
 
 // GetUserOperationsByMonth mocks base method.
-func (m *MockUser) GetUserOperationsByMonth(ctx context.Context, userId int, yearMonth string) ([]string, error) {
+func (m *MockUser) GetUserOperationsByMonth(ctx context.Context, userId int, yearMonth string) ([]entity.Operation, error) {
 	m.ctrl.T.Helper()
 	ret := m.ctrl.Call(m, "GetUserOperationsByMonth", ctx, userId, yearMonth)
-	ret0, _ := ret[0].([]string)
+	ret0, _ := ret[0].([]entity.Operation)
 	ret1, _ := ret[1].(error)
 	return ret0, ret1
 }
@@ -97,11 +114,27 @@ func (mr *MockUserMockRecorder) GetUserOperationsByMonth(ctx, userId, yearMonth
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetUserOperationsByMonth", reflect.TypeOf((*MockUser)(nil).GetUserOperationsByMonth), ctx, userId, yearMonth)
 }
 
+// GetUserOperationsPage mocks base method.
+func (m *MockUser) GetUserOperationsPage(ctx context.Context, userId int, filter entity.OperationFilter) ([]entity.Operation, string, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetUserOperationsPage", ctx, userId, filter)
+	ret0, _ := ret[0].([]entity.Operation)
+	ret1, _ := ret[1].(string)
+	ret2, _ := ret[2].(error)
+	return ret0, ret1, ret2
+}
+
+// GetUserOperationsPage indicates an expected call of GetUserOperationsPage.
+func (mr *MockUserMockRecorder) GetUserOperationsPage(ctx, userId, filter any) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetUserOperationsPage", reflect.TypeOf((*MockUser)(nil).GetUserOperationsPage), ctx, userId, filter)
+}
+
 // GetUserSegments mocks base method.
-func (m *MockUser) GetUserSegments(ctx context.Context, userId int) ([]string, error) {
+func (m *MockUser) GetUserSegments(ctx context.Context, userId int) ([]entity.UserSegment, error) {
 	m.ctrl.T.Helper()
 	ret := m.ctrl.Call(m, "GetUserSegments", ctx, userId)
-	ret0, _ := ret[0].([]string)
+	ret0, _ := ret[0].([]entity.UserSegment)
 	ret1, _ := ret[1].(error)
 	return ret0, ret1
 }
@@ -112,19 +145,77 @@ func (mr *MockUserMockRecorder) GetUserSegments(ctx, userId any) *gomock.Call {
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetUserSegments", reflect.TypeOf((*MockUser)(nil).GetUserSegments), ctx, userId)
 }
 
-// UploadAndReturnDownloadURL mocks base method.
-func (m *MockUser) UploadAndReturnDownloadURL(ctx context.Context, name string, data []string) (string, error) {
+// GetUserSegmentsAt mocks base method.
+func (m *MockUser) GetUserSegmentsAt(ctx context.Context, userId int, at time.Time) ([]entity.UserSegment, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetUserSegmentsAt", ctx, userId, at)
+	ret0, _ := ret[0].([]entity.UserSegment)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetUserSegmentsAt indicates an expected call of GetUserSegmentsAt.
+func (mr *MockUserMockRecorder) GetUserSegmentsAt(ctx, userId, at any) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetUserSegmentsAt", reflect.TypeOf((*MockUser)(nil).GetUserSegmentsAt), ctx, userId, at)
+}
+
+// SetUserAttributes mocks base method.
+func (m *MockUser) SetUserAttributes(ctx context.Context, userId int, attrs entity.UserAttributes) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "SetUserAttributes", ctx, userId, attrs)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// SetUserAttributes indicates an expected call of SetUserAttributes.
+func (mr *MockUserMockRecorder) SetUserAttributes(ctx, userId, attrs any) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SetUserAttributes", reflect.TypeOf((*MockUser)(nil).SetUserAttributes), ctx, userId, attrs)
+}
+
+// SetUserSegmentExpiry mocks base method.
+func (m *MockUser) SetUserSegmentExpiry(ctx context.Context, userId int, segment string, expiry entity.Expiry) (entity.UserSegment, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "SetUserSegmentExpiry", ctx, userId, segment, expiry)
+	ret0, _ := ret[0].(entity.UserSegment)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// SetUserSegmentExpiry indicates an expected call of SetUserSegmentExpiry.
+func (mr *MockUserMockRecorder) SetUserSegmentExpiry(ctx, userId, segment, expiry any) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SetUserSegmentExpiry", reflect.TypeOf((*MockUser)(nil).SetUserSegmentExpiry), ctx, userId, segment, expiry)
+}
+
+// StreamOperations mocks base method.
+func (m *MockUser) StreamOperations(ctx context.Context, filter entity.FeedFilter, fn func(entity.FeedEntry) error) error {
 	m.ctrl.T.Helper()
-	ret := m.ctrl.Call(m, "UploadAndReturnDownloadURL", ctx, name, data)
+	ret := m.ctrl.Call(m, "StreamOperations", ctx, filter, fn)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// StreamOperations indicates an expected call of StreamOperations.
+func (mr *MockUserMockRecorder) StreamOperations(ctx, filter, fn any) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "StreamOperations", reflect.TypeOf((*MockUser)(nil).StreamOperations), ctx, filter, fn)
+}
+
+// UploadUserOperations mocks base method.
+func (m *MockUser) UploadUserOperations(ctx context.Context, userId int, filter entity.OperationFilter, name string) (string, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "UploadUserOperations", ctx, userId, filter, name)
 	ret0, _ := ret[0].(string)
 	ret1, _ := ret[1].(error)
 	return ret0, ret1
 }
 
-// UploadAndReturnDownloadURL indicates an expected call of UploadAndReturnDownloadURL.
-func (mr *MockUserMockRecorder) UploadAndReturnDownloadURL(ctx, name, data any) *gomock.Call {
+// UploadUserOperations indicates an expected call of UploadUserOperations.
+func (mr *MockUserMockRecorder) UploadUserOperations(ctx, userId, filter, name any) *gomock.Call {
 	mr.mock.ctrl.T.Helper()
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "UploadAndReturnDownloadURL", reflect.TypeOf((*MockUser)(nil).UploadAndReturnDownloadURL), ctx, name, data)
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "UploadUserOperations", reflect.TypeOf((*MockUser)(nil).UploadUserOperations), ctx, userId, filter, name)
 }
 
 // MockSegment is a mock of Segment interface.
@@ -151,31 +242,31 @@ func (m *MockSegment) EXPECT() *MockSegmentMockRecorder {
 }
 
 // CreateSegment mocks base method.
-func (m *MockSegment) CreateSegment(ctx context.Context, name string) error {
+func (m *MockSegment) CreateSegment(ctx context.Context, segment entity.Segment) error {
 	m.ctrl.T.Helper()
-	ret := m.ctrl.Call(m, "CreateSegment", ctx, name)
+	ret := m.ctrl.Call(m, "CreateSegment", ctx, segment)
 	ret0, _ := ret[0].(error)
 	return ret0
 }
 
 // CreateSegment indicates an expected call of CreateSegment.
-func (mr *MockSegmentMockRecorder) CreateSegment(ctx, name any) *gomock.Call {
+func (mr *MockSegmentMockRecorder) CreateSegment(ctx, segment any) *gomock.Call {
 	mr.mock.ctrl.T.Helper()
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "CreateSegment", reflect.TypeOf((*MockSegment)(nil).CreateSegment), ctx, name)
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "CreateSegment", reflect.TypeOf((*MockSegment)(nil).CreateSegment), ctx, segment)
 }
 
 // CreateSegmentAuto mocks base method.
-func (m *MockSegment) CreateSegmentAuto(ctx context.Context, name string, percentage float64) error {
+func (m *MockSegment) CreateSegmentAuto(ctx context.Context, segment entity.Segment, percentage float64) error {
 	m.ctrl.T.Helper()
-	ret := m.ctrl.Call(m, "CreateSegmentAuto", ctx, name, percentage)
+	ret := m.ctrl.Call(m, "CreateSegmentAuto", ctx, segment, percentage)
 	ret0, _ := ret[0].(error)
 	return ret0
 }
 
 // CreateSegmentAuto indicates an expected call of CreateSegmentAuto.
-func (mr *MockSegmentMockRecorder) CreateSegmentAuto(ctx, name, percentage any) *gomock.Call {
+func (mr *MockSegmentMockRecorder) CreateSegmentAuto(ctx, segment, percentage any) *gomock.Call {
 	mr.mock.ctrl.T.Helper()
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "CreateSegmentAuto", reflect.TypeOf((*MockSegment)(nil).CreateSegmentAuto), ctx, name, percentage)
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "CreateSegmentAuto", reflect.TypeOf((*MockSegment)(nil).CreateSegmentAuto), ctx, segment, percentage)
 }
 
 // DeleteSegment mocks base method.
@@ -192,19 +283,122 @@ func (mr *MockSegmentMockRecorder) DeleteSegment(ctx, name any) *gomock.Call {
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "DeleteSegment", reflect.TypeOf((*MockSegment)(nil).DeleteSegment), ctx, name)
 }
 
+// GetSegment mocks base method.
+func (m *MockSegment) GetSegment(ctx context.Context, name string) (entity.Segment, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetSegment", ctx, name)
+	ret0, _ := ret[0].(entity.Segment)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetSegment indicates an expected call of GetSegment.
+func (mr *MockSegmentMockRecorder) GetSegment(ctx, name any) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetSegment", reflect.TypeOf((*MockSegment)(nil).GetSegment), ctx, name)
+}
+
 // GetSegments mocks base method.
-func (m *MockSegment) GetSegments(ctx context.Context) ([]string, error) {
+func (m *MockSegment) GetSegments(ctx context.Context, filter entity.SegmentFilter) ([]entity.Segment, error) {
 	m.ctrl.T.Helper()
-	ret := m.ctrl.Call(m, "GetSegments", ctx)
-	ret0, _ := ret[0].([]string)
+	ret := m.ctrl.Call(m, "GetSegments", ctx, filter)
+	ret0, _ := ret[0].([]entity.Segment)
 	ret1, _ := ret[1].(error)
 	return ret0, ret1
 }
 
 // GetSegments indicates an expected call of GetSegments.
-func (mr *MockSegmentMockRecorder) GetSegments(ctx any) *gomock.Call {
+func (mr *MockSegmentMockRecorder) GetSegments(ctx, filter any) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetSegments", reflect.TypeOf((*MockSegment)(nil).GetSegments), ctx, filter)
+}
+
+// RebalanceAutoSegments mocks base method.
+func (m *MockSegment) RebalanceAutoSegments(ctx context.Context) (int, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "RebalanceAutoSegments", ctx)
+	ret0, _ := ret[0].(int)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// RebalanceAutoSegments indicates an expected call of RebalanceAutoSegments.
+func (mr *MockSegmentMockRecorder) RebalanceAutoSegments(ctx any) *gomock.Call {
 	mr.mock.ctrl.T.Helper()
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetSegments", reflect.TypeOf((*MockSegment)(nil).GetSegments), ctx)
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "RebalanceAutoSegments", reflect.TypeOf((*MockSegment)(nil).RebalanceAutoSegments), ctx)
+}
+
+// RecomputeRuleSegments mocks base method.
+func (m *MockSegment) RecomputeRuleSegments(ctx context.Context) (int, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "RecomputeRuleSegments", ctx)
+	ret0, _ := ret[0].(int)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// RecomputeRuleSegments indicates an expected call of RecomputeRuleSegments.
+func (mr *MockSegmentMockRecorder) RecomputeRuleSegments(ctx any) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "RecomputeRuleSegments", reflect.TypeOf((*MockSegment)(nil).RecomputeRuleSegments), ctx)
+}
+
+// RenameSegment mocks base method.
+func (m *MockSegment) RenameSegment(ctx context.Context, name, newName string) (entity.Segment, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "RenameSegment", ctx, name, newName)
+	ret0, _ := ret[0].(entity.Segment)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// RenameSegment indicates an expected call of RenameSegment.
+func (mr *MockSegmentMockRecorder) RenameSegment(ctx, name, newName any) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "RenameSegment", reflect.TypeOf((*MockSegment)(nil).RenameSegment), ctx, name, newName)
+}
+
+// StreamSegmentMembers mocks base method.
+func (m *MockSegment) StreamSegmentMembers(ctx context.Context, segmentID int64, fn func(entity.SegmentMember) error) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "StreamSegmentMembers", ctx, segmentID, fn)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// StreamSegmentMembers indicates an expected call of StreamSegmentMembers.
+func (mr *MockSegmentMockRecorder) StreamSegmentMembers(ctx, segmentID, fn any) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "StreamSegmentMembers", reflect.TypeOf((*MockSegment)(nil).StreamSegmentMembers), ctx, segmentID, fn)
+}
+
+// StreamSegmentOperations mocks base method.
+func (m *MockSegment) StreamSegmentOperations(ctx context.Context, segmentID int64, from, to time.Time, fn func(entity.Operation) error) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "StreamSegmentOperations", ctx, segmentID, from, to, fn)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// StreamSegmentOperations indicates an expected call of StreamSegmentOperations.
+func (mr *MockSegmentMockRecorder) StreamSegmentOperations(ctx, segmentID, from, to, fn any) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "StreamSegmentOperations", reflect.TypeOf((*MockSegment)(nil).StreamSegmentOperations), ctx, segmentID, from, to, fn)
+}
+
+// UpdateSegment mocks base method.
+func (m *MockSegment) UpdateSegment(ctx context.Context, name string, update entity.SegmentUpdate) (entity.Segment, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "UpdateSegment", ctx, name, update)
+	ret0, _ := ret[0].(entity.Segment)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// UpdateSegment indicates an expected call of UpdateSegment.
+func (mr *MockSegmentMockRecorder) UpdateSegment(ctx, name, update any) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "UpdateSegment", reflect.TypeOf((*MockSegment)(nil).UpdateSegment), ctx, name, update)
 }
 
 // MockScheduler is a mock of Scheduler interface.
@@ -230,6 +424,21 @@ func (m *MockScheduler) EXPECT() *MockSchedulerMockRecorder {
 	return m.recorder
 }
 
+// DeleteExpiredIdempotencyKeys mocks base method.
+func (m *MockScheduler) DeleteExpiredIdempotencyKeys(ctx context.Context) (int, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "DeleteExpiredIdempotencyKeys", ctx)
+	ret0, _ := ret[0].(int)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// DeleteExpiredIdempotencyKeys indicates an expected call of DeleteExpiredIdempotencyKeys.
+func (mr *MockSchedulerMockRecorder) DeleteExpiredIdempotencyKeys(ctx any) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "DeleteExpiredIdempotencyKeys", reflect.TypeOf((*MockScheduler)(nil).DeleteExpiredIdempotencyKeys), ctx)
+}
+
 // DeleteExpiredRows mocks base method.
 func (m *MockScheduler) DeleteExpiredRows(ctx context.Context) (int, error) {
 	m.ctrl.T.Helper()
@@ -244,3 +453,337 @@ func (mr *MockSchedulerMockRecorder) DeleteExpiredRows(ctx any) *gomock.Call {
 	mr.mock.ctrl.T.Helper()
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "DeleteExpiredRows", reflect.TypeOf((*MockScheduler)(nil).DeleteExpiredRows), ctx)
 }
+
+// DeleteOldReports mocks base method.
+func (m *MockScheduler) DeleteOldReports(ctx context.Context) (int, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "DeleteOldReports", ctx)
+	ret0, _ := ret[0].(int)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// DeleteOldReports indicates an expected call of DeleteOldReports.
+func (mr *MockSchedulerMockRecorder) DeleteOldReports(ctx any) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "DeleteOldReports", reflect.TypeOf((*MockScheduler)(nil).DeleteOldReports), ctx)
+}
+
+// RebalanceAutoSegments mocks base method.
+func (m *MockScheduler) RebalanceAutoSegments(ctx context.Context) (int, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "RebalanceAutoSegments", ctx)
+	ret0, _ := ret[0].(int)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// RebalanceAutoSegments indicates an expected call of RebalanceAutoSegments.
+func (mr *MockSchedulerMockRecorder) RebalanceAutoSegments(ctx any) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "RebalanceAutoSegments", reflect.TypeOf((*MockScheduler)(nil).RebalanceAutoSegments), ctx)
+}
+
+// RecomputeRuleSegments mocks base method.
+func (m *MockScheduler) RecomputeRuleSegments(ctx context.Context) (int, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "RecomputeRuleSegments", ctx)
+	ret0, _ := ret[0].(int)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// RecomputeRuleSegments indicates an expected call of RecomputeRuleSegments.
+func (mr *MockSchedulerMockRecorder) RecomputeRuleSegments(ctx any) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "RecomputeRuleSegments", reflect.TypeOf((*MockScheduler)(nil).RecomputeRuleSegments), ctx)
+}
+
+// MockReport is a mock of Report interface.
+type MockReport struct {
+	ctrl     *gomock.Controller
+	recorder *MockReportMockRecorder
+}
+
+// MockReportMockRecorder is the mock recorder for MockReport.
+type MockReportMockRecorder struct {
+	mock *MockReport
+}
+
+// NewMockReport creates a new mock instance.
+func NewMockReport(ctrl *gomock.Controller) *MockReport {
+	mock := &MockReport{ctrl: ctrl}
+	mock.recorder = &MockReportMockRecorder{mock}
+	return mock
+}
+
+// EXPECT returns an object that allows the caller to indicate expected use.
+func (m *MockReport) EXPECT() *MockReportMockRecorder {
+	return m.recorder
+}
+
+// CreateReport mocks base method.
+func (m *MockReport) CreateReport(ctx context.Context, job entity.ReportJob) (entity.ReportJob, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "CreateReport", ctx, job)
+	ret0, _ := ret[0].(entity.ReportJob)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// CreateReport indicates an expected call of CreateReport.
+func (mr *MockReportMockRecorder) CreateReport(ctx, job any) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "CreateReport", reflect.TypeOf((*MockReport)(nil).CreateReport), ctx, job)
+}
+
+// GetReport mocks base method.
+func (m *MockReport) GetReport(ctx context.Context, id int64) (entity.ReportJob, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetReport", ctx, id)
+	ret0, _ := ret[0].(entity.ReportJob)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetReport indicates an expected call of GetReport.
+func (mr *MockReportMockRecorder) GetReport(ctx, id any) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetReport", reflect.TypeOf((*MockReport)(nil).GetReport), ctx, id)
+}
+
+// MockBulk is a mock of Bulk interface.
+type MockBulk struct {
+	ctrl     *gomock.Controller
+	recorder *MockBulkMockRecorder
+}
+
+// MockBulkMockRecorder is the mock recorder for MockBulk.
+type MockBulkMockRecorder struct {
+	mock *MockBulk
+}
+
+// NewMockBulk creates a new mock instance.
+func NewMockBulk(ctrl *gomock.Controller) *MockBulk {
+	mock := &MockBulk{ctrl: ctrl}
+	mock.recorder = &MockBulkMockRecorder{mock}
+	return mock
+}
+
+// EXPECT returns an object that allows the caller to indicate expected use.
+func (m *MockBulk) EXPECT() *MockBulkMockRecorder {
+	return m.recorder
+}
+
+// CreateBulkJob mocks base method.
+func (m *MockBulk) CreateBulkJob(ctx context.Context, job entity.BulkJob, values []string) (entity.BulkJob, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "CreateBulkJob", ctx, job, values)
+	ret0, _ := ret[0].(entity.BulkJob)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// CreateBulkJob indicates an expected call of CreateBulkJob.
+func (mr *MockBulkMockRecorder) CreateBulkJob(ctx, job, values any) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "CreateBulkJob", reflect.TypeOf((*MockBulk)(nil).CreateBulkJob), ctx, job, values)
+}
+
+// GetBulkJob mocks base method.
+func (m *MockBulk) GetBulkJob(ctx context.Context, id int64) (entity.BulkJob, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetBulkJob", ctx, id)
+	ret0, _ := ret[0].(entity.BulkJob)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetBulkJob indicates an expected call of GetBulkJob.
+func (mr *MockBulkMockRecorder) GetBulkJob(ctx, id any) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetBulkJob", reflect.TypeOf((*MockBulk)(nil).GetBulkJob), ctx, id)
+}
+
+// GetBulkJobErrors mocks base method.
+func (m *MockBulk) GetBulkJobErrors(ctx context.Context, id int64) ([]entity.BulkRow, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetBulkJobErrors", ctx, id)
+	ret0, _ := ret[0].([]entity.BulkRow)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetBulkJobErrors indicates an expected call of GetBulkJobErrors.
+func (mr *MockBulkMockRecorder) GetBulkJobErrors(ctx, id any) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetBulkJobErrors", reflect.TypeOf((*MockBulk)(nil).GetBulkJobErrors), ctx, id)
+}
+
+// MockAuth is a mock of Auth interface.
+type MockAuth struct {
+	ctrl     *gomock.Controller
+	recorder *MockAuthMockRecorder
+}
+
+// MockAuthMockRecorder is the mock recorder for MockAuth.
+type MockAuthMockRecorder struct {
+	mock *MockAuth
+}
+
+// NewMockAuth creates a new mock instance.
+func NewMockAuth(ctrl *gomock.Controller) *MockAuth {
+	mock := &MockAuth{ctrl: ctrl}
+	mock.recorder = &MockAuthMockRecorder{mock}
+	return mock
+}
+
+// EXPECT returns an object that allows the caller to indicate expected use.
+func (m *MockAuth) EXPECT() *MockAuthMockRecorder {
+	return m.recorder
+}
+
+// Authenticate mocks base method.
+func (m *MockAuth) Authenticate(ctx context.Context, key string) (entity.Caller, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Authenticate", ctx, key)
+	ret0, _ := ret[0].(entity.Caller)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// Authenticate indicates an expected call of Authenticate.
+func (mr *MockAuthMockRecorder) Authenticate(ctx, key any) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Authenticate", reflect.TypeOf((*MockAuth)(nil).Authenticate), ctx, key)
+}
+
+// AuthenticateToken mocks base method.
+func (m *MockAuth) AuthenticateToken(ctx context.Context, token string) (entity.Caller, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "AuthenticateToken", ctx, token)
+	ret0, _ := ret[0].(entity.Caller)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// AuthenticateToken indicates an expected call of AuthenticateToken.
+func (mr *MockAuthMockRecorder) AuthenticateToken(ctx, token any) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "AuthenticateToken", reflect.TypeOf((*MockAuth)(nil).AuthenticateToken), ctx, token)
+}
+
+// CreateAPIKey mocks base method.
+func (m *MockAuth) CreateAPIKey(ctx context.Context, name, role string) (entity.APIKey, string, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "CreateAPIKey", ctx, name, role)
+	ret0, _ := ret[0].(entity.APIKey)
+	ret1, _ := ret[1].(string)
+	ret2, _ := ret[2].(error)
+	return ret0, ret1, ret2
+}
+
+// CreateAPIKey indicates an expected call of CreateAPIKey.
+func (mr *MockAuthMockRecorder) CreateAPIKey(ctx, name, role any) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "CreateAPIKey", reflect.TypeOf((*MockAuth)(nil).CreateAPIKey), ctx, name, role)
+}
+
+// DeleteAPIKey mocks base method.
+func (m *MockAuth) DeleteAPIKey(ctx context.Context, id int64) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "DeleteAPIKey", ctx, id)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// DeleteAPIKey indicates an expected call of DeleteAPIKey.
+func (mr *MockAuthMockRecorder) DeleteAPIKey(ctx, id any) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "DeleteAPIKey", reflect.TypeOf((*MockAuth)(nil).DeleteAPIKey), ctx, id)
+}
+
+// GetAPIKeys mocks base method.
+func (m *MockAuth) GetAPIKeys(ctx context.Context) ([]entity.APIKey, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetAPIKeys", ctx)
+	ret0, _ := ret[0].([]entity.APIKey)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetAPIKeys indicates an expected call of GetAPIKeys.
+func (mr *MockAuthMockRecorder) GetAPIKeys(ctx any) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetAPIKeys", reflect.TypeOf((*MockAuth)(nil).GetAPIKeys), ctx)
+}
+
+// MockReportWorker is a mock of ReportWorker interface.
+type MockReportWorker struct {
+	ctrl     *gomock.Controller
+	recorder *MockReportWorkerMockRecorder
+}
+
+// MockReportWorkerMockRecorder is the mock recorder for MockReportWorker.
+type MockReportWorkerMockRecorder struct {
+	mock *MockReportWorker
+}
+
+// NewMockReportWorker creates a new mock instance.
+func NewMockReportWorker(ctrl *gomock.Controller) *MockReportWorker {
+	mock := &MockReportWorker{ctrl: ctrl}
+	mock.recorder = &MockReportWorkerMockRecorder{mock}
+	return mock
+}
+
+// EXPECT returns an object that allows the caller to indicate expected use.
+func (m *MockReportWorker) EXPECT() *MockReportWorkerMockRecorder {
+	return m.recorder
+}
+
+// Run mocks base method.
+func (m *MockReportWorker) Run(ctx context.Context) {
+	m.ctrl.T.Helper()
+	m.ctrl.Call(m, "Run", ctx)
+}
+
+// Run indicates an expected call of Run.
+func (mr *MockReportWorkerMockRecorder) Run(ctx any) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Run", reflect.TypeOf((*MockReportWorker)(nil).Run), ctx)
+}
+
+// MockBulkWorker is a mock of BulkWorker interface.
+type MockBulkWorker struct {
+	ctrl     *gomock.Controller
+	recorder *MockBulkWorkerMockRecorder
+}
+
+// MockBulkWorkerMockRecorder is the mock recorder for MockBulkWorker.
+type MockBulkWorkerMockRecorder struct {
+	mock *MockBulkWorker
+}
+
+// NewMockBulkWorker creates a new mock instance.
+func NewMockBulkWorker(ctrl *gomock.Controller) *MockBulkWorker {
+	mock := &MockBulkWorker{ctrl: ctrl}
+	mock.recorder = &MockBulkWorkerMockRecorder{mock}
+	return mock
+}
+
+// EXPECT returns an object that allows the caller to indicate expected use.
+func (m *MockBulkWorker) EXPECT() *MockBulkWorkerMockRecorder {
+	return m.recorder
+}
+
+// Run mocks base method.
+func (m *MockBulkWorker) Run(ctx context.Context) {
+	m.ctrl.T.Helper()
+	m.ctrl.Call(m, "Run", ctx)
+}
+
+// Run indicates an expected call of Run.
+func (mr *MockBulkWorkerMockRecorder) Run(ctx any) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Run", reflect.TypeOf((*MockBulkWorker)(nil).Run), ctx)
+}
@@ -2,50 +2,112 @@ package service
 
 import (
 	"context"
+	"time"
 
 	"github.com/realPointer/segments/internal/entity"
 	"github.com/realPointer/segments/internal/repo"
 	"github.com/realPointer/segments/internal/service/services"
 	webapi "github.com/realPointer/segments/internal/ydisk"
+	"github.com/realPointer/segments/pkg/logger"
 )
 
 //go:generate mockgen -source=service.go -destination=mocks/mock.go
 
 type User interface {
-	CreateUser(ctx context.Context, userId int) error
-	GetUserSegments(ctx context.Context, userId int) ([]string, error)
-	AddOrRemoveUserSegments(ctx context.Context, userId int, addSegments []entity.AddSegment, removeSegments []string) error
-	GetUserOperations(ctx context.Context, userId int) ([]string, error)
-	GetUserOperationsByMonth(ctx context.Context, userId int, yearMonth string) ([]string, error)
-	UploadAndReturnDownloadURL(ctx context.Context, name string, data []string) (string, error)
+	CreateUser(ctx context.Context, userId int, attrs entity.UserAttributes) error
+	SetUserAttributes(ctx context.Context, userId int, attrs entity.UserAttributes) error
+	GetUserAttributes(ctx context.Context, userId int) (entity.UserAttributes, error)
+	GetUserSegments(ctx context.Context, userId int) ([]entity.UserSegment, error)
+	GetUserSegmentsAt(ctx context.Context, userId int, at time.Time) ([]entity.UserSegment, error)
+	AddOrRemoveUserSegments(ctx context.Context, userId int, addSegments []entity.AddSegment, removeSegments []string, idempotencyKey string) ([]entity.SegmentChange, error)
+	SetUserSegmentExpiry(ctx context.Context, userId int, segment string, expiry entity.Expiry) (entity.UserSegment, error)
+	GetUserOperations(ctx context.Context, userId int) ([]entity.Operation, error)
+	GetUserOperationsByMonth(ctx context.Context, userId int, yearMonth string) ([]entity.Operation, error)
+	GetUserOperationsPage(ctx context.Context, userId int, filter entity.OperationFilter) ([]entity.Operation, string, error)
+	StreamOperations(ctx context.Context, filter entity.FeedFilter, fn func(entity.FeedEntry) error) error
+	UploadUserOperations(ctx context.Context, userId int, filter entity.OperationFilter, name string) (string, error)
 }
 
 type Segment interface {
-	CreateSegment(ctx context.Context, name string) error
-	CreateSegmentAuto(ctx context.Context, name string, percentage float64) error
+	CreateSegment(ctx context.Context, segment entity.Segment) error
+	CreateSegmentAuto(ctx context.Context, segment entity.Segment, percentage float64) error
 	DeleteSegment(ctx context.Context, name string) error
-	GetSegments(ctx context.Context) ([]string, error)
+	GetSegments(ctx context.Context, filter entity.SegmentFilter) ([]entity.Segment, error)
+	GetSegment(ctx context.Context, name string) (entity.Segment, error)
+	UpdateSegment(ctx context.Context, name string, update entity.SegmentUpdate) (entity.Segment, error)
+	RenameSegment(ctx context.Context, name, newName string) (entity.Segment, error)
+	RebalanceAutoSegments(ctx context.Context) (int, error)
+	RecomputeRuleSegments(ctx context.Context) (int, error)
+	StreamSegmentMembers(ctx context.Context, segmentID int64, fn func(entity.SegmentMember) error) error
+	StreamSegmentOperations(ctx context.Context, segmentID int64, from, to time.Time, fn func(entity.Operation) error) error
 }
 
 type Scheduler interface {
 	DeleteExpiredRows(ctx context.Context) (int, error)
+	DeleteExpiredIdempotencyKeys(ctx context.Context) (int, error)
+	RebalanceAutoSegments(ctx context.Context) (int, error)
+	RecomputeRuleSegments(ctx context.Context) (int, error)
+	DeleteOldReports(ctx context.Context) (int, error)
+}
+
+type Report interface {
+	CreateReport(ctx context.Context, job entity.ReportJob) (entity.ReportJob, error)
+	GetReport(ctx context.Context, id int64) (entity.ReportJob, error)
+}
+
+type Bulk interface {
+	CreateBulkJob(ctx context.Context, job entity.BulkJob, values []string) (entity.BulkJob, error)
+	GetBulkJob(ctx context.Context, id int64) (entity.BulkJob, error)
+	GetBulkJobErrors(ctx context.Context, id int64) ([]entity.BulkRow, error)
+}
+
+type Auth interface {
+	CreateAPIKey(ctx context.Context, name, role string) (entity.APIKey, string, error)
+	GetAPIKeys(ctx context.Context) ([]entity.APIKey, error)
+	DeleteAPIKey(ctx context.Context, id int64) error
+	Authenticate(ctx context.Context, key string) (entity.Caller, error)
+	AuthenticateToken(ctx context.Context, token string) (entity.Caller, error)
+}
+
+type ReportWorker interface {
+	Run(ctx context.Context)
+}
+
+type BulkWorker interface {
+	Run(ctx context.Context)
 }
 
 type Services struct {
 	User
 	Segment
 	Scheduler
+	Report
+	ReportWorker
+	Bulk
+	BulkWorker
+	Auth
 }
 
 type ServicesDependencies struct {
-	Repos      *repo.Repositories
-	YandexDisk webapi.Disk
+	Repos        *repo.Repositories
+	Disk         webapi.Disk
+	Logger       logger.Interface
+	Export       services.ExportConfig
+	Auth         services.AuthConfig
+	ReportWorker services.ReportWorkerConfig
+	BulkWorker   services.BulkWorkerConfig
 }
 
 func NewServices(deps ServicesDependencies) *Services {
 	return &Services{
-		User:      services.NewUserService(deps.Repos.User, deps.YandexDisk),
+		User:      services.NewUserService(deps.Repos.User, deps.Disk, deps.Export),
 		Segment:   services.NewSegmentService(deps.Repos.Segment),
-		Scheduler: services.NewSheduler(deps.Repos.Expired),
+		Scheduler: services.NewSheduler(deps.Repos.Expired, deps.Repos.Segment, deps.Disk, deps.Export),
+		Report:    services.NewReportService(deps.Repos.Report),
+		ReportWorker: services.NewReportWorker(deps.Repos.Report, deps.Repos.User, deps.Repos.Segment, deps.Disk, deps.Export,
+			deps.Logger, deps.ReportWorker),
+		Bulk:       services.NewBulkService(deps.Repos.Bulk),
+		BulkWorker: services.NewBulkWorker(deps.Repos.Bulk, deps.Logger, deps.BulkWorker),
+		Auth:       services.NewAuthService(deps.Repos.APIKey, deps.Auth),
 	}
 }
@@ -0,0 +1,183 @@
+package services
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/mock/gomock"
+
+	"github.com/realPointer/segments/internal/entity"
+	mock_repo "github.com/realPointer/segments/internal/repo/mocks"
+	"github.com/realPointer/segments/internal/repo/repoerrs"
+)
+
+// signToken returns a JWT of the header and claims signed with secret.
+func signToken(secret, header, claims string) string {
+	enc := base64.RawURLEncoding.EncodeToString
+	unsigned := enc([]byte(header)) + "." + enc([]byte(claims))
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(unsigned))
+
+	return unsigned + "." + enc(mac.Sum(nil))
+}
+
+func TestAuthService_CreateAPIKey(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	apiKeyRepo := mock_repo.NewMockAPIKey(ctrl)
+
+	var stored entity.APIKey
+	var hash string
+	apiKeyRepo.EXPECT().CreateAPIKey(gomock.Any(), gomock.Any(), gomock.Any()).
+		DoAndReturn(func(ctx context.Context, key entity.APIKey, h string) (entity.APIKey, error) {
+			stored, hash = key, h
+			key.ID = 3
+			return key, nil
+		})
+
+	created, key, err := NewAuthService(apiKeyRepo, AuthConfig{}).CreateAPIKey(context.Background(), "marketing", entity.RoleAssigner)
+	require.NoError(t, err)
+	assert.Equal(t, int64(3), created.ID)
+	assert.Equal(t, entity.APIKey{Name: "marketing", Role: entity.RoleAssigner, Prefix: key[:12]}, stored)
+	assert.True(t, strings.HasPrefix(key, "seg_"))
+	assert.Len(t, key, 68)
+	assert.Equal(t, hashAPIKey(key), hash)
+	assert.NotContains(t, hash, key)
+}
+
+func TestAuthService_Authenticate(t *testing.T) {
+	type MockBehavior func(apiKeyRepo *mock_repo.MockAPIKey)
+
+	testCases := []struct {
+		name         string
+		key          string
+		mockBehavior MockBehavior
+		want         entity.Caller
+		wantErrIs    error
+	}{
+		{
+			name: "stored key",
+			key:  "seg_key",
+			mockBehavior: func(apiKeyRepo *mock_repo.MockAPIKey) {
+				apiKeyRepo.EXPECT().GetAPIKeyByHash(gomock.Any(), hashAPIKey("seg_key")).
+					Return(entity.APIKey{ID: 3, Name: "marketing", Role: entity.RoleAssigner}, nil)
+			},
+			want: entity.Caller{Name: "marketing", Role: entity.RoleAssigner},
+		},
+		{
+			name:         "bootstrap key",
+			key:          "bootstrap-secret",
+			mockBehavior: func(apiKeyRepo *mock_repo.MockAPIKey) {},
+			want:         entity.Caller{Name: "bootstrap", Role: entity.RoleAdmin},
+		},
+		{
+			name: "unknown key",
+			key:  "seg_unknown",
+			mockBehavior: func(apiKeyRepo *mock_repo.MockAPIKey) {
+				apiKeyRepo.EXPECT().GetAPIKeyByHash(gomock.Any(), hashAPIKey("seg_unknown")).
+					Return(entity.APIKey{}, repoerrs.New(repoerrs.ErrNotFound, "API key not found", nil))
+			},
+			wantErrIs: repoerrs.ErrNotFound,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			apiKeyRepo := mock_repo.NewMockAPIKey(ctrl)
+			tc.mockBehavior(apiKeyRepo)
+
+			s := NewAuthService(apiKeyRepo, AuthConfig{BootstrapKey: "bootstrap-secret"})
+			got, err := s.Authenticate(context.Background(), tc.key)
+			if tc.wantErrIs != nil {
+				assert.ErrorIs(t, err, tc.wantErrIs)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tc.want, got)
+		})
+	}
+}
+
+func TestAuthService_AuthenticateToken(t *testing.T) {
+	now := time.Date(2023, 9, 1, 12, 0, 0, 0, time.UTC)
+	header := `{"alg":"HS256","typ":"JWT"}`
+
+	testCases := []struct {
+		name    string
+		secret  string
+		token   string
+		want    entity.Caller
+		wantErr string
+	}{
+		{
+			name:   "OK",
+			secret: "secret",
+			token:  signToken("secret", header, `{"sub":"crm","role":"reader","exp":1693573200}`),
+			want:   entity.Caller{Name: "crm", Role: entity.RoleReader},
+		},
+		{
+			name:    "tokens not accepted",
+			token:   signToken("", header, `{"sub":"crm","role":"reader"}`),
+			wantErr: "bearer tokens are not accepted",
+		},
+		{
+			name:    "wrong secret",
+			secret:  "secret",
+			token:   signToken("other", header, `{"sub":"crm","role":"reader"}`),
+			wantErr: "invalid token signature",
+		},
+		{
+			name:    "unsigned",
+			secret:  "secret",
+			token:   signToken("secret", `{"alg":"none"}`, `{"sub":"crm","role":"admin"}`),
+			wantErr: `unsupported token algorithm "none", expected HS256`,
+		},
+		{
+			name:    "expired",
+			secret:  "secret",
+			token:   signToken("secret", header, `{"sub":"crm","role":"reader","exp":1693569600}`),
+			wantErr: "token expired",
+		},
+		{
+			name:    "not valid yet",
+			secret:  "secret",
+			token:   signToken("secret", header, `{"sub":"crm","role":"reader","nbf":1693573200}`),
+			wantErr: "token not valid yet",
+		},
+		{
+			name:    "unknown role",
+			secret:  "secret",
+			token:   signToken("secret", header, `{"sub":"crm","role":"owner"}`),
+			wantErr: `token has unknown role "owner"`,
+		},
+		{
+			name:    "malformed",
+			secret:  "secret",
+			token:   "not-a-token",
+			wantErr: "malformed token",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			s := NewAuthService(nil, AuthConfig{JWTSecret: tc.secret})
+			s.now = func() time.Time { return now }
+
+			got, err := s.AuthenticateToken(context.Background(), tc.token)
+			if tc.wantErr != "" {
+				assert.ErrorIs(t, err, repoerrs.ErrInvalidInput)
+				assert.EqualError(t, err, tc.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tc.want, got)
+		})
+	}
+}
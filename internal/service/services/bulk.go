@@ -0,0 +1,129 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/realPointer/segments/internal/entity"
+	"github.com/realPointer/segments/internal/repo"
+	"github.com/realPointer/segments/pkg/logger"
+)
+
+type BulkService struct {
+	bulkRepo repo.Bulk
+}
+
+func NewBulkService(bulkRepo repo.Bulk) *BulkService {
+	return &BulkService{
+		bulkRepo: bulkRepo,
+	}
+}
+
+func (s *BulkService) CreateBulkJob(ctx context.Context, job entity.BulkJob, values []string) (entity.BulkJob, error) {
+	return s.bulkRepo.CreateBulkJob(ctx, job, values)
+}
+
+func (s *BulkService) GetBulkJob(ctx context.Context, id int64) (entity.BulkJob, error) {
+	return s.bulkRepo.GetBulkJob(ctx, id)
+}
+
+func (s *BulkService) GetBulkJobErrors(ctx context.Context, id int64) ([]entity.BulkRow, error) {
+	return s.bulkRepo.GetBulkJobErrors(ctx, id)
+}
+
+// BulkWorkerConfig -.
+type BulkWorkerConfig struct {
+	// Workers is how many jobs are run at once.
+	Workers int
+	// PollInterval is how long an idle worker waits before looking for jobs
+	// again.
+	PollInterval time.Duration
+	// Lease is how long a job stays with the worker that claimed it without
+	// progress. It is renewed with every chunk of rows.
+	Lease time.Duration
+	// MaxAttempts limits how many times a job is tried before it fails.
+	MaxAttempts int
+	// RetryDelay is the wait before the second attempt, doubled for every
+	// attempt after it.
+	RetryDelay time.Duration
+	// ChunkSize is how many rows are applied in one transaction, at most
+	// maxBulkChunkSize.
+	ChunkSize int
+}
+
+// maxBulkChunkSize keeps the statements of a chunk within the 65535
+// parameters postgres takes.
+const maxBulkChunkSize = 10000
+
+// BulkWorker runs queued bulk jobs.
+type BulkWorker struct {
+	bulkRepo repo.Bulk
+	l        logger.Interface
+	cfg      BulkWorkerConfig
+}
+
+func NewBulkWorker(bulkRepo repo.Bulk, l logger.Interface, cfg BulkWorkerConfig) *BulkWorker {
+	if cfg.Workers < 1 {
+		cfg.Workers = 1
+	}
+	if cfg.MaxAttempts < 1 {
+		cfg.MaxAttempts = 1
+	}
+	if cfg.ChunkSize < 1 {
+		cfg.ChunkSize = 1000
+	}
+	if cfg.ChunkSize > maxBulkChunkSize {
+		cfg.ChunkSize = maxBulkChunkSize
+	}
+
+	return &BulkWorker{
+		bulkRepo: bulkRepo,
+		l:        l,
+		cfg:      cfg,
+	}
+}
+
+// Run runs jobs until ctx is cancelled. Jobs interrupted by the cancellation
+// are claimed again once their lease runs out and go on with the rows left.
+func (w *BulkWorker) Run(ctx context.Context) {
+	runWorkers(ctx, w.cfg.Workers, w.cfg.PollInterval, w.l, "BulkWorker", w.RunOnce)
+}
+
+// RunOnce claims a due job and applies its pending rows chunk by chunk. It
+// reports whether there was a job to claim.
+func (w *BulkWorker) RunOnce(ctx context.Context) (bool, error) {
+	job, ok, err := w.bulkRepo.ClaimBulkJob(ctx, w.cfg.Lease)
+	if err != nil || !ok {
+		return false, err
+	}
+
+	err = w.process(ctx, job)
+	if err == nil {
+		return true, w.bulkRepo.CompleteBulkJob(ctx, job.ID)
+	}
+
+	msg, ok := jobMessage(err)
+	if !ok {
+		w.l.Error(fmt.Errorf("BulkWorker - bulk job %d attempt %d: %w", job.ID, job.Attempts, err))
+	}
+
+	if permanent(err) || job.Attempts >= w.cfg.MaxAttempts {
+		w.l.Warn("BulkWorker - bulk job %d failed after %d attempts: %s", job.ID, job.Attempts, msg)
+		return true, w.bulkRepo.FailBulkJob(ctx, job.ID, msg)
+	}
+
+	delay := w.cfg.RetryDelay << (job.Attempts - 1)
+	w.l.Info("BulkWorker - bulk job %d attempt %d failed, retrying in %s: %s", job.ID, job.Attempts, delay, msg)
+
+	return true, w.bulkRepo.RetryBulkJob(ctx, job.ID, msg, delay)
+}
+
+func (w *BulkWorker) process(ctx context.Context, job entity.BulkJob) error {
+	for {
+		n, err := w.bulkRepo.ProcessBulkRows(ctx, job, w.cfg.ChunkSize, w.cfg.Lease)
+		if err != nil || n == 0 {
+			return err
+		}
+	}
+}
@@ -0,0 +1,100 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/mock/gomock"
+
+	"github.com/realPointer/segments/internal/entity"
+	mock_repo "github.com/realPointer/segments/internal/repo/mocks"
+	"github.com/realPointer/segments/internal/repo/repoerrs"
+	"github.com/realPointer/segments/pkg/logger"
+)
+
+func TestBulkWorker_RunOnce(t *testing.T) {
+	type MockBehavior func(bulkRepo *mock_repo.MockBulk, job entity.BulkJob)
+
+	cfg := BulkWorkerConfig{Lease: 2 * time.Minute, MaxAttempts: 3, RetryDelay: 30 * time.Second, ChunkSize: 2}
+
+	testCases := []struct {
+		name         string
+		job          entity.BulkJob
+		mockBehavior MockBehavior
+		wantClaimed  bool
+	}{
+		{
+			name: "no job due",
+			mockBehavior: func(bulkRepo *mock_repo.MockBulk, job entity.BulkJob) {
+				bulkRepo.EXPECT().ClaimBulkJob(gomock.Any(), cfg.Lease).Return(entity.BulkJob{}, false, nil)
+			},
+		},
+		{
+			name: "OK",
+			job:  entity.BulkJob{ID: 7, Operation: entity.OperationAdd, Segment: "segment1", Attempts: 1},
+			mockBehavior: func(bulkRepo *mock_repo.MockBulk, job entity.BulkJob) {
+				bulkRepo.EXPECT().ClaimBulkJob(gomock.Any(), cfg.Lease).Return(job, true, nil)
+				gomock.InOrder(
+					bulkRepo.EXPECT().ProcessBulkRows(gomock.Any(), job, 2, cfg.Lease).Return(2, nil),
+					bulkRepo.EXPECT().ProcessBulkRows(gomock.Any(), job, 2, cfg.Lease).Return(1, nil),
+					bulkRepo.EXPECT().ProcessBulkRows(gomock.Any(), job, 2, cfg.Lease).Return(0, nil),
+				)
+				bulkRepo.EXPECT().CompleteBulkJob(gomock.Any(), int64(7)).Return(nil)
+			},
+			wantClaimed: true,
+		},
+		{
+			name: "segment deleted",
+			job:  entity.BulkJob{ID: 7, Operation: entity.OperationAdd, Segment: "segment1", Attempts: 1},
+			mockBehavior: func(bulkRepo *mock_repo.MockBulk, job entity.BulkJob) {
+				bulkRepo.EXPECT().ClaimBulkJob(gomock.Any(), cfg.Lease).Return(job, true, nil)
+				bulkRepo.EXPECT().ProcessBulkRows(gomock.Any(), job, 2, cfg.Lease).
+					Return(0, repoerrs.New(repoerrs.ErrNotFound, `segment "segment1" not found`, nil))
+				bulkRepo.EXPECT().FailBulkJob(gomock.Any(), int64(7), `segment "segment1" not found`).Return(nil)
+			},
+			wantClaimed: true,
+		},
+		{
+			name: "database error",
+			job:  entity.BulkJob{ID: 7, Operation: entity.OperationDelete, Segment: "segment1", Attempts: 2},
+			mockBehavior: func(bulkRepo *mock_repo.MockBulk, job entity.BulkJob) {
+				bulkRepo.EXPECT().ClaimBulkJob(gomock.Any(), cfg.Lease).Return(job, true, nil)
+				gomock.InOrder(
+					bulkRepo.EXPECT().ProcessBulkRows(gomock.Any(), job, 2, cfg.Lease).Return(2, nil),
+					bulkRepo.EXPECT().ProcessBulkRows(gomock.Any(), job, 2, cfg.Lease).Return(0, errors.New("connection reset")),
+				)
+				bulkRepo.EXPECT().RetryBulkJob(gomock.Any(), int64(7), "internal error", time.Minute).Return(nil)
+			},
+			wantClaimed: true,
+		},
+		{
+			name: "out of attempts",
+			job:  entity.BulkJob{ID: 7, Operation: entity.OperationDelete, Segment: "segment1", Attempts: 3},
+			mockBehavior: func(bulkRepo *mock_repo.MockBulk, job entity.BulkJob) {
+				bulkRepo.EXPECT().ClaimBulkJob(gomock.Any(), cfg.Lease).Return(job, true, nil)
+				bulkRepo.EXPECT().ProcessBulkRows(gomock.Any(), job, 2, cfg.Lease).Return(0, errors.New("connection reset"))
+				bulkRepo.EXPECT().FailBulkJob(gomock.Any(), int64(7), "internal error").Return(nil)
+			},
+			wantClaimed: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			defer ctrl.Finish()
+
+			bulkRepo := mock_repo.NewMockBulk(ctrl)
+			tc.mockBehavior(bulkRepo, tc.job)
+
+			worker := NewBulkWorker(bulkRepo, logger.New("error"), cfg)
+
+			claimed, err := worker.RunOnce(context.Background())
+			assert.NoError(t, err)
+			assert.Equal(t, tc.wantClaimed, claimed)
+		})
+	}
+}
@@ -0,0 +1,258 @@
+package services
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"crypto/rand"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/realPointer/segments/internal/entity"
+	"github.com/realPointer/segments/internal/repo/repoerrs"
+	webapi "github.com/realPointer/segments/internal/ydisk"
+)
+
+const (
+	_exportBufferSize    = 64 << 10
+	_defaultNameTemplate = "{date}/{name}_{id}.{ext}"
+)
+
+// ExportConfig -.
+type ExportConfig struct {
+	// Gzip compresses reports, their names get a .gz suffix.
+	Gzip bool
+	// Folder holds all reports, the root of the storage when empty.
+	Folder string
+	// NameTemplate names reports within Folder, slashes in it make
+	// subfolders. {date} stands for the UTC day of the upload, {user} for the
+	// user or segment reported on, {id} for a random id of the report, {name}
+	// for the subject and period of the report and {ext} for its format.
+	NameTemplate string
+	// Retention is how long reports are kept, forever when zero.
+	Retention time.Duration
+}
+
+// reportFile is what reports are named after.
+type reportFile struct {
+	user string
+	id   string
+	name string
+	ext  string
+}
+
+// exporter uploads reports to the disk, laid out as configured.
+type exporter struct {
+	disk  webapi.Disk
+	cfg   ExportConfig
+	now   func() time.Time
+	newID func() string
+}
+
+func newExporter(disk webapi.Disk, cfg ExportConfig) *exporter {
+	if cfg.NameTemplate == "" {
+		cfg.NameTemplate = _defaultNameTemplate
+	}
+	cfg.Folder = strings.Trim(cfg.Folder, "/")
+
+	return &exporter{disk: disk, cfg: cfg, now: time.Now, newID: newReportID}
+}
+
+// path returns the name of the report on the disk.
+func (e *exporter) path(f reportFile) string {
+	// Values can't add folders of their own.
+	value := strings.NewReplacer("/", "_").Replace
+	name := strings.NewReplacer(
+		"{date}", e.now().UTC().Format(time.DateOnly),
+		"{user}", value(f.user),
+		"{id}", value(f.id),
+		"{name}", value(f.name),
+		"{ext}", value(f.ext),
+	).Replace(e.cfg.NameTemplate)
+
+	if e.cfg.Folder == "" {
+		return name
+	}
+
+	return e.cfg.Folder + "/" + name
+}
+
+func (e *exporter) upload(ctx context.Context, f reportFile, write func(io.Writer) error) (string, error) {
+	return upload(ctx, e.disk, e.path(f), e.cfg.Gzip, write)
+}
+
+// deleteExpired deletes the reports older than the retention.
+func (e *exporter) deleteExpired(ctx context.Context) (int, error) {
+	if e.cfg.Retention <= 0 {
+		return 0, nil
+	}
+
+	return e.disk.DeleteOlderThan(ctx, e.cfg.Folder, e.now().Add(-e.cfg.Retention))
+}
+
+// newReportID returns a random id for a report. Names can't be told from
+// those of other reports, where links are only as private as their names.
+func newReportID() string {
+	id := make([]byte, 6)
+	_, _ = rand.Read(id)
+
+	return hex.EncodeToString(id)
+}
+
+// upload streams what write produces to the disk under name, gzipped and
+// with a .gz suffix when compress is set, and returns a link to download it.
+// Nothing but a buffer of it is held in memory.
+func upload(ctx context.Context, disk webapi.Disk, name string, compress bool, write func(io.Writer) error) (string, error) {
+	if compress {
+		name += ".gz"
+	}
+
+	pr, pw := io.Pipe()
+	written := make(chan error, 1)
+	go func() {
+		err := produce(pw, compress, write)
+		pw.CloseWithError(err)
+		written <- err
+	}()
+
+	url, err := disk.UploadAndReturnDownloadURL(ctx, name, pr)
+	// Unblocks the writer when the disk gave up before reading everything.
+	pr.Close()
+
+	// A failed write is what made the upload fail, unless the write failed
+	// because the upload was over.
+	writeErr := <-written
+	if writeErr != nil && !errors.Is(writeErr, io.ErrClosedPipe) {
+		return "", writeErr
+	}
+	if err != nil {
+		return "", err
+	}
+
+	return url, nil
+}
+
+func produce(w io.Writer, compress bool, write func(io.Writer) error) error {
+	bw := bufio.NewWriterSize(w, _exportBufferSize)
+
+	if !compress {
+		err := write(bw)
+		if err != nil {
+			return err
+		}
+
+		return bw.Flush()
+	}
+
+	zw := gzip.NewWriter(bw)
+	err := write(zw)
+	if err != nil {
+		return err
+	}
+	err = zw.Close()
+	if err != nil {
+		return fmt.Errorf("gzip.Close: %w", err)
+	}
+
+	return bw.Flush()
+}
+
+type csvRecorder interface {
+	CSVRecord() []string
+}
+
+// recordEncoder writes records one by one in format: RFC 4180 CSV with the
+// header, a JSON array or one JSON object per line.
+type recordEncoder[T csvRecorder] struct {
+	w      io.Writer
+	format string
+	csv    *csv.Writer
+	count  int
+}
+
+func newRecordEncoder[T csvRecorder](w io.Writer, format string, header []string) (*recordEncoder[T], error) {
+	e := &recordEncoder[T]{w: w, format: format}
+
+	switch format {
+	case entity.FormatCSV:
+		e.csv = csv.NewWriter(w)
+		e.csv.UseCRLF = true
+		_ = e.csv.Write(header)
+	case entity.FormatJSON, entity.FormatNDJSON:
+	default:
+		return nil, repoerrs.New(repoerrs.ErrInvalidInput, fmt.Sprintf("unknown format %q", format), nil)
+	}
+
+	return e, nil
+}
+
+func (e *recordEncoder[T]) Encode(record T) error {
+	defer func() { e.count++ }()
+
+	switch e.format {
+	case entity.FormatCSV:
+		_ = e.csv.Write(record.CSVRecord())
+		// csv.Writer buffers on its own, its errors show up on flushes.
+		return e.csv.Error()
+	case entity.FormatJSON:
+		data, err := json.Marshal(record)
+		if err != nil {
+			return err
+		}
+		sep := ","
+		if e.count == 0 {
+			sep = "["
+		}
+		_, err = io.WriteString(e.w, sep)
+		if err != nil {
+			return err
+		}
+		_, err = e.w.Write(data)
+
+		return err
+	default:
+		return json.NewEncoder(e.w).Encode(record)
+	}
+}
+
+// Close finishes the records, it doesn't close the writer.
+func (e *recordEncoder[T]) Close() error {
+	switch e.format {
+	case entity.FormatCSV:
+		e.csv.Flush()
+
+		return e.csv.Error()
+	case entity.FormatJSON:
+		end := "]\n"
+		if e.count == 0 {
+			end = "[]\n"
+		}
+		_, err := io.WriteString(e.w, end)
+
+		return err
+	default:
+		return nil
+	}
+}
+
+// encodeRecords streams the records fn is called with through a
+// recordEncoder.
+func encodeRecords[T csvRecorder](w io.Writer, format string, header []string, stream func(fn func(T) error) error) error {
+	enc, err := newRecordEncoder[T](w, format, header)
+	if err != nil {
+		return err
+	}
+
+	err = stream(enc.Encode)
+	if err != nil {
+		return err
+	}
+
+	return enc.Close()
+}
@@ -0,0 +1,212 @@
+package services
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/realPointer/segments/internal/entity"
+	"github.com/realPointer/segments/internal/repo/repoerrs"
+	webapi "github.com/realPointer/segments/internal/ydisk"
+)
+
+func TestUpload(t *testing.T) {
+	writeErr := errors.New("query failed")
+
+	testCases := []struct {
+		name      string
+		compress  bool
+		diskErr   error
+		write     func(w io.Writer) error
+		wantName  string
+		wantData  string
+		wantErrIs error
+	}{
+		{
+			name:     "OK",
+			write:    func(w io.Writer) error { _, err := io.WriteString(w, "42"); return err },
+			wantName: "42.csv",
+			wantData: "42",
+		},
+		{
+			name:     "gzip",
+			compress: true,
+			write:    func(w io.Writer) error { _, err := io.WriteString(w, "42"); return err },
+			wantName: "42.csv.gz",
+			wantData: "42",
+		},
+		{
+			name: "write fails",
+			write: func(w io.Writer) error {
+				_, _ = io.WriteString(w, "42")
+				return writeErr
+			},
+			wantErrIs: writeErr,
+		},
+		{
+			name:      "disk fails",
+			diskErr:   webapi.ErrUnavailable,
+			write:     func(w io.Writer) error { _, err := w.Write(make([]byte, 2*_exportBufferSize)); return err },
+			wantErrIs: webapi.ErrUnavailable,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			disk := &fakeDisk{err: tc.diskErr}
+
+			url, err := upload(context.Background(), disk, "42.csv", tc.compress, tc.write)
+			if tc.wantErrIs != nil {
+				assert.ErrorIs(t, err, tc.wantErrIs)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, "https://disk.example/"+tc.wantName, url)
+			assert.Equal(t, tc.wantName, disk.name)
+
+			data := disk.data
+			if tc.compress {
+				zr, err := gzip.NewReader(bytes.NewReader([]byte(data)))
+				require.NoError(t, err)
+				unzipped, err := io.ReadAll(zr)
+				require.NoError(t, err)
+				data = string(unzipped)
+			}
+			assert.Equal(t, tc.wantData, data)
+		})
+	}
+}
+
+func TestExporter_Path(t *testing.T) {
+	now := time.Date(2023, 9, 1, 23, 30, 0, 0, time.FixedZone("UTC-1", -3600))
+	file := reportFile{user: "42", id: "7", name: "42_2023-08", ext: "csv"}
+
+	testCases := []struct {
+		name string
+		cfg  ExportConfig
+		file reportFile
+		want string
+	}{
+		{
+			name: "default template",
+			cfg:  ExportConfig{Folder: "/reports/"},
+			file: file,
+			want: "reports/2023-09-02/42_2023-08_7.csv",
+		},
+		{
+			name: "no folder",
+			cfg:  ExportConfig{NameTemplate: "{user}/{date}_{id}.{ext}"},
+			file: file,
+			want: "42/2023-09-02_7.csv",
+		},
+		{
+			name: "values can't add folders",
+			cfg:  ExportConfig{Folder: "reports", NameTemplate: "{user}/{name}.{ext}"},
+			file: reportFile{user: "a/b", name: "../c", ext: "json"},
+			want: "reports/a_b/.._c.json",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			e := newExporter(&fakeDisk{}, tc.cfg)
+			e.now = func() time.Time { return now }
+
+			assert.Equal(t, tc.want, e.path(tc.file))
+		})
+	}
+}
+
+func TestNewReportID(t *testing.T) {
+	id := newReportID()
+	assert.Len(t, id, 12)
+	assert.NotEqual(t, id, newReportID())
+}
+
+func TestExporter_DeleteExpired(t *testing.T) {
+	now := time.Date(2023, 9, 1, 0, 0, 0, 0, time.UTC)
+
+	disk := &fakeDisk{}
+	e := newExporter(disk, ExportConfig{Folder: "reports"})
+	deleted, err := e.deleteExpired(context.Background())
+	require.NoError(t, err)
+	assert.Zero(t, deleted)
+	assert.Empty(t, disk.folder, "reports are kept forever without a retention")
+
+	e = newExporter(disk, ExportConfig{Folder: "reports/", Retention: 48 * time.Hour})
+	e.now = func() time.Time { return now }
+	deleted, err = e.deleteExpired(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, 1, deleted)
+	assert.Equal(t, "reports", disk.folder)
+	assert.Equal(t, now.Add(-48*time.Hour), disk.before)
+}
+
+func TestEncodeRecords(t *testing.T) {
+	at := time.Date(2023, 8, 1, 1, 0, 0, 0, time.UTC)
+	operations := []entity.Operation{
+		{UserID: 1, Segment: "segment1", Operation: "add", Time: at},
+		{UserID: 1, Segment: "segment1", Operation: "delete", Time: at},
+	}
+
+	testCases := []struct {
+		format     string
+		operations []entity.Operation
+		want       string
+		wantErrIs  error
+	}{
+		{
+			format:     entity.FormatCSV,
+			operations: operations,
+			want:       "user_id,segment,variant,operation,time,actor,source,reason,batch,expires_at\r\n1,segment1,,add,2023-08-01T01:00:00Z,,,,,\r\n1,segment1,,delete,2023-08-01T01:00:00Z,,,,,\r\n",
+		},
+		{
+			format:     entity.FormatJSON,
+			operations: operations,
+			want: `[{"user_id":1,"segment":"segment1","operation":"add","time":"2023-08-01T01:00:00Z"},` +
+				`{"user_id":1,"segment":"segment1","operation":"delete","time":"2023-08-01T01:00:00Z"}]` + "\n",
+		},
+		{
+			format: entity.FormatJSON,
+			want:   "[]\n",
+		},
+		{
+			format:     entity.FormatNDJSON,
+			operations: operations[:1],
+			want:       `{"user_id":1,"segment":"segment1","operation":"add","time":"2023-08-01T01:00:00Z"}` + "\n",
+		},
+		{
+			format:    "xml",
+			wantErrIs: repoerrs.ErrInvalidInput,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(fmt.Sprintf("%s %d", tc.format, len(tc.operations)), func(t *testing.T) {
+			var buf bytes.Buffer
+			err := encodeRecords(&buf, tc.format, entity.OperationCSVHeader, func(fn func(entity.Operation) error) error {
+				for _, operation := range tc.operations {
+					err := fn(operation)
+					if err != nil {
+						return err
+					}
+				}
+				return nil
+			})
+			if tc.wantErrIs != nil {
+				assert.ErrorIs(t, err, tc.wantErrIs)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tc.want, buf.String())
+		})
+	}
+}
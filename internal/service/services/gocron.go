@@ -4,18 +4,43 @@ import (
 	"context"
 
 	"github.com/realPointer/segments/internal/repo"
+	webapi "github.com/realPointer/segments/internal/ydisk"
 )
 
 type Scheduler struct {
 	expiredStorage repo.Expired
+	segmentStorage repo.Segment
+	exporter       *exporter
 }
 
-func NewSheduler(expiredStorage repo.Expired) *Scheduler {
+func NewSheduler(expiredStorage repo.Expired, segmentStorage repo.Segment, disk webapi.Disk, export ExportConfig) *Scheduler {
 	return &Scheduler{
 		expiredStorage: expiredStorage,
+		segmentStorage: segmentStorage,
+		exporter:       newExporter(disk, export),
 	}
 }
 
 func (s *Scheduler) DeleteExpiredRows(ctx context.Context) (int, error) {
 	return s.expiredStorage.DeleteExpiredRows(ctx)
 }
+
+// DeleteExpiredIdempotencyKeys deletes the idempotency keys kept for longer
+// than a day.
+func (s *Scheduler) DeleteExpiredIdempotencyKeys(ctx context.Context) (int, error) {
+	return s.expiredStorage.DeleteExpiredIdempotencyKeys(ctx)
+}
+
+func (s *Scheduler) RebalanceAutoSegments(ctx context.Context) (int, error) {
+	return s.segmentStorage.RebalanceAutoSegments(ctx)
+}
+
+func (s *Scheduler) RecomputeRuleSegments(ctx context.Context) (int, error) {
+	return s.segmentStorage.RecomputeRuleSegments(ctx)
+}
+
+// DeleteOldReports deletes the reports kept on the disk for longer than the
+// retention.
+func (s *Scheduler) DeleteOldReports(ctx context.Context) (int, error) {
+	return s.exporter.deleteExpired(ctx)
+}
@@ -0,0 +1,266 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strconv"
+	"time"
+
+	"github.com/realPointer/segments/internal/entity"
+	"github.com/realPointer/segments/internal/repo"
+	webapi "github.com/realPointer/segments/internal/ydisk"
+	"github.com/realPointer/segments/pkg/logger"
+)
+
+type ReportService struct {
+	reportRepo repo.Report
+}
+
+func NewReportService(reportRepo repo.Report) *ReportService {
+	return &ReportService{
+		reportRepo: reportRepo,
+	}
+}
+
+func (s *ReportService) CreateReport(ctx context.Context, job entity.ReportJob) (entity.ReportJob, error) {
+	return s.reportRepo.CreateReportJob(ctx, job)
+}
+
+func (s *ReportService) GetReport(ctx context.Context, id int64) (entity.ReportJob, error) {
+	return s.reportRepo.GetReportJob(ctx, id)
+}
+
+// ReportWorkerConfig -.
+type ReportWorkerConfig struct {
+	// Workers is how many reports are generated at once.
+	Workers int
+	// PollInterval is how long an idle worker waits before looking for jobs
+	// again.
+	PollInterval time.Duration
+	// Lease is how long a job stays with the worker that claimed it. A job
+	// still running after that is taken to be abandoned and is claimed again.
+	Lease time.Duration
+	// MaxAttempts limits how many times a job is tried before it fails.
+	MaxAttempts int
+	// RetryDelay is the wait before the second attempt, doubled for every
+	// attempt after it.
+	RetryDelay time.Duration
+}
+
+// ReportWorker generates queued reports and uploads them to the disk.
+type ReportWorker struct {
+	reportRepo  repo.Report
+	userRepo    repo.User
+	segmentRepo repo.Segment
+	exporter    *exporter
+	l           logger.Interface
+	cfg         ReportWorkerConfig
+}
+
+func NewReportWorker(reportRepo repo.Report, userRepo repo.User, segmentRepo repo.Segment, disk webapi.Disk, export ExportConfig, l logger.Interface, cfg ReportWorkerConfig) *ReportWorker {
+	if cfg.Workers < 1 {
+		cfg.Workers = 1
+	}
+	if cfg.MaxAttempts < 1 {
+		cfg.MaxAttempts = 1
+	}
+
+	return &ReportWorker{
+		reportRepo:  reportRepo,
+		userRepo:    userRepo,
+		segmentRepo: segmentRepo,
+		exporter:    newExporter(disk, export),
+		l:           l,
+		cfg:         cfg,
+	}
+}
+
+// Run generates reports until ctx is cancelled. Jobs interrupted by the
+// cancellation are claimed again once their lease runs out.
+func (w *ReportWorker) Run(ctx context.Context) {
+	runWorkers(ctx, w.cfg.Workers, w.cfg.PollInterval, w.l, "ReportWorker", w.RunOnce)
+}
+
+// RunOnce claims a due job and generates it. It reports whether there was a
+// job to claim.
+func (w *ReportWorker) RunOnce(ctx context.Context) (bool, error) {
+	job, ok, err := w.reportRepo.ClaimReportJob(ctx, w.cfg.Lease)
+	if err != nil || !ok {
+		return false, err
+	}
+
+	url, err := w.generate(ctx, job)
+	if err == nil {
+		return true, w.reportRepo.CompleteReportJob(ctx, job.ID, url)
+	}
+
+	msg, ok := jobMessage(err)
+	if !ok {
+		w.l.Error(fmt.Errorf("ReportWorker - report %d attempt %d: %w", job.ID, job.Attempts, err))
+	}
+
+	if permanent(err) || job.Attempts >= w.cfg.MaxAttempts {
+		w.l.Warn("ReportWorker - report %d failed after %d attempts: %s", job.ID, job.Attempts, msg)
+		return true, w.reportRepo.FailReportJob(ctx, job.ID, msg)
+	}
+
+	delay := w.cfg.RetryDelay << (job.Attempts - 1)
+	w.l.Info("ReportWorker - report %d attempt %d failed, retrying in %s: %s", job.ID, job.Attempts, delay, msg)
+
+	return true, w.reportRepo.RetryReportJob(ctx, job.ID, msg, delay)
+}
+
+func (w *ReportWorker) generate(ctx context.Context, job entity.ReportJob) (string, error) {
+	var from, to time.Time
+	if job.From != nil {
+		from = *job.From
+	}
+	if job.To != nil {
+		to = *job.To
+	}
+
+	file := reportFile{user: job.Segment, id: w.exporter.newID(), ext: job.Format}
+	var write func(io.Writer) error
+
+	switch job.Kind {
+	case entity.ReportSegmentMembers:
+		file.name = job.Segment + "_members"
+		write = func(wr io.Writer) error {
+			return encodeRecords(wr, job.Format, entity.SegmentMemberCSVHeader, func(fn func(entity.SegmentMember) error) error {
+				return w.segmentRepo.StreamSegmentMembers(ctx, job.SegmentID, fn)
+			})
+		}
+	case entity.ReportSegmentOperations:
+		file.name = job.Segment + "_operations"
+		write = func(wr io.Writer) error {
+			return encodeRecords(wr, job.Format, entity.OperationCSVHeader, func(fn func(entity.Operation) error) error {
+				return w.segmentRepo.StreamSegmentOperations(ctx, job.SegmentID, from, to, fn)
+			})
+		}
+	case entity.ReportSegmentDaily:
+		if to.IsZero() {
+			to = time.Now()
+		}
+
+		file.name = job.Segment + "_daily"
+		write = func(wr io.Writer) error {
+			return encodeRecords(wr, job.Format, entity.SegmentDailyCountCSVHeader, func(fn func(entity.SegmentDailyCount) error) error {
+				counter := newDailyCounter(from, to, fn)
+				// Counting starts with the members of the first day, so the
+				// history before it is needed as well.
+				err := w.segmentRepo.StreamSegmentOperations(ctx, job.SegmentID, time.Time{}, to, counter.add)
+				if err != nil {
+					return err
+				}
+
+				return counter.close()
+			})
+		}
+	default:
+		file.user = strconv.Itoa(job.UserID)
+		file.name = file.user
+		write = func(wr io.Writer) error {
+			return encodeRecords(wr, job.Format, entity.OperationCSVHeader, func(fn func(entity.Operation) error) error {
+				return w.userRepo.StreamUserOperations(ctx, job.UserID, entity.OperationFilter{From: from, To: to, Segment: job.Segment}, fn)
+			})
+		}
+	}
+
+	return w.exporter.upload(ctx, file, write)
+}
+
+// dailyCounter counts the members of a segment at the end of every UTC day
+// from the day of from to the one of to, while the operations on it are
+// replayed ordered by time, and emits the count of every day once it is
+// over. Operations after to are ignored. Without from it starts with the day
+// of the first operation.
+// Additions and removals are counted when they change the membership.
+type dailyCounter struct {
+	to      time.Time
+	emit    func(entity.SegmentDailyCount) error
+	members map[int]bool
+	// day is the start of the day being counted, zero until the first
+	// operation when there is no from.
+	day   time.Time
+	count entity.SegmentDailyCount
+}
+
+func newDailyCounter(from, to time.Time, emit func(entity.SegmentDailyCount) error) *dailyCounter {
+	c := &dailyCounter{to: to, emit: emit, members: make(map[int]bool)}
+	if !from.IsZero() {
+		c.day = from.UTC().Truncate(24 * time.Hour)
+	}
+
+	return c
+}
+
+func (c *dailyCounter) add(operation entity.Operation) error {
+	// TTL changes leave the membership as it is.
+	if operation.Operation == entity.OperationTTL || !operation.Time.Before(c.to) {
+		return nil
+	}
+	if c.day.IsZero() {
+		c.day = operation.Time.UTC().Truncate(24 * time.Hour)
+	}
+
+	if operation.Time.Before(c.day) {
+		c.apply(operation)
+		return nil
+	}
+	for !operation.Time.Before(c.day.AddDate(0, 0, 1)) {
+		err := c.next()
+		if err != nil {
+			return err
+		}
+	}
+
+	added, removed := c.apply(operation)
+	if added {
+		c.count.Added++
+	}
+	if removed {
+		c.count.Removed++
+	}
+
+	return nil
+}
+
+// close emits the days left until to.
+func (c *dailyCounter) close() error {
+	if c.day.IsZero() {
+		return nil
+	}
+	for c.day.Before(c.to) {
+		err := c.next()
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (c *dailyCounter) apply(operation entity.Operation) (added, removed bool) {
+	member := operation.Operation == entity.OperationAdd
+	changed := c.members[operation.UserID] != member
+	if member {
+		c.members[operation.UserID] = true
+	} else {
+		delete(c.members, operation.UserID)
+	}
+
+	return changed && member, changed && !member
+}
+
+// next emits the count of the day and moves on to the following one.
+func (c *dailyCounter) next() error {
+	count := c.count
+	count.Date = c.day.Format(time.DateOnly)
+	count.Members = len(c.members)
+
+	c.day = c.day.AddDate(0, 0, 1)
+	c.count = entity.SegmentDailyCount{}
+
+	return c.emit(count)
+}
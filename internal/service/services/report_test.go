@@ -0,0 +1,294 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/mock/gomock"
+
+	"github.com/realPointer/segments/internal/entity"
+	mock_repo "github.com/realPointer/segments/internal/repo/mocks"
+	"github.com/realPointer/segments/internal/repo/repoerrs"
+	webapi "github.com/realPointer/segments/internal/ydisk"
+	"github.com/realPointer/segments/pkg/logger"
+)
+
+// fakeDisk remembers the last upload and deletion and fails with err when it
+// is set.
+type fakeDisk struct {
+	name string
+	data string
+	err  error
+
+	folder string
+	before time.Time
+}
+
+func (d *fakeDisk) UploadAndReturnDownloadURL(ctx context.Context, name string, r io.Reader) (string, error) {
+	if d.err != nil {
+		return "", d.err
+	}
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return "", err
+	}
+	d.name, d.data = name, string(data)
+
+	return "https://disk.example/" + name, nil
+}
+
+func (d *fakeDisk) DeleteOlderThan(ctx context.Context, folder string, t time.Time) (int, error) {
+	if d.err != nil {
+		return 0, d.err
+	}
+	d.folder, d.before = folder, t
+
+	return 1, nil
+}
+
+// stream returns a stand-in for StreamUserOperations calling fn with the
+// operations.
+func stream(operations ...entity.Operation) func(ctx context.Context, userId int, filter entity.OperationFilter, fn func(entity.Operation) error) error {
+	return func(ctx context.Context, userId int, filter entity.OperationFilter, fn func(entity.Operation) error) error {
+		for _, operation := range operations {
+			err := fn(operation)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+func TestReportWorker_RunOnce(t *testing.T) {
+	type MockBehavior func(reportRepo *mock_repo.MockReport, userRepo *mock_repo.MockUser, segmentRepo *mock_repo.MockSegment, job entity.ReportJob)
+
+	from := time.Date(2023, 8, 1, 0, 0, 0, 0, time.UTC)
+	to := from.AddDate(0, 1, 0)
+	dayAfter := from.AddDate(0, 0, 2)
+	operation := entity.Operation{UserID: 1, Segment: "segment1", Operation: "add", Time: from.Add(time.Hour)}
+	cfg := ReportWorkerConfig{Lease: 10 * time.Minute, MaxAttempts: 3, RetryDelay: 30 * time.Second}
+	export := ExportConfig{NameTemplate: "{name}_{id}.{ext}"}
+
+	testCases := []struct {
+		name         string
+		job          entity.ReportJob
+		diskErr      error
+		mockBehavior MockBehavior
+		wantClaimed  bool
+		wantName     string
+		wantData     string
+	}{
+		{
+			name: "no job due",
+			mockBehavior: func(reportRepo *mock_repo.MockReport, userRepo *mock_repo.MockUser, segmentRepo *mock_repo.MockSegment, job entity.ReportJob) {
+				reportRepo.EXPECT().ClaimReportJob(gomock.Any(), cfg.Lease).Return(entity.ReportJob{}, false, nil)
+			},
+		},
+		{
+			name: "OK",
+			job:  entity.ReportJob{ID: 7, Kind: entity.ReportUserOperations, UserID: 1, Segment: "segment1", From: &from, To: &to, Format: entity.FormatNDJSON, Attempts: 1},
+			mockBehavior: func(reportRepo *mock_repo.MockReport, userRepo *mock_repo.MockUser, segmentRepo *mock_repo.MockSegment, job entity.ReportJob) {
+				reportRepo.EXPECT().ClaimReportJob(gomock.Any(), cfg.Lease).Return(job, true, nil)
+				userRepo.EXPECT().StreamUserOperations(gomock.Any(), 1, entity.OperationFilter{From: from, To: to, Segment: "segment1"}, gomock.Any()).
+					DoAndReturn(stream(operation))
+				reportRepo.EXPECT().CompleteReportJob(gomock.Any(), int64(7), "https://disk.example/1_c845f2c218bb.ndjson").Return(nil)
+			},
+			wantClaimed: true,
+			wantName:    "1_c845f2c218bb.ndjson",
+			wantData:    `{"user_id":1,"segment":"segment1","operation":"add","time":"2023-08-01T01:00:00Z"}` + "\n",
+		},
+		{
+			name: "segment members",
+			job:  entity.ReportJob{ID: 8, Kind: entity.ReportSegmentMembers, Segment: "segment1", SegmentID: 3, Format: entity.FormatCSV, Attempts: 1},
+			mockBehavior: func(reportRepo *mock_repo.MockReport, userRepo *mock_repo.MockUser, segmentRepo *mock_repo.MockSegment, job entity.ReportJob) {
+				reportRepo.EXPECT().ClaimReportJob(gomock.Any(), cfg.Lease).Return(job, true, nil)
+				segmentRepo.EXPECT().StreamSegmentMembers(gomock.Any(), int64(3), gomock.Any()).
+					DoAndReturn(func(ctx context.Context, segmentID int64, fn func(entity.SegmentMember) error) error {
+						for _, member := range []entity.SegmentMember{{UserID: 1}, {UserID: 2, Variant: "B", Expire: &to}} {
+							err := fn(member)
+							if err != nil {
+								return err
+							}
+						}
+						return nil
+					})
+				reportRepo.EXPECT().CompleteReportJob(gomock.Any(), int64(8), "https://disk.example/segment1_members_c845f2c218bb.csv").Return(nil)
+			},
+			wantClaimed: true,
+			wantName:    "segment1_members_c845f2c218bb.csv",
+			wantData:    "user_id,variant,expire\r\n1,,\r\n2,B,2023-09-01T00:00:00Z\r\n",
+		},
+		{
+			name: "segment daily counts",
+			job:  entity.ReportJob{ID: 9, Kind: entity.ReportSegmentDaily, Segment: "segment1", SegmentID: 3, From: &from, To: &dayAfter, Format: entity.FormatJSON, Attempts: 1},
+			mockBehavior: func(reportRepo *mock_repo.MockReport, userRepo *mock_repo.MockUser, segmentRepo *mock_repo.MockSegment, job entity.ReportJob) {
+				reportRepo.EXPECT().ClaimReportJob(gomock.Any(), cfg.Lease).Return(job, true, nil)
+				segmentRepo.EXPECT().StreamSegmentOperations(gomock.Any(), int64(3), time.Time{}, dayAfter, gomock.Any()).
+					DoAndReturn(func(ctx context.Context, segmentID int64, from, to time.Time, fn func(entity.Operation) error) error {
+						return fn(operation)
+					})
+				reportRepo.EXPECT().CompleteReportJob(gomock.Any(), int64(9), "https://disk.example/segment1_daily_c845f2c218bb.json").Return(nil)
+			},
+			wantClaimed: true,
+			wantName:    "segment1_daily_c845f2c218bb.json",
+			wantData:    `[{"date":"2023-08-01","members":1,"added":1,"removed":0},{"date":"2023-08-02","members":1,"added":0,"removed":0}]` + "\n",
+		},
+		{
+			name: "segment deleted",
+			job:  entity.ReportJob{ID: 10, Kind: entity.ReportSegmentOperations, Segment: "segment1", SegmentID: 3, Format: entity.FormatCSV, Attempts: 1},
+			mockBehavior: func(reportRepo *mock_repo.MockReport, userRepo *mock_repo.MockUser, segmentRepo *mock_repo.MockSegment, job entity.ReportJob) {
+				reportRepo.EXPECT().ClaimReportJob(gomock.Any(), cfg.Lease).Return(job, true, nil)
+				segmentRepo.EXPECT().StreamSegmentOperations(gomock.Any(), int64(3), time.Time{}, time.Time{}, gomock.Any()).
+					Return(repoerrs.New(repoerrs.ErrNotFound, "segment not found", nil))
+				reportRepo.EXPECT().FailReportJob(gomock.Any(), int64(10), "segment not found").Return(nil)
+			},
+			wantClaimed: true,
+		},
+		{
+			name:    "disk unavailable",
+			job:     entity.ReportJob{ID: 7, UserID: 1, Format: entity.FormatCSV, Attempts: 2},
+			diskErr: fmt.Errorf("PUT /reports/1_7.csv: %w", webapi.ErrUnavailable),
+			mockBehavior: func(reportRepo *mock_repo.MockReport, userRepo *mock_repo.MockUser, segmentRepo *mock_repo.MockSegment, job entity.ReportJob) {
+				reportRepo.EXPECT().ClaimReportJob(gomock.Any(), cfg.Lease).Return(job, true, nil)
+				userRepo.EXPECT().StreamUserOperations(gomock.Any(), 1, entity.OperationFilter{}, gomock.Any()).DoAndReturn(stream())
+				reportRepo.EXPECT().RetryReportJob(gomock.Any(), int64(7), "report storage is not available", time.Minute).Return(nil)
+			},
+			wantClaimed: true,
+		},
+		{
+			name:    "out of attempts",
+			job:     entity.ReportJob{ID: 7, UserID: 1, Format: entity.FormatCSV, Attempts: 3},
+			diskErr: webapi.ErrUnavailable,
+			mockBehavior: func(reportRepo *mock_repo.MockReport, userRepo *mock_repo.MockUser, segmentRepo *mock_repo.MockSegment, job entity.ReportJob) {
+				reportRepo.EXPECT().ClaimReportJob(gomock.Any(), cfg.Lease).Return(job, true, nil)
+				userRepo.EXPECT().StreamUserOperations(gomock.Any(), 1, entity.OperationFilter{}, gomock.Any()).DoAndReturn(stream())
+				reportRepo.EXPECT().FailReportJob(gomock.Any(), int64(7), "report storage is not available").Return(nil)
+			},
+			wantClaimed: true,
+		},
+		{
+			name:    "storage error",
+			job:     entity.ReportJob{ID: 7, UserID: 1, Format: entity.FormatCSV, Attempts: 3},
+			diskErr: errors.New("PUT https://storage.example/reports/1_7.csv: status 403: AccessDenied"),
+			mockBehavior: func(reportRepo *mock_repo.MockReport, userRepo *mock_repo.MockUser, segmentRepo *mock_repo.MockSegment, job entity.ReportJob) {
+				reportRepo.EXPECT().ClaimReportJob(gomock.Any(), cfg.Lease).Return(job, true, nil)
+				userRepo.EXPECT().StreamUserOperations(gomock.Any(), 1, entity.OperationFilter{}, gomock.Any()).DoAndReturn(stream())
+				reportRepo.EXPECT().FailReportJob(gomock.Any(), int64(7), "internal error").Return(nil)
+			},
+			wantClaimed: true,
+		},
+		{
+			name: "invalid input",
+			job:  entity.ReportJob{ID: 7, UserID: 1, Format: entity.FormatCSV, Attempts: 1},
+			mockBehavior: func(reportRepo *mock_repo.MockReport, userRepo *mock_repo.MockUser, segmentRepo *mock_repo.MockSegment, job entity.ReportJob) {
+				reportRepo.EXPECT().ClaimReportJob(gomock.Any(), cfg.Lease).Return(job, true, nil)
+				userRepo.EXPECT().StreamUserOperations(gomock.Any(), 1, entity.OperationFilter{}, gomock.Any()).
+					Return(repoerrs.New(repoerrs.ErrInvalidInput, "unknown operation", nil))
+				reportRepo.EXPECT().FailReportJob(gomock.Any(), int64(7), "unknown operation").Return(nil)
+			},
+			wantClaimed: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			defer ctrl.Finish()
+
+			reportRepo := mock_repo.NewMockReport(ctrl)
+			userRepo := mock_repo.NewMockUser(ctrl)
+			segmentRepo := mock_repo.NewMockSegment(ctrl)
+			tc.mockBehavior(reportRepo, userRepo, segmentRepo, tc.job)
+
+			disk := &fakeDisk{err: tc.diskErr}
+			worker := NewReportWorker(reportRepo, userRepo, segmentRepo, disk, export, logger.New("error"), cfg)
+			worker.exporter.newID = func() string { return "c845f2c218bb" }
+
+			claimed, err := worker.RunOnce(context.Background())
+			assert.NoError(t, err)
+			assert.Equal(t, tc.wantClaimed, claimed)
+			assert.Equal(t, tc.wantName, disk.name)
+			assert.Equal(t, tc.wantData, disk.data)
+		})
+	}
+}
+
+func TestReportWorker_RunOnce_ClaimError(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	reportRepo := mock_repo.NewMockReport(ctrl)
+	reportRepo.EXPECT().ClaimReportJob(gomock.Any(), gomock.Any()).Return(entity.ReportJob{}, false, errors.New("some error"))
+
+	worker := NewReportWorker(reportRepo, mock_repo.NewMockUser(ctrl), mock_repo.NewMockSegment(ctrl), &fakeDisk{}, ExportConfig{}, logger.New("error"), ReportWorkerConfig{})
+
+	claimed, err := worker.RunOnce(context.Background())
+	assert.Error(t, err)
+	assert.False(t, claimed)
+}
+
+func TestDailyCounter(t *testing.T) {
+	day := func(d, h int) time.Time {
+		return time.Date(2023, 8, d, h, 0, 0, 0, time.UTC)
+	}
+	operations := []entity.Operation{
+		{UserID: 1, Operation: entity.OperationAdd, Time: day(1, 10)},
+		{UserID: 2, Operation: entity.OperationAdd, Time: day(2, 10)},
+		{UserID: 3, Operation: entity.OperationAdd, Time: day(2, 11)},
+		// A repeated addition doesn't change the membership.
+		{UserID: 3, Operation: entity.OperationAdd, Time: day(2, 12)},
+		// Neither does a TTL change.
+		{UserID: 2, Operation: entity.OperationTTL, Time: day(2, 13)},
+		{UserID: 1, Operation: entity.OperationDelete, Time: day(3, 9)},
+		{UserID: 2, Operation: entity.OperationExpire, Time: day(4, 0)},
+		{UserID: 1, Operation: entity.OperationAdd, Time: day(4, 23)},
+	}
+
+	testCases := []struct {
+		name     string
+		from, to time.Time
+		want     []entity.SegmentDailyCount
+	}{
+		{
+			name: "whole history",
+			to:   day(5, 0),
+			want: []entity.SegmentDailyCount{
+				{Date: "2023-08-01", Members: 1, Added: 1},
+				{Date: "2023-08-02", Members: 3, Added: 2},
+				{Date: "2023-08-03", Members: 2, Removed: 1},
+				{Date: "2023-08-04", Members: 2, Added: 1, Removed: 1},
+			},
+		},
+		{
+			name: "starting mid history",
+			from: day(3, 15),
+			to:   day(4, 12),
+			want: []entity.SegmentDailyCount{
+				{Date: "2023-08-03", Members: 2, Removed: 1},
+				{Date: "2023-08-04", Members: 1, Removed: 1},
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var got []entity.SegmentDailyCount
+			counter := newDailyCounter(tc.from, tc.to, func(count entity.SegmentDailyCount) error {
+				got = append(got, count)
+				return nil
+			})
+			for _, operation := range operations {
+				assert.NoError(t, counter.add(operation))
+			}
+			assert.NoError(t, counter.close())
+
+			assert.Equal(t, tc.want, got)
+		})
+	}
+}
@@ -2,7 +2,9 @@ package services
 
 import (
 	"context"
+	"time"
 
+	"github.com/realPointer/segments/internal/entity"
 	"github.com/realPointer/segments/internal/repo"
 )
 
@@ -14,18 +16,46 @@ func NewSegmentService(segmentRepo repo.Segment) *SegmentService {
 	return &SegmentService{segmentRepo: segmentRepo}
 }
 
-func (s *SegmentService) CreateSegment(ctx context.Context, name string) error {
-	return s.segmentRepo.CreateSegment(ctx, name)
+func (s *SegmentService) CreateSegment(ctx context.Context, segment entity.Segment) error {
+	return s.segmentRepo.CreateSegment(ctx, segment)
 }
 
-func (s *SegmentService) CreateSegmentAuto(ctx context.Context, name string, percentage float64) error {
-	return s.segmentRepo.CreateSegmentAuto(ctx, name, percentage)
+func (s *SegmentService) CreateSegmentAuto(ctx context.Context, segment entity.Segment, percentage float64) error {
+	return s.segmentRepo.CreateSegmentAuto(ctx, segment, percentage)
 }
 
 func (s *SegmentService) DeleteSegment(ctx context.Context, name string) error {
 	return s.segmentRepo.DeleteSegment(ctx, name)
 }
 
-func (s *SegmentService) GetSegments(ctx context.Context) ([]string, error) {
-	return s.segmentRepo.GetSegments(ctx)
+func (s *SegmentService) GetSegments(ctx context.Context, filter entity.SegmentFilter) ([]entity.Segment, error) {
+	return s.segmentRepo.GetSegments(ctx, filter)
+}
+
+func (s *SegmentService) GetSegment(ctx context.Context, name string) (entity.Segment, error) {
+	return s.segmentRepo.GetSegment(ctx, name)
+}
+
+func (s *SegmentService) UpdateSegment(ctx context.Context, name string, update entity.SegmentUpdate) (entity.Segment, error) {
+	return s.segmentRepo.UpdateSegment(ctx, name, update)
+}
+
+func (s *SegmentService) RenameSegment(ctx context.Context, name, newName string) (entity.Segment, error) {
+	return s.segmentRepo.RenameSegment(ctx, name, newName)
+}
+
+func (s *SegmentService) RebalanceAutoSegments(ctx context.Context) (int, error) {
+	return s.segmentRepo.RebalanceAutoSegments(ctx)
+}
+
+func (s *SegmentService) RecomputeRuleSegments(ctx context.Context) (int, error) {
+	return s.segmentRepo.RecomputeRuleSegments(ctx)
+}
+
+func (s *SegmentService) StreamSegmentMembers(ctx context.Context, segmentID int64, fn func(entity.SegmentMember) error) error {
+	return s.segmentRepo.StreamSegmentMembers(ctx, segmentID, fn)
+}
+
+func (s *SegmentService) StreamSegmentOperations(ctx context.Context, segmentID int64, from, to time.Time, fn func(entity.Operation) error) error {
+	return s.segmentRepo.StreamSegmentOperations(ctx, segmentID, from, to, fn)
 }
@@ -8,6 +8,7 @@ import (
 	"github.com/stretchr/testify/assert"
 	"go.uber.org/mock/gomock"
 
+	"github.com/realPointer/segments/internal/entity"
 	mock_services "github.com/realPointer/segments/internal/service/mocks"
 )
 
@@ -104,11 +105,12 @@ func TestSegmentsService_CreateSegment(t *testing.T) {
 	for _, tc := range testCases {
 		t.Run(tc.name, func(t *testing.T) {
 			mockSegment := mock_services.NewMockSegment(ctrl)
-			mockSegment.EXPECT().CreateSegment(tc.input.ctx, tc.input.name).Return(tc.expectedOutput.err)
+			segment := entity.Segment{Name: tc.input.name}
+			mockSegment.EXPECT().CreateSegment(tc.input.ctx, segment).Return(tc.expectedOutput.err)
 
 			segmentService := NewSegmentService(mockSegment)
 
-			err := segmentService.CreateSegment(tc.input.ctx, tc.input.name)
+			err := segmentService.CreateSegment(tc.input.ctx, segment)
 
 			assert.Equal(t, tc.expectedOutput.err, err)
 		})
@@ -161,11 +163,12 @@ func TestSegmentsService_CreateSegmentAuto(t *testing.T) {
 	for _, tc := range testCases {
 		t.Run(tc.name, func(t *testing.T) {
 			mockSegment := mock_services.NewMockSegment(ctrl)
-			mockSegment.EXPECT().CreateSegmentAuto(tc.input.ctx, tc.input.name, tc.input.percentage).Return(tc.expectedOutput.err)
+			segment := entity.Segment{Name: tc.input.name}
+			mockSegment.EXPECT().CreateSegmentAuto(tc.input.ctx, segment, tc.input.percentage).Return(tc.expectedOutput.err)
 
 			segmentService := NewSegmentService(mockSegment)
 
-			err := segmentService.CreateSegmentAuto(tc.input.ctx, tc.input.name, tc.input.percentage)
+			err := segmentService.CreateSegmentAuto(tc.input.ctx, segment, tc.input.percentage)
 
 			assert.Equal(t, tc.expectedOutput.err, err)
 		})
@@ -231,11 +234,12 @@ func TestSegmentsService_GetSegments(t *testing.T) {
 	defer ctrl.Finish()
 
 	type input struct {
-		ctx context.Context
+		ctx    context.Context
+		filter entity.SegmentFilter
 	}
 
 	type output struct {
-		segments []string
+		segments []entity.Segment
 		err      error
 	}
 
@@ -250,7 +254,18 @@ func TestSegmentsService_GetSegments(t *testing.T) {
 				ctx: context.Background(),
 			},
 			expectedOutput: output{
-				segments: []string{"segment1", "segment2"},
+				segments: []entity.Segment{{Name: "segment1"}, {Name: "segment2"}},
+				err:      nil,
+			},
+		},
+		{
+			name: "filtered",
+			input: input{
+				ctx:    context.Background(),
+				filter: entity.SegmentFilter{Tag: "promo", Owner: "growth"},
+			},
+			expectedOutput: output{
+				segments: []entity.Segment{{Name: "segment1", Owner: "growth", Tags: []string{"promo"}}},
 				err:      nil,
 			},
 		},
@@ -269,14 +284,136 @@ func TestSegmentsService_GetSegments(t *testing.T) {
 	for _, tc := range testCases {
 		t.Run(tc.name, func(t *testing.T) {
 			mockSegment := mock_services.NewMockSegment(ctrl)
-			mockSegment.EXPECT().GetSegments(tc.input.ctx).Return(tc.expectedOutput.segments, tc.expectedOutput.err)
+			mockSegment.EXPECT().GetSegments(tc.input.ctx, tc.input.filter).Return(tc.expectedOutput.segments, tc.expectedOutput.err)
 
 			segmentService := NewSegmentService(mockSegment)
 
-			segments, err := segmentService.GetSegments(tc.input.ctx)
+			segments, err := segmentService.GetSegments(tc.input.ctx, tc.input.filter)
 
 			assert.Equal(t, tc.expectedOutput.segments, segments)
 			assert.Equal(t, tc.expectedOutput.err, err)
 		})
 	}
 }
+
+func TestSegmentsService_UpdateSegment(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	owner := "growth"
+
+	type input struct {
+		ctx    context.Context
+		name   string
+		update entity.SegmentUpdate
+	}
+
+	type output struct {
+		segment entity.Segment
+		err     error
+	}
+
+	testCases := []struct {
+		name           string
+		input          input
+		expectedOutput output
+	}{
+		{
+			name: "success",
+			input: input{
+				ctx:    context.Background(),
+				name:   "segment1",
+				update: entity.SegmentUpdate{Owner: &owner},
+			},
+			expectedOutput: output{
+				segment: entity.Segment{Name: "segment1", Owner: owner},
+				err:     nil,
+			},
+		},
+		{
+			name: "error",
+			input: input{
+				ctx:    context.Background(),
+				name:   "segment1",
+				update: entity.SegmentUpdate{Owner: &owner},
+			},
+			expectedOutput: output{
+				err: errors.New("error"),
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			mockSegment := mock_services.NewMockSegment(ctrl)
+			mockSegment.EXPECT().UpdateSegment(tc.input.ctx, tc.input.name, tc.input.update).Return(tc.expectedOutput.segment, tc.expectedOutput.err)
+
+			segmentService := NewSegmentService(mockSegment)
+
+			segment, err := segmentService.UpdateSegment(tc.input.ctx, tc.input.name, tc.input.update)
+
+			assert.Equal(t, tc.expectedOutput.segment, segment)
+			assert.Equal(t, tc.expectedOutput.err, err)
+		})
+	}
+}
+
+func TestSegmentsService_RenameSegment(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	type input struct {
+		ctx     context.Context
+		name    string
+		newName string
+	}
+
+	type output struct {
+		segment entity.Segment
+		err     error
+	}
+
+	testCases := []struct {
+		name           string
+		input          input
+		expectedOutput output
+	}{
+		{
+			name: "success",
+			input: input{
+				ctx:     context.Background(),
+				name:    "segment1",
+				newName: "segment2",
+			},
+			expectedOutput: output{
+				segment: entity.Segment{ID: 1, Name: "segment2"},
+				err:     nil,
+			},
+		},
+		{
+			name: "error",
+			input: input{
+				ctx:     context.Background(),
+				name:    "segment1",
+				newName: "segment2",
+			},
+			expectedOutput: output{
+				err: errors.New("error"),
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			mockSegment := mock_services.NewMockSegment(ctrl)
+			mockSegment.EXPECT().RenameSegment(tc.input.ctx, tc.input.name, tc.input.newName).Return(tc.expectedOutput.segment, tc.expectedOutput.err)
+
+			segmentService := NewSegmentService(mockSegment)
+
+			segment, err := segmentService.RenameSegment(tc.input.ctx, tc.input.name, tc.input.newName)
+
+			assert.Equal(t, tc.expectedOutput.segment, segment)
+			assert.Equal(t, tc.expectedOutput.err, err)
+		})
+	}
+}
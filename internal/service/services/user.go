@@ -2,6 +2,10 @@ package services
 
 import (
 	"context"
+	"fmt"
+	"io"
+	"strconv"
+	"time"
 
 	"github.com/realPointer/segments/internal/entity"
 	"github.com/realPointer/segments/internal/repo"
@@ -10,36 +14,75 @@ import (
 
 type UserService struct {
 	userRepo repo.User
-	yDisk    webapi.Disk
+	exporter *exporter
 }
 
-func NewUserService(userRepo repo.User, yDisk webapi.Disk) *UserService {
+func NewUserService(userRepo repo.User, disk webapi.Disk, export ExportConfig) *UserService {
 	return &UserService{
 		userRepo: userRepo,
-		yDisk:    yDisk,
+		exporter: newExporter(disk, export),
 	}
 }
 
-func (s *UserService) CreateUser(ctx context.Context, userId int) error {
-	return s.userRepo.CreateUser(ctx, userId)
+func (s *UserService) CreateUser(ctx context.Context, userId int, attrs entity.UserAttributes) error {
+	return s.userRepo.CreateUser(ctx, userId, attrs)
 }
 
-func (s *UserService) GetUserSegments(ctx context.Context, userId int) ([]string, error) {
+func (s *UserService) SetUserAttributes(ctx context.Context, userId int, attrs entity.UserAttributes) error {
+	return s.userRepo.SetUserAttributes(ctx, userId, attrs)
+}
+
+func (s *UserService) GetUserAttributes(ctx context.Context, userId int) (entity.UserAttributes, error) {
+	return s.userRepo.GetUserAttributes(ctx, userId)
+}
+
+func (s *UserService) GetUserSegments(ctx context.Context, userId int) ([]entity.UserSegment, error) {
 	return s.userRepo.GetUserSegments(ctx, userId)
 }
 
-func (s *UserService) AddOrRemoveUserSegments(ctx context.Context, userId int, addSegments []entity.AddSegment, removeSegments []string) error {
-	return s.userRepo.AddOrRemoveUserSegments(ctx, userId, addSegments, removeSegments)
+func (s *UserService) GetUserSegmentsAt(ctx context.Context, userId int, at time.Time) ([]entity.UserSegment, error) {
+	return s.userRepo.GetUserSegmentsAt(ctx, userId, at)
+}
+
+func (s *UserService) AddOrRemoveUserSegments(ctx context.Context, userId int, addSegments []entity.AddSegment, removeSegments []string, idempotencyKey string) ([]entity.SegmentChange, error) {
+	return s.userRepo.AddOrRemoveUserSegments(ctx, userId, addSegments, removeSegments, idempotencyKey)
+}
+
+func (s *UserService) SetUserSegmentExpiry(ctx context.Context, userId int, segment string, expiry entity.Expiry) (entity.UserSegment, error) {
+	return s.userRepo.SetUserSegmentExpiry(ctx, userId, segment, expiry)
 }
 
-func (s *UserService) GetUserOperations(ctx context.Context, userId int) ([]string, error) {
+func (s *UserService) GetUserOperations(ctx context.Context, userId int) ([]entity.Operation, error) {
 	return s.userRepo.GetUserOperations(ctx, userId)
 }
 
-func (s *UserService) GetUserOperationsByMonth(ctx context.Context, userId int, yearMonth string) ([]string, error) {
+func (s *UserService) GetUserOperationsByMonth(ctx context.Context, userId int, yearMonth string) ([]entity.Operation, error) {
 	return s.userRepo.GetUserOperationsByMonth(ctx, userId, yearMonth)
 }
 
-func (s *UserService) UploadAndReturnDownloadURL(ctx context.Context, name string, data []string) (string, error) {
-	return s.yDisk.UploadAndReturnDownloadURL(ctx, name, data)
+func (s *UserService) GetUserOperationsPage(ctx context.Context, userId int, filter entity.OperationFilter) ([]entity.Operation, string, error) {
+	return s.userRepo.GetUserOperationsPage(ctx, userId, filter)
+}
+
+func (s *UserService) StreamOperations(ctx context.Context, filter entity.FeedFilter, fn func(entity.FeedEntry) error) error {
+	return s.userRepo.StreamOperations(ctx, filter, fn)
+}
+
+// UploadUserOperations uploads the operations of the user matching the
+// filter as a CSV file with a header and returns a link to download it. The
+// name tells the subject and period of the report, the file gets a random
+// request id so that reports requested at the same time don't overwrite each
+// other.
+func (s *UserService) UploadUserOperations(ctx context.Context, userId int, filter entity.OperationFilter, name string) (string, error) {
+	file := reportFile{user: strconv.Itoa(userId), id: s.exporter.newID(), name: name, ext: entity.FormatCSV}
+	url, err := s.exporter.upload(ctx, file, func(w io.Writer) error {
+		return encodeRecords(w, entity.FormatCSV, entity.OperationCSVHeader, func(fn func(entity.Operation) error) error {
+			return s.userRepo.StreamUserOperations(ctx, userId, filter, fn)
+		})
+	})
+	if err != nil {
+		return "", fmt.Errorf("UserService.UploadUserOperations - upload: %w", err)
+	}
+
+	return url, nil
 }
@@ -0,0 +1,69 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/realPointer/segments/internal/repo/repoerrs"
+	webapi "github.com/realPointer/segments/internal/ydisk"
+	"github.com/realPointer/segments/pkg/logger"
+)
+
+// runWorkers calls runOnce from the given number of goroutines until ctx is
+// cancelled. A goroutine that found nothing to do waits pollInterval before
+// calling it again.
+func runWorkers(ctx context.Context, workers int, pollInterval time.Duration, l logger.Interface, name string, runOnce func(context.Context) (bool, error)) {
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for {
+				claimed, err := runOnce(ctx)
+				if err != nil && ctx.Err() == nil {
+					l.Error(fmt.Errorf("%s.loop - w.RunOnce: %w", name, err))
+				}
+				if claimed {
+					continue
+				}
+
+				select {
+				case <-ctx.Done():
+					return
+				case <-time.After(pollInterval):
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// permanent reports whether a job failing with err would fail again: bad
+// input and deleted data won't get better, everything else might.
+func permanent(err error) bool {
+	return errors.Is(err, repoerrs.ErrInvalidInput) || errors.Is(err, repoerrs.ErrNotFound)
+}
+
+// internalJobError is what a job failed by an error not meant for clients
+// shows instead of it.
+const internalJobError = "internal error"
+
+// jobMessage returns the error a failed job shows to clients. Only the
+// messages of repository errors are written for them; other errors may name
+// internals such as storage URLs, so they are replaced with a fixed message
+// and ok is false.
+func jobMessage(err error) (msg string, ok bool) {
+	var repoErr *repoerrs.Error
+	if errors.As(err, &repoErr) {
+		return repoErr.Msg, true
+	}
+	if errors.Is(err, webapi.ErrUnavailable) {
+		return "report storage is not available", false
+	}
+
+	return internalJobError, false
+}
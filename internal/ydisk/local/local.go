@@ -0,0 +1,171 @@
+// Package local keeps reports in a directory of the local filesystem and
+// serves them over HTTP from the service itself.
+package local
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Disk stores reports in Dir. Download links point at BaseURL, where the
+// Disk itself is expected to be mounted as an http.Handler.
+type Disk struct {
+	dir     string
+	baseURL string
+	files   http.Handler
+}
+
+func New(dir, baseURL string) (*Disk, error) {
+	err := os.MkdirAll(dir, 0o755)
+	if err != nil {
+		return nil, fmt.Errorf("local - New - os.MkdirAll: %w", err)
+	}
+
+	return &Disk{
+		dir:     dir,
+		baseURL: strings.TrimSuffix(baseURL, "/"),
+		files:   http.FileServer(http.Dir(dir)),
+	}, nil
+}
+
+func (d *Disk) UploadAndReturnDownloadURL(ctx context.Context, name string, r io.Reader) (string, error) {
+	name, err := cleanName(name)
+	if err != nil {
+		return "", err
+	}
+	file := filepath.Join(d.dir, filepath.FromSlash(name))
+
+	err = os.MkdirAll(filepath.Dir(file), 0o755)
+	if err != nil {
+		return "", fmt.Errorf("local - UploadAndReturnDownloadURL - os.MkdirAll: %w", err)
+	}
+
+	// Readers must never see a half-written report, so it is written aside
+	// and renamed into place.
+	tmp, err := os.CreateTemp(filepath.Dir(file), ".upload-*")
+	if err != nil {
+		return "", fmt.Errorf("local - UploadAndReturnDownloadURL - os.CreateTemp: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	_, err = io.Copy(tmp, r)
+	if err == nil {
+		err = tmp.Close()
+	} else {
+		tmp.Close()
+	}
+	if err != nil {
+		return "", fmt.Errorf("local - UploadAndReturnDownloadURL - io.Copy: %w", err)
+	}
+
+	err = os.Rename(tmp.Name(), file)
+	if err != nil {
+		return "", fmt.Errorf("local - UploadAndReturnDownloadURL - os.Rename: %w", err)
+	}
+
+	return d.baseURL + "/" + escapePath(name), nil
+}
+
+// DeleteOlderThan deletes the reports in folder last modified before t, and
+// the folders they leave empty.
+func (d *Disk) DeleteOlderThan(ctx context.Context, folder string, t time.Time) (int, error) {
+	root := d.dir
+	if folder != "" {
+		name, err := cleanName(folder)
+		if err != nil {
+			return 0, err
+		}
+		root = filepath.Join(d.dir, filepath.FromSlash(name))
+	}
+
+	deleted := 0
+	var dirs []string
+	err := filepath.WalkDir(root, func(file string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			if file == root && errors.Is(err, fs.ErrNotExist) {
+				return fs.SkipAll
+			}
+			return err
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if entry.IsDir() {
+			if file != root {
+				dirs = append(dirs, file)
+			}
+			return nil
+		}
+
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		if !info.ModTime().Before(t) {
+			return nil
+		}
+
+		err = os.Remove(file)
+		if err != nil {
+			return err
+		}
+		deleted++
+
+		return nil
+	})
+
+	// Folders come after their parents, so removing them backwards empties
+	// the deepest ones first. Those still holding reports fail to be removed.
+	for i := len(dirs) - 1; i >= 0; i-- {
+		_ = os.Remove(dirs[i])
+	}
+
+	if err != nil {
+		return deleted, fmt.Errorf("local - DeleteOlderThan - filepath.WalkDir: %w", err)
+	}
+
+	return deleted, nil
+}
+
+// ServeHTTP serves the stored reports, the request path is the report name.
+// Directories aren't listed. It doesn't check who asks, the handler is to be
+// mounted behind authentication.
+func (d *Disk) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if strings.HasSuffix(r.URL.Path, "/") || strings.HasPrefix(path.Base(r.URL.Path), ".upload-") {
+		http.NotFound(w, r)
+		return
+	}
+
+	w.Header().Set("Content-Disposition", "attachment")
+	d.files.ServeHTTP(w, r)
+}
+
+// cleanName returns the report name relative to the directory. Names are
+// rooted at the directory, so they can't point outside of it.
+func cleanName(name string) (string, error) {
+	clean := strings.TrimPrefix(path.Clean("/"+name), "/")
+	if clean == "" {
+		return "", fmt.Errorf("local - invalid report name %q", name)
+	}
+
+	return clean, nil
+}
+
+func escapePath(name string) string {
+	segments := strings.Split(name, "/")
+	for i, s := range segments {
+		segments[i] = url.PathEscape(s)
+	}
+
+	return strings.Join(segments, "/")
+}
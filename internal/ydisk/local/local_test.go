@@ -0,0 +1,101 @@
+package local
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDisk_UploadAndReturnDownloadURL(t *testing.T) {
+	dir := t.TempDir()
+	server := httptest.NewUnstartedServer(nil)
+	disk, err := New(dir, "http://"+server.Listener.Addr().String()+"/files/")
+	require.NoError(t, err)
+	server.Config.Handler = http.StripPrefix("/files", disk)
+	server.Start()
+	defer server.Close()
+
+	data := []byte("user_id,segment\r\n42,AVITO\r\n")
+
+	link, err := disk.UploadAndReturnDownloadURL(context.Background(), "reports/42 2023-08.csv", bytes.NewReader(data))
+	require.NoError(t, err)
+	assert.Equal(t, server.URL+"/files/reports/42%202023-08.csv", link)
+
+	resp, err := http.Get(link)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, data, body)
+
+	resp, err = http.Get(server.URL + "/files/reports/")
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+}
+
+func TestDisk_UploadAndReturnDownloadURL_StaysInDir(t *testing.T) {
+	root := t.TempDir()
+	dir := filepath.Join(root, "reports")
+	disk, err := New(dir, "http://localhost/files")
+	require.NoError(t, err)
+
+	link, err := disk.UploadAndReturnDownloadURL(context.Background(), "../../escape.csv", strings.NewReader("42"))
+	require.NoError(t, err)
+	assert.Equal(t, "http://localhost/files/escape.csv", link)
+
+	_, err = os.Stat(filepath.Join(root, "escape.csv"))
+	assert.True(t, os.IsNotExist(err))
+	_, err = os.Stat(filepath.Join(dir, "escape.csv"))
+	assert.NoError(t, err)
+
+	_, err = disk.UploadAndReturnDownloadURL(context.Background(), "/", strings.NewReader("42"))
+	assert.Error(t, err)
+}
+
+func TestDisk_DeleteOlderThan(t *testing.T) {
+	dir := t.TempDir()
+	disk, err := New(dir, "http://localhost/files")
+	require.NoError(t, err)
+
+	now := time.Now()
+	for name, age := range map[string]time.Duration{
+		"reports/2023-08-01/1_1.csv": 48 * time.Hour,
+		"reports/2023-08-02/2_2.csv": 48 * time.Hour,
+		"reports/2023-08-02/3_3.csv": time.Hour,
+		"other/4_4.csv":              48 * time.Hour,
+	} {
+		_, err := disk.UploadAndReturnDownloadURL(context.Background(), name, strings.NewReader("42"))
+		require.NoError(t, err)
+		file := filepath.Join(dir, filepath.FromSlash(name))
+		require.NoError(t, os.Chtimes(file, now.Add(-age), now.Add(-age)))
+	}
+
+	deleted, err := disk.DeleteOlderThan(context.Background(), "reports", now.Add(-24*time.Hour))
+	require.NoError(t, err)
+	assert.Equal(t, 2, deleted)
+
+	for name, exists := range map[string]bool{
+		"reports/2023-08-01":         false,
+		"reports/2023-08-02/2_2.csv": false,
+		"reports/2023-08-02/3_3.csv": true,
+		"other/4_4.csv":              true,
+	} {
+		_, err := os.Stat(filepath.Join(dir, filepath.FromSlash(name)))
+		assert.Equal(t, exists, err == nil, name)
+	}
+
+	deleted, err = disk.DeleteOlderThan(context.Background(), "missing", now)
+	assert.NoError(t, err)
+	assert.Zero(t, deleted)
+}
@@ -0,0 +1,340 @@
+// Package s3 keeps reports in a bucket of S3 compatible object storage, such
+// as AWS S3, MinIO or Yandex Object Storage, and hands out presigned links
+// to them.
+package s3
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	webapi "github.com/realPointer/segments/internal/ydisk"
+)
+
+const (
+	_defaultURLExpiry = 24 * time.Hour
+	_defaultPartSize  = 8 << 20
+	_partRetries      = 3
+	_partRetryDelay   = time.Second
+)
+
+// Config -.
+type Config struct {
+	// Endpoint is the base URL of the storage, objects are addressed as
+	// Endpoint/Bucket/key.
+	Endpoint  string
+	Region    string
+	Bucket    string
+	AccessKey string
+	SecretKey string
+	// URLExpiry is how long download links stay valid, a day by default.
+	URLExpiry time.Duration
+	// PartSize is the most of a report held in memory, 8 MiB by default.
+	// Larger reports are uploaded in parts of that size, which S3 requires
+	// to be at least 5 MiB.
+	PartSize int
+}
+
+// Storage -.
+type Storage struct {
+	endpoint    *url.URL
+	bucket      string
+	urlExpiry   time.Duration
+	partSize    int
+	partRetries int
+	signer      signer
+	client      *http.Client
+	now         func() time.Time
+	sleep       func(ctx context.Context, d time.Duration) error
+}
+
+func New(cfg Config) (*Storage, error) {
+	endpoint, err := url.Parse(strings.TrimSuffix(cfg.Endpoint, "/"))
+	if err != nil || endpoint.Host == "" {
+		return nil, fmt.Errorf("s3 - New - invalid endpoint %q", cfg.Endpoint)
+	}
+	if cfg.Bucket == "" {
+		return nil, fmt.Errorf("s3 - New - bucket is required")
+	}
+
+	region := cfg.Region
+	if region == "" {
+		region = "us-east-1"
+	}
+	urlExpiry := cfg.URLExpiry
+	if urlExpiry <= 0 {
+		urlExpiry = _defaultURLExpiry
+	}
+	partSize := cfg.PartSize
+	if partSize <= 0 {
+		partSize = _defaultPartSize
+	}
+
+	return &Storage{
+		endpoint:    endpoint,
+		bucket:      cfg.Bucket,
+		urlExpiry:   urlExpiry,
+		partSize:    partSize,
+		partRetries: _partRetries,
+		signer:      signer{accessKey: cfg.AccessKey, secretKey: cfg.SecretKey, region: region},
+		client:      &http.Client{Timeout: 30 * time.Second},
+		now:         time.Now,
+		sleep:       sleep,
+	}, nil
+}
+
+// UploadAndReturnDownloadURL uploads a report fitting in a part with a
+// single request, and larger ones as a multipart upload.
+func (s *Storage) UploadAndReturnDownloadURL(ctx context.Context, name string, r io.Reader) (string, error) {
+	objectURL := s.objectURL(name)
+
+	part := make([]byte, s.partSize)
+	n, err := io.ReadFull(r, part)
+	switch {
+	case err == io.EOF || err == io.ErrUnexpectedEOF:
+		_, _, err = s.send(ctx, http.MethodPut, objectURL, webapi.ContentType(name), part[:n])
+	case err != nil:
+		err = fmt.Errorf("io.ReadFull: %w", err)
+	default:
+		err = s.uploadMultipart(ctx, objectURL, name, part, r)
+	}
+	if err != nil {
+		return "", fmt.Errorf("s3 - UploadAndReturnDownloadURL - %w", err)
+	}
+
+	return s.signer.presign(objectURL, s.now(), s.urlExpiry).String(), nil
+}
+
+// uploadMultipart uploads the first part and the rest of r in parts the size
+// of the first one. The upload is aborted when it fails, so the storage
+// doesn't keep the parts.
+func (s *Storage) uploadMultipart(ctx context.Context, objectURL *url.URL, name string, part []byte, r io.Reader) error {
+	create := *objectURL
+	create.RawQuery = "uploads="
+	_, body, err := s.send(ctx, http.MethodPost, &create, webapi.ContentType(name), nil)
+	if err != nil {
+		return err
+	}
+
+	var created struct {
+		UploadID string `xml:"UploadId"`
+	}
+	err = xml.Unmarshal(body, &created)
+	if err != nil || created.UploadID == "" {
+		return fmt.Errorf("POST %s: invalid response: %s", create.Path, body)
+	}
+
+	uploadURL := *objectURL
+	uploadURL.RawQuery = url.Values{"uploadId": {created.UploadID}}.Encode()
+
+	err = s.uploadParts(ctx, &uploadURL, part, r)
+	if err != nil {
+		// The upload is aborted even when ctx is what made it fail.
+		_, _, abortErr := s.send(context.WithoutCancel(ctx), http.MethodDelete, &uploadURL, "", nil)
+		if abortErr != nil {
+			return fmt.Errorf("%w, and aborting the upload failed: %s", err, abortErr)
+		}
+
+		return err
+	}
+
+	return nil
+}
+
+type completedPart struct {
+	PartNumber int
+	ETag       string
+}
+
+func (s *Storage) uploadParts(ctx context.Context, uploadURL *url.URL, part []byte, r io.Reader) error {
+	var parts []completedPart
+	for number := 1; len(part) > 0; number++ {
+		partURL := *uploadURL
+		query := partURL.Query()
+		query.Set("partNumber", strconv.Itoa(number))
+		partURL.RawQuery = query.Encode()
+
+		etag, err := s.uploadPart(ctx, &partURL, part)
+		if err != nil {
+			return err
+		}
+		parts = append(parts, completedPart{PartNumber: number, ETag: etag})
+
+		n, err := io.ReadFull(r, part[:cap(part)])
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return fmt.Errorf("io.ReadFull: %w", err)
+		}
+		part = part[:n]
+	}
+
+	complete, _ := xml.Marshal(struct {
+		XMLName xml.Name        `xml:"CompleteMultipartUpload"`
+		Parts   []completedPart `xml:"Part"`
+	}{Parts: parts})
+	_, body, err := s.send(ctx, http.MethodPost, uploadURL, "application/xml", complete)
+	if err != nil {
+		return err
+	}
+
+	// Completing may fail after the response has started, the error is
+	// then in its body.
+	var result struct {
+		XMLName xml.Name
+		Code    string
+		Message string
+	}
+	if xml.Unmarshal(body, &result) == nil && result.XMLName.Local == "Error" {
+		return fmt.Errorf("POST %s: %w: %s: %s", uploadURL.Path, webapi.ErrUnavailable, result.Code, result.Message)
+	}
+
+	return nil
+}
+
+// uploadPart uploads a part, retrying it while the storage is unavailable,
+// and returns its ETag.
+func (s *Storage) uploadPart(ctx context.Context, partURL *url.URL, part []byte) (string, error) {
+	for attempt := 0; ; attempt++ {
+		header, _, err := s.send(ctx, http.MethodPut, partURL, "", part)
+		if err == nil {
+			return header.Get("ETag"), nil
+		}
+		if !errors.Is(err, webapi.ErrUnavailable) || attempt >= s.partRetries {
+			return "", err
+		}
+
+		err = s.sleep(ctx, _partRetryDelay<<attempt)
+		if err != nil {
+			return "", err
+		}
+	}
+}
+
+// send signs and sends a request with body and returns the header and body
+// of its response.
+func (s *Storage) send(ctx context.Context, method string, u *url.URL, contentType string, body []byte) (http.Header, []byte, error) {
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, nil, fmt.Errorf("http.NewRequestWithContext: %w", err)
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	s.signer.sign(req, hashHex(body), s.now())
+
+	return s.do(req)
+}
+
+// DeleteOlderThan lists the objects under the folder and deletes those last
+// modified before t one by one.
+func (s *Storage) DeleteOlderThan(ctx context.Context, folder string, t time.Time) (int, error) {
+	prefix := strings.Trim(folder, "/")
+	if prefix != "" {
+		prefix += "/"
+	}
+
+	deleted := 0
+	token := ""
+	for {
+		query := url.Values{"list-type": {"2"}, "prefix": {prefix}}
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+		listURL := s.objectURL("")
+		listURL.RawQuery = query.Encode()
+
+		_, body, err := s.send(ctx, http.MethodGet, listURL, "", nil)
+		if err != nil {
+			return deleted, fmt.Errorf("s3 - DeleteOlderThan - %w", err)
+		}
+
+		var list struct {
+			Contents []struct {
+				Key          string
+				LastModified time.Time
+			}
+			IsTruncated           bool
+			NextContinuationToken string
+		}
+		err = xml.Unmarshal(body, &list)
+		if err != nil {
+			return deleted, fmt.Errorf("s3 - DeleteOlderThan - xml.Unmarshal: %w", err)
+		}
+
+		for _, object := range list.Contents {
+			if !object.LastModified.Before(t) {
+				continue
+			}
+
+			_, _, err := s.send(ctx, http.MethodDelete, s.objectURL(object.Key), "", nil)
+			if err != nil {
+				return deleted, fmt.Errorf("s3 - DeleteOlderThan - %w", err)
+			}
+			deleted++
+		}
+
+		if !list.IsTruncated {
+			return deleted, nil
+		}
+		token = list.NextContinuationToken
+	}
+}
+
+func (s *Storage) objectURL(name string) *url.URL {
+	u := *s.endpoint
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/" + s.bucket
+	if name != "" {
+		u.Path += "/" + strings.TrimPrefix(name, "/")
+	}
+
+	return &u
+}
+
+// do sends req, checks that it succeeded and returns the header and body of
+// its response. Failures to reach the storage and its server errors mean it
+// is unavailable.
+func (s *Storage) do(req *http.Request) (http.Header, []byte, error) {
+	resp, err := s.client.Do(req)
+	if err != nil {
+		if req.Context().Err() != nil {
+			return nil, nil, req.Context().Err()
+		}
+		return nil, nil, fmt.Errorf("%s %s: %w: %s", req.Method, req.URL.Path, webapi.ErrUnavailable, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 == 2 {
+		body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+		if err != nil {
+			return nil, nil, fmt.Errorf("%s %s: %w: %s", req.Method, req.URL.Path, webapi.ErrUnavailable, err)
+		}
+
+		return resp.Header, body, nil
+	}
+
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	if resp.StatusCode >= 500 {
+		return nil, nil, fmt.Errorf("%s %s: %w: status %d: %s", req.Method, req.URL.Path, webapi.ErrUnavailable, resp.StatusCode, body)
+	}
+
+	return nil, nil, fmt.Errorf("%s %s: status %d: %s", req.Method, req.URL.Path, resp.StatusCode, body)
+}
+
+func sleep(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
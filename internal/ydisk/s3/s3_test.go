@@ -0,0 +1,407 @@
+package s3
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"testing/iotest"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	webapi "github.com/realPointer/segments/internal/ydisk"
+)
+
+// fakeS3 is a MinIO-like stand-in keeping objects in memory. It checks the
+// signatures of requests as they arrive on the wire.
+type fakeS3 struct {
+	signer  signer
+	bucket  string
+	mu      sync.Mutex
+	objects map[string][]byte
+	// modified holds the times objects were last modified by their keys.
+	modified map[string]time.Time
+	fail     int
+	// uploads holds the parts of multipart uploads in progress by their id.
+	uploads map[string]map[int][]byte
+	// failParts is how many uploads of parts fail before they succeed.
+	failParts int
+	aborted   int
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if f.fail != 0 {
+		w.WriteHeader(f.fail)
+		return
+	}
+
+	key, ok := strings.CutPrefix(r.URL.Path, "/"+f.bucket)
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	u := *r.URL
+	u.Scheme, u.Host = "http", r.Host
+
+	switch r.Method {
+	case http.MethodPut, http.MethodPost, http.MethodDelete:
+		body, _ := io.ReadAll(r.Body)
+		if r.Header.Get("X-Amz-Content-Sha256") != hashHex(body) || !f.validHeaderSignature(r, &u) {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		f.multipart(w, r, key, body)
+	case http.MethodHead:
+		if !f.validHeaderSignature(r, &u) {
+			w.WriteHeader(http.StatusForbidden)
+		}
+	case http.MethodGet:
+		if r.URL.Query().Get("list-type") == "2" {
+			if !f.validHeaderSignature(r, &u) {
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+
+			f.mu.Lock()
+			defer f.mu.Unlock()
+			f.list(w, r)
+			return
+		}
+
+		if !f.validPresignedURL(&u) {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+
+		f.mu.Lock()
+		body, ok := f.objects[key]
+		f.mu.Unlock()
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		_, _ = w.Write(body)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// multipart handles the requests changing objects, with f.mu held.
+func (f *fakeS3) multipart(w http.ResponseWriter, r *http.Request, key string, body []byte) {
+	query := r.URL.Query()
+	uploadID := query.Get("uploadId")
+	parts, ok := f.uploads[uploadID]
+
+	switch {
+	case r.Method == http.MethodPut && uploadID == "":
+		f.objects[key], f.modified[key] = body, time.Now()
+	case r.Method == http.MethodDelete && uploadID == "":
+		delete(f.objects, key)
+		delete(f.modified, key)
+		w.WriteHeader(http.StatusNoContent)
+	case r.Method == http.MethodPost && query.Has("uploads"):
+		uploadID = fmt.Sprintf("upload-%d", len(f.uploads)+f.aborted+1)
+		f.uploads[uploadID] = map[int][]byte{}
+		fmt.Fprintf(w, "<InitiateMultipartUploadResult><UploadId>%s</UploadId></InitiateMultipartUploadResult>", uploadID)
+	case !ok:
+		w.WriteHeader(http.StatusNotFound)
+	case r.Method == http.MethodPut:
+		if f.failParts > 0 {
+			f.failParts--
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		number, _ := strconv.Atoi(query.Get("partNumber"))
+		parts[number] = body
+		w.Header().Set("ETag", fmt.Sprintf(`"%s"`, hashHex(body)))
+	case r.Method == http.MethodPost:
+		var complete struct {
+			Parts []completedPart `xml:"Part"`
+		}
+		_ = xml.Unmarshal(body, &complete)
+
+		var object []byte
+		for i, part := range complete.Parts {
+			data, ok := parts[part.PartNumber]
+			if part.PartNumber != i+1 || !ok || part.ETag != fmt.Sprintf(`"%s"`, hashHex(data)) {
+				fmt.Fprint(w, "<Error><Code>InvalidPart</Code><Message>One or more of the specified parts could not be found.</Message></Error>")
+				return
+			}
+			object = append(object, data...)
+		}
+		f.objects[key], f.modified[key] = object, time.Now()
+		delete(f.uploads, uploadID)
+	case r.Method == http.MethodDelete:
+		delete(f.uploads, uploadID)
+		f.aborted++
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// list lists the objects of the bucket under a prefix, a page of two at a
+// time, with f.mu held.
+func (f *fakeS3) list(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	var keys []string
+	for key := range f.objects {
+		key = strings.TrimPrefix(key, "/")
+		if strings.HasPrefix(key, query.Get("prefix")) && key > query.Get("continuation-token") {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	type object struct {
+		Key          string
+		LastModified time.Time
+	}
+	result := struct {
+		XMLName               xml.Name `xml:"ListBucketResult"`
+		Contents              []object
+		IsTruncated           bool
+		NextContinuationToken string `xml:",omitempty"`
+	}{}
+	for i, key := range keys {
+		if i == 2 {
+			result.IsTruncated, result.NextContinuationToken = true, keys[i-1]
+			break
+		}
+		result.Contents = append(result.Contents, object{Key: key, LastModified: f.modified["/"+key]})
+	}
+
+	_ = xml.NewEncoder(w).Encode(result)
+}
+
+func (f *fakeS3) validHeaderSignature(r *http.Request, u *url.URL) bool {
+	t, err := time.Parse(amzDateFormat, r.Header.Get("X-Amz-Date"))
+	if err != nil {
+		return false
+	}
+
+	req, _ := http.NewRequest(r.Method, u.String(), nil)
+	if v := r.Header.Get("Content-Type"); v != "" {
+		req.Header.Set("Content-Type", v)
+	}
+	f.signer.sign(req, r.Header.Get("X-Amz-Content-Sha256"), t)
+
+	return req.Header.Get("Authorization") == r.Header.Get("Authorization")
+}
+
+func (f *fakeS3) validPresignedURL(u *url.URL) bool {
+	query := u.Query()
+	t, err := time.Parse(amzDateFormat, query.Get("X-Amz-Date"))
+	if err != nil {
+		return false
+	}
+
+	unsigned := *u
+	unsigned.RawQuery = ""
+	expires, _ := time.ParseDuration(query.Get("X-Amz-Expires") + "s")
+
+	return f.signer.presign(&unsigned, t, expires).Query().Get("X-Amz-Signature") == query.Get("X-Amz-Signature")
+}
+
+func newFakeS3(t *testing.T) (*fakeS3, *httptest.Server, *Storage) {
+	fake := &fakeS3{
+		signer:   signer{accessKey: "minio", secretKey: "minio123", region: "us-east-1"},
+		bucket:   "reports",
+		objects:  map[string][]byte{},
+		modified: map[string]time.Time{},
+		uploads:  map[string]map[int][]byte{},
+	}
+	server := httptest.NewServer(fake)
+	t.Cleanup(server.Close)
+
+	storage, err := New(Config{
+		Endpoint:  server.URL,
+		Bucket:    "reports",
+		AccessKey: "minio",
+		SecretKey: "minio123",
+	})
+	require.NoError(t, err)
+
+	return fake, server, storage
+}
+
+func TestStorage_UploadAndReturnDownloadURL(t *testing.T) {
+	_, _, storage := newFakeS3(t)
+	data := []byte("user_id,segment\r\n42,AVITO\r\n")
+
+	link, err := storage.UploadAndReturnDownloadURL(context.Background(), "42 2023-08.csv", bytes.NewReader(data))
+	require.NoError(t, err)
+
+	resp, err := http.Get(link)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, data, body)
+}
+
+func TestStorage_UploadAndReturnDownloadURL_Errors(t *testing.T) {
+	testCases := []struct {
+		name    string
+		prepare func(fake *fakeS3, server *httptest.Server, storage *Storage)
+		wantIs  error
+	}{
+		{
+			name: "wrong secret",
+			prepare: func(fake *fakeS3, server *httptest.Server, storage *Storage) {
+				storage.signer.secretKey = "wrong"
+			},
+		},
+		{
+			name: "server error",
+			prepare: func(fake *fakeS3, server *httptest.Server, storage *Storage) {
+				fake.fail = http.StatusServiceUnavailable
+			},
+			wantIs: webapi.ErrUnavailable,
+		},
+		{
+			name: "unreachable",
+			prepare: func(fake *fakeS3, server *httptest.Server, storage *Storage) {
+				server.Close()
+			},
+			wantIs: webapi.ErrUnavailable,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			fake, server, storage := newFakeS3(t)
+			tc.prepare(fake, server, storage)
+
+			_, err := storage.UploadAndReturnDownloadURL(context.Background(), "42.csv", strings.NewReader("42"))
+			assert.Error(t, err)
+			if tc.wantIs != nil {
+				assert.ErrorIs(t, err, tc.wantIs)
+			}
+		})
+	}
+}
+
+func TestStorage_UploadAndReturnDownloadURL_Multipart(t *testing.T) {
+	testCases := []struct {
+		name        string
+		data        string
+		failParts   int
+		wantObject  bool
+		wantWaits   []time.Duration
+		wantAborted int
+	}{
+		{
+			name:       "fits in a part",
+			data:       "012",
+			wantObject: true,
+		},
+		{
+			name:       "parts",
+			data:       "0123456789",
+			wantObject: true,
+		},
+		{
+			name:       "parts are retried",
+			data:       "0123456789",
+			failParts:  2,
+			wantObject: true,
+			wantWaits:  []time.Duration{time.Second, 2 * time.Second},
+		},
+		{
+			name:        "retries exhausted",
+			data:        "0123456789",
+			failParts:   4,
+			wantWaits:   []time.Duration{time.Second, 2 * time.Second, 4 * time.Second},
+			wantAborted: 1,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			fake, _, storage := newFakeS3(t)
+			fake.failParts = tc.failParts
+			storage.partSize = 4
+			var waits []time.Duration
+			storage.sleep = func(ctx context.Context, d time.Duration) error {
+				waits = append(waits, d)
+				return nil
+			}
+
+			// Hides the length of the data, as a stream of it would.
+			r := struct{ io.Reader }{strings.NewReader(tc.data)}
+			link, err := storage.UploadAndReturnDownloadURL(context.Background(), "42.csv", r)
+
+			assert.Equal(t, tc.wantWaits, waits)
+			assert.Equal(t, tc.wantAborted, fake.aborted)
+			assert.Empty(t, fake.uploads)
+			if !tc.wantObject {
+				assert.ErrorIs(t, err, webapi.ErrUnavailable)
+				assert.NotContains(t, fake.objects, "/42.csv")
+				return
+			}
+			require.NoError(t, err)
+
+			resp, err := http.Get(link)
+			require.NoError(t, err)
+			defer resp.Body.Close()
+			body, _ := io.ReadAll(resp.Body)
+			assert.Equal(t, tc.data, string(body))
+		})
+	}
+}
+
+func TestStorage_UploadAndReturnDownloadURL_ReadError(t *testing.T) {
+	fake, _, storage := newFakeS3(t)
+	storage.partSize = 4
+	readErr := errors.New("read error")
+
+	r := io.MultiReader(strings.NewReader("0123456789"), iotest.ErrReader(readErr))
+	_, err := storage.UploadAndReturnDownloadURL(context.Background(), "42.csv", r)
+
+	assert.ErrorIs(t, err, readErr)
+	assert.Equal(t, 1, fake.aborted)
+	assert.Empty(t, fake.objects)
+}
+
+func TestStorage_DeleteOlderThan(t *testing.T) {
+	fake, _, storage := newFakeS3(t)
+	now := time.Now()
+	for name, age := range map[string]time.Duration{
+		"reports/2023-08-01/1_1.csv": 48 * time.Hour,
+		"reports/2023-08-02/2_2.csv": 48 * time.Hour,
+		"reports/2023-08-02/3_3.csv": time.Hour,
+		"reports/2023-08-03/4_4.csv": 72 * time.Hour,
+		"other/5_5.csv":              48 * time.Hour,
+	} {
+		_, err := storage.UploadAndReturnDownloadURL(context.Background(), name, strings.NewReader("42"))
+		require.NoError(t, err)
+		fake.modified["/"+name] = now.Add(-age)
+	}
+
+	deleted, err := storage.DeleteOlderThan(context.Background(), "reports", now.Add(-24*time.Hour))
+	require.NoError(t, err)
+	assert.Equal(t, 3, deleted)
+
+	var left []string
+	for key := range fake.objects {
+		left = append(left, key)
+	}
+	assert.ElementsMatch(t, []string{"/reports/2023-08-02/3_3.csv", "/other/5_5.csv"}, left)
+}
@@ -1,8 +1,39 @@
 package webapi
 
-import "context"
+import (
+	"context"
+	"errors"
+	"io"
+	"path"
+	"time"
+)
+
+var ErrUnavailable = errors.New("disk is not available")
 
 type Disk interface {
-	UploadAndReturnDownloadURL(ctx context.Context, name string, data []string) (string, error)
-	IsAvailable() bool
+	// UploadAndReturnDownloadURL stores what is read from r, until EOF, as the
+	// report name. Slashes in the name separate folders, which are created
+	// as needed. Reports may be larger than the memory of the service, so
+	// disks must not read them whole.
+	UploadAndReturnDownloadURL(ctx context.Context, name string, r io.Reader) (string, error)
+	// DeleteOlderThan deletes the reports in folder and its subfolders last
+	// modified before t and returns how many it deleted, also when it fails
+	// part way.
+	DeleteOlderThan(ctx context.Context, folder string, t time.Time) (int, error)
+}
+
+// ContentType returns the media type of a report named name.
+func ContentType(name string) string {
+	switch path.Ext(name) {
+	case ".csv":
+		return "text/csv"
+	case ".json":
+		return "application/json"
+	case ".ndjson":
+		return "application/x-ndjson"
+	case ".gz":
+		return "application/gzip"
+	default:
+		return "application/octet-stream"
+	}
 }
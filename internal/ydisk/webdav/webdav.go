@@ -0,0 +1,295 @@
+// Package webdav keeps reports on a WebDAV server, such as Nextcloud or
+// nginx with the dav module.
+package webdav
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	webapi "github.com/realPointer/segments/internal/ydisk"
+)
+
+const _timeout = 30 * time.Second
+
+// Config -.
+type Config struct {
+	// URL is the collection reports are uploaded to.
+	URL      string
+	Username string
+	Password string
+	// PublicURL is where clients download the reports from, URL by default.
+	// It is needed when downloads go through a different host or don't
+	// require credentials.
+	PublicURL string
+}
+
+// Disk -.
+type Disk struct {
+	url       *url.URL
+	publicURL string
+	username  string
+	password  string
+	client    *http.Client
+	// uploader has no overall timeout, uploads of large reports take as
+	// long as they take. Only the wait for the response is bounded.
+	uploader *http.Client
+	// folders remembers the folders known to exist, so that they aren't
+	// created before every upload.
+	folders sync.Map
+}
+
+func New(cfg Config) (*Disk, error) {
+	u, err := url.Parse(strings.TrimSuffix(cfg.URL, "/"))
+	if err != nil || u.Host == "" {
+		return nil, fmt.Errorf("webdav - New - invalid url %q", cfg.URL)
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.ResponseHeaderTimeout = _timeout
+
+	publicURL := cfg.PublicURL
+	if publicURL == "" {
+		publicURL = u.String()
+	}
+
+	return &Disk{
+		url:       u,
+		publicURL: strings.TrimSuffix(publicURL, "/"),
+		username:  cfg.Username,
+		password:  cfg.Password,
+		client:    &http.Client{Timeout: _timeout},
+		uploader:  &http.Client{Transport: transport},
+	}, nil
+}
+
+// UploadAndReturnDownloadURL streams the report to the server, with chunked
+// transfer encoding unless r tells its length.
+func (d *Disk) UploadAndReturnDownloadURL(ctx context.Context, name string, r io.Reader) (string, error) {
+	err := d.makeFolders(ctx, path.Dir(strings.TrimPrefix(name, "/")))
+	if err != nil {
+		return "", fmt.Errorf("webdav - UploadAndReturnDownloadURL - %w", err)
+	}
+
+	escaped := escapePath(name)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, d.url.String()+"/"+escaped, r)
+	if err != nil {
+		return "", fmt.Errorf("webdav - UploadAndReturnDownloadURL - http.NewRequestWithContext: %w", err)
+	}
+	req.Header.Set("Content-Type", webapi.ContentType(name))
+
+	resp, err := d.do(d.uploader, req)
+	if err != nil {
+		return "", fmt.Errorf("webdav - UploadAndReturnDownloadURL - %w", err)
+	}
+	resp.Body.Close()
+
+	return d.publicURL + "/" + escaped, nil
+}
+
+// makeFolders creates the folder and its parents unless they are known to
+// exist.
+func (d *Disk) makeFolders(ctx context.Context, folder string) error {
+	if folder == "." || folder == "" {
+		return nil
+	}
+	if _, ok := d.folders.Load(folder); ok {
+		return nil
+	}
+
+	err := d.makeFolders(ctx, path.Dir(folder))
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "MKCOL", d.url.String()+"/"+escapePath(folder)+"/", nil)
+	if err != nil {
+		return fmt.Errorf("http.NewRequestWithContext: %w", err)
+	}
+
+	// 405 Method Not Allowed is the answer when the folder exists.
+	resp, err := d.do(d.client, req, http.StatusMethodNotAllowed)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	d.folders.Store(folder, struct{}{})
+
+	return nil
+}
+
+// DeleteOlderThan walks the folder with PROPFIND requests of depth 1, which
+// unlike infinite depth servers have to support, and deletes the reports
+// last modified before t.
+func (d *Disk) DeleteOlderThan(ctx context.Context, folder string, t time.Time) (int, error) {
+	collection := *d.url
+	if folder = strings.Trim(folder, "/"); folder != "" {
+		collection.Path += "/" + folder
+	}
+	collection.Path += "/"
+	collection.RawPath = ""
+
+	deleted, err := d.deleteOlderThan(ctx, &collection, t)
+	if err != nil {
+		return deleted, fmt.Errorf("webdav - DeleteOlderThan - %w", err)
+	}
+
+	return deleted, nil
+}
+
+func (d *Disk) deleteOlderThan(ctx context.Context, collection *url.URL, t time.Time) (int, error) {
+	entries, err := d.list(ctx, collection)
+	if err != nil {
+		return 0, err
+	}
+
+	deleted := 0
+	for _, entry := range entries {
+		member := *collection
+		member.Path = entry.path
+
+		if entry.folder {
+			n, err := d.deleteOlderThan(ctx, &member, t)
+			deleted += n
+			if err != nil {
+				return deleted, err
+			}
+			continue
+		}
+		if !entry.modified.Before(t) {
+			continue
+		}
+
+		req, err := http.NewRequestWithContext(ctx, http.MethodDelete, member.String(), nil)
+		if err != nil {
+			return deleted, fmt.Errorf("http.NewRequestWithContext: %w", err)
+		}
+		resp, err := d.do(d.client, req)
+		if err != nil {
+			return deleted, err
+		}
+		resp.Body.Close()
+		deleted++
+	}
+
+	return deleted, nil
+}
+
+type resource struct {
+	path     string
+	folder   bool
+	modified time.Time
+}
+
+const _propfind = `<?xml version="1.0" encoding="utf-8"?>
+<propfind xmlns="DAV:"><prop><resourcetype/><getlastmodified/></prop></propfind>`
+
+// list returns the members of the collection, none when it doesn't exist.
+func (d *Disk) list(ctx context.Context, collection *url.URL) ([]resource, error) {
+	req, err := http.NewRequestWithContext(ctx, "PROPFIND", collection.String(), strings.NewReader(_propfind))
+	if err != nil {
+		return nil, fmt.Errorf("http.NewRequestWithContext: %w", err)
+	}
+	req.Header.Set("Depth", "1")
+	req.Header.Set("Content-Type", "application/xml")
+
+	resp, err := d.do(d.client, req, http.StatusNotFound)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, nil
+	}
+
+	var multistatus struct {
+		Responses []struct {
+			Href     string `xml:"href"`
+			Propstat []struct {
+				Prop struct {
+					ResourceType struct {
+						Collection *struct{} `xml:"collection"`
+					} `xml:"resourcetype"`
+					LastModified string `xml:"getlastmodified"`
+				} `xml:"prop"`
+			} `xml:"propstat"`
+		} `xml:"response"`
+	}
+	err = xml.NewDecoder(resp.Body).Decode(&multistatus)
+	if err != nil {
+		return nil, fmt.Errorf("PROPFIND %s: xml.Decode: %w", collection.Path, err)
+	}
+
+	var entries []resource
+	for _, r := range multistatus.Responses {
+		href, err := url.Parse(r.Href)
+		if err != nil {
+			return nil, fmt.Errorf("PROPFIND %s: invalid href %q", collection.Path, r.Href)
+		}
+		// The collection itself is listed along with its members.
+		if strings.TrimSuffix(href.Path, "/") == strings.TrimSuffix(collection.Path, "/") {
+			continue
+		}
+
+		e := resource{path: href.Path}
+		for _, propstat := range r.Propstat {
+			if propstat.Prop.ResourceType.Collection != nil {
+				e.folder = true
+			}
+			if modified, err := http.ParseTime(propstat.Prop.LastModified); err == nil {
+				e.modified = modified
+			}
+		}
+		if !e.folder && e.modified.IsZero() {
+			return nil, fmt.Errorf("PROPFIND %s: no modification time for %s", collection.Path, href.Path)
+		}
+
+		entries = append(entries, e)
+	}
+
+	return entries, nil
+}
+
+// do sends req with the credentials and checks that it succeeded, with a 2xx
+// status or one of also. The body of the response is left to the caller.
+// Failures to reach the server and its server errors mean it is unavailable.
+func (d *Disk) do(client *http.Client, req *http.Request, also ...int) (*http.Response, error) {
+	if d.username != "" {
+		req.SetBasicAuth(d.username, d.password)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("%s %s: %w: %s", req.Method, req.URL.Path, webapi.ErrUnavailable, err)
+	}
+
+	if resp.StatusCode/100 == 2 || slices.Contains(also, resp.StatusCode) {
+		return resp, nil
+	}
+	defer resp.Body.Close()
+
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	if resp.StatusCode >= 500 {
+		return nil, fmt.Errorf("%s %s: %w: status %d: %s", req.Method, req.URL.Path, webapi.ErrUnavailable, resp.StatusCode, body)
+	}
+
+	return nil, fmt.Errorf("%s %s: status %d: %s", req.Method, req.URL.Path, resp.StatusCode, body)
+}
+
+func escapePath(name string) string {
+	segments := strings.Split(strings.TrimPrefix(name, "/"), "/")
+	for i, s := range segments {
+		segments[i] = url.PathEscape(s)
+	}
+
+	return strings.Join(segments, "/")
+}
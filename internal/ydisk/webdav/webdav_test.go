@@ -0,0 +1,199 @@
+package webdav
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	webapi "github.com/realPointer/segments/internal/ydisk"
+)
+
+func TestDisk_UploadAndReturnDownloadURL(t *testing.T) {
+	var gotPath, gotUser, gotPassword string
+	var gotBody []byte
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPut {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		gotPath = r.URL.EscapedPath()
+		gotUser, gotPassword, _ = r.BasicAuth()
+		gotBody, _ = io.ReadAll(r.Body)
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer server.Close()
+
+	disk, err := New(Config{URL: server.URL + "/dav/reports/", Username: "user", Password: "secret", PublicURL: "https://files.example.com/reports"})
+	require.NoError(t, err)
+
+	link, err := disk.UploadAndReturnDownloadURL(context.Background(), "42 2023-08.csv", strings.NewReader("42"))
+	require.NoError(t, err)
+
+	assert.Equal(t, "https://files.example.com/reports/42%202023-08.csv", link)
+	assert.Equal(t, "/dav/reports/42%202023-08.csv", gotPath)
+	assert.Equal(t, "user", gotUser)
+	assert.Equal(t, "secret", gotPassword)
+	assert.Equal(t, []byte("42"), gotBody)
+}
+
+func TestDisk_UploadAndReturnDownloadURL_Errors(t *testing.T) {
+	testCases := []struct {
+		name   string
+		status int
+		wantIs error
+	}{
+		{name: "forbidden", status: http.StatusForbidden},
+		{name: "server error", status: http.StatusBadGateway, wantIs: webapi.ErrUnavailable},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(tc.status)
+			}))
+			defer server.Close()
+
+			disk, err := New(Config{URL: server.URL})
+			require.NoError(t, err)
+
+			_, err = disk.UploadAndReturnDownloadURL(context.Background(), "42.csv", strings.NewReader("42"))
+			assert.Error(t, err)
+			if tc.wantIs != nil {
+				assert.ErrorIs(t, err, tc.wantIs)
+			}
+		})
+	}
+}
+
+// fakeWebDAV is a stand-in for a WebDAV server keeping files in memory. Like
+// real servers, it requires the parents of files and folders to exist.
+type fakeWebDAV struct {
+	mu       sync.Mutex
+	folders  map[string]bool
+	files    map[string][]byte
+	modified map[string]time.Time
+}
+
+func newFakeWebDAV(t *testing.T) (*fakeWebDAV, *Disk) {
+	fake := &fakeWebDAV{
+		folders:  map[string]bool{"/dav": true},
+		files:    map[string][]byte{},
+		modified: map[string]time.Time{},
+	}
+	server := httptest.NewServer(fake)
+	t.Cleanup(server.Close)
+
+	disk, err := New(Config{URL: server.URL + "/dav"})
+	require.NoError(t, err)
+
+	return fake, disk
+}
+
+func (f *fakeWebDAV) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	name := strings.TrimSuffix(r.URL.Path, "/")
+	if !f.folders[path.Dir(name)] {
+		w.WriteHeader(http.StatusConflict)
+		return
+	}
+
+	switch r.Method {
+	case "MKCOL":
+		if f.folders[name] || f.files[name] != nil {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		f.folders[name] = true
+		w.WriteHeader(http.StatusCreated)
+	case http.MethodPut:
+		f.files[name], _ = io.ReadAll(r.Body)
+		f.modified[name] = time.Now()
+		w.WriteHeader(http.StatusCreated)
+	case http.MethodDelete:
+		delete(f.files, name)
+		w.WriteHeader(http.StatusNoContent)
+	case "PROPFIND":
+		if !f.folders[name] {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		w.WriteHeader(http.StatusMultiStatus)
+		fmt.Fprint(w, `<?xml version="1.0" encoding="utf-8"?><D:multistatus xmlns:D="DAV:">`)
+		fmt.Fprintf(w, `<D:response><D:href>%s/</D:href><D:propstat><D:prop><D:resourcetype><D:collection/></D:resourcetype></D:prop></D:propstat></D:response>`, name)
+		for folder := range f.folders {
+			if path.Dir(folder) == name {
+				fmt.Fprintf(w, `<D:response><D:href>%s/</D:href><D:propstat><D:prop><D:resourcetype><D:collection/></D:resourcetype></D:prop></D:propstat></D:response>`, (&url.URL{Path: folder}).EscapedPath())
+			}
+		}
+		for file := range f.files {
+			if path.Dir(file) == name {
+				fmt.Fprintf(w, `<D:response><D:href>%s</D:href><D:propstat><D:prop><D:resourcetype/><D:getlastmodified>%s</D:getlastmodified></D:prop></D:propstat></D:response>`,
+					(&url.URL{Path: file}).EscapedPath(), f.modified[file].UTC().Format(http.TimeFormat))
+			}
+		}
+		fmt.Fprint(w, `</D:multistatus>`)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func TestDisk_UploadAndReturnDownloadURL_Folders(t *testing.T) {
+	fake, disk := newFakeWebDAV(t)
+
+	_, err := disk.UploadAndReturnDownloadURL(context.Background(), "reports/2023-08-01/1_1.csv", strings.NewReader("1"))
+	require.NoError(t, err)
+	_, err = disk.UploadAndReturnDownloadURL(context.Background(), "reports/2023-08-02/2_2.csv", strings.NewReader("2"))
+	require.NoError(t, err)
+
+	assert.True(t, fake.folders["/dav/reports/2023-08-01"])
+	assert.Equal(t, []byte("2"), fake.files["/dav/reports/2023-08-02/2_2.csv"])
+
+	// Folders made by someone else are taken as they are.
+	disk, err = New(Config{URL: disk.url.String()})
+	require.NoError(t, err)
+	_, err = disk.UploadAndReturnDownloadURL(context.Background(), "reports/2023-08-01/3_3.csv", strings.NewReader("3"))
+	assert.NoError(t, err)
+}
+
+func TestDisk_DeleteOlderThan(t *testing.T) {
+	fake, disk := newFakeWebDAV(t)
+	now := time.Now()
+	for name, age := range map[string]time.Duration{
+		"reports/2023-08-01/1 1.csv": 48 * time.Hour,
+		"reports/2023-08-02/2_2.csv": 48 * time.Hour,
+		"reports/2023-08-02/3_3.csv": time.Hour,
+		"other/4_4.csv":              48 * time.Hour,
+	} {
+		_, err := disk.UploadAndReturnDownloadURL(context.Background(), name, strings.NewReader("42"))
+		require.NoError(t, err)
+		fake.modified["/dav/"+name] = now.Add(-age)
+	}
+
+	deleted, err := disk.DeleteOlderThan(context.Background(), "reports", now.Add(-24*time.Hour))
+	require.NoError(t, err)
+	assert.Equal(t, 2, deleted)
+
+	var left []string
+	for name := range fake.files {
+		left = append(left, name)
+	}
+	assert.ElementsMatch(t, []string{"/dav/reports/2023-08-02/3_3.csv", "/dav/other/4_4.csv"}, left)
+
+	deleted, err = disk.DeleteOlderThan(context.Background(), "missing", now)
+	assert.NoError(t, err)
+	assert.Zero(t, deleted)
+}
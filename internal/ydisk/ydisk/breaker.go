@@ -0,0 +1,73 @@
+package ydisk
+
+import (
+	"sync"
+	"time"
+)
+
+// breaker is a circuit breaker. After threshold failures in a row it opens
+// and turns calls away for cooldown, then lets a single trial call through:
+// its success closes the breaker, its failure opens it again, and when it is
+// cancelled the next call is the trial.
+type breaker struct {
+	threshold int
+	cooldown  time.Duration
+	now       func() time.Time
+
+	mu       sync.Mutex
+	failures int
+	openedAt time.Time
+	trial    bool
+}
+
+// allow reports whether a call may go ahead and whether it is the trial,
+// which a call allowed while the breaker is half-open is. The outcome of the
+// trial must be reported, or the trial released.
+func (b *breaker) allow() (ok, trial bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.failures < b.threshold {
+		return true, false
+	}
+	if b.trial || b.now().Sub(b.openedAt) < b.cooldown {
+		return false, false
+	}
+	b.trial = true
+
+	return true, true
+}
+
+// open reports whether calls are being turned away.
+func (b *breaker) open() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.failures >= b.threshold && (b.trial || b.now().Sub(b.openedAt) < b.cooldown)
+}
+
+func (b *breaker) success() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.failures, b.trial = 0, false
+}
+
+func (b *breaker) failure() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.failures++
+	if b.failures >= b.threshold {
+		b.openedAt, b.trial = b.now(), false
+	}
+}
+
+// release ends the trial without an outcome, as when the caller cancelled
+// it, and lets the next call be the trial.
+func (b *breaker) release() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.trial = false
+}
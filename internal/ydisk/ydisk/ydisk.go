@@ -1,149 +1,474 @@
+// Package ydisk keeps reports on Yandex Disk and hands out its download
+// links.
 package ydisk
 
 import (
-	"bytes"
 	"context"
-	"encoding/csv"
 	"encoding/json"
 	"errors"
-	"log"
+	"fmt"
+	"io"
+	"math/rand"
 	"net/http"
 	"net/url"
+	"os"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	webapi "github.com/realPointer/segments/internal/ydisk"
 )
 
-type YandexDisk struct {
-	token string
+const (
+	_defaultBaseURL          = "https://cloud-api.yandex.net/v1/disk"
+	_defaultTimeout          = 30 * time.Second
+	_defaultMaxRetries       = 3
+	_defaultMinBackoff       = 500 * time.Millisecond
+	_defaultMaxBackoff       = 30 * time.Second
+	_defaultBreakerThreshold = 5
+	_defaultBreakerCooldown  = 30 * time.Second
+)
+
+// Config -.
+type Config struct {
+	Token string
+	// BaseURL is the root of the REST API, https://cloud-api.yandex.net/v1/disk
+	// by default.
+	BaseURL string
+	// Timeout bounds every request to the REST API, including reading its
+	// response. Uploads of reports take as long as they take, only the wait
+	// for their response is bounded.
+	Timeout time.Duration
+	// MaxRetries is how many times a request failing with a network error,
+	// 429 or 5xx is repeated. Negative values turn retries off.
+	MaxRetries int
+	// MinBackoff and MaxBackoff bound the exponential backoff between
+	// retries. A Retry-After of the response takes precedence, up to
+	// MaxBackoff.
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+	// BreakerThreshold uploads failing in a row because the disk is
+	// unavailable open the circuit breaker. Uploads fail right away for
+	// BreakerCooldown, then a single one is let through to try the disk.
+	BreakerThreshold int
+	BreakerCooldown  time.Duration
 }
 
-func NewYandexDisk(token string) *YandexDisk {
-	return &YandexDisk{token: token}
+type YandexDisk struct {
+	token      string
+	baseURL    string
+	client     *http.Client
+	uploader   *http.Client
+	maxRetries int
+	minBackoff time.Duration
+	maxBackoff time.Duration
+	breaker    *breaker
+	sleep      func(ctx context.Context, d time.Duration) error
+	// folders remembers the folders known to exist, so that they aren't
+	// created before every upload.
+	folders sync.Map
 }
 
-func (d *YandexDisk) UploadAndReturnDownloadURL(ctx context.Context, name string, data []string) (string, error) {
-	if !d.IsAvailable() {
-		return "", errors.New("Yandex Disk is not available")
+func New(cfg Config) (*YandexDisk, error) {
+	baseURL := cfg.BaseURL
+	if baseURL == "" {
+		baseURL = _defaultBaseURL
 	}
-
-	// Convert []string to CSV format
-	var buf bytes.Buffer
-	w := csv.NewWriter(&buf)
-	for _, record := range data {
-		if err := w.Write([]string{record}); err != nil {
-			return "", err
-		}
+	u, err := url.Parse(baseURL)
+	if err != nil || u.Host == "" {
+		return nil, fmt.Errorf("ydisk - New - invalid base url %q", cfg.BaseURL)
 	}
-	w.Flush()
 
-	// Upload CSV file to Yandex Disk
-	uploadPath, err := d.uploadCSVFile(ctx, name, buf.Bytes())
-	if err != nil {
-		return "", err
+	timeout := cfg.Timeout
+	if timeout <= 0 {
+		timeout = _defaultTimeout
+	}
+	maxRetries := cfg.MaxRetries
+	if maxRetries == 0 {
+		maxRetries = _defaultMaxRetries
+	}
+	if maxRetries < 0 {
+		maxRetries = 0
+	}
+	minBackoff := cfg.MinBackoff
+	if minBackoff <= 0 {
+		minBackoff = _defaultMinBackoff
+	}
+	maxBackoff := cfg.MaxBackoff
+	if maxBackoff <= 0 {
+		maxBackoff = _defaultMaxBackoff
+	}
+	threshold := cfg.BreakerThreshold
+	if threshold <= 0 {
+		threshold = _defaultBreakerThreshold
+	}
+	cooldown := cfg.BreakerCooldown
+	if cooldown <= 0 {
+		cooldown = _defaultBreakerCooldown
 	}
-	log.Default().Println(uploadPath)
 
-	// Get download URL for uploaded file
-	downloadURL, err := d.getDownloadURL(ctx, uploadPath)
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.ResponseHeaderTimeout = timeout
+
+	return &YandexDisk{
+		token:      cfg.Token,
+		baseURL:    strings.TrimSuffix(baseURL, "/"),
+		client:     &http.Client{Timeout: timeout},
+		uploader:   &http.Client{Transport: transport},
+		maxRetries: maxRetries,
+		minBackoff: minBackoff,
+		maxBackoff: maxBackoff,
+		breaker:    &breaker{threshold: threshold, cooldown: cooldown, now: time.Now},
+		sleep:      sleep,
+	}, nil
+}
+
+// UploadAndReturnDownloadURL spools the report to a temporary file, as Yandex
+// Disk takes it in a single request which may have to be repeated, and
+// uploads it from there.
+func (d *YandexDisk) UploadAndReturnDownloadURL(ctx context.Context, name string, r io.Reader) (string, error) {
+	file, size, err := spool(r)
 	if err != nil {
-		return "", err
+		return "", fmt.Errorf("ydisk - UploadAndReturnDownloadURL - %w", err)
 	}
+	defer func() {
+		file.Close()
+		os.Remove(file.Name())
+	}()
 
-	return downloadURL, nil
-}
+	ok, trial := d.breaker.allow()
+	if !ok {
+		return "", fmt.Errorf("ydisk - UploadAndReturnDownloadURL: %w: circuit breaker is open", webapi.ErrUnavailable)
+	}
 
-func (d *YandexDisk) IsAvailable() bool {
-	resp, err := http.Head("https://cloud-api.yandex.net/v1/disk/")
+	link, err := d.upload(ctx, name, file, size)
+	switch {
+	case errors.Is(err, webapi.ErrUnavailable):
+		d.breaker.failure()
+	case ctx.Err() == nil:
+		d.breaker.success()
+	case trial:
+		// A cancelled upload says nothing of the disk.
+		d.breaker.release()
+	}
 	if err != nil {
-		return false
+		return "", fmt.Errorf("ydisk - UploadAndReturnDownloadURL - %w", err)
 	}
-	defer resp.Body.Close()
 
-	return resp.StatusCode == http.StatusMethodNotAllowed
+	return link, nil
 }
 
-func (d *YandexDisk) uploadCSVFile(ctx context.Context, name string, data []byte) (string, error) {
-	const baseURL = "https://cloud-api.yandex.net/v1/disk/resources/upload"
+func (d *YandexDisk) upload(ctx context.Context, name string, file io.ReaderAt, size int64) (string, error) {
+	err := d.makeFolders(ctx, path.Dir(strings.TrimPrefix(name, "/")))
+	if err != nil {
+		return "", err
+	}
 
 	params := url.Values{}
 	params.Set("path", name)
 	params.Set("overwrite", "true")
 
-	req, err := http.NewRequestWithContext(ctx, http.MethodGet, baseURL+"?"+params.Encode(), nil)
+	var uploadLink struct {
+		Href   string `json:"href"`
+		Method string `json:"method"`
+	}
+	_, err = d.api(ctx, http.MethodGet, "/resources/upload?"+params.Encode(), &uploadLink)
 	if err != nil {
 		return "", err
 	}
 
-	req.Header.Set("Authorization", "OAuth "+d.token)
+	method := uploadLink.Method
+	if method == "" {
+		method = http.MethodPut
+	}
+	resp, err := d.do(ctx, d.uploader, func() (*http.Request, error) {
+		req, err := http.NewRequestWithContext(ctx, method, uploadLink.Href, io.NewSectionReader(file, 0, size))
+		if err != nil {
+			return nil, err
+		}
+		req.ContentLength = size
 
-	client := &http.Client{}
-	resp, err := client.Do(req)
+		return req, nil
+	})
 	if err != nil {
 		return "", err
 	}
-	defer resp.Body.Close()
+	resp.Body.Close()
 
-	if resp.StatusCode != http.StatusOK {
-		return "", errors.New("failed to get upload URL")
-	}
+	params = url.Values{}
+	params.Set("path", name)
 
-	var uploadURL struct {
+	var downloadLink struct {
 		Href string `json:"href"`
 	}
-
-	err = json.NewDecoder(resp.Body).Decode(&uploadURL)
+	_, err = d.api(ctx, http.MethodGet, "/resources/download?"+params.Encode(), &downloadLink)
 	if err != nil {
 		return "", err
 	}
 
-	req, err = http.NewRequestWithContext(ctx, http.MethodPut, uploadURL.Href, bytes.NewReader(data))
-	if err != nil {
-		return "", err
+	return downloadLink.Href, nil
+}
+
+// makeFolders creates the folder and its parents unless they are known to
+// exist.
+func (d *YandexDisk) makeFolders(ctx context.Context, folder string) error {
+	if folder == "." || folder == "" {
+		return nil
+	}
+	if _, ok := d.folders.Load(folder); ok {
+		return nil
 	}
 
-	resp, err = client.Do(req)
+	err := d.makeFolders(ctx, path.Dir(folder))
 	if err != nil {
-		return "", err
+		return err
 	}
-	defer resp.Body.Close()
 
-	if resp.StatusCode != http.StatusCreated {
-		return "", errors.New("failed to upload file")
+	params := url.Values{}
+	params.Set("path", folder)
+
+	// 409 Conflict is the answer when the folder exists.
+	_, err = d.api(ctx, http.MethodPut, "/resources?"+params.Encode(), nil, http.StatusConflict)
+	if err != nil {
+		return err
 	}
+	d.folders.Store(folder, struct{}{})
 
-	return name, nil
+	return nil
 }
 
-func (d *YandexDisk) getDownloadURL(ctx context.Context, path string) (string, error) {
-	const baseURL = "https://cloud-api.yandex.net/v1/disk/resources/download"
+// DeleteOlderThan walks the folder and permanently deletes the reports last
+// modified before t, rather than moving them to the trash.
+func (d *YandexDisk) DeleteOlderThan(ctx context.Context, folder string, t time.Time) (int, error) {
+	deleted, err := d.deleteOlderThan(ctx, "/"+strings.Trim(folder, "/"), t)
+	if err != nil {
+		return deleted, fmt.Errorf("ydisk - DeleteOlderThan - %w", err)
+	}
 
-	params := url.Values{}
-	params.Set("path", path)
+	return deleted, nil
+}
 
-	req, err := http.NewRequestWithContext(ctx, http.MethodGet, baseURL+"?"+params.Encode(), nil)
+type resource struct {
+	Path     string    `json:"path"`
+	Type     string    `json:"type"`
+	Modified time.Time `json:"modified"`
+}
+
+func (d *YandexDisk) deleteOlderThan(ctx context.Context, folder string, t time.Time) (int, error) {
+	resources, err := d.list(ctx, folder)
 	if err != nil {
-		return "", err
+		return 0, err
+	}
+
+	deleted := 0
+	for _, r := range resources {
+		if r.Type == "dir" {
+			n, err := d.deleteOlderThan(ctx, r.Path, t)
+			deleted += n
+			if err != nil {
+				return deleted, err
+			}
+			continue
+		}
+		if !r.Modified.Before(t) {
+			continue
+		}
+
+		params := url.Values{}
+		params.Set("path", r.Path)
+		params.Set("permanently", "true")
+		_, err := d.api(ctx, http.MethodDelete, "/resources?"+params.Encode(), nil)
+		if err != nil {
+			return deleted, err
+		}
+		deleted++
+	}
+
+	return deleted, nil
+}
+
+// list returns what the folder holds, nothing when it doesn't exist. All of
+// it is listed before anything is deleted, as deleting shifts the pages.
+func (d *YandexDisk) list(ctx context.Context, folder string) ([]resource, error) {
+	const limit = 100
+
+	var resources []resource
+	for offset := 0; ; offset += limit {
+		params := url.Values{}
+		params.Set("path", folder)
+		params.Set("limit", strconv.Itoa(limit))
+		params.Set("offset", strconv.Itoa(offset))
+		params.Set("fields", "_embedded.items.path,_embedded.items.type,_embedded.items.modified")
+
+		var page struct {
+			Embedded struct {
+				Items []resource `json:"items"`
+			} `json:"_embedded"`
+		}
+		status, err := d.api(ctx, http.MethodGet, "/resources?"+params.Encode(), &page, http.StatusNotFound)
+		if err != nil {
+			return nil, err
+		}
+		if status == http.StatusNotFound {
+			return nil, nil
+		}
+
+		resources = append(resources, page.Embedded.Items...)
+		if len(page.Embedded.Items) < limit {
+			return resources, nil
+		}
 	}
+}
 
-	req.Header.Set("Authorization", "OAuth "+d.token)
+// api sends a request to the REST API at path and decodes the response into
+// v, unless v is nil. Statuses in also count as success, their responses
+// aren't decoded. It returns the status of the response.
+func (d *YandexDisk) api(ctx context.Context, method, path string, v any, also ...int) (int, error) {
+	resp, err := d.do(ctx, d.client, func() (*http.Request, error) {
+		req, err := http.NewRequestWithContext(ctx, method, d.baseURL+path, nil)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Authorization", "OAuth "+d.token)
+		req.Header.Set("Accept", "application/json")
 
-	client := &http.Client{}
-	resp, err := client.Do(req)
+		return req, nil
+	}, also...)
 	if err != nil {
-		return "", err
+		return 0, err
 	}
 	defer resp.Body.Close()
 
-	if resp.StatusCode != http.StatusOK {
-		return "", errors.New("failed to get download URL")
+	if v == nil || resp.StatusCode/100 != 2 {
+		return resp.StatusCode, nil
+	}
+	err = json.NewDecoder(resp.Body).Decode(v)
+	if err != nil {
+		return 0, fmt.Errorf("%s %s: json.Decode: %w", method, path, err)
 	}
 
-	var downloadURL struct {
-		Href string `json:"href"`
+	return resp.StatusCode, nil
+}
+
+// do sends the request newReq builds until it succeeds, with a 2xx status or
+// one of also, retrying network errors, 429 and 5xx with backoff. Requests
+// that still fail mean the disk is unavailable. The body of a successful
+// response is left to the caller.
+func (d *YandexDisk) do(ctx context.Context, client *http.Client, newReq func() (*http.Request, error), also ...int) (*http.Response, error) {
+	for attempt := 0; ; attempt++ {
+		req, err := newReq()
+		if err != nil {
+			return nil, err
+		}
+
+		resp, err := client.Do(req)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			err = fmt.Errorf("%s %s: %w: %s", req.Method, req.URL.Path, webapi.ErrUnavailable, err)
+		} else if resp.StatusCode/100 == 2 || slices.Contains(also, resp.StatusCode) {
+			return resp, nil
+		} else {
+			err = responseError(req, resp)
+		}
+
+		if !errors.Is(err, webapi.ErrUnavailable) || attempt >= d.maxRetries {
+			return nil, err
+		}
+
+		wait := d.backoff(attempt, resp)
+		if sleepErr := d.sleep(ctx, wait); sleepErr != nil {
+			return nil, sleepErr
+		}
 	}
+}
 
-	err = json.NewDecoder(resp.Body).Decode(&downloadURL)
+// spool copies r to a temporary file and returns it with its size. The file
+// is the caller's to close and remove.
+func spool(r io.Reader) (*os.File, int64, error) {
+	file, err := os.CreateTemp("", "ydisk-*")
 	if err != nil {
-		return "", err
+		return nil, 0, fmt.Errorf("os.CreateTemp: %w", err)
 	}
 
-	return downloadURL.Href, nil
+	size, err := io.Copy(file, r)
+	if err != nil {
+		file.Close()
+		os.Remove(file.Name())
+
+		return nil, 0, fmt.Errorf("io.Copy: %w", err)
+	}
+
+	return file, size, nil
+}
+
+// responseError reads the error of the failed response and closes it.
+func responseError(req *http.Request, resp *http.Response) error {
+	defer resp.Body.Close()
+
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	var apiErr struct {
+		Description string `json:"description"`
+		Error       string `json:"error"`
+	}
+	detail := strings.TrimSpace(string(body))
+	if json.Unmarshal(body, &apiErr) == nil && apiErr.Error != "" {
+		detail = apiErr.Error + ": " + apiErr.Description
+	}
+
+	if resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500 {
+		return fmt.Errorf("%s %s: %w: status %d: %s", req.Method, req.URL.Path, webapi.ErrUnavailable, resp.StatusCode, detail)
+	}
+
+	return fmt.Errorf("%s %s: status %d: %s", req.Method, req.URL.Path, resp.StatusCode, detail)
+}
+
+// backoff returns the wait before retry number attempt+1: the Retry-After of
+// resp when it has one, otherwise a jittered exponential delay.
+func (d *YandexDisk) backoff(attempt int, resp *http.Response) time.Duration {
+	if resp != nil {
+		if wait, ok := retryAfter(resp.Header.Get("Retry-After"), time.Now()); ok {
+			return min(wait, d.maxBackoff)
+		}
+	}
+
+	wait := d.minBackoff << attempt
+	if wait <= 0 || wait > d.maxBackoff {
+		wait = d.maxBackoff
+	}
+
+	// Full jitter on the upper half keeps clients from retrying in step.
+	return wait/2 + time.Duration(rand.Int63n(int64(wait/2)+1))
+}
+
+// retryAfter parses a Retry-After header, given in seconds or as an HTTP
+// date.
+func retryAfter(v string, now time.Time) (time.Duration, bool) {
+	if v == "" {
+		return 0, false
+	}
+	if seconds, err := strconv.Atoi(v); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second, true
+	}
+	if t, err := http.ParseTime(v); err == nil {
+		return max(t.Sub(now), 0), true
+	}
+
+	return 0, false
+}
+
+func sleep(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
 }
@@ -0,0 +1,483 @@
+package ydisk
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	pathpkg "path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"testing/iotest"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	webapi "github.com/realPointer/segments/internal/ydisk"
+)
+
+// fakeYandexDisk is a stand-in for the REST API of Yandex Disk and its
+// upload and download hosts. Responses queued in failures are served to the
+// requests of the REST API before they are handled.
+type fakeYandexDisk struct {
+	token string
+	url   string
+
+	mu       sync.Mutex
+	folders  map[string]bool
+	files    map[string][]byte
+	modified map[string]time.Time
+	failures []fakeFailure
+	requests int
+}
+
+type fakeFailure struct {
+	status     int
+	retryAfter string
+	delay      time.Duration
+}
+
+func newFakeYandexDisk(t *testing.T) (*fakeYandexDisk, *httptest.Server) {
+	fake := &fakeYandexDisk{
+		token:    "token",
+		folders:  map[string]bool{"": true},
+		files:    map[string][]byte{},
+		modified: map[string]time.Time{},
+	}
+	server := httptest.NewServer(fake)
+	t.Cleanup(server.Close)
+	fake.url = server.URL
+
+	return fake, server
+}
+
+func (f *fakeYandexDisk) fail(failures ...fakeFailure) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.failures = append(f.failures, failures...)
+}
+
+func (f *fakeYandexDisk) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	path := strings.Trim(strings.TrimPrefix(r.URL.Query().Get("path"), "disk:"), "/")
+
+	switch {
+	case strings.HasPrefix(r.URL.Path, "/v1/disk/"):
+		f.mu.Lock()
+		f.requests++
+		var failure *fakeFailure
+		if len(f.failures) > 0 {
+			failure = &f.failures[0]
+			f.failures = f.failures[1:]
+		}
+		f.mu.Unlock()
+
+		if failure != nil {
+			time.Sleep(failure.delay)
+			if failure.retryAfter != "" {
+				w.Header().Set("Retry-After", failure.retryAfter)
+			}
+			writeJSON(w, failure.status, map[string]string{"error": "FakeError", "description": http.StatusText(failure.status)})
+			return
+		}
+
+		if r.Header.Get("Authorization") != "OAuth "+f.token {
+			writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "UnauthorizedError", "description": "Не авторизован."})
+			return
+		}
+
+		f.mu.Lock()
+		defer f.mu.Unlock()
+
+		switch r.URL.Path {
+		case "/v1/disk/resources":
+			f.resources(w, r, path)
+		case "/v1/disk/resources/upload":
+			if !f.folders[pathpkg.Dir("/" + path)[1:]] {
+				writeJSON(w, http.StatusConflict, map[string]string{"error": "DiskPathDoesntExistsError", "description": "Указанного пути не существует."})
+				return
+			}
+			writeJSON(w, http.StatusOK, map[string]string{"href": f.url + "/upload/" + path, "method": http.MethodPut})
+		case "/v1/disk/resources/download":
+			if _, ok := f.files[path]; !ok {
+				writeJSON(w, http.StatusNotFound, map[string]string{"error": "DiskNotFoundError", "description": "Не удалось найти запрошенный ресурс."})
+				return
+			}
+			writeJSON(w, http.StatusOK, map[string]string{"href": f.url + "/download/" + path, "method": http.MethodGet})
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	case strings.HasPrefix(r.URL.Path, "/upload/") && r.Method == http.MethodPut:
+		body, _ := io.ReadAll(r.Body)
+		f.mu.Lock()
+		f.files[strings.TrimPrefix(r.URL.Path, "/upload/")] = body
+		f.modified[strings.TrimPrefix(r.URL.Path, "/upload/")] = time.Now()
+		f.mu.Unlock()
+		w.WriteHeader(http.StatusCreated)
+	case strings.HasPrefix(r.URL.Path, "/download/") && r.Method == http.MethodGet:
+		f.mu.Lock()
+		body, ok := f.files[strings.TrimPrefix(r.URL.Path, "/download/")]
+		f.mu.Unlock()
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		_, _ = w.Write(body)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// resources creates folders, lists and deletes them and files, with f.mu
+// held.
+func (f *fakeYandexDisk) resources(w http.ResponseWriter, r *http.Request, path string) {
+	switch r.Method {
+	case http.MethodPut:
+		if f.folders[path] {
+			writeJSON(w, http.StatusConflict, map[string]string{"error": "DiskPathPointsToExistentDirectoryError", "description": "По указанному пути уже существует папка с таким именем."})
+			return
+		}
+		if !f.folders[pathpkg.Dir("/" + path)[1:]] {
+			writeJSON(w, http.StatusConflict, map[string]string{"error": "DiskPathDoesntExistsError", "description": "Указанного пути не существует."})
+			return
+		}
+		f.folders[path] = true
+		writeJSON(w, http.StatusCreated, map[string]string{"href": f.url + "/v1/disk/resources?path=disk:/" + path})
+	case http.MethodGet:
+		if !f.folders[path] {
+			writeJSON(w, http.StatusNotFound, map[string]string{"error": "DiskNotFoundError", "description": "Не удалось найти запрошенный ресурс."})
+			return
+		}
+
+		type item struct {
+			Path     string    `json:"path"`
+			Type     string    `json:"type"`
+			Modified time.Time `json:"modified"`
+		}
+		var items []item
+		for folder := range f.folders {
+			if folder != "" && pathpkg.Dir("/" + folder)[1:] == path {
+				items = append(items, item{Path: "disk:/" + folder, Type: "dir"})
+			}
+		}
+		for file := range f.files {
+			if pathpkg.Dir("/" + file)[1:] == path {
+				items = append(items, item{Path: "disk:/" + file, Type: "file", Modified: f.modified[file]})
+			}
+		}
+		sort.Slice(items, func(i, j int) bool { return items[i].Path < items[j].Path })
+
+		offset, _ := strconv.Atoi(r.URL.Query().Get("offset"))
+		limit, _ := strconv.Atoi(r.URL.Query().Get("limit"))
+		items = items[min(offset, len(items)):min(offset+limit, len(items))]
+		writeJSON(w, http.StatusOK, map[string]any{"_embedded": map[string]any{"items": items}})
+	case http.MethodDelete:
+		if _, ok := f.files[path]; !ok || r.URL.Query().Get("permanently") != "true" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		delete(f.files, path)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+// newTestDisk returns a client of the fake which records the backoff it
+// waits for instead of sleeping.
+func newTestDisk(t *testing.T, server *httptest.Server, cfg Config) (*YandexDisk, *[]time.Duration) {
+	cfg.BaseURL = server.URL + "/v1/disk"
+	if cfg.Token == "" {
+		cfg.Token = "token"
+	}
+
+	disk, err := New(cfg)
+	require.NoError(t, err)
+
+	var waits []time.Duration
+	disk.sleep = func(ctx context.Context, d time.Duration) error {
+		waits = append(waits, d)
+		return ctx.Err()
+	}
+
+	return disk, &waits
+}
+
+func TestYandexDisk_UploadAndReturnDownloadURL(t *testing.T) {
+	_, server := newFakeYandexDisk(t)
+	disk, _ := newTestDisk(t, server, Config{})
+	data := []byte("user_id,segment\r\n42,AVITO\r\n")
+
+	link, err := disk.UploadAndReturnDownloadURL(context.Background(), "42_2023-08.csv", bytes.NewReader(data))
+	require.NoError(t, err)
+
+	resp, err := http.Get(link)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, data, body)
+}
+
+func TestYandexDisk_UploadAndReturnDownloadURL_Retries(t *testing.T) {
+	testCases := []struct {
+		name      string
+		failures  []fakeFailure
+		cfg       Config
+		wantWaits []time.Duration
+		wantErr   bool
+		wantErrIs error
+	}{
+		{
+			name:      "retry after",
+			failures:  []fakeFailure{{status: http.StatusTooManyRequests, retryAfter: "2"}, {status: http.StatusServiceUnavailable, retryAfter: "1"}},
+			cfg:       Config{MaxRetries: 3},
+			wantWaits: []time.Duration{2 * time.Second, time.Second},
+		},
+		{
+			name:      "retry after capped",
+			failures:  []fakeFailure{{status: http.StatusTooManyRequests, retryAfter: "3600"}},
+			cfg:       Config{MaxRetries: 3, MaxBackoff: 10 * time.Second},
+			wantWaits: []time.Duration{10 * time.Second},
+		},
+		{
+			name: "retries exhausted",
+			failures: []fakeFailure{
+				{status: http.StatusBadGateway, retryAfter: "1"},
+				{status: http.StatusBadGateway, retryAfter: "1"},
+				{status: http.StatusBadGateway, retryAfter: "1"},
+			},
+			cfg:       Config{MaxRetries: 2},
+			wantWaits: []time.Duration{time.Second, time.Second},
+			wantErr:   true,
+			wantErrIs: webapi.ErrUnavailable,
+		},
+		{
+			name:     "client errors aren't retried",
+			failures: []fakeFailure{{status: http.StatusForbidden}},
+			cfg:      Config{MaxRetries: 3},
+			wantErr:  true,
+		},
+		{
+			name:      "timeout",
+			failures:  []fakeFailure{{status: http.StatusOK, delay: 200 * time.Millisecond}},
+			cfg:       Config{MaxRetries: -1, Timeout: 50 * time.Millisecond},
+			wantErr:   true,
+			wantErrIs: webapi.ErrUnavailable,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			fake, server := newFakeYandexDisk(t)
+			fake.fail(tc.failures...)
+			disk, waits := newTestDisk(t, server, tc.cfg)
+
+			_, err := disk.UploadAndReturnDownloadURL(context.Background(), "42.csv", strings.NewReader("42"))
+
+			assert.Equal(t, tc.wantWaits, *waits)
+			if !tc.wantErr {
+				assert.NoError(t, err)
+				return
+			}
+			assert.Error(t, err)
+			if tc.wantErrIs != nil {
+				assert.ErrorIs(t, err, tc.wantErrIs)
+			} else {
+				assert.NotErrorIs(t, err, webapi.ErrUnavailable)
+			}
+		})
+	}
+}
+
+func TestYandexDisk_UploadAndReturnDownloadURL_WrongToken(t *testing.T) {
+	_, server := newFakeYandexDisk(t)
+	disk, waits := newTestDisk(t, server, Config{Token: "wrong"})
+
+	_, err := disk.UploadAndReturnDownloadURL(context.Background(), "42.csv", strings.NewReader("42"))
+	assert.ErrorContains(t, err, "status 401: UnauthorizedError")
+	assert.NotErrorIs(t, err, webapi.ErrUnavailable)
+	assert.Empty(t, *waits)
+	assert.False(t, disk.breaker.open())
+}
+
+func TestYandexDisk_CircuitBreaker(t *testing.T) {
+	fake, server := newFakeYandexDisk(t)
+	disk, _ := newTestDisk(t, server, Config{MaxRetries: -1, BreakerThreshold: 2, BreakerCooldown: time.Minute})
+	now := time.Date(2023, 9, 1, 12, 0, 0, 0, time.UTC)
+	disk.breaker.now = func() time.Time { return now }
+	upload := func() error {
+		_, err := disk.UploadAndReturnDownloadURL(context.Background(), "42.csv", strings.NewReader("42"))
+		return err
+	}
+
+	fake.fail(fakeFailure{status: http.StatusInternalServerError}, fakeFailure{status: http.StatusInternalServerError})
+	assert.ErrorIs(t, upload(), webapi.ErrUnavailable)
+	assert.False(t, disk.breaker.open())
+	assert.ErrorIs(t, upload(), webapi.ErrUnavailable)
+	assert.True(t, disk.breaker.open())
+
+	// Open: uploads fail without reaching the disk.
+	requests := fake.requests
+	err := upload()
+	assert.ErrorIs(t, err, webapi.ErrUnavailable)
+	assert.ErrorContains(t, err, "circuit breaker is open")
+	assert.Equal(t, requests, fake.requests)
+
+	// Half-open: a failed trial opens the breaker again.
+	now = now.Add(time.Minute)
+	assert.False(t, disk.breaker.open())
+	fake.fail(fakeFailure{status: http.StatusInternalServerError})
+	assert.ErrorIs(t, upload(), webapi.ErrUnavailable)
+	assert.True(t, disk.breaker.open())
+
+	// A successful trial closes it.
+	now = now.Add(time.Minute)
+	assert.NoError(t, upload())
+	assert.False(t, disk.breaker.open())
+	assert.NoError(t, upload())
+}
+
+func TestYandexDisk_UploadAndReturnDownloadURL_Cancelled(t *testing.T) {
+	fake, server := newFakeYandexDisk(t)
+	fake.fail(fakeFailure{status: http.StatusServiceUnavailable})
+	disk, _ := newTestDisk(t, server, Config{BreakerThreshold: 1})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	_, err := disk.UploadAndReturnDownloadURL(ctx, "42.csv", strings.NewReader("42"))
+	assert.True(t, errors.Is(err, context.Canceled))
+	assert.False(t, disk.breaker.open())
+}
+
+func TestYandexDisk_CircuitBreaker_CancelledTrial(t *testing.T) {
+	fake, server := newFakeYandexDisk(t)
+	disk, _ := newTestDisk(t, server, Config{MaxRetries: -1, BreakerThreshold: 1, BreakerCooldown: time.Minute})
+	now := time.Date(2023, 9, 1, 12, 0, 0, 0, time.UTC)
+	disk.breaker.now = func() time.Time { return now }
+
+	fake.fail(fakeFailure{status: http.StatusInternalServerError})
+	_, err := disk.UploadAndReturnDownloadURL(context.Background(), "42.csv", strings.NewReader("42"))
+	assert.ErrorIs(t, err, webapi.ErrUnavailable)
+	assert.True(t, disk.breaker.open())
+
+	// The trial is cancelled before it reaches the disk.
+	now = now.Add(time.Minute)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = disk.UploadAndReturnDownloadURL(ctx, "42.csv", strings.NewReader("42"))
+	assert.ErrorIs(t, err, context.Canceled)
+	assert.False(t, disk.breaker.open())
+
+	// The next upload is the trial.
+	_, err = disk.UploadAndReturnDownloadURL(context.Background(), "42.csv", strings.NewReader("42"))
+	assert.NoError(t, err)
+	assert.False(t, disk.breaker.open())
+}
+
+func TestYandexDisk_UploadAndReturnDownloadURL_ReadError(t *testing.T) {
+	fake, server := newFakeYandexDisk(t)
+	disk, _ := newTestDisk(t, server, Config{BreakerThreshold: 1})
+	readErr := errors.New("read error")
+
+	_, err := disk.UploadAndReturnDownloadURL(context.Background(), "42.csv", iotest.ErrReader(readErr))
+	assert.ErrorIs(t, err, readErr)
+	assert.Zero(t, fake.requests)
+	assert.False(t, disk.breaker.open())
+}
+
+func TestYandexDisk_UploadAndReturnDownloadURL_Folders(t *testing.T) {
+	fake, server := newFakeYandexDisk(t)
+	disk, _ := newTestDisk(t, server, Config{})
+
+	_, err := disk.UploadAndReturnDownloadURL(context.Background(), "reports/2023-08-01/1_1.csv", strings.NewReader("1"))
+	require.NoError(t, err)
+	_, err = disk.UploadAndReturnDownloadURL(context.Background(), "reports/2023-08-01/2_2.csv", strings.NewReader("2"))
+	require.NoError(t, err)
+
+	assert.True(t, fake.folders["reports/2023-08-01"])
+	assert.Equal(t, []byte("2"), fake.files["reports/2023-08-01/2_2.csv"])
+	// Folders are created once: a request to the API for each of them and two
+	// for every upload.
+	assert.Equal(t, 2+2*2, fake.requests)
+
+	// Folders made by someone else are taken as they are.
+	disk, _ = newTestDisk(t, server, Config{})
+	_, err = disk.UploadAndReturnDownloadURL(context.Background(), "reports/2023-08-01/3_3.csv", strings.NewReader("3"))
+	assert.NoError(t, err)
+}
+
+func TestYandexDisk_DeleteOlderThan(t *testing.T) {
+	fake, server := newFakeYandexDisk(t)
+	disk, _ := newTestDisk(t, server, Config{})
+	now := time.Now()
+	files := map[string]time.Duration{
+		"reports/2023-08-02/3_3.csv": time.Hour,
+		"other/4_4.csv":              48 * time.Hour,
+	}
+	// More than a page of old reports.
+	for i := 0; i < 150; i++ {
+		files[fmt.Sprintf("reports/2023-08-01/%d.csv", i)] = 48 * time.Hour
+	}
+	for name, age := range files {
+		_, err := disk.UploadAndReturnDownloadURL(context.Background(), name, strings.NewReader("42"))
+		require.NoError(t, err)
+		fake.modified[name] = now.Add(-age)
+	}
+
+	deleted, err := disk.DeleteOlderThan(context.Background(), "reports", now.Add(-24*time.Hour))
+	require.NoError(t, err)
+	assert.Equal(t, 150, deleted)
+
+	var left []string
+	for name := range fake.files {
+		left = append(left, name)
+	}
+	assert.ElementsMatch(t, []string{"reports/2023-08-02/3_3.csv", "other/4_4.csv"}, left)
+
+	deleted, err = disk.DeleteOlderThan(context.Background(), "missing", now)
+	assert.NoError(t, err)
+	assert.Zero(t, deleted)
+}
+
+func TestRetryAfter(t *testing.T) {
+	now := time.Date(2023, 9, 1, 12, 0, 0, 0, time.UTC)
+
+	wait, ok := retryAfter("120", now)
+	assert.True(t, ok)
+	assert.Equal(t, 2*time.Minute, wait)
+
+	wait, ok = retryAfter(now.Add(30*time.Second).Format(http.TimeFormat), now)
+	assert.True(t, ok)
+	assert.Equal(t, 30*time.Second, wait)
+
+	_, ok = retryAfter("soon", now)
+	assert.False(t, ok)
+}
+
+func TestYandexDisk_Backoff(t *testing.T) {
+	disk, err := New(Config{MinBackoff: time.Second, MaxBackoff: 5 * time.Second})
+	require.NoError(t, err)
+
+	for attempt, limit := range []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 5 * time.Second, 5 * time.Second} {
+		wait := disk.backoff(attempt, nil)
+		assert.GreaterOrEqual(t, wait, limit/2)
+		assert.LessOrEqual(t, wait, limit)
+	}
+}
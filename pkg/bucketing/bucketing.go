@@ -0,0 +1,95 @@
+// Package bucketing assigns users to percentage segments deterministically.
+//
+// A user falls into bucket MurmurHash3(salt + ":" + userID) mod Buckets and is
+// a member of a segment with percentage p when the bucket is below
+// p * Buckets / 100. Any service that knows the salt can compute membership
+// on its own, and raising the percentage only adds users on top of the
+// current ones.
+//
+// Segments of one layer share the salt and each of them owns its own range
+// of buckets, so a user can fall into at most one of them.
+package bucketing
+
+import (
+	"math"
+	"sort"
+	"strconv"
+)
+
+// Buckets is the number of buckets users are spread over, so percentages
+// are honoured up to two decimal places.
+const Buckets = 10000
+
+// Bucket returns the bucket of the user for the given salt.
+func Bucket(salt string, userID int) int {
+	key := salt + ":" + strconv.Itoa(userID)
+
+	return int(Sum32([]byte(key), 0) % Buckets)
+}
+
+// Threshold returns the number of buckets covered by percentage.
+func Threshold(percentage float64) int {
+	return int(math.Round(percentage * Buckets / 100))
+}
+
+// InSegment reports whether the user belongs to a segment with the given salt
+// and percentage.
+func InSegment(salt string, userID int, percentage float64) bool {
+	return InRange(salt, userID, 0, percentage)
+}
+
+// InRange reports whether the bucket of the user falls into the percentage of
+// buckets starting at offset. Segments sharing a salt and covering disjoint
+// ranges never have common users.
+func InRange(salt string, userID int, offset int, percentage float64) bool {
+	bucket := Bucket(salt, userID)
+
+	return bucket >= offset && bucket < offset+Threshold(percentage)
+}
+
+// Variant returns the index of the variant the user gets, picked with the
+// given weights. The pick hashes the user with a key of its own, so it does
+// not depend on the user's bucket and stays the same when the segment grows.
+// It returns -1 when the weights add up to zero.
+func Variant(salt string, userID int, weights []int) int {
+	total := 0
+	for _, w := range weights {
+		total += w
+	}
+	if total <= 0 {
+		return -1
+	}
+
+	key := salt + ":variant:" + strconv.Itoa(userID)
+	point := int(Sum32([]byte(key), 0) % uint32(total))
+
+	for i, w := range weights {
+		if point < w {
+			return i
+		}
+		point -= w
+	}
+
+	return len(weights) - 1
+}
+
+// FreeOffset returns the lowest offset at which size buckets do not overlap
+// any of the taken ranges, given as [offset, offset+size) pairs. The second
+// result is false when there is no room left.
+func FreeOffset(taken [][2]int, size int) (int, bool) {
+	sorted := make([][2]int, len(taken))
+	copy(sorted, taken)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i][0] < sorted[j][0] })
+
+	offset := 0
+	for _, r := range sorted {
+		if r[0]-offset >= size {
+			return offset, true
+		}
+		if r[1] > offset {
+			offset = r[1]
+		}
+	}
+
+	return offset, Buckets-offset >= size
+}
@@ -0,0 +1,120 @@
+package bucketing
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSum32(t *testing.T) {
+	testCases := []struct {
+		name string
+		data string
+		seed uint32
+		want uint32
+	}{
+		{name: "empty", data: "", seed: 0, want: 0},
+		{name: "empty with seed", data: "", seed: 1, want: 0x514e28b7},
+		{name: "empty with max seed", data: "", seed: 0xffffffff, want: 0x81f16f39},
+		{name: "one block", data: "test", seed: 0, want: 0xba6bd213},
+		{name: "one block with seed", data: "aaaa", seed: 0x9747b28c, want: 0x5a97808a},
+		{name: "tail", data: "Hello, world!", seed: 0, want: 0xc0363e43},
+		{name: "long", data: "The quick brown fox jumps over the lazy dog", seed: 0, want: 0x2e4ff723},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.want, Sum32([]byte(tc.data), tc.seed))
+		})
+	}
+}
+
+func TestThreshold(t *testing.T) {
+	assert.Equal(t, 0, Threshold(0))
+	assert.Equal(t, 1000, Threshold(10))
+	assert.Equal(t, 1234, Threshold(12.34))
+	assert.Equal(t, Buckets, Threshold(100))
+}
+
+func TestInSegment(t *testing.T) {
+	const users = 20000
+
+	members := func(salt string, percentage float64) map[int]bool {
+		m := make(map[int]bool)
+		for id := 1; id <= users; id++ {
+			if InSegment(salt, id, percentage) {
+				m[id] = true
+			}
+		}
+		return m
+	}
+
+	ten := members("salt", 10)
+	twenty := members("salt", 20)
+
+	assert.InDelta(t, users/10, len(ten), users/100)
+	assert.InDelta(t, users/5, len(twenty), users/100)
+
+	for id := range ten {
+		assert.True(t, twenty[id], "user %d left the segment after ramping up", id)
+	}
+
+	assert.Equal(t, ten, members("salt", 10))
+	assert.NotEqual(t, ten, members("other salt", 10))
+	assert.Empty(t, members("salt", 0))
+	assert.Len(t, members("salt", 100), users)
+}
+
+func TestInRange(t *testing.T) {
+	for id := 1; id <= 1000; id++ {
+		first := InRange("layer", id, 0, 30)
+		second := InRange("layer", id, Threshold(30), 50)
+		assert.False(t, first && second, "user %d is in both ranges", id)
+		assert.Equal(t, InSegment("layer", id, 30), first)
+	}
+}
+
+func TestFreeOffset(t *testing.T) {
+	testCases := []struct {
+		name   string
+		taken  [][2]int
+		size   int
+		want   int
+		wantOK bool
+	}{
+		{name: "empty layer", size: 1000, want: 0, wantOK: true},
+		{name: "after taken", taken: [][2]int{{0, 3000}}, size: 1000, want: 3000, wantOK: true},
+		{name: "gap", taken: [][2]int{{5000, 6000}, {0, 1000}}, size: 2000, want: 1000, wantOK: true},
+		{name: "gap too small", taken: [][2]int{{0, 1000}, {1500, 9000}}, size: 1000, want: 9000, wantOK: true},
+		{name: "full", taken: [][2]int{{0, 5000}, {5000, 9500}}, size: 1000, want: 9500, wantOK: false},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			got, ok := FreeOffset(tc.taken, tc.size)
+			assert.Equal(t, tc.wantOK, ok)
+			if ok {
+				assert.Equal(t, tc.want, got)
+			}
+		})
+	}
+}
+
+func TestVariant(t *testing.T) {
+	const users = 20000
+
+	counts := make([]int, 3)
+	for id := 1; id <= users; id++ {
+		v := Variant("salt", id, []int{50, 25, 25})
+		counts[v]++
+		assert.Equal(t, v, Variant("salt", id, []int{50, 25, 25}))
+	}
+
+	assert.InDelta(t, users/2, counts[0], users/50)
+	assert.InDelta(t, users/4, counts[1], users/50)
+	assert.InDelta(t, users/4, counts[2], users/50)
+
+	assert.Equal(t, 0, Variant("salt", 1, []int{1}))
+	assert.Equal(t, 1, Variant("salt", 1, []int{0, 1}))
+	assert.Equal(t, -1, Variant("salt", 1, nil))
+}
@@ -0,0 +1,56 @@
+package bucketing
+
+import (
+	"encoding/binary"
+	"math/bits"
+)
+
+const (
+	_c1 = 0xcc9e2d51
+	_c2 = 0x1b873593
+)
+
+// Sum32 returns the 32-bit MurmurHash3 (x86 variant) of data with the given
+// seed.
+func Sum32(data []byte, seed uint32) uint32 {
+	h := seed
+	n := len(data)
+
+	for len(data) >= 4 {
+		k := binary.LittleEndian.Uint32(data)
+		data = data[4:]
+
+		k *= _c1
+		k = bits.RotateLeft32(k, 15)
+		k *= _c2
+
+		h ^= k
+		h = bits.RotateLeft32(h, 13)
+		h = h*5 + 0xe6546b64
+	}
+
+	var k uint32
+	switch len(data) {
+	case 3:
+		k ^= uint32(data[2]) << 16
+		fallthrough
+	case 2:
+		k ^= uint32(data[1]) << 8
+		fallthrough
+	case 1:
+		k ^= uint32(data[0])
+		k *= _c1
+		k = bits.RotateLeft32(k, 15)
+		k *= _c2
+		h ^= k
+	}
+
+	h ^= uint32(n)
+	h ^= h >> 16
+	h *= 0x85ebca6b
+	h ^= h >> 13
+	h *= 0xc2b2ae35
+	h ^= h >> 16
+
+	return h
+}
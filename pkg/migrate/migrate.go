@@ -0,0 +1,374 @@
+// Package migrate implements versioned postgres schema migrations.
+package migrate
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"regexp"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+
+	"github.com/realPointer/segments/pkg/postgres"
+)
+
+const (
+	_defaultTable = "schema_migrations"
+	// _defaultLockID is an arbitrary key for pg_advisory_xact_lock shared by
+	// every replica, so only one of them migrates the schema at a time.
+	_defaultLockID = 4_105_229_187_633_991
+)
+
+var (
+	ErrUnknownVersion = errors.New("unknown migration version")
+	ErrNoDown         = errors.New("migration has no down script")
+)
+
+var _fileName = regexp.MustCompile(`^(\d+)_(\w+)\.(up|down)\.sql$`)
+
+// Migration -.
+type Migration struct {
+	Version uint
+	Name    string
+	Up      string
+	Down    string
+}
+
+// Status -.
+type Status struct {
+	Migration
+	Applied   bool
+	AppliedAt time.Time
+}
+
+// Migrator -.
+type Migrator struct {
+	*postgres.Postgres
+	migrations []Migration
+	table      string
+	lockID     int64
+}
+
+// New -.
+func New(pg *postgres.Postgres, fsys fs.FS, opts ...Option) (*Migrator, error) {
+	migrations, err := Load(fsys)
+	if err != nil {
+		return nil, fmt.Errorf("migrate - New - Load: %w", err)
+	}
+
+	m := &Migrator{
+		Postgres:   pg,
+		migrations: migrations,
+		table:      _defaultTable,
+		lockID:     _defaultLockID,
+	}
+
+	// Custom options
+	for _, opt := range opts {
+		opt(m)
+	}
+
+	return m, nil
+}
+
+// Load reads NNNN_name.up.sql and NNNN_name.down.sql files from the root of
+// fsys and returns them sorted by version.
+func Load(fsys fs.FS) ([]Migration, error) {
+	entries, err := fs.ReadDir(fsys, ".")
+	if err != nil {
+		return nil, fmt.Errorf("fs.ReadDir: %w", err)
+	}
+
+	byVersion := make(map[uint]*Migration)
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+
+		match := _fileName.FindStringSubmatch(entry.Name())
+		if match == nil {
+			continue
+		}
+
+		version, err := strconv.ParseUint(match[1], 10, 32)
+		if err != nil || version == 0 {
+			return nil, fmt.Errorf("%s: invalid version", entry.Name())
+		}
+
+		body, err := fs.ReadFile(fsys, entry.Name())
+		if err != nil {
+			return nil, fmt.Errorf("fs.ReadFile: %w", err)
+		}
+
+		mig, ok := byVersion[uint(version)]
+		if !ok {
+			mig = &Migration{Version: uint(version), Name: match[2]}
+			byVersion[uint(version)] = mig
+		}
+		if mig.Name != match[2] {
+			return nil, fmt.Errorf("version %d is used by both %q and %q", version, mig.Name, match[2])
+		}
+
+		if match[3] == "up" {
+			mig.Up = string(body)
+		} else {
+			mig.Down = string(body)
+		}
+	}
+
+	migrations := make([]Migration, 0, len(byVersion))
+	for _, mig := range byVersion {
+		if mig.Up == "" {
+			return nil, fmt.Errorf("version %d (%s) has no up script", mig.Version, mig.Name)
+		}
+
+		migrations = append(migrations, *mig)
+	}
+
+	sort.Slice(migrations, func(i, j int) bool {
+		return migrations[i].Version < migrations[j].Version
+	})
+
+	return migrations, nil
+}
+
+// Up applies every pending migration.
+func (m *Migrator) Up(ctx context.Context) ([]Migration, error) {
+	var done []Migration
+
+	err := m.inTx(ctx, func(tx pgx.Tx, applied map[uint]time.Time) error {
+		for _, mig := range m.migrations {
+			if _, ok := applied[mig.Version]; ok {
+				continue
+			}
+
+			if err := m.apply(ctx, tx, mig); err != nil {
+				return err
+			}
+			done = append(done, mig)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Migrator.Up: %w", err)
+	}
+
+	return done, nil
+}
+
+// Down rolls back the last steps applied migrations.
+func (m *Migrator) Down(ctx context.Context, steps int) ([]Migration, error) {
+	var done []Migration
+
+	err := m.inTx(ctx, func(tx pgx.Tx, applied map[uint]time.Time) error {
+		for i := len(m.migrations) - 1; i >= 0 && len(done) < steps; i-- {
+			mig := m.migrations[i]
+			if _, ok := applied[mig.Version]; !ok {
+				continue
+			}
+
+			if err := m.revert(ctx, tx, mig); err != nil {
+				return err
+			}
+			done = append(done, mig)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Migrator.Down: %w", err)
+	}
+
+	return done, nil
+}
+
+// Goto applies or rolls back migrations until version is the latest applied
+// one. Version 0 rolls back everything.
+func (m *Migrator) Goto(ctx context.Context, version uint) ([]Migration, error) {
+	if version != 0 && m.find(version) < 0 {
+		return nil, fmt.Errorf("Migrator.Goto: %w: %d", ErrUnknownVersion, version)
+	}
+
+	var done []Migration
+
+	err := m.inTx(ctx, func(tx pgx.Tx, applied map[uint]time.Time) error {
+		for i := len(m.migrations) - 1; i >= 0; i-- {
+			mig := m.migrations[i]
+			if _, ok := applied[mig.Version]; !ok || mig.Version <= version {
+				continue
+			}
+
+			if err := m.revert(ctx, tx, mig); err != nil {
+				return err
+			}
+			done = append(done, mig)
+		}
+
+		for _, mig := range m.migrations {
+			if _, ok := applied[mig.Version]; ok || mig.Version > version {
+				continue
+			}
+
+			if err := m.apply(ctx, tx, mig); err != nil {
+				return err
+			}
+			done = append(done, mig)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Migrator.Goto: %w", err)
+	}
+
+	return done, nil
+}
+
+// Status reports which of the known migrations are applied.
+func (m *Migrator) Status(ctx context.Context) ([]Status, error) {
+	var statuses []Status
+
+	err := m.inTx(ctx, func(tx pgx.Tx, applied map[uint]time.Time) error {
+		for _, mig := range m.migrations {
+			appliedAt, ok := applied[mig.Version]
+			statuses = append(statuses, Status{
+				Migration: mig,
+				Applied:   ok,
+				AppliedAt: appliedAt,
+			})
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Migrator.Status: %w", err)
+	}
+
+	return statuses, nil
+}
+
+// inTx runs fn in a transaction holding the migration advisory lock, so
+// replicas booting at the same time apply the schema one after another.
+func (m *Migrator) inTx(ctx context.Context, fn func(tx pgx.Tx, applied map[uint]time.Time) error) error {
+	tx, err := m.Pool.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("m.Pool.Begin: %w", err)
+	}
+	defer func() { _ = tx.Rollback(ctx) }()
+
+	_, err = tx.Exec(ctx, "SELECT pg_advisory_xact_lock($1)", m.lockID)
+	if err != nil {
+		return fmt.Errorf("pg_advisory_xact_lock: %w", err)
+	}
+
+	_, err = tx.Exec(ctx, fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s (
+		version BIGINT PRIMARY KEY NOT NULL,
+		name VARCHAR(255) NOT NULL,
+		applied_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+	)`, pgx.Identifier{m.table}.Sanitize()))
+	if err != nil {
+		return fmt.Errorf("create %s: %w", m.table, err)
+	}
+
+	applied, err := m.applied(ctx, tx)
+	if err != nil {
+		return err
+	}
+
+	err = fn(tx, applied)
+	if err != nil {
+		return err
+	}
+
+	err = tx.Commit(ctx)
+	if err != nil {
+		return fmt.Errorf("tx.Commit: %w", err)
+	}
+
+	return nil
+}
+
+func (m *Migrator) applied(ctx context.Context, tx pgx.Tx) (map[uint]time.Time, error) {
+	sql, args, _ := m.Builder.
+		Select("version", "applied_at").
+		From(m.table).
+		ToSql()
+
+	rows, err := tx.Query(ctx, sql, args...)
+	if err != nil {
+		return nil, fmt.Errorf("tx.Query: %w", err)
+	}
+	defer rows.Close()
+
+	applied := make(map[uint]time.Time)
+	for rows.Next() {
+		var version int64
+		var appliedAt time.Time
+		err := rows.Scan(&version, &appliedAt)
+		if err != nil {
+			return nil, fmt.Errorf("rows.Scan: %w", err)
+		}
+
+		applied[uint(version)] = appliedAt
+	}
+
+	return applied, rows.Err()
+}
+
+func (m *Migrator) apply(ctx context.Context, tx pgx.Tx, mig Migration) error {
+	_, err := tx.Exec(ctx, mig.Up)
+	if err != nil {
+		return fmt.Errorf("%d_%s up: %w", mig.Version, mig.Name, err)
+	}
+
+	sql, args, _ := m.Builder.
+		Insert(m.table).
+		Columns("version", "name").
+		Values(mig.Version, mig.Name).
+		ToSql()
+
+	_, err = tx.Exec(ctx, sql, args...)
+	if err != nil {
+		return fmt.Errorf("%d_%s: insert version: %w", mig.Version, mig.Name, err)
+	}
+
+	return nil
+}
+
+func (m *Migrator) revert(ctx context.Context, tx pgx.Tx, mig Migration) error {
+	if mig.Down == "" {
+		return fmt.Errorf("%d_%s: %w", mig.Version, mig.Name, ErrNoDown)
+	}
+
+	_, err := tx.Exec(ctx, mig.Down)
+	if err != nil {
+		return fmt.Errorf("%d_%s down: %w", mig.Version, mig.Name, err)
+	}
+
+	sql, args, _ := m.Builder.
+		Delete(m.table).
+		Where("version = $1", mig.Version).
+		ToSql()
+
+	_, err = tx.Exec(ctx, sql, args...)
+	if err != nil {
+		return fmt.Errorf("%d_%s: delete version: %w", mig.Version, mig.Name, err)
+	}
+
+	return nil
+}
+
+func (m *Migrator) find(version uint) int {
+	for i, mig := range m.migrations {
+		if mig.Version == version {
+			return i
+		}
+	}
+
+	return -1
+}
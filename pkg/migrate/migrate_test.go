@@ -0,0 +1,288 @@
+package migrate
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/Masterminds/squirrel"
+	"github.com/pashagolub/pgxmock/v3"
+	"github.com/realPointer/segments/pkg/postgres"
+	"github.com/stretchr/testify/assert"
+)
+
+var testFS = fstest.MapFS{
+	"0001_init.up.sql":        {Data: []byte("CREATE TABLE a")},
+	"0001_init.down.sql":      {Data: []byte("DROP TABLE a")},
+	"0002_add_b.up.sql":       {Data: []byte("CREATE TABLE b")},
+	"0002_add_b.down.sql":     {Data: []byte("DROP TABLE b")},
+	"0003_no_down.up.sql":     {Data: []byte("CREATE TABLE c")},
+	"migrations.go":           {Data: []byte("package migrations")},
+	"README.md":               {Data: []byte("not a migration")},
+	"0004_not_sql.up.sql.bak": {Data: []byte("ignored")},
+}
+
+func TestLoad(t *testing.T) {
+	testCases := []struct {
+		name    string
+		fsys    fstest.MapFS
+		want    []Migration
+		wantErr bool
+	}{
+		{
+			name: "OK",
+			fsys: testFS,
+			want: []Migration{
+				{Version: 1, Name: "init", Up: "CREATE TABLE a", Down: "DROP TABLE a"},
+				{Version: 2, Name: "add_b", Up: "CREATE TABLE b", Down: "DROP TABLE b"},
+				{Version: 3, Name: "no_down", Up: "CREATE TABLE c"},
+			},
+		},
+		{
+			name: "down without up",
+			fsys: fstest.MapFS{
+				"0001_init.down.sql": {Data: []byte("DROP TABLE a")},
+			},
+			wantErr: true,
+		},
+		{
+			name: "version used twice",
+			fsys: fstest.MapFS{
+				"0001_init.up.sql":  {Data: []byte("CREATE TABLE a")},
+				"0001_other.up.sql": {Data: []byte("CREATE TABLE b")},
+			},
+			wantErr: true,
+		},
+		{
+			name: "zero version",
+			fsys: fstest.MapFS{
+				"0000_init.up.sql": {Data: []byte("CREATE TABLE a")},
+			},
+			wantErr: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := Load(tc.fsys)
+			if tc.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tc.want, got)
+		})
+	}
+}
+
+func expectLock(m pgxmock.PgxPoolIface, applied ...int64) {
+	m.ExpectBegin()
+	m.ExpectExec("SELECT pg_advisory_xact_lock").
+		WithArgs(int64(_defaultLockID)).
+		WillReturnResult(pgxmock.NewResult("SELECT", 1))
+	m.ExpectExec("CREATE TABLE IF NOT EXISTS \"schema_migrations\"").
+		WillReturnResult(pgxmock.NewResult("CREATE TABLE", 0))
+
+	rows := pgxmock.NewRows([]string{"version", "applied_at"})
+	for _, version := range applied {
+		rows.AddRow(version, time.Date(2023, time.September, 1, 0, 0, 0, 0, time.UTC))
+	}
+	m.ExpectQuery("SELECT version, applied_at FROM schema_migrations").WillReturnRows(rows)
+}
+
+func TestMigrator(t *testing.T) {
+	type MockBehavior func(m pgxmock.PgxPoolIface)
+
+	testCases := []struct {
+		name         string
+		run          func(m *Migrator) ([]Migration, error)
+		mockBehavior MockBehavior
+		want         []uint
+		wantErr      error
+	}{
+		{
+			name: "up from scratch",
+			run: func(m *Migrator) ([]Migration, error) {
+				return m.Up(context.Background())
+			},
+			mockBehavior: func(m pgxmock.PgxPoolIface) {
+				expectLock(m)
+				for i, table := range []string{"a", "b", "c"} {
+					m.ExpectExec("CREATE TABLE " + table).WillReturnResult(pgxmock.NewResult("CREATE TABLE", 0))
+					m.ExpectExec("INSERT INTO schema_migrations").
+						WithArgs(uint(i+1), pgxmock.AnyArg()).
+						WillReturnResult(pgxmock.NewResult("INSERT", 1))
+				}
+				m.ExpectCommit()
+			},
+			want: []uint{1, 2, 3},
+		},
+		{
+			name: "up applies only pending",
+			run: func(m *Migrator) ([]Migration, error) {
+				return m.Up(context.Background())
+			},
+			mockBehavior: func(m pgxmock.PgxPoolIface) {
+				expectLock(m, 1, 2)
+				m.ExpectExec("CREATE TABLE c").WillReturnResult(pgxmock.NewResult("CREATE TABLE", 0))
+				m.ExpectExec("INSERT INTO schema_migrations").
+					WithArgs(uint(3), "no_down").
+					WillReturnResult(pgxmock.NewResult("INSERT", 1))
+				m.ExpectCommit()
+			},
+			want: []uint{3},
+		},
+		{
+			name: "up error rolls back",
+			run: func(m *Migrator) ([]Migration, error) {
+				return m.Up(context.Background())
+			},
+			mockBehavior: func(m pgxmock.PgxPoolIface) {
+				expectLock(m, 1)
+				m.ExpectExec("CREATE TABLE b").WillReturnError(errors.New("syntax error"))
+				m.ExpectRollback()
+			},
+			wantErr: errors.New("syntax error"),
+		},
+		{
+			name: "down one step",
+			run: func(m *Migrator) ([]Migration, error) {
+				return m.Down(context.Background(), 1)
+			},
+			mockBehavior: func(m pgxmock.PgxPoolIface) {
+				expectLock(m, 1, 2)
+				m.ExpectExec("DROP TABLE b").WillReturnResult(pgxmock.NewResult("DROP TABLE", 0))
+				m.ExpectExec("DELETE FROM schema_migrations").
+					WithArgs(uint(2)).
+					WillReturnResult(pgxmock.NewResult("DELETE", 1))
+				m.ExpectCommit()
+			},
+			want: []uint{2},
+		},
+		{
+			name: "down without down script",
+			run: func(m *Migrator) ([]Migration, error) {
+				return m.Down(context.Background(), 1)
+			},
+			mockBehavior: func(m pgxmock.PgxPoolIface) {
+				expectLock(m, 1, 2, 3)
+				m.ExpectRollback()
+			},
+			wantErr: ErrNoDown,
+		},
+		{
+			name: "goto older version",
+			run: func(m *Migrator) ([]Migration, error) {
+				return m.Goto(context.Background(), 1)
+			},
+			mockBehavior: func(m pgxmock.PgxPoolIface) {
+				expectLock(m, 1, 2)
+				m.ExpectExec("DROP TABLE b").WillReturnResult(pgxmock.NewResult("DROP TABLE", 0))
+				m.ExpectExec("DELETE FROM schema_migrations").
+					WithArgs(uint(2)).
+					WillReturnResult(pgxmock.NewResult("DELETE", 1))
+				m.ExpectCommit()
+			},
+			want: []uint{2},
+		},
+		{
+			name: "goto newer version",
+			run: func(m *Migrator) ([]Migration, error) {
+				return m.Goto(context.Background(), 2)
+			},
+			mockBehavior: func(m pgxmock.PgxPoolIface) {
+				expectLock(m)
+				m.ExpectExec("CREATE TABLE a").WillReturnResult(pgxmock.NewResult("CREATE TABLE", 0))
+				m.ExpectExec("INSERT INTO schema_migrations").
+					WithArgs(uint(1), "init").
+					WillReturnResult(pgxmock.NewResult("INSERT", 1))
+				m.ExpectExec("CREATE TABLE b").WillReturnResult(pgxmock.NewResult("CREATE TABLE", 0))
+				m.ExpectExec("INSERT INTO schema_migrations").
+					WithArgs(uint(2), "add_b").
+					WillReturnResult(pgxmock.NewResult("INSERT", 1))
+				m.ExpectCommit()
+			},
+			want: []uint{1, 2},
+		},
+		{
+			name: "goto unknown version",
+			run: func(m *Migrator) ([]Migration, error) {
+				return m.Goto(context.Background(), 42)
+			},
+			mockBehavior: func(m pgxmock.PgxPoolIface) {},
+			wantErr:      ErrUnknownVersion,
+		},
+		{
+			name: "lock error",
+			run: func(m *Migrator) ([]Migration, error) {
+				return m.Up(context.Background())
+			},
+			mockBehavior: func(m pgxmock.PgxPoolIface) {
+				m.ExpectBegin()
+				m.ExpectExec("SELECT pg_advisory_xact_lock").
+					WithArgs(int64(_defaultLockID)).
+					WillReturnError(errors.New("canceling statement due to lock timeout"))
+				m.ExpectRollback()
+			},
+			wantErr: errors.New("canceling statement due to lock timeout"),
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			poolMock, _ := pgxmock.NewPool()
+			defer poolMock.Close()
+			tc.mockBehavior(poolMock)
+
+			postgresMock := &postgres.Postgres{
+				Builder: squirrel.StatementBuilder.PlaceholderFormat(squirrel.Dollar),
+				Pool:    poolMock,
+			}
+			migrator, err := New(postgresMock, testFS)
+			assert.NoError(t, err)
+
+			got, err := tc.run(migrator)
+			if tc.wantErr != nil {
+				if !errors.Is(err, tc.wantErr) {
+					assert.ErrorContains(t, err, tc.wantErr.Error())
+				}
+				return
+			}
+			assert.NoError(t, err)
+
+			versions := make([]uint, 0, len(got))
+			for _, mig := range got {
+				versions = append(versions, mig.Version)
+			}
+			assert.Equal(t, tc.want, versions)
+
+			err = poolMock.ExpectationsWereMet()
+			assert.NoError(t, err)
+		})
+	}
+}
+
+func TestMigrator_Status(t *testing.T) {
+	poolMock, _ := pgxmock.NewPool()
+	defer poolMock.Close()
+
+	expectLock(poolMock, 1)
+	poolMock.ExpectCommit()
+
+	migrator, err := New(&postgres.Postgres{
+		Builder: squirrel.StatementBuilder.PlaceholderFormat(squirrel.Dollar),
+		Pool:    poolMock,
+	}, testFS)
+	assert.NoError(t, err)
+
+	statuses, err := migrator.Status(context.Background())
+	assert.NoError(t, err)
+	assert.Len(t, statuses, 3)
+	assert.True(t, statuses[0].Applied)
+	assert.Equal(t, time.Date(2023, time.September, 1, 0, 0, 0, 0, time.UTC), statuses[0].AppliedAt)
+	assert.False(t, statuses[1].Applied)
+	assert.False(t, statuses[2].Applied)
+	assert.NoError(t, poolMock.ExpectationsWereMet())
+}
@@ -0,0 +1,18 @@
+package migrate
+
+// Option -.
+type Option func(*Migrator)
+
+// Table -.
+func Table(name string) Option {
+	return func(m *Migrator) {
+		m.table = name
+	}
+}
+
+// LockID -.
+func LockID(id int64) Option {
+	return func(m *Migrator) {
+		m.lockID = id
+	}
+}
@@ -0,0 +1,116 @@
+package rules
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+type tokenKind int
+
+const (
+	tokenEOF tokenKind = iota
+	tokenIdent
+	tokenString
+	tokenNumber
+	tokenOperator
+)
+
+type token struct {
+	kind  tokenKind
+	text  string
+	value any
+	pos   int
+}
+
+func (t token) is(kind tokenKind, text string) bool {
+	return t.kind == kind && t.text == text
+}
+
+// operators are matched longest first.
+var operators = []string{"==", "!=", "<=", ">=", "&&", "||", "<", ">", "!", "(", ")", "[", "]", ",", "."}
+
+func lex(src string) ([]token, error) {
+	var tokens []token
+
+	for i := 0; i < len(src); {
+		c := rune(src[i])
+
+		switch {
+		case unicode.IsSpace(c):
+			i++
+		case c == '"':
+			end := i + 1
+			for end < len(src) && src[end] != '"' {
+				if src[end] == '\\' {
+					end++
+				}
+				end++
+			}
+			if end >= len(src) {
+				return nil, fmt.Errorf("rules: unterminated string at %d", i)
+			}
+
+			text := src[i : end+1]
+			value, err := strconv.Unquote(text)
+			if err != nil {
+				return nil, fmt.Errorf("rules: invalid string at %d", i)
+			}
+
+			tokens = append(tokens, token{kind: tokenString, text: text, value: value, pos: i})
+			i = end + 1
+		case isDigit(c) || c == '-' && i+1 < len(src) && isDigit(rune(src[i+1])):
+			end := i + 1
+			for end < len(src) && (isDigit(rune(src[end])) || src[end] == '.') {
+				end++
+			}
+
+			text := src[i:end]
+			value, err := strconv.ParseFloat(text, 64)
+			if err != nil {
+				return nil, fmt.Errorf("rules: invalid number %q at %d", text, i)
+			}
+
+			tokens = append(tokens, token{kind: tokenNumber, text: text, value: value, pos: i})
+			i = end
+		case c == '_' || unicode.IsLetter(c):
+			end := i + 1
+			for end < len(src) && (src[end] == '_' || unicode.IsLetter(rune(src[end])) || isDigit(rune(src[end]))) {
+				end++
+			}
+
+			text := src[i:end]
+			t := token{kind: tokenIdent, text: text, pos: i}
+			switch text {
+			case "true":
+				t.value = true
+			case "false":
+				t.value = false
+			}
+
+			tokens = append(tokens, t)
+			i = end
+		default:
+			op := ""
+			for _, candidate := range operators {
+				if strings.HasPrefix(src[i:], candidate) {
+					op = candidate
+					break
+				}
+			}
+			if op == "" {
+				return nil, fmt.Errorf("rules: unexpected %q at %d", src[i], i)
+			}
+
+			tokens = append(tokens, token{kind: tokenOperator, text: op, pos: i})
+			i += len(op)
+		}
+	}
+
+	return append(tokens, token{kind: tokenEOF, pos: len(src)}), nil
+}
+
+func isDigit(c rune) bool {
+	return c >= '0' && c <= '9'
+}
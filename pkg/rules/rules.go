@@ -0,0 +1,409 @@
+// Package rules implements the expression language of rule-based segments.
+//
+// A rule is a boolean expression over user attributes:
+//
+//	country == "RU" && platform in ["ios", "android"]
+//	signup_date >= "2023-01-01" || !(properties.plan == "free")
+//
+// Operands are string, number, true, false and null literals, attribute
+// names and dotted paths into nested attributes. Comparisons are ==, !=, <,
+// <=, >, >=, in and not in, combined with &&, || and ! and grouped with
+// parentheses. Strings and numbers are ordered, values of different types are
+// never equal and never ordered, and a missing attribute is null.
+package rules
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Rule is a parsed expression.
+type Rule struct {
+	src  string
+	root node
+}
+
+// Parse parses the expression src.
+func Parse(src string) (*Rule, error) {
+	tokens, err := lex(src)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &parser{tokens: tokens}
+	root, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if p.peek().kind != tokenEOF {
+		return nil, p.unexpected()
+	}
+
+	return &Rule{src: src, root: root}, nil
+}
+
+// Match reports whether the attributes satisfy the rule. Nested attributes
+// are map[string]any values, numbers may be of any integer or float type.
+func (r *Rule) Match(attrs map[string]any) bool {
+	return r.root.eval(attrs) == true
+}
+
+// String returns the source of the rule.
+func (r *Rule) String() string {
+	return r.src
+}
+
+type node interface {
+	eval(attrs map[string]any) any
+}
+
+type literal struct {
+	value any
+}
+
+func (n literal) eval(map[string]any) any {
+	return n.value
+}
+
+type attribute struct {
+	path []string
+}
+
+func (n attribute) eval(attrs map[string]any) any {
+	var v any = attrs
+	for _, key := range n.path {
+		m, ok := v.(map[string]any)
+		if !ok {
+			return nil
+		}
+		v = m[key]
+	}
+
+	return normalize(v)
+}
+
+type not struct {
+	operand node
+}
+
+func (n not) eval(attrs map[string]any) any {
+	return n.operand.eval(attrs) != true
+}
+
+type logical struct {
+	and         bool
+	left, right node
+}
+
+func (n logical) eval(attrs map[string]any) any {
+	left := n.left.eval(attrs) == true
+	if n.and != left {
+		return left
+	}
+
+	return n.right.eval(attrs) == true
+}
+
+type comparison struct {
+	op          string
+	left, right node
+}
+
+func (n comparison) eval(attrs map[string]any) any {
+	left, right := n.left.eval(attrs), n.right.eval(attrs)
+
+	switch n.op {
+	case "==":
+		return equal(left, right)
+	case "!=":
+		return !equal(left, right)
+	}
+
+	c, ok := compare(left, right)
+	if !ok {
+		return false
+	}
+
+	switch n.op {
+	case "<":
+		return c < 0
+	case "<=":
+		return c <= 0
+	case ">":
+		return c > 0
+	default:
+		return c >= 0
+	}
+}
+
+type membership struct {
+	negate  bool
+	operand node
+	list    []any
+}
+
+func (n membership) eval(attrs map[string]any) any {
+	v := n.operand.eval(attrs)
+	for _, item := range n.list {
+		if equal(v, item) {
+			return !n.negate
+		}
+	}
+
+	return n.negate
+}
+
+func normalize(v any) any {
+	switch v := v.(type) {
+	case int:
+		return float64(v)
+	case int32:
+		return float64(v)
+	case int64:
+		return float64(v)
+	case float32:
+		return float64(v)
+	}
+
+	return v
+}
+
+func equal(a, b any) bool {
+	switch a := a.(type) {
+	case nil, string, float64, bool:
+		return a == b
+	}
+
+	return false
+}
+
+func compare(a, b any) (int, bool) {
+	switch a := a.(type) {
+	case string:
+		b, ok := b.(string)
+		if !ok {
+			return 0, false
+		}
+
+		return strings.Compare(a, b), true
+	case float64:
+		b, ok := b.(float64)
+		if !ok {
+			return 0, false
+		}
+
+		switch {
+		case a < b:
+			return -1, true
+		case a > b:
+			return 1, true
+		}
+
+		return 0, true
+	}
+
+	return 0, false
+}
+
+var comparisons = map[string]bool{"==": true, "!=": true, "<": true, "<=": true, ">": true, ">=": true}
+
+type parser struct {
+	tokens []token
+	pos    int
+}
+
+func (p *parser) peek() token {
+	return p.tokens[p.pos]
+}
+
+func (p *parser) next() token {
+	t := p.tokens[p.pos]
+	if t.kind != tokenEOF {
+		p.pos++
+	}
+
+	return t
+}
+
+func (p *parser) unexpected() error {
+	t := p.peek()
+	if t.kind == tokenEOF {
+		return fmt.Errorf("rules: unexpected end of expression")
+	}
+
+	return fmt.Errorf("rules: unexpected %q at %d", t.text, t.pos)
+}
+
+func (p *parser) expect(kind tokenKind, text string) error {
+	if !p.peek().is(kind, text) {
+		return p.unexpected()
+	}
+	p.next()
+
+	return nil
+}
+
+func (p *parser) parseOr() (node, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+
+	for p.peek().is(tokenOperator, "||") {
+		p.next()
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = logical{left: left, right: right}
+	}
+
+	return left, nil
+}
+
+func (p *parser) parseAnd() (node, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+
+	for p.peek().is(tokenOperator, "&&") {
+		p.next()
+		right, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		left = logical{and: true, left: left, right: right}
+	}
+
+	return left, nil
+}
+
+func (p *parser) parseUnary() (node, error) {
+	if p.peek().is(tokenOperator, "!") {
+		p.next()
+		operand, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+
+		return not{operand: operand}, nil
+	}
+
+	return p.parseComparison()
+}
+
+func (p *parser) parseComparison() (node, error) {
+	left, err := p.parseOperand()
+	if err != nil {
+		return nil, err
+	}
+
+	t := p.peek()
+	switch {
+	case t.kind == tokenOperator && comparisons[t.text]:
+		p.next()
+		right, err := p.parseOperand()
+		if err != nil {
+			return nil, err
+		}
+
+		return comparison{op: t.text, left: left, right: right}, nil
+	case t.is(tokenIdent, "in"), t.is(tokenIdent, "not"):
+		p.next()
+		negate := t.text == "not"
+		if negate {
+			err := p.expect(tokenIdent, "in")
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		list, err := p.parseList()
+		if err != nil {
+			return nil, err
+		}
+
+		return membership{negate: negate, operand: left, list: list}, nil
+	}
+
+	return left, nil
+}
+
+func (p *parser) parseOperand() (node, error) {
+	t := p.peek()
+
+	switch t.kind {
+	case tokenString, tokenNumber:
+		p.next()
+		return literal{value: t.value}, nil
+	case tokenIdent:
+		switch t.text {
+		case "true", "false", "null":
+			p.next()
+			return literal{value: t.value}, nil
+		case "in", "not":
+			return nil, p.unexpected()
+		}
+		p.next()
+
+		path := []string{t.text}
+		for p.peek().is(tokenOperator, ".") {
+			p.next()
+			if p.peek().kind != tokenIdent {
+				return nil, p.unexpected()
+			}
+			path = append(path, p.next().text)
+		}
+
+		return attribute{path: path}, nil
+	case tokenOperator:
+		if t.text == "(" {
+			p.next()
+			inner, err := p.parseOr()
+			if err != nil {
+				return nil, err
+			}
+
+			err = p.expect(tokenOperator, ")")
+			if err != nil {
+				return nil, err
+			}
+
+			return inner, nil
+		}
+	}
+
+	return nil, p.unexpected()
+}
+
+func (p *parser) parseList() ([]any, error) {
+	err := p.expect(tokenOperator, "[")
+	if err != nil {
+		return nil, err
+	}
+
+	var list []any
+	for !p.peek().is(tokenOperator, "]") {
+		if len(list) > 0 {
+			err := p.expect(tokenOperator, ",")
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		item, err := p.parseOperand()
+		if err != nil {
+			return nil, err
+		}
+
+		lit, ok := item.(literal)
+		if !ok {
+			return nil, fmt.Errorf("rules: list items must be literals")
+		}
+		list = append(list, lit.value)
+	}
+	p.next()
+
+	return list, nil
+}
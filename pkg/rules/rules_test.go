@@ -0,0 +1,80 @@
+package rules
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRule_Match(t *testing.T) {
+	attrs := map[string]any{
+		"id":          int64(42),
+		"country":     "RU",
+		"platform":    "ios",
+		"signup_date": "2023-08-31",
+		"properties": map[string]any{
+			"plan":   "pro",
+			"orders": float64(3),
+			"beta":   true,
+		},
+	}
+
+	testCases := []struct {
+		rule string
+		want bool
+	}{
+		{rule: `country == "RU"`, want: true},
+		{rule: `country != "RU"`, want: false},
+		{rule: `country == "RU" && platform in ["ios", "android"]`, want: true},
+		{rule: `country == "KZ" || platform in ["ios", "android"]`, want: true},
+		{rule: `platform not in ["ios", "android"]`, want: false},
+		{rule: `signup_date >= "2023-01-01" && signup_date < "2024-01-01"`, want: true},
+		{rule: `id > 40 && id <= 42`, want: true},
+		{rule: `properties.orders >= 3`, want: true},
+		{rule: `properties.plan == "pro" && properties.beta`, want: true},
+		{rule: `!(properties.plan == "free")`, want: true},
+		{rule: `!properties.beta`, want: false},
+		{rule: `properties.missing == null`, want: true},
+		{rule: `properties.missing.deeper == null`, want: true},
+		{rule: `country > 1`, want: false},
+		{rule: `properties.orders == "3"`, want: false},
+		{rule: `country == "RU" && (platform == "web" || id == 42)`, want: true},
+		{rule: `id in [1, 2, -3]`, want: false},
+		{rule: `country`, want: false},
+		{rule: `true`, want: true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.rule, func(t *testing.T) {
+			rule, err := Parse(tc.rule)
+			assert.NoError(t, err)
+			assert.Equal(t, tc.want, rule.Match(attrs))
+		})
+	}
+}
+
+func TestParse_Errors(t *testing.T) {
+	testCases := []struct {
+		name    string
+		rule    string
+		wantErr string
+	}{
+		{name: "empty", rule: ``, wantErr: "rules: unexpected end of expression"},
+		{name: "dangling operator", rule: `country ==`, wantErr: "rules: unexpected end of expression"},
+		{name: "single equals", rule: `country = "RU"`, wantErr: `rules: unexpected '=' at 8`},
+		{name: "unterminated string", rule: `country == "RU`, wantErr: "rules: unterminated string at 11"},
+		{name: "unbalanced parentheses", rule: `(country == "RU"`, wantErr: "rules: unexpected end of expression"},
+		{name: "trailing tokens", rule: `country == "RU" platform`, wantErr: `rules: unexpected "platform" at 16`},
+		{name: "in without list", rule: `platform in "ios"`, wantErr: `rules: unexpected "\"ios\"" at 12`},
+		{name: "not without in", rule: `platform not ["ios"]`, wantErr: `rules: unexpected "[" at 13`},
+		{name: "attribute in list", rule: `platform in [country]`, wantErr: "rules: list items must be literals"},
+		{name: "bad path", rule: `properties.`, wantErr: "rules: unexpected end of expression"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := Parse(tc.rule)
+			assert.EqualError(t, err, tc.wantErr)
+		})
+	}
+}